@@ -0,0 +1,132 @@
+/* SPDX-License-Identifier: GPL-2.0
+ *
+ * Copyright (C) 2017-2018 Jason A. Donenfeld <Jason@zx2c4.com>. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"strconv"
+)
+
+/* Pinning of the encryption and decryption workers to CPUs (Linux only),
+ * the workers of a kind are spread across the CPUs the process may run on
+ *
+ * A worker applies a change once idle, when woken by the changed channel
+ */
+type workerPin struct {
+	name    string // kind and slot, e.g. "encryption/0"
+	slot    int    // lowest free index among the workers of the kind
+	cpu     int    // pinned CPU (-1 = none)
+	restore []int  // affinity of the thread prior to pinning
+}
+
+/* Enables or disables the pinning of workers,
+ * every worker is pinned to a single CPU (round-robin by slot)
+ */
+func (device *Device) SetWorkerAffinity(enabled bool) {
+	device.affinity.mutex.Lock()
+	defer device.affinity.mutex.Unlock()
+
+	if device.affinity.enabled == enabled {
+		return
+	}
+	device.affinity.enabled = enabled
+	device.affinity.cpus = nil
+	if enabled {
+		device.affinity.cpus = allowedCPUs()
+	}
+	close(device.affinity.changed)
+	device.affinity.changed = make(chan struct{})
+}
+
+func (device *Device) WorkerAffinity() bool {
+	device.affinity.mutex.Lock()
+	defer device.affinity.mutex.Unlock()
+	return device.affinity.enabled
+}
+
+/* Returns the CPUs of every running worker by name,
+ * as reported by the kernel once pinned (nil if not pinned)
+ */
+func (device *Device) WorkerAffinities() map[string][]int {
+	device.affinity.mutex.Lock()
+	defer device.affinity.mutex.Unlock()
+
+	affinities := make(map[string][]int, len(device.affinity.workers))
+	for name, cpus := range device.affinity.workers {
+		affinities[name] = append([]int(nil), cpus...)
+	}
+	return affinities
+}
+
+/* Registers a worker of the kind under the lowest free slot
+ */
+func (device *Device) newWorkerPin(kind string) *workerPin {
+	device.affinity.mutex.Lock()
+	defer device.affinity.mutex.Unlock()
+
+	pin := &workerPin{cpu: -1}
+	for {
+		pin.name = kind + "/" + strconv.Itoa(pin.slot)
+		if _, ok := device.affinity.workers[pin.name]; !ok {
+			break
+		}
+		pin.slot += 1
+	}
+	device.affinity.workers[pin.name] = nil
+	return pin
+}
+
+/* Pins (or unpins) the calling worker as configured,
+ * returns a channel closed on the next change of configuration
+ */
+func (device *Device) applyAffinity(pin *workerPin) <-chan struct{} {
+	device.affinity.mutex.Lock()
+	defer device.affinity.mutex.Unlock()
+
+	logError := device.log.Error
+
+	cpu := -1
+	if device.affinity.enabled && len(device.affinity.cpus) > 0 {
+		cpu = device.affinity.cpus[pin.slot%len(device.affinity.cpus)]
+	}
+
+	if cpu == pin.cpu {
+		return device.affinity.changed
+	}
+
+	if pin.cpu >= 0 {
+		if err := unpinThread(pin.restore); err != nil {
+			logError.Println("Failed to unpin", pin.name, "worker:", err)
+		}
+		pin.cpu = -1
+		device.affinity.workers[pin.name] = nil
+	}
+
+	if cpu >= 0 {
+		pin.restore = device.affinity.cpus
+		cpus, err := pinThread(cpu)
+		if err != nil {
+			logError.Println("Failed to pin", pin.name, "worker to CPU", strconv.Itoa(cpu)+":", err)
+			unpinThread(pin.restore)
+		} else {
+			pin.cpu = cpu
+			device.affinity.workers[pin.name] = cpus
+		}
+	}
+
+	return device.affinity.changed
+}
+
+/* Unpins the calling worker and frees its slot
+ */
+func (device *Device) releaseAffinity(pin *workerPin) {
+	device.affinity.mutex.Lock()
+	defer device.affinity.mutex.Unlock()
+
+	if pin.cpu >= 0 {
+		unpinThread(pin.restore)
+	}
+	delete(device.affinity.workers, pin.name)
+}
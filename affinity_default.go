@@ -0,0 +1,23 @@
+// +build !linux
+
+/* SPDX-License-Identifier: GPL-2.0
+ *
+ * Copyright (C) 2017-2018 Jason A. Donenfeld <Jason@zx2c4.com>. All Rights Reserved.
+ */
+
+package main
+
+/* Workers are not pinned on this platform,
+ * as no CPUs are reported enabling the pinning has no effect
+ */
+func allowedCPUs() []int {
+	return nil
+}
+
+func pinThread(cpu int) ([]int, error) {
+	return nil, nil
+}
+
+func unpinThread(cpus []int) error {
+	return nil
+}
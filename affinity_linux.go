@@ -0,0 +1,62 @@
+/* SPDX-License-Identifier: GPL-2.0
+ *
+ * Copyright (C) 2017-2018 Jason A. Donenfeld <Jason@zx2c4.com>. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"golang.org/x/sys/unix"
+	"runtime"
+)
+
+/* Returns the CPUs the process may run on
+ */
+func allowedCPUs() []int {
+	var set unix.CPUSet
+	if err := unix.SchedGetaffinity(0, &set); err != nil {
+		return nil
+	}
+	return cpuSetList(&set)
+}
+
+/* Locks the calling goroutine to its thread and pins the thread to the CPU,
+ * returns the affinity of the thread as reported by the kernel
+ */
+func pinThread(cpu int) ([]int, error) {
+	runtime.LockOSThread()
+
+	var set unix.CPUSet
+	set.Set(cpu)
+	if err := unix.SchedSetaffinity(0, &set); err != nil {
+		return nil, err
+	}
+
+	set.Zero()
+	if err := unix.SchedGetaffinity(0, &set); err != nil {
+		return nil, err
+	}
+	return cpuSetList(&set), nil
+}
+
+/* Restores the affinity of the thread and unlocks the calling goroutine
+ */
+func unpinThread(cpus []int) error {
+	defer runtime.UnlockOSThread()
+
+	var set unix.CPUSet
+	for _, cpu := range cpus {
+		set.Set(cpu)
+	}
+	return unix.SchedSetaffinity(0, &set)
+}
+
+func cpuSetList(set *unix.CPUSet) []int {
+	var cpus []int
+	for cpu := 0; len(cpus) < set.Count(); cpu += 1 {
+		if set.IsSet(cpu) {
+			cpus = append(cpus, cpu)
+		}
+	}
+	return cpus
+}
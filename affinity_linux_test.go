@@ -0,0 +1,71 @@
+/* SPDX-License-Identifier: GPL-2.0
+ *
+ * Copyright (C) 2017-2018 Jason A. Donenfeld <Jason@zx2c4.com>. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWorkerAffinity(t *testing.T) {
+	dev := randDevice(t)
+	defer dev.Close()
+
+	// waits until every worker is pinned (or unpinned)
+
+	await := func(pinned bool) map[string][]int {
+		deadline := time.Now().Add(time.Second * 5)
+		for {
+			affinities := dev.WorkerAffinities()
+			done := len(affinities) >= 2*runtime.NumCPU()
+			for _, cpus := range affinities {
+				if (cpus != nil) != pinned {
+					done = false
+				}
+			}
+			if done {
+				return affinities
+			}
+			if time.Now().After(deadline) {
+				t.Fatal("workers not updated:", affinities)
+			}
+			time.Sleep(time.Millisecond * 10)
+		}
+	}
+
+	uapiSet(t, dev, "worker_affinity=true")
+	if get := uapiRequest(t, dev, "get=1\n\n"); !strings.Contains(get, "worker_affinity=true\n") {
+		t.Fatal("worker affinity not reported:", get)
+	}
+	affinities := await(true)
+
+	// every worker runs on a single CPU, distinct from the other workers of its kind
+
+	allowed := allowedCPUs()
+	for _, kind := range []string{"encryption", "decryption"} {
+		seen := make(map[int]string)
+		for slot := 0; slot < runtime.NumCPU(); slot += 1 {
+			name := fmt.Sprintf("%s/%d", kind, slot)
+			cpus := affinities[name]
+			if len(cpus) != 1 {
+				t.Fatal("worker", name, "has affinity", cpus)
+			}
+			if cpus[0] != allowed[slot%len(allowed)] {
+				t.Fatal("worker", name, "pinned to", cpus[0])
+			}
+			if other, ok := seen[cpus[0]]; ok && slot < len(allowed) {
+				t.Fatal("workers", other, "and", name, "pinned to CPU", cpus[0])
+			}
+			seen[cpus[0]] = name
+		}
+	}
+
+	uapiSet(t, dev, "worker_affinity=false")
+	await(false)
+}
@@ -5,7 +5,14 @@
 
 package main
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
 
 type DummyDatagram struct {
 	msg      []byte
@@ -19,12 +26,23 @@ type DummyBind struct {
 	in4    chan DummyDatagram
 	ou4    chan DummyDatagram
 	closed bool
+
+	sendErr error // returned by Send
+	pathMTU int   // returned by PathMTU
 }
 
 func (b *DummyBind) SetMark(v uint32) error {
 	return nil
 }
 
+func (b *DummyBind) SetDontFragment(enabled bool) error {
+	return nil
+}
+
+func (b *DummyBind) SetTrafficClass(tc uint8) error {
+	return nil
+}
+
 func (b *DummyBind) ReceiveIPv6(buff []byte) (int, Endpoint, error) {
 	datagram, ok := <-b.in6
 	if !ok {
@@ -51,5 +69,192 @@ func (b *DummyBind) Close() error {
 }
 
 func (b *DummyBind) Send(buff []byte, end Endpoint) error {
+	return b.sendErr
+}
+
+func (b *DummyBind) PathMTU(end Endpoint) (int, error) {
+	return b.pathMTU, nil
+}
+
+/* In-memory bind connecting two devices without sockets
+ *
+ * Datagrams sent by one bind of a pair are received (as IPv4) by the other,
+ * reporting the local endpoint of the sender as source.
+ * A bind may be reopened after being closed, as done by Device.BindUpdate.
+ */
+type ChannelBind struct {
+	local  *DummyEndpoint // endpoint of this bind
+	remote *DummyEndpoint // endpoint of the paired bind
+	rx     chan []byte    // datagrams sent to this bind
+	tx     chan []byte    // datagrams sent to the paired bind
+	sent   chan []byte    // copies of sent datagrams (dropped when full)
+	closed chan struct{}
+}
+
+func CreateChannelBindPair() (*ChannelBind, *ChannelBind) {
+	var binds [2]*ChannelBind
+	var locals [2]*DummyEndpoint
+	queues := [2]chan []byte{
+		make(chan []byte, QueueInboundSize),
+		make(chan []byte, QueueInboundSize),
+	}
+	for i := range binds {
+		locals[i], _ = CreateDummyEndpoint()
+	}
+	for i := range binds {
+		binds[i] = &ChannelBind{
+			local:  locals[i],
+			remote: locals[1-i],
+			rx:     queues[i],
+			tx:     queues[1-i],
+			sent:   make(chan []byte, QueueInboundSize),
+			closed: make(chan struct{}),
+		}
+	}
+	return binds[0], binds[1]
+}
+
+/* Uses the bind for the device, in place of sockets
+ */
+func (b *ChannelBind) Attach(device *Device) {
+	device.net.createBind = func(ports []uint16) (Bind, []uint16, error) {
+		select {
+		case <-b.closed:
+			b.closed = make(chan struct{})
+		default:
+		}
+		return b, ports, nil
+	}
+}
+
+func (b *ChannelBind) SetMark(v uint32) error {
+	return nil
+}
+
+func (b *ChannelBind) SetDontFragment(enabled bool) error {
+	return nil
+}
+
+func (b *ChannelBind) SetTrafficClass(tc uint8) error {
+	return nil
+}
+
+func (b *ChannelBind) ReceiveIPv4(buff []byte) (int, Endpoint, error) {
+	select {
+	case msg := <-b.rx:
+		return copy(buff, msg), b.remote, nil
+	case <-b.closed:
+		return 0, nil, errors.New("closed")
+	}
+}
+
+func (b *ChannelBind) ReceiveIPv6(buff []byte) (int, Endpoint, error) {
+	<-b.closed
+	return 0, nil, errors.New("closed")
+}
+
+func (b *ChannelBind) Send(buff []byte, end Endpoint) error {
+	msg := make([]byte, len(buff))
+	copy(msg, buff)
+	select {
+	case b.tx <- msg:
+	default: // dropped, like a congested link
+	}
+	select {
+	case b.sent <- msg:
+	default:
+	}
 	return nil
 }
+
+func (b *ChannelBind) Close() error {
+	close(b.closed)
+	return nil
+}
+
+/* Creates two devices peered over a pair of channel binds,
+ * the devices own the tunnel addresses 10.0.0.1 and 10.0.0.2
+ */
+func genChannelPair(t *testing.T) (*Device, *Device) {
+	var loggers [2]*Logger
+	for i := range loggers {
+		loggers[i] = NewLogger(LogLevelError, fmt.Sprintf("dev%d ", i))
+	}
+	return genChannelPairLogger(t, loggers)
+}
+
+func genChannelPairLogger(t *testing.T, loggers [2]*Logger) (*Device, *Device) {
+	return genChannelPairWith(t, loggers, NewDevice)
+}
+
+func genChannelPairWith(
+	t *testing.T,
+	loggers [2]*Logger,
+	newDevice func(TUNDevice, *Logger) *Device,
+) (*Device, *Device) {
+	var devices [2]*Device
+	var keys [2]NoisePrivateKey
+
+	bind1, bind2 := CreateChannelBindPair()
+	binds := [2]*ChannelBind{bind1, bind2}
+
+	for i := range devices {
+		var err error
+		keys[i], err = newPrivateKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		tun, _ := CreateDummyTUN(fmt.Sprintf("tun%d", i), 0)
+		devices[i] = newDevice(tun, loggers[i])
+		devices[i].SetPrivateKey(keys[i])
+		binds[i].Attach(devices[i])
+		devices[i].Up()
+		if !devices[i].isUp.Get() {
+			t.Fatal("failed to bring up device")
+		}
+	}
+
+	for i, device := range devices {
+		pk := keys[1-i].publicKey()
+		uapiSet(t, device, fmt.Sprintf(
+			"public_key=%s\nallowed_ip=10.0.0.%d/32",
+			pk.ToHex(), 2-i,
+		))
+		peer := device.LookupPeer(pk)
+		peer.mutex.Lock()
+		peer.endpoint = binds[i].remote
+		peer.mutex.Unlock()
+	}
+
+	return devices[0], devices[1]
+}
+
+func TestChannelBindHandshake(t *testing.T) {
+	dev1, dev2 := genChannelPair(t)
+	defer dev1.Close()
+	defer dev2.Close()
+
+	// traffic in both directions after the handshake
+
+	addrs := [2]net.IP{net.IPv4(10, 0, 0, 1), net.IPv4(10, 0, 0, 2)}
+	devices := [2]*Device{dev1, dev2}
+	for i, device := range devices {
+		device.tun.device.(*DummyTUN).packets <- genIPv4Packet(addrs[i], addrs[1-i], 100)
+		recvPacket(t, devices[1-i].tun.device, time.Second*5)
+	}
+
+	for i, device := range devices {
+		peer := device.LookupPeer(devices[1-i].noise.publicKey)
+		if atomic.LoadInt64(&peer.stats.lastHandshakeNano) == 0 {
+			t.Fatal("handshake not completed on device", i)
+		}
+	}
+
+	// the pair survives rebinding
+
+	if err := dev1.BindUpdate(); err != nil {
+		t.Fatal(err)
+	}
+	dev1.tun.device.(*DummyTUN).packets <- genIPv4Packet(addrs[0], addrs[1], 100)
+	recvPacket(t, dev2.tun.device, time.Second*5)
+}
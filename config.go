@@ -0,0 +1,347 @@
+/* SPDX-License-Identifier: GPL-2.0
+ *
+ * Copyright (C) 2017-2018 Jason A. Donenfeld <Jason@zx2c4.com>. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/* Loading of wg(8) style configuration files
+ *
+ * The file is translated into a UAPI set operation,
+ * which is validated as a whole and only then applied (see ipcSetTransaction).
+ * Peers which are not present in the file are removed,
+ * while the remaining peers keep their sessions.
+ *
+ * The file is the full configuration: keys it leaves out are reset
+ * (FwMark, PresharedKey, PersistentKeepalive and AllowedIPs),
+ * except for an omitted ListenPort, which any port already bound satisfies.
+ *
+ * The live configuration is exported in the same format,
+ * with peers ordered by public key, such that unchanged
+ * configurations export to identical text.
+ */
+
+const (
+	configSectionNone = iota
+	configSectionInterface
+	configSectionPeer
+)
+
+/* Keys used by wg-quick(8), these are ignored
+ */
+var configIgnoredKeys = map[string]bool{
+	"address":    true,
+	"dns":        true,
+	"mtu":        true,
+	"table":      true,
+	"preup":      true,
+	"postup":     true,
+	"predown":    true,
+	"postdown":   true,
+	"saveconfig": true,
+}
+
+func configKeyToHex(value string) (string, error) {
+	key, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return "", err
+	}
+	if len(key) != NoisePublicKeySize {
+		return "", errors.New("Key has invalid length")
+	}
+	return hex.EncodeToString(key), nil
+}
+
+func configHexToKey(value string) string {
+	key, _ := hex.DecodeString(value)
+	return base64.StdEncoding.EncodeToString(key)
+}
+
+/* Translates a configuration file into UAPI set lines
+ *
+ * Returns the lines and the public keys (hex) of the configured peers
+ */
+func parseConfig(file *os.File) ([]string, map[string]bool, error) {
+	lines := make([]string, 0, 100)
+	peers := make(map[string]bool)
+	section := configSectionNone
+	peerLine := -1            // index of the public_key line of the current peer
+	seen := map[string]bool{} // keys given in the current section
+
+	// keys left out of a section are reset to their defaults
+
+	closeSection := func() {
+		switch section {
+		case configSectionNone, configSectionInterface:
+			if !seen["fwmark"] {
+				lines = append(lines, "fwmark=0")
+			}
+		case configSectionPeer:
+			if !seen["presharedkey"] {
+				lines = append(lines, "preshared_key="+NoiseSymmetricKey{}.ToHex())
+			}
+			if !seen["persistentkeepalive"] {
+				lines = append(lines, "persistent_keepalive_interval=0")
+			}
+		}
+		seen = map[string]bool{}
+	}
+
+	scanner := bufio.NewScanner(file)
+	for number := 1; scanner.Scan(); number++ {
+
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		fail := func(msg string) error {
+			return fmt.Errorf("Line %d: %s", number, msg)
+		}
+
+		// section headers
+
+		switch strings.ToLower(line) {
+		case "[interface]":
+			if section != configSectionNone {
+				return nil, nil, fail("Interface section must come first")
+			}
+			section = configSectionInterface
+			continue
+		case "[peer]":
+			closeSection()
+			section = configSectionPeer
+			peerLine = len(lines)
+			lines = append(lines, "", "replace_allowed_ips=true")
+			continue
+		}
+
+		// key value pairs
+
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			return nil, nil, fail("Expected key = value")
+		}
+		key := strings.ToLower(strings.TrimSpace(parts[0]))
+		value := strings.TrimSpace(parts[1])
+		seen[key] = true
+
+		switch section {
+		case configSectionInterface:
+			switch key {
+			case "privatekey":
+				sk, err := configKeyToHex(value)
+				if err != nil {
+					return nil, nil, fail("Invalid PrivateKey")
+				}
+				lines = append(lines, "private_key="+sk)
+			case "listenport":
+				ports, err := parseListenPorts(value)
+				if err != nil {
+					return nil, nil, fail("Invalid ListenPort")
+				}
+				lines = append(lines, "listen_port="+formatListenPorts(ports))
+			case "fwmark":
+				if value == "off" {
+					value = "0"
+				}
+				mark, err := strconv.ParseUint(value, 0, 32)
+				if err != nil {
+					return nil, nil, fail("Invalid FwMark")
+				}
+				lines = append(lines, fmt.Sprintf("fwmark=%d", mark))
+			default:
+				if !configIgnoredKeys[key] {
+					return nil, nil, fail("Invalid key in Interface section: " + key)
+				}
+			}
+
+		case configSectionPeer:
+			switch key {
+			case "publickey":
+				pk, err := configKeyToHex(value)
+				if err != nil {
+					return nil, nil, fail("Invalid PublicKey")
+				}
+				if peers[pk] || lines[peerLine] != "" {
+					return nil, nil, fail("Duplicate PublicKey")
+				}
+				peers[pk] = true
+				lines[peerLine] = "public_key=" + pk
+			case "presharedkey":
+				psk, err := configKeyToHex(value)
+				if err != nil {
+					return nil, nil, fail("Invalid PresharedKey")
+				}
+				lines = append(lines, "preshared_key="+psk)
+			case "endpoint":
+				lines = append(lines, "endpoint="+value)
+			case "persistentkeepalive":
+				if value == "off" {
+					value = "0"
+				}
+				lines = append(lines, "persistent_keepalive_interval="+value)
+			case "allowedips":
+				for _, ip := range strings.Split(value, ",") {
+					if ip = strings.TrimSpace(ip); ip != "" {
+						lines = append(lines, "allowed_ip="+ip)
+					}
+				}
+			default:
+				return nil, nil, fail("Invalid key in Peer section: " + key)
+			}
+
+		default:
+			return nil, nil, fail("Key outside of section")
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, nil, err
+	}
+	closeSection()
+
+	// every peer section must name the peer
+
+	for _, line := range lines {
+		if line == "" {
+			return nil, nil, errors.New("Peer section without PublicKey")
+		}
+	}
+
+	return lines, peers, nil
+}
+
+/* Applies the configuration file to the device,
+ * either completely or (on error) not at all
+ */
+func (device *Device) LoadConfigFile(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	lines, peers, err := parseConfig(file)
+	if err != nil {
+		return fmt.Errorf("Failed to parse %s: %s", path, err)
+	}
+
+	// hold the ipc lock, such that no set operation changes the peers meanwhile
+
+	device.ipc.mutex.Lock()
+	defer device.ipc.mutex.Unlock()
+
+	// the listen port is only updated when changed, to avoid a rebind
+
+	device.net.mutex.RLock()
+	port := formatListenPorts(append([]uint16{device.net.port}, device.net.extra...))
+	device.net.mutex.RUnlock()
+
+	set := make([]string, 0, len(lines))
+	for _, line := range lines {
+		if line == "listen_port="+port {
+			continue
+		}
+		set = append(set, line)
+	}
+
+	// remove peers absent from the file
+
+	device.peers.mutex.RLock()
+	for key := range device.peers.keyMap {
+		if pk := key.ToHex(); !peers[pk] {
+			set = append(set, "public_key="+pk, "remove=true")
+		}
+	}
+	device.peers.mutex.RUnlock()
+
+	device.log.Info.Println("Loading configuration from", path)
+
+	if err := ipcSetTransaction(device, set); err != nil {
+		return err
+	}
+	return nil
+}
+
+/* Exports the configuration of the device, without the private key
+ */
+func (device *Device) ExportConfig() (string, error) {
+	return device.exportConfig(false)
+}
+
+/* Exports the configuration of the device, including the private key
+ */
+func (device *Device) ExportConfigWithPrivateKey() (string, error) {
+	return device.exportConfig(true)
+}
+
+func (device *Device) exportConfig(privateKey bool) (string, error) {
+	state := ipcGetState(device)
+	lines := make([]string, 0, 100)
+	send := func(key, value string) {
+		lines = append(lines, key+" = "+value)
+	}
+
+	lines = append(lines, "[Interface]")
+
+	if privateKey && state.PrivateKey != "" {
+		send("PrivateKey", configHexToKey(state.PrivateKey))
+	}
+
+	if state.ListenPort != 0 {
+		ports := append([]uint16{state.ListenPort}, state.ExtraListenPorts...)
+		send("ListenPort", formatListenPorts(ports))
+	}
+
+	if state.Fwmark != 0 {
+		send("FwMark", fmt.Sprintf("0x%x", state.Fwmark))
+	}
+
+	sort.Slice(state.Peers, func(i, j int) bool {
+		return state.Peers[i].PublicKey < state.Peers[j].PublicKey
+	})
+
+	var noPresharedKey NoiseSymmetricKey
+
+	for _, peer := range state.Peers {
+		lines = append(lines, "", "[Peer]")
+		send("PublicKey", configHexToKey(peer.PublicKey))
+		if peer.PresharedKey != noPresharedKey.ToHex() {
+			send("PresharedKey", configHexToKey(peer.PresharedKey))
+		}
+		if len(peer.AllowedIPs) != 0 {
+			send("AllowedIPs", strings.Join(peer.AllowedIPs, ", "))
+		}
+
+		// endpoints configured by hostname are exported as such
+
+		if peer.endpointHost != "" {
+			send("Endpoint", peer.endpointHost)
+		} else if peer.Endpoint != "" {
+			send("Endpoint", peer.Endpoint)
+		}
+
+		if peer.PersistentKeepaliveInterval != 0 {
+			send("PersistentKeepalive", strconv.Itoa(int(peer.PersistentKeepaliveInterval)))
+		}
+	}
+
+	return strings.Join(lines, "\n") + "\n", nil
+}
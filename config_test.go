@@ -0,0 +1,320 @@
+/* SPDX-License-Identifier: GPL-2.0
+ *
+ * Copyright (C) 2017-2018 Jason A. Donenfeld <Jason@zx2c4.com>. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadConfigFile(t *testing.T) {
+	device := randDevice(t)
+	defer device.Close()
+
+	dir, err := ioutil.TempDir("", "wireguard")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var keys [3]string
+	var pks [3]NoisePublicKey
+	for i := range keys {
+		sk, err := newPrivateKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		pks[i] = sk.publicKey()
+		keys[i] = base64.StdEncoding.EncodeToString(pks[i][:])
+	}
+
+	sk, _ := newPrivateKey()
+	var psk NoiseSymmetricKey
+	psk[0] = 1
+	configPath := path.Join(dir, "wg0.conf")
+	writeConfig := func(config string) {
+		if err := ioutil.WriteFile(configPath, []byte(config), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	writeConfig(`[Interface]
+PrivateKey = ` + base64.StdEncoding.EncodeToString(sk[:]) + `
+Address = 10.0.0.1/24 # ignored, wg-quick only
+FwMark = 0x20
+
+[Peer]
+PublicKey = ` + keys[0] + `
+AllowedIPs = 10.0.0.2/32, fd00::2/128
+AllowedIPs = 10.0.0.5/32
+Endpoint = 192.0.2.1:51820
+PresharedKey = ` + base64.StdEncoding.EncodeToString(psk[:]) + `
+PersistentKeepalive = 15
+
+[Peer]
+AllowedIPs = 10.0.0.3/32
+PublicKey = ` + keys[1] + `
+PersistentKeepalive = 25
+`)
+
+	if err := device.LoadConfigFile(configPath); err != nil {
+		t.Fatal(err)
+	}
+
+	if !device.noise.privateKey.Equals(sk) {
+		t.Fatal("private key not loaded")
+	}
+	peer0 := device.LookupPeer(pks[0])
+	peer1 := device.LookupPeer(pks[1])
+	if peer0 == nil || peer1 == nil {
+		t.Fatal("peers not added")
+	}
+	if len(device.routing.table.AllowedIPs(peer0)) != 3 {
+		t.Fatal("allowed ips of all lines not loaded:", device.routing.table.AllowedIPs(peer0))
+	}
+	if peer0.handshake.PresharedKey() != psk || peer0.persistentKeepaliveInterval != 15 {
+		t.Fatal("preshared key or persistent keepalive not loaded")
+	}
+	if peer1.persistentKeepaliveInterval != 25 {
+		t.Fatal("persistent keepalive not loaded")
+	}
+	if device.net.fwmark != 0x20 {
+		t.Fatal("fwmark not loaded")
+	}
+
+	// mark session of peer which remains
+
+	keypair := &Keypair{}
+	peer0.keyPairs.current = keypair
+
+	// reload with one peer replaced,
+	// keys removed from the file are reset
+
+	writeConfig(`[Interface]
+PrivateKey = ` + base64.StdEncoding.EncodeToString(sk[:]) + `
+
+[Peer]
+PublicKey = ` + keys[0] + `
+AllowedIPs = 10.0.0.2/32, fd00::2/128
+Endpoint = 192.0.2.1:51820
+
+[Peer]
+PublicKey = ` + keys[2] + `
+AllowedIPs = 10.0.0.4/32
+`)
+
+	if err := device.LoadConfigFile(configPath); err != nil {
+		t.Fatal(err)
+	}
+
+	if device.LookupPeer(pks[0]) != peer0 {
+		t.Fatal("unchanged peer was replaced")
+	}
+	if peer0.keyPairs.Current() != keypair {
+		t.Fatal("unchanged peer lost its keypair")
+	}
+	if device.LookupPeer(pks[1]) != nil {
+		t.Fatal("absent peer was not removed")
+	}
+	if device.LookupPeer(pks[2]) == nil {
+		t.Fatal("new peer was not added")
+	}
+	if len(device.routing.table.AllowedIPs(peer0)) != 2 {
+		t.Fatal("removed allowed ips retained:", device.routing.table.AllowedIPs(peer0))
+	}
+	if peer0.handshake.PresharedKey() != (NoiseSymmetricKey{}) || peer0.persistentKeepaliveInterval != 0 {
+		t.Fatal("removed preshared key or persistent keepalive retained")
+	}
+	if device.net.fwmark != 0 {
+		t.Fatal("removed fwmark retained")
+	}
+
+	// malformed files are rejected without changes
+
+	writeConfig("[Peer]\nAllowedIPs = 10.0.0.5/32\n")
+	if err := device.LoadConfigFile(configPath); err == nil {
+		t.Fatal("peer without public key accepted")
+	}
+	if device.LookupPeer(pks[0]) == nil || device.LookupPeer(pks[2]) == nil {
+		t.Fatal("malformed configuration was applied")
+	}
+
+	// as are files with invalid values, even after valid peers
+
+	writeConfig(`[Interface]
+PrivateKey = ` + base64.StdEncoding.EncodeToString(sk[:]) + `
+
+[Peer]
+PublicKey = ` + keys[1] + `
+AllowedIPs = 10.0.0.3/32
+
+[Peer]
+PublicKey = ` + keys[2] + `
+PersistentKeepalive = 70000
+`)
+	if err := device.LoadConfigFile(configPath); err == nil {
+		t.Fatal("invalid persistent keepalive accepted")
+	}
+	if device.LookupPeer(pks[0]) == nil || device.LookupPeer(pks[1]) != nil {
+		t.Fatal("invalid configuration was partially applied")
+	}
+}
+
+func TestWatchConfig(t *testing.T) {
+	device := randDevice(t)
+	defer device.Close()
+
+	dir, err := ioutil.TempDir("", "wireguard")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	configPath := path.Join(dir, "wg0.conf")
+	if err := ioutil.WriteFile(configPath, []byte("[Interface]\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	watcher, err := device.WatchConfig(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer watcher.Stop()
+
+	// rapid successive writes, the last one adds a peer
+
+	sk, _ := newPrivateKey()
+	pk := sk.publicKey()
+	for i := 0; i < 5; i++ {
+		config := "[Interface]\n"
+		if i == 4 {
+			config += "[Peer]\nPublicKey = " + base64.StdEncoding.EncodeToString(pk[:]) + "\n"
+		}
+		if err := ioutil.WriteFile(configPath, []byte(config), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	deadline := time.Now().Add(ConfigReloadDelay * 20)
+	for device.LookupPeer(pk) == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("configuration was not reloaded")
+		}
+		time.Sleep(ConfigReloadDelay / 5)
+	}
+
+	if err := watcher.Stop(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExportConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wireguard")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var keys [3]string
+	for i := range keys {
+		sk, err := newPrivateKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys[i] = base64.StdEncoding.EncodeToString(sk[:])
+	}
+	sk, _ := newPrivateKey()
+
+	config := `[Interface]
+PrivateKey = ` + base64.StdEncoding.EncodeToString(sk[:]) + `
+ListenPort = ` + formatListenPorts(freePorts(t, 1)) + `
+
+[Peer]
+PublicKey = ` + keys[0] + `
+PresharedKey = ` + keys[1] + `
+AllowedIPs = 10.0.0.2/32, fd00::2/128
+Endpoint = 192.0.2.1:51820
+PersistentKeepalive = 25
+
+[Peer]
+PublicKey = ` + keys[2] + `
+AllowedIPs = 10.0.0.3/32
+Endpoint = [2001:db8::1]:51820
+`
+
+	// import into a device, export and import the export into another
+
+	load := func(config string) *Device {
+		device := randDevice(t)
+		configPath := path.Join(dir, "wg0.conf")
+		if err := ioutil.WriteFile(configPath, []byte(config), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := device.LoadConfigFile(configPath); err != nil {
+			t.Fatal(err)
+		}
+		return device
+	}
+
+	device1 := load(config)
+	defer device1.Close()
+	exported, err := device1.ExportConfigWithPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	device2 := load(exported)
+	defer device2.Close()
+	reexported, err := device2.ExportConfigWithPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exported != reexported {
+		t.Fatalf("export not preserved by import:\n%s\n%s", exported, reexported)
+	}
+
+	// the export is equivalent to the imported configuration
+
+	parse := func(config string) map[string]bool {
+		file, err := ioutil.TempFile(dir, "parse")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer file.Close()
+		file.WriteString(config)
+		file.Seek(0, 0)
+		lines, _, err := parseConfig(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		set := make(map[string]bool)
+		for _, line := range lines {
+			set[line] = true
+		}
+		return set
+	}
+	imported, roundtrip := parse(config), parse(exported)
+	if len(imported) != len(roundtrip) {
+		t.Fatalf("export differs from configuration:\n%s", exported)
+	}
+	for line := range imported {
+		if !roundtrip[line] {
+			t.Fatal("export lacks", line, "\n", exported)
+		}
+	}
+
+	// the private key is only exported on request
+
+	exported, _ = device1.ExportConfig()
+	if strings.Contains(exported, "PrivateKey") {
+		t.Fatal("private key exported:\n", exported)
+	}
+}
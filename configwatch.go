@@ -0,0 +1,89 @@
+/* SPDX-License-Identifier: GPL-2.0
+ *
+ * Copyright (C) 2017-2018 Jason A. Donenfeld <Jason@zx2c4.com>. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+const (
+	ConfigReloadDelay = time.Millisecond * 250 // quiet period before reloading a modified config
+)
+
+/* Reloads the configuration file whenever it is modified
+ *
+ * Change notifications are platform dependent,
+ * see configwatch_linux.go and configwatch_darwin.go
+ */
+type ConfigWatcher struct {
+	device   *Device
+	path     string
+	source   io.Closer      // platform specific source of notifications
+	changed  chan struct{}  // signaled when the file may have changed
+	stop     chan struct{}  // closed to stop all routines
+	stopping sync.WaitGroup // routines pending stop
+	stopOnce sync.Once
+}
+
+func newConfigWatcher(device *Device, path string) *ConfigWatcher {
+	return &ConfigWatcher{
+		device:  device,
+		path:    path,
+		changed: make(chan struct{}, 1),
+		stop:    make(chan struct{}),
+	}
+}
+
+func (watcher *ConfigWatcher) notify() {
+	select {
+	case watcher.changed <- struct{}{}:
+	default:
+	}
+}
+
+/* Reloads the config once no further changes
+ * have been observed for ConfigReloadDelay
+ */
+func (watcher *ConfigWatcher) routineReload() {
+	logError := watcher.device.log.Error
+
+	defer watcher.stopping.Done()
+
+	timer := time.NewTimer(time.Hour)
+	timer.Stop()
+
+	for {
+		select {
+		case <-watcher.stop:
+			timer.Stop()
+			return
+
+		case <-watcher.changed:
+			timer.Reset(ConfigReloadDelay)
+
+		case <-timer.C:
+			if err := watcher.device.LoadConfigFile(watcher.path); err != nil {
+				logError.Println("Failed to reload configuration:", err)
+			}
+		}
+	}
+}
+
+/* Stops watching the file, waits for pending routines to exit
+ */
+func (watcher *ConfigWatcher) Stop() error {
+	var err error
+	watcher.stopOnce.Do(func() {
+		close(watcher.stop)
+		if watcher.source != nil {
+			err = watcher.source.Close()
+		}
+		watcher.stopping.Wait()
+	})
+	return err
+}
@@ -0,0 +1,103 @@
+/* SPDX-License-Identifier: GPL-2.0
+ *
+ * Copyright (C) 2017-2018 Jason A. Donenfeld <Jason@zx2c4.com>. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"golang.org/x/sys/unix"
+	"path"
+	"time"
+)
+
+/* Watches both the directory containing the file (for files replaced by
+ * editors) and the file itself (for in-place writes) using kqueue.
+ */
+func (device *Device) WatchConfig(filePath string) (*ConfigWatcher, error) {
+
+	kqueueFd, err := unix.Kqueue()
+	if err != nil {
+		return nil, err
+	}
+
+	dirFd, err := unix.Open(path.Dir(filePath), unix.O_EVTONLY, 0)
+	if err != nil {
+		unix.Close(kqueueFd)
+		return nil, err
+	}
+
+	watcher := newConfigWatcher(device, filePath)
+	watcher.stopping.Add(2)
+
+	go watcher.routineReload()
+
+	go func() {
+		defer func() {
+			unix.Close(kqueueFd)
+			unix.Close(dirFd)
+			watcher.stopping.Done()
+		}()
+
+		fileFd := -1
+		defer func() {
+			if fileFd >= 0 {
+				unix.Close(fileFd)
+			}
+		}()
+
+		// poll periodically for the stop signal
+
+		timeout := unix.NsecToTimespec(int64(time.Second))
+		events := make([]unix.Kevent_t, 2)
+
+		for {
+			changes := []unix.Kevent_t{{
+				Ident:  uint64(dirFd),
+				Filter: unix.EVFILT_VNODE,
+				Flags:  unix.EV_ADD | unix.EV_ENABLE | unix.EV_CLEAR,
+				Fflags: unix.NOTE_WRITE,
+			}}
+
+			// (re)open the file, as it may have been replaced
+
+			if fileFd < 0 {
+				fileFd, _ = unix.Open(filePath, unix.O_EVTONLY, 0)
+			}
+			if fileFd >= 0 {
+				changes = append(changes, unix.Kevent_t{
+					Ident:  uint64(fileFd),
+					Filter: unix.EVFILT_VNODE,
+					Flags:  unix.EV_ADD | unix.EV_ENABLE | unix.EV_CLEAR,
+					Fflags: unix.NOTE_WRITE | unix.NOTE_EXTEND | unix.NOTE_DELETE | unix.NOTE_RENAME,
+				})
+			}
+
+			n, err := unix.Kevent(kqueueFd, changes, events, &timeout)
+
+			select {
+			case <-watcher.stop:
+				return
+			default:
+			}
+
+			if err == unix.EINTR {
+				continue
+			}
+			if err != nil {
+				device.log.Error.Println("Failed to watch configuration:", err)
+				return
+			}
+
+			for _, event := range events[:n] {
+				if event.Ident == uint64(fileFd) && event.Fflags&(unix.NOTE_DELETE|unix.NOTE_RENAME) != 0 {
+					unix.Close(fileFd)
+					fileFd = -1
+				}
+				watcher.notify()
+			}
+		}
+	}()
+
+	return watcher, nil
+}
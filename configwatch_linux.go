@@ -0,0 +1,70 @@
+/* SPDX-License-Identifier: GPL-2.0
+ *
+ * Copyright (C) 2017-2018 Jason A. Donenfeld <Jason@zx2c4.com>. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"golang.org/x/sys/unix"
+	"path"
+	"unsafe"
+)
+
+/* Watches the directory containing the file using inotify,
+ * such that files replaced by editors (rename over) are detected
+ */
+func (device *Device) WatchConfig(filePath string) (*ConfigWatcher, error) {
+
+	inotify, err := inotifyWatch(
+		path.Dir(filePath),
+		unix.IN_CLOSE_WRITE|
+			unix.IN_MODIFY|
+			unix.IN_MOVED_TO|
+			unix.IN_CREATE,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	watcher := newConfigWatcher(device, filePath)
+	watcher.source = inotify
+	watcher.stopping.Add(2)
+
+	go watcher.routineReload()
+
+	go func() {
+		defer watcher.stopping.Done()
+
+		name := path.Base(filePath)
+		var buff [4096]byte
+		for {
+			n, err := inotify.Read(buff[:])
+			if err != nil {
+				return
+			}
+			for offset := 0; offset+unix.SizeofInotifyEvent <= n; {
+				event := (*unix.InotifyEvent)(unsafe.Pointer(&buff[offset]))
+				start := offset + unix.SizeofInotifyEvent
+				offset = start + int(event.Len)
+				if offset > n {
+					break
+				}
+				if cString(buff[start:offset]) == name {
+					watcher.notify()
+				}
+			}
+		}
+	}()
+
+	return watcher, nil
+}
+
+func cString(b []byte) string {
+	for i, c := range b {
+		if c == 0 {
+			return string(b[:i])
+		}
+	}
+	return string(b)
+}
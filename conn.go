@@ -7,15 +7,24 @@ package main
 
 import (
 	"errors"
+	"fmt"
 	"golang.org/x/net/ipv4"
 	"golang.org/x/net/ipv6"
+	"math/rand"
 	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
 )
 
 /* A Bind handles listening on a port for both IPv6 and IPv4 UDP traffic
  */
 type Bind interface {
 	SetMark(value uint32) error
+	SetDontFragment(enabled bool) error
+	SetTrafficClass(tc uint8) error
 	ReceiveIPv6(buff []byte) (int, Endpoint, error)
 	ReceiveIPv4(buff []byte) (int, Endpoint, error)
 	Send(buff []byte, end Endpoint) error
@@ -34,6 +43,147 @@ type Endpoint interface {
 	DstToBytes() []byte  // used for mac2 cookie calculations
 	DstIP() net.IP
 	SrcIP() net.IP
+
+	Equal(other Endpoint) bool // compares the destination (family, address, port and zone)
+}
+
+/* An Endpoint which knows the index of the interface
+ * on which its datagram was received (0 if unknown)
+ */
+type InterfaceEndpoint interface {
+	SrcIfindex() int32
+}
+
+/* An Endpoint whose source address may be fixed by configuration,
+ * retained (unlike the cached source) until released by SetSrc(nil)
+ */
+type SourceEndpoint interface {
+	SetSrc(ip net.IP) error
+}
+
+/* Creates the endpoints and binds of a device,
+ * allowing embedders to supply their own transport (e.g. for NAT traversal)
+ *
+ * CreateEndpoint parses an endpoint as configured (host:port, unless understood otherwise),
+ * CreateBind listens on the ports (0 = any), returning the ports bound
+ */
+type EndpointFactory interface {
+	CreateEndpoint(s string) (Endpoint, error)
+	CreateBind(ports []uint16) (Bind, []uint16, error)
+}
+
+/* Creates native endpoints, and sockets as configured on the device
+ */
+type nativeEndpointFactory struct {
+	device *Device
+}
+
+func (factory nativeEndpointFactory) CreateEndpoint(s string) (Endpoint, error) {
+	return CreateEndpoint(s)
+}
+
+/* Must hold net lock
+ */
+func (factory nativeEndpointFactory) CreateBind(ports []uint16) (Bind, []uint16, error) {
+	return factory.device.net.createBind(ports)
+}
+
+/* Options of the native bind, as configured on the device
+ */
+type bindOptions struct {
+	dualStack bool   // single IPv6 socket per port (unless bound to an address)
+	address   net.IP // local address of the sockets (nil = any)
+	freebind  bool   // allow binding to an address not (yet) assigned
+	receivers int    // sockets per port and family, sharing the port by SO_REUSEPORT
+	sticky    bool   // pin the source of every endpoint
+}
+
+/* Must hold net lock
+ */
+func (device *Device) bindOptions() bindOptions {
+	return bindOptions{
+		dualStack: device.net.dual,
+		address:   device.net.address,
+		freebind:  device.net.freebind,
+		receivers: device.net.receivers,
+		sticky:    !device.net.noSticky,
+	}
+}
+
+/* A Bind with several receivers per family (e.g. SO_REUSEPORT sockets),
+ * between which the kernel balances inbound datagrams,
+ * every receiver is served by a receive routine of its own
+ *
+ * ReceiveIPv4 and ReceiveIPv6 receive on the first receiver
+ */
+type ParallelReceiveBind interface {
+	Receivers() int
+	ReceiveIPv4On(receiver int, buff []byte) (int, Endpoint, error)
+	ReceiveIPv6On(receiver int, buff []byte) (int, Endpoint, error)
+}
+
+/* A Bind which keeps track of the endpoint of the most recent
+ * authenticated packet (e.g. to follow route changes)
+ */
+type EndpointTracker interface {
+	UpdateLastEndpoint(end Endpoint)
+}
+
+/* A Bind which can determine the path MTU to an endpoint,
+ * excluding the IP and UDP headers
+ */
+type PathMTUDiscoverer interface {
+	PathMTU(end Endpoint) (int, error)
+}
+
+/* A Bind which can connect its sockets to the endpoint of a single peer
+ * (nil restores the unconnected mode)
+ *
+ * Connected sockets drop datagrams from any other source,
+ * including handshakes of the peer from a new address, hence the peer cannot roam
+ */
+type PointToPointBind interface {
+	SetPointToPoint(end Endpoint) error
+}
+
+/* A Bind which sets the flow label of outbound IPv6 datagrams,
+ * such that ECMP routers keep the traffic of a peer on a single path
+ * (0 restores the default label chosen by the kernel)
+ */
+type FlowLabelBind interface {
+	SetFlowLabel(label uint32) error
+}
+
+const FlowLabelMask = 0xfffff // flow labels are 20 bits
+
+/* A Bind which bounds the time a send blocks on a full socket buffer,
+ * sends exceeding the timeout fail with ErrSendTimeout
+ * (0 restores sends blocking without bound)
+ */
+type SendTimeoutBind interface {
+	SetSendTimeout(timeout time.Duration) error
+}
+
+var ErrSendTimeout = errors.New("Send timed out")
+
+/* An Endpoint marking the datagrams sent to it (e.g. for policy routing),
+ * overriding the mark of the bind (0 = that of the bind)
+ */
+type MarkEndpoint interface {
+	SetMark(mark uint32)
+}
+
+/* A Bind which reports cached sources of endpoints found invalid by the kernel
+ * (e.g. after an interface change), before clearing the source and retrying the send
+ */
+type SourceInvalidationNotifier interface {
+	SetSourceInvalidationHandler(handler func(end Endpoint))
+}
+
+/* A Bind which observes changes of local addresses and links
+ */
+type NetworkChangeNotifier interface {
+	SetNetworkChangeHandler(handler func())
 }
 
 func parseEndpoint(s string) (*net.UDPAddr, error) {
@@ -44,10 +194,38 @@ func parseEndpoint(s string) (*net.UDPAddr, error) {
 	if err != nil {
 		return nil, err
 	}
-	if ip := net.ParseIP(host); ip == nil {
+
+	zone, scoped := "", false
+	if i := strings.LastIndexByte(host, '%'); i >= 0 {
+		host, zone, scoped = host[:i], host[i+1:], true
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
 		return nil, errors.New("Failed to parse IP address: " + host)
 	}
 
+	// multicast groups (e.g. for discovery of peers on the link)
+	// are addressed through a single interface
+
+	if ip.To4() == nil && ip.IsMulticast() && !scoped {
+		return nil, errors.New("Multicast endpoint requires an interface zone: " + host)
+	}
+
+	// ensure that the zone (if any) is valid for the address
+
+	if scoped {
+		if ip.To4() != nil {
+			return nil, errors.New("Zone specified for IPv4 address: " + host)
+		}
+		if zone == "" {
+			return nil, errors.New("Empty zone in address: " + s)
+		}
+		if _, err := zoneToUint32(zone); err != nil {
+			return nil, err
+		}
+	}
+
 	// parse address and port
 
 	addr, err := net.ResolveUDPAddr("udp", s)
@@ -57,6 +235,101 @@ func parseEndpoint(s string) (*net.UDPAddr, error) {
 	return addr, err
 }
 
+/* Resolves the zone of a scoped IPv6 address to an interface index
+ *
+ * The zone is either the name of an existing interface or an index
+ */
+func zoneToUint32(zone string) (uint32, error) {
+	if zone == "" {
+		return 0, nil
+	}
+	if intr, err := net.InterfaceByName(zone); err == nil {
+		return uint32(intr.Index), nil
+	}
+	n, err := strconv.ParseUint(zone, 10, 32)
+	if err != nil {
+		return 0, errors.New("Unknown interface in zone: " + zone)
+	}
+	return uint32(n), nil
+}
+
+/* Formats an interface index as the zone of a scoped IPv6 address,
+ * preferring the interface name
+ */
+func zoneToString(index uint32) string {
+	if index == 0 {
+		return ""
+	}
+	if intr, err := net.InterfaceByIndex(int(index)); err == nil {
+		return intr.Name
+	}
+	return strconv.FormatUint(uint64(index), 10)
+}
+
+/* Creates a bind on a port within [low, high] (e.g. a range approved by a firewall),
+ * trying every port of the range once, in random order, until one binds
+ *
+ * Returns the chosen port, or an error if no port of the range is available
+ */
+func CreateBindInRange(low, high uint16) (Bind, uint16, error) {
+	if low == 0 || low > high {
+		return nil, 0, fmt.Errorf("Invalid port range %d-%d", low, high)
+	}
+
+	var err error
+	for _, i := range rand.Perm(int(high-low) + 1) {
+		port := low + uint16(i)
+		bind, ports, e := CreateBind([]uint16{port})
+		if e == nil {
+			return bind, ports[0], nil
+		}
+		err = e
+	}
+	return nil, 0, fmt.Errorf("No port available in range %d-%d: %v", low, high, err)
+}
+
+/* Replaces the factory creating the endpoints and binds of the device
+ * (nil restores the native factory) and rebinds using the factory
+ *
+ * Endpoints already configured are retained
+ */
+func (device *Device) SetEndpointFactory(factory EndpointFactory) error {
+	if factory == nil {
+		factory = nativeEndpointFactory{device}
+	}
+	device.net.mutex.Lock()
+	device.net.factory = factory
+	device.net.mutex.Unlock()
+	return device.BindUpdate()
+}
+
+func (device *Device) EndpointFactory() EndpointFactory {
+	device.net.mutex.RLock()
+	defer device.net.mutex.RUnlock()
+	return device.net.factory
+}
+
+/* Counts a cached source address found invalid (e.g. after an interface change),
+ * frequent invalidations indicate a flapping interface
+ */
+func (device *Device) sourceInvalidated(end Endpoint) {
+	atomic.AddUint64(&device.stats.srcInvalidations, 1)
+	device.log.Debug.Println("Clearing invalid source", end.SrcToString(), "of endpoint", end.DstToString())
+}
+
+/* Maps the error of a bind to an ipcError (0 for none)
+ */
+func bindErrorCode(err error) int64 {
+	switch {
+	case err == nil:
+		return 0
+	case errors.Is(err, syscall.EADDRINUSE):
+		return ipcErrorPortInUse
+	default:
+		return ipcErrorIO
+	}
+}
+
 /* Must hold device and net lock
  */
 func unsafeCloseBind(device *Device) error {
@@ -65,6 +338,7 @@ func unsafeCloseBind(device *Device) error {
 	if netc.bind != nil {
 		err = netc.bind.Close()
 		netc.bind = nil
+		netc.stopping.Wait()
 	}
 	return err
 }
@@ -95,7 +369,327 @@ func (device *Device) BindSetMark(mark uint32) error {
 	return nil
 }
 
-func (device *Device) BindUpdate() error {
+/* Enables path MTU discovery on the bind,
+ * sends exceeding the path MTU then fail with EMSGSIZE
+ */
+func (device *Device) BindSetDontFragment(enabled bool) error {
+
+	device.net.mutex.Lock()
+	defer device.net.mutex.Unlock()
+
+	// check if modified
+
+	if device.net.dontFrag == enabled {
+		return nil
+	}
+
+	// update DF bit on existing bind
+
+	device.net.dontFrag = enabled
+	if device.isUp.Get() && device.net.bind != nil {
+		if err := device.net.bind.SetDontFragment(enabled); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (device *Device) BindSetTrafficClass(tc uint8) error {
+
+	device.net.mutex.Lock()
+	defer device.net.mutex.Unlock()
+
+	// check if modified
+
+	if device.net.tclass == tc {
+		return nil
+	}
+
+	// update traffic class on existing bind
+
+	device.net.tclass = tc
+	if device.isUp.Get() && device.net.bind != nil {
+		if err := device.net.bind.SetTrafficClass(tc); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (device *Device) BindSetFlowLabel(label uint32) error {
+
+	if label&^FlowLabelMask != 0 {
+		return errors.New("Flow label exceeds 20 bits")
+	}
+
+	device.net.mutex.Lock()
+	defer device.net.mutex.Unlock()
+
+	// check if modified
+
+	if device.net.flow == label {
+		return nil
+	}
+
+	// update flow label on existing bind
+
+	device.net.flow = label
+	if device.isUp.Get() && device.net.bind != nil {
+		return unsafeSetFlowLabel(device.net.bind, label)
+	}
+
+	return nil
+}
+
+/* Must hold device.net.mutex
+ */
+func unsafeSetFlowLabel(bind Bind, label uint32) error {
+	if flow, ok := bind.(FlowLabelBind); ok {
+		return flow.SetFlowLabel(label)
+	}
+	if label != 0 {
+		return errors.New("Flow labels not supported by bind")
+	}
+	return nil
+}
+
+func (device *Device) BindSetSendTimeout(timeout time.Duration) error {
+
+	if timeout < 0 {
+		return errors.New("Negative send timeout")
+	}
+
+	device.net.mutex.Lock()
+	defer device.net.mutex.Unlock()
+
+	// check if modified
+
+	if device.net.sndTimeout == timeout {
+		return nil
+	}
+
+	// update send timeout on existing bind
+
+	device.net.sndTimeout = timeout
+	if device.isUp.Get() && device.net.bind != nil {
+		return unsafeSetSendTimeout(device.net.bind, timeout)
+	}
+
+	return nil
+}
+
+/* Must hold device.net.mutex
+ */
+func unsafeSetSendTimeout(bind Bind, timeout time.Duration) error {
+	if bounded, ok := bind.(SendTimeoutBind); ok {
+		return bounded.SetSendTimeout(timeout)
+	}
+	if timeout != 0 {
+		return errors.New("Send timeouts not supported by bind")
+	}
+	return nil
+}
+
+/* Connects the bind to the endpoint of the peer,
+ * when point-to-point mode is enabled and the device has exactly one peer
+ *
+ * Must hold device.net.mutex and device.peers.mutex
+ */
+func unsafeUpdatePointToPoint(device *Device, bind Bind) error {
+	p2p, ok := bind.(PointToPointBind)
+	if !ok {
+		return nil
+	}
+
+	var end Endpoint
+	if device.net.p2p && len(device.peers.keyMap) == 1 {
+		for _, peer := range device.peers.keyMap {
+			peer.mutex.RLock()
+			end = peer.endpoint
+			peer.mutex.RUnlock()
+		}
+	}
+
+	return p2p.SetPointToPoint(end)
+}
+
+/* Enables connecting the bind to the endpoint of a single peer
+ *
+ * The peer cannot roam while connected: its handshakes from another address are dropped
+ * by the kernel, only a new endpoint configured for the peer reconnects the bind
+ */
+func (device *Device) BindSetPointToPoint(enabled bool) error {
+
+	device.net.mutex.Lock()
+	defer device.net.mutex.Unlock()
+
+	device.peers.mutex.RLock()
+	defer device.peers.mutex.RUnlock()
+
+	if enabled && !device.net.p2p {
+		device.log.Info.Println("Point-to-point mode enabled, roaming of the peer is disabled")
+	}
+
+	device.net.p2p = enabled
+	if device.isUp.Get() && device.net.bind != nil {
+		return unsafeUpdatePointToPoint(device, device.net.bind)
+	}
+
+	return nil
+}
+
+/* Switches between separate IPv4 and IPv6 sockets
+ * and a single dual-stack socket, rebinding if changed
+ */
+func (device *Device) BindSetDualStack(enabled bool) error {
+	device.net.mutex.Lock()
+	changed := device.net.dual != enabled
+	device.net.dual = enabled
+	device.net.mutex.Unlock()
+
+	if !changed {
+		return nil
+	}
+	return device.BindUpdate()
+}
+
+/* Disables sticky sockets, rebinding if changed:
+ * the source of received datagrams is not retained for replies
+ * and route changes are not tracked (no netlink socket is opened)
+ */
+func (device *Device) BindSetDisableStickySockets(disabled bool) error {
+	device.net.mutex.Lock()
+	changed := device.net.noSticky != disabled
+	device.net.noSticky = disabled
+	device.net.mutex.Unlock()
+
+	if !changed {
+		return nil
+	}
+	return device.BindUpdate()
+}
+
+/* Sets the number of receive routines per family,
+ * with more than one the sockets of every port are opened with SO_REUSEPORT
+ * and the kernel balances inbound datagrams across them
+ */
+func (device *Device) BindSetReceivers(receivers int) error {
+	if receivers < 1 || receivers > MaxReceivers {
+		return errors.New("Number of receivers must be between 1 and " + strconv.Itoa(MaxReceivers))
+	}
+
+	device.net.mutex.Lock()
+	changed := device.net.receivers != receivers
+	device.net.receivers = receivers
+	device.net.mutex.Unlock()
+
+	if !changed {
+		return nil
+	}
+	return device.BindUpdate()
+}
+
+/* Allows binding to a listen address which is not (yet) assigned locally,
+ * rebinding if changed and a listen address is set
+ */
+func (device *Device) BindSetFreebind(enabled bool) error {
+	device.net.mutex.Lock()
+	changed := device.net.freebind != enabled && device.net.address != nil
+	device.net.freebind = enabled
+	device.net.mutex.Unlock()
+
+	if !changed {
+		return nil
+	}
+	return device.BindUpdate()
+}
+
+/* Binds the sockets to a local address (nil restores the wildcard address),
+ * the address takes precedence over dual-stack mode
+ */
+func (device *Device) BindSetAddress(addr net.IP) error {
+	if addr != nil && addr.IsUnspecified() {
+		addr = nil
+	}
+	if addr4 := addr.To4(); addr4 != nil {
+		addr = addr4
+	}
+
+	device.net.mutex.Lock()
+	changed := !device.net.address.Equal(addr)
+	device.net.address = addr
+	device.net.mutex.Unlock()
+
+	if !changed {
+		return nil
+	}
+	return device.BindUpdate()
+}
+
+/* Settings of the bind, saved before applying several
+ * such that a failure part way restores all of them
+ */
+type bindSettings struct {
+	ports      []uint16
+	address    net.IP
+	freebind   bool
+	fwmark     uint32
+	dontFrag   bool
+	tclass     uint8
+	p2p        bool
+	dual       bool
+	flow       uint32
+	noSticky   bool
+	sndTimeout time.Duration
+	receivers  int
+}
+
+func (device *Device) bindSettings() bindSettings {
+	device.net.mutex.RLock()
+	defer device.net.mutex.RUnlock()
+
+	netc := &device.net
+	return bindSettings{
+		ports:      append([]uint16{netc.port}, netc.extra...),
+		address:    netc.address,
+		freebind:   netc.freebind,
+		fwmark:     netc.fwmark,
+		dontFrag:   netc.dontFrag,
+		tclass:     netc.tclass,
+		p2p:        netc.p2p,
+		dual:       netc.dual,
+		flow:       netc.flow,
+		noSticky:   netc.noSticky,
+		sndTimeout: netc.sndTimeout,
+		receivers:  netc.receivers,
+	}
+}
+
+/* Restores saved settings of the bind and rebinds
+ */
+func (device *Device) bindRestore(settings bindSettings) error {
+	device.net.mutex.Lock()
+	netc := &device.net
+	netc.port, netc.extra = settings.ports[0], settings.ports[1:]
+	netc.address = settings.address
+	netc.freebind = settings.freebind
+	netc.fwmark = settings.fwmark
+	netc.dontFrag = settings.dontFrag
+	netc.tclass = settings.tclass
+	netc.p2p = settings.p2p
+	netc.dual = settings.dual
+	netc.flow = settings.flow
+	netc.noSticky = settings.noSticky
+	netc.sndTimeout = settings.sndTimeout
+	netc.receivers = settings.receivers
+	device.net.mutex.Unlock()
+
+	return device.BindUpdate()
+}
+
+func (device *Device) BindUpdate() (err error) {
 
 	device.net.mutex.Lock()
 	defer device.net.mutex.Unlock()
@@ -103,6 +697,15 @@ func (device *Device) BindUpdate() error {
 	device.peers.mutex.Lock()
 	defer device.peers.mutex.Unlock()
 
+	// record the outcome (reported over UAPI)
+
+	defer func() {
+		device.net.bindErr = bindErrorCode(err)
+		if err != nil {
+			device.publishEvent(Event{Kind: EventError, Message: "Failed to bind: " + err.Error()})
+		}
+	}()
+
 	// close existing sockets
 
 	if err := unsafeCloseBind(device); err != nil {
@@ -115,40 +718,182 @@ func (device *Device) BindUpdate() error {
 
 		// bind to new port
 
-		var err error
+		var ports []uint16
 		netc := &device.net
-		netc.bind, netc.port, err = CreateBind(netc.port)
+		netc.bind, ports, err = netc.factory.CreateBind(append([]uint16{netc.port}, netc.extra...))
 		if err != nil {
 			netc.bind = nil
 			netc.port = 0
+			netc.extra = nil
+			return err
+		}
+		netc.port, netc.extra = ports[0], ports[1:]
+
+		if err := unsafeStartBind(device); err != nil {
 			return err
 		}
 
-		// set fwmark
+		device.log.Debug.Println("UDP bind has been updated")
+	}
+
+	return nil
+}
+
+/* Migrates to sockets on new ports, retaining the state of peers (e.g. keypairs):
+ * the new bind is created before the existing bind is closed,
+ * which continues to be used if the ports are unavailable
+ */
+func (device *Device) BindMigrate(ports []uint16) error {
+
+	device.net.mutex.Lock()
+	defer device.net.mutex.Unlock()
+
+	device.peers.mutex.Lock()
+	defer device.peers.mutex.Unlock()
+
+	// bound once the device is up
+
+	netc := &device.net
+	if !device.isUp.Get() {
+		netc.port, netc.extra = ports[0], ports[1:]
+		return nil
+	}
+
+	bind, ports, err := netc.factory.CreateBind(ports)
+	if err != nil {
+		return err
+	}
+
+	// the new bind is configured completely before the existing bind is closed
+
+	if err := unsafeConfigureBind(device, bind); err != nil {
+		bind.Close()
+		return err
+	}
+
+	// swap the binds (sends hold the net lock, so none are in flight)
+
+	if err := unsafeCloseBind(device); err != nil {
+		device.log.Error.Println("Failed to close previous bind:", err)
+	}
+	netc.bind = bind
+	netc.port, netc.extra = ports[0], ports[1:]
+
+	if err := unsafeActivateBind(device); err != nil {
+		netc.bindErr = bindErrorCode(err)
+		return err
+	}
+	netc.bindErr = 0
+
+	device.log.Debug.Println("UDP bind has been migrated to port", netc.port)
+	return nil
+}
+
+/* Configures a newly created bind (before it replaces the bind of the device),
+ * must hold device and net lock
+ */
+func unsafeConfigureBind(device *Device, bind Bind) error {
+	var err error
+	netc := &device.net
+
+	// observe network changes
 
-		if netc.fwmark != 0 {
-			err = netc.bind.SetMark(netc.fwmark)
-			if err != nil {
-				return err
-			}
+	if notifier, ok := bind.(NetworkChangeNotifier); ok {
+		notifier.SetNetworkChangeHandler(netc.monitor.notify)
+	}
+	if notifier, ok := bind.(SourceInvalidationNotifier); ok {
+		notifier.SetSourceInvalidationHandler(device.sourceInvalidated)
+	}
+
+	// set fwmark
+
+	if netc.fwmark != 0 {
+		err = bind.SetMark(netc.fwmark)
+		if err != nil {
+			return err
 		}
+	}
 
-		// clear cached source addresses
+	// set DF bit
 
-		for _, peer := range device.peers.keyMap {
-			peer.mutex.Lock()
-			defer peer.mutex.Unlock()
-			if peer.endpoint != nil {
-				peer.endpoint.ClearSrc()
-			}
+	if netc.dontFrag {
+		err = bind.SetDontFragment(true)
+		if err != nil {
+			return err
 		}
+	}
 
-		// start receiving routines
+	// set traffic class
 
-		go device.RoutineReceiveIncoming(ipv4.Version, netc.bind)
-		go device.RoutineReceiveIncoming(ipv6.Version, netc.bind)
+	if netc.tclass != 0 {
+		err = bind.SetTrafficClass(netc.tclass)
+		if err != nil {
+			return err
+		}
+	}
 
-		device.log.Debug.Println("UDP bind has been updated")
+	// set flow label
+
+	if netc.flow != 0 {
+		err = unsafeSetFlowLabel(bind, netc.flow)
+		if err != nil {
+			return err
+		}
+	}
+
+	// set send timeout
+
+	if netc.sndTimeout != 0 {
+		err = unsafeSetSendTimeout(bind, netc.sndTimeout)
+		if err != nil {
+			return err
+		}
+	}
+
+	// connect to single peer
+
+	return unsafeUpdatePointToPoint(device, bind)
+}
+
+/* Configures a newly created bind and starts receiving,
+ * must hold device and net lock
+ */
+func unsafeStartBind(device *Device) error {
+	if err := unsafeConfigureBind(device, device.net.bind); err != nil {
+		return err
+	}
+	return unsafeActivateBind(device)
+}
+
+/* Starts receiving on the configured bind of the device,
+ * must hold device and net lock
+ */
+func unsafeActivateBind(device *Device) error {
+	netc := &device.net
+
+	// clear cached source addresses
+
+	for _, peer := range device.peers.keyMap {
+		peer.mutex.Lock()
+		defer peer.mutex.Unlock()
+		if peer.endpoint != nil {
+			peer.endpoint.ClearSrc()
+		}
+		if peer.endpointBackup != nil {
+			peer.endpointBackup.ClearSrc()
+		}
+	}
+
+	// start receiving routines (for every receiver)
+
+	receivers := 1
+	if parallel, ok := netc.bind.(ParallelReceiveBind); ok {
+		receivers = parallel.Receivers()
+	}
+	netc.stopping.Add(2 * receivers)
+	for i := 0; i < receivers; i++ {
+		go device.RoutineReceiveIncoming(ipv4.Version, i, netc.bind)
+		go device.RoutineReceiveIncoming(ipv6.Version, i, netc.bind)
 	}
 
 	return nil
@@ -8,6 +8,10 @@
 package main
 
 import (
+	"errors"
+	"fmt"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
 	"net"
 )
 
@@ -51,6 +55,15 @@ func (e *NativeEndpoint) DstToBytes() []byte {
 	return out
 }
 
+func (e *NativeEndpoint) Equal(other Endpoint) bool {
+	o, ok := other.(*NativeEndpoint)
+	if !ok {
+		return false
+	}
+	a, b := (*net.UDPAddr)(e), (*net.UDPAddr)(o)
+	return a.IP.Equal(b.IP) && a.Port == b.Port && a.Zone == b.Zone
+}
+
 func (e *NativeEndpoint) DstToString() string {
 	return (*net.UDPAddr)(e).String()
 }
@@ -81,24 +94,64 @@ func listenNet(network string, port int) (*net.UDPConn, int, error) {
 	return conn, uaddr.Port, nil
 }
 
-func CreateBind(uport uint16) (Bind, uint16, error) {
+func CreateBind(ports []uint16) (Bind, []uint16, error) {
 	var err error
 	var bind NativeBind
 
-	port := int(uport)
+	if len(ports) != 1 {
+		return nil, nil, errors.New("Multiple listen ports not supported on this platform")
+	}
+
+	port := int(ports[0])
 
 	bind.ipv4, port, err = listenNet("udp4", port)
 	if err != nil {
-		return nil, 0, err
+		return nil, nil, err
 	}
 
 	bind.ipv6, port, err = listenNet("udp6", port)
 	if err != nil {
 		bind.ipv4.Close()
-		return nil, 0, err
+		return nil, nil, err
 	}
 
-	return &bind, uint16(port), nil
+	return &bind, []uint16{uint16(port)}, nil
+}
+
+func CreateDualStackBind(ports []uint16) (Bind, []uint16, error) {
+	return nil, nil, errors.New("Dual-stack sockets not supported on this platform")
+}
+
+func CreateBindAddress(ports []uint16, addr net.IP, freebind bool) (Bind, []uint16, error) {
+	return nil, nil, errors.New("Listen addresses not supported on this platform")
+}
+
+/* Sources are never pinned on this platform,
+ * hence sticky is ignored and every bind is without sticky sockets
+ */
+func createBindWithOptions(ports []uint16, options bindOptions) (Bind, []uint16, error) {
+	if options.receivers > 1 {
+		return nil, nil, errors.New("Multiple receivers not supported on this platform")
+	}
+	if options.address != nil {
+		return CreateBindAddress(ports, options.address, options.freebind)
+	}
+	if options.dualStack {
+		return CreateDualStackBind(ports)
+	}
+	return CreateBind(ports)
+}
+
+/* Returns the port of the IPv4 and IPv6 sockets,
+ * as assigned by the operating system if port 0 was requested
+ */
+func (bind *NativeBind) Port() (uint16, error) {
+	port4 := bind.ipv4.LocalAddr().(*net.UDPAddr).Port
+	port6 := bind.ipv6.LocalAddr().(*net.UDPAddr).Port
+	if port4 != port6 {
+		return 0, fmt.Errorf("IPv4 and IPv6 sockets bound to different ports (%d and %d)", port4, port6)
+	}
+	return uint16(port4), nil
 }
 
 func (bind *NativeBind) Close() error {
@@ -123,7 +176,7 @@ func (bind *NativeBind) ReceiveIPv6(buff []byte) (int, Endpoint, error) {
 func (bind *NativeBind) Send(buff []byte, endpoint Endpoint) error {
 	var err error
 	nend := endpoint.(*NativeEndpoint)
-	if nend.IP.To16() != nil {
+	if nend.IP.To4() == nil {
 		_, err = bind.ipv6.WriteToUDP(buff, (*net.UDPAddr)(nend))
 	} else {
 		_, err = bind.ipv4.WriteToUDP(buff, (*net.UDPAddr)(nend))
@@ -134,3 +187,14 @@ func (bind *NativeBind) Send(buff []byte, endpoint Endpoint) error {
 func (bind *NativeBind) SetMark(_ uint32) error {
 	return nil
 }
+
+func (bind *NativeBind) SetDontFragment(_ bool) error {
+	return nil
+}
+
+func (bind *NativeBind) SetTrafficClass(tc uint8) error {
+	if err := ipv6.NewConn(bind.ipv6).SetTrafficClass(int(tc)); err != nil {
+		return err
+	}
+	return ipv4.NewConn(bind.ipv4).SetTOS(int(tc))
+}
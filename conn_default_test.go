@@ -0,0 +1,80 @@
+// +build !linux
+
+/* SPDX-License-Identifier: GPL-2.0
+ *
+ * Copyright (C) 2017-2018 Jason A. Donenfeld <Jason@zx2c4.com>. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+func TestDefaultBindLoopback(t *testing.T) {
+	bind1, ports1, err := CreateBind([]uint16{0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bind1.Close()
+
+	bind2, ports2, err := CreateBind([]uint16{0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bind2.Close()
+
+	if ports1[0] == 0 || ports2[0] == 0 {
+		t.Fatal("bound port not reported")
+	}
+
+	if port, err := bind1.(*NativeBind).Port(); err != nil || port != ports1[0] {
+		t.Fatal("unexpected port", port, "reported on creation", ports1[0], err)
+	}
+
+	for _, host := range []string{"127.0.0.1", "[::1]"} {
+		end, err := CreateEndpoint(fmt.Sprintf("%s:%d", host, ports2[0]))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		msg := []byte("wireguard default bind " + host)
+		if err := bind1.Send(msg, end); err != nil {
+			t.Fatal(err)
+		}
+
+		var buff [MaxMessageSize]byte
+		var n int
+		var src Endpoint
+		if host == "127.0.0.1" {
+			n, src, err = bind2.ReceiveIPv4(buff[:])
+		} else {
+			n, src, err = bind2.ReceiveIPv6(buff[:])
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buff[:n], msg) {
+			t.Fatal("received unexpected datagram:", buff[:n])
+		}
+
+		// replies reach the sender
+
+		if err := bind2.Send(msg, src); err != nil {
+			t.Fatal(err)
+		}
+		if host == "127.0.0.1" {
+			n, _, err = bind1.ReceiveIPv4(buff[:])
+		} else {
+			n, _, err = bind1.ReceiveIPv6(buff[:])
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buff[:n], msg) {
+			t.Fatal("received unexpected reply:", buff[:n])
+		}
+	}
+}
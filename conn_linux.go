@@ -15,13 +15,21 @@
 package main
 
 import (
+	"encoding/binary"
 	"errors"
+	"fmt"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
 	"golang.org/x/sys/unix"
 	"net"
-	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
 	"unsafe"
 )
 
+const ipv6FlowInfoSend = 33 // IPV6_FLOWINFO_SEND, not provided by golang.org/x/sys/unix
+
 type IPv4Source struct {
 	src     [4]byte
 	ifindex int32
@@ -32,10 +40,19 @@ type IPv6Source struct {
 	//ifindex belongs in dst.ZoneId
 }
 
+/* The source cache is shared with the route listener,
+ * which only marks it stale; the send path clears it before the next send.
+ * Hence sending only takes the lock after a route change.
+ */
 type NativeEndpoint struct {
-	dst  [unsafe.Sizeof(unix.SockaddrInet6{})]byte
-	src  [unsafe.Sizeof(IPv6Source{})]byte
-	isV6 bool
+	dst      [unsafe.Sizeof(unix.SockaddrInet6{})]byte
+	src      [unsafe.Sizeof(IPv6Source{})]byte
+	isV6     bool
+	srcMutex sync.Mutex // held when modifying src
+	srcStale int32      // set by the route listener
+	srcFixed bool       // src set by SetSrc, retained by ClearSrc
+	sock     int        // index of the listening port the endpoint was seen on
+	mark     uint32     // SO_MARK of datagrams sent (0 = that of the socket)
 }
 
 func (endpoint *NativeEndpoint) src4() *IPv4Source {
@@ -54,16 +71,48 @@ func (endpoint *NativeEndpoint) dst6() *unix.SockaddrInet6 {
 	return (*unix.SockaddrInet6)(unsafe.Pointer(&endpoint.dst[0]))
 }
 
+/* A socket pair is opened for every listening port,
+ * in dual-stack mode a single IPv6 socket serves both families
+ * and when bound to an address only the sockets of its family are opened
+ *
+ * With multiple receivers every receiver has sockets of its own (SO_REUSEPORT),
+ * datagrams are sent from the sockets of the first receiver
+ */
 type NativeBind struct {
-	sock4        int
-	sock6        int
+	sock4        []int
+	sock6        []int
+	reuse4       [][]int       // sockets of further receivers (per port), sock4 serves the first
+	reuse6       [][]int       // sockets of further receivers (per port), sock6 serves the first
+	dualStack    bool          // IPv4 is carried as v4-mapped IPv6
+	address      net.IP        // local address of the sockets (nil = wildcard)
+	closing      chan struct{} // unblocks the receive of a family without sockets
 	netlinkSock  int
-	lastEndpoint *NativeEndpoint
-	lastMark     uint32
+	lastEndpoint atomic.Value // *NativeEndpoint
+	lastMark     uint32       // mark of the sockets (0 = none), accessed atomically
+	connected    atomic.Value // *NativeEndpoint (point-to-point mode)
+	multicast    sync.Mutex   // held while sending to a multicast group
+	flowLabel    uint32       // IPv6 flow label (0 = kernel default)
+	sendTimeout  int64        // SO_SNDTIMEO in nanoseconds (0 = none), accessed atomically
+	changed      atomic.Value // func(), called on address and link changes
+	srcInvalid   atomic.Value // func(Endpoint), called when a cached source is found invalid
+	noSticky     bool         // sources are neither learned nor passed, no route listener
+
+	routeHealth RoutineHealth // liveness of the route listener
 }
 
 var _ Endpoint = (*NativeEndpoint)(nil)
+var _ SourceEndpoint = (*NativeEndpoint)(nil)
 var _ Bind = (*NativeBind)(nil)
+var _ EndpointTracker = (*NativeBind)(nil)
+var _ PathMTUDiscoverer = (*NativeBind)(nil)
+var _ PointToPointBind = (*NativeBind)(nil)
+var _ NetworkChangeNotifier = (*NativeBind)(nil)
+var _ FlowLabelBind = (*NativeBind)(nil)
+var _ ParallelReceiveBind = (*NativeBind)(nil)
+var _ SendTimeoutBind = (*NativeBind)(nil)
+var _ HealthReporter = (*NativeBind)(nil)
+var _ SourceInvalidationNotifier = (*NativeBind)(nil)
+var _ MarkEndpoint = (*NativeEndpoint)(nil)
 
 func CreateEndpoint(s string) (Endpoint, error) {
 	var end NativeEndpoint
@@ -107,7 +156,11 @@ func createNetlinkRouteSocket() (int, error) {
 	}
 	saddr := &unix.SockaddrNetlink{
 		Family: unix.AF_NETLINK,
-		Groups: uint32(1 << (unix.RTNLGRP_IPV4_ROUTE - 1)),
+		Groups: uint32(1<<(unix.RTNLGRP_IPV4_ROUTE-1)) |
+			uint32(1<<(unix.RTNLGRP_IPV6_ROUTE-1)) |
+			uint32(1<<(unix.RTNLGRP_IPV4_IFADDR-1)) |
+			uint32(1<<(unix.RTNLGRP_IPV6_IFADDR-1)) |
+			uint32(1<<(unix.RTNLGRP_LINK-1)),
 	}
 	err = unix.Bind(sock, saddr)
 	if err != nil {
@@ -118,58 +171,413 @@ func createNetlinkRouteSocket() (int, error) {
 
 }
 
-func CreateBind(port uint16) (*NativeBind, uint16, error) {
+func CreateBind(ports []uint16) (*NativeBind, []uint16, error) {
+	return createNativeBind(ports, bindOptions{receivers: 1, sticky: true})
+}
+
+/* Creates a bind with a single IPv6 socket (IPV6_V6ONLY=0) per port,
+ * IPv4 peers are reached through v4-mapped addresses
+ */
+func CreateDualStackBind(ports []uint16) (*NativeBind, []uint16, error) {
+	return createNativeBind(ports, bindOptions{dualStack: true, receivers: 1, sticky: true})
+}
+
+/* Creates a bind with the sockets bound to a local address,
+ * only datagrams of the family of the address are sent and received
+ *
+ * With freebind the address need not (yet) be assigned to an interface,
+ * such that the daemon may start before the address is configured
+ */
+func CreateBindAddress(ports []uint16, addr net.IP, freebind bool) (*NativeBind, []uint16, error) {
+	if addr == nil {
+		return nil, nil, errors.New("Missing listen address")
+	}
+	return createNativeBind(ports, bindOptions{address: addr, freebind: freebind, receivers: 1, sticky: true})
+}
+
+/* Creates a bind as described by the options,
+ * with more than one receiver a socket (pair) per port is created for each of the receivers,
+ * sharing the ports by SO_REUSEPORT, the kernel balances inbound datagrams across the receivers (by flow)
+ *
+ * Without sticky sockets the kernel chooses the source of every datagram (unless fixed by SetSrc)
+ * and no netlink socket is opened to track route changes
+ */
+func createBindWithOptions(ports []uint16, options bindOptions) (*NativeBind, []uint16, error) {
+	if options.receivers < 1 {
+		return nil, nil, errors.New("Invalid number of receivers")
+	}
+	if options.address != nil {
+		options.dualStack = false
+	}
+	return createNativeBind(ports, options)
+}
+
+func createNativeBind(ports []uint16, options bindOptions) (*NativeBind, []uint16, error) {
 	var err error
 	var bind NativeBind
 
-	bind.netlinkSock, err = createNetlinkRouteSocket()
-	if err != nil {
-		return nil, 0, err
+	bind.dualStack = options.dualStack
+	bind.address = options.address
+	bind.closing = make(chan struct{})
+	bind.reuse4 = make([][]int, options.receivers-1)
+	bind.reuse6 = make([][]int, options.receivers-1)
+	bind.noSticky = !options.sticky
+	bind.netlinkSock = -1
+	reusePort := options.receivers > 1
+
+	if options.sticky {
+		bind.netlinkSock, err = createNetlinkRouteSocket()
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	closeAll := func() {
+		if bind.netlinkSock >= 0 {
+			unix.Close(bind.netlinkSock)
+		}
+		for _, sock := range append(bind.socks4(), bind.socks6()...) {
+			unix.Close(sock)
+		}
+	}
+
+	addr4 := options.address.To4()
+
+	bound := make([]uint16, len(ports))
+	for i, port := range ports {
+		var sock4, sock6 int
+
+		// an ephemeral port is first reserved exclusively,
+		// as the kernel may otherwise assign the port of another SO_REUSEPORT group
+
+		if reusePort && port == 0 {
+			var sock int
+			if addr4 == nil {
+				sock, port, err = create6(0, options.dualStack, options.address, options.freebind, false)
+			} else {
+				sock, port, err = create4(0, addr4, options.freebind, false)
+			}
+			if err != nil {
+				closeAll()
+				return nil, nil, err
+			}
+			unix.Close(sock)
+		}
+
+		if addr4 == nil {
+			sock6, port, err = create6(port, options.dualStack, options.address, options.freebind, reusePort)
+			if err != nil {
+				closeAll()
+				return nil, nil, err
+			}
+			bind.sock6 = append(bind.sock6, sock6)
+
+			for r := range bind.reuse6 {
+				sock6, _, err = create6(port, options.dualStack, options.address, options.freebind, true)
+				if err != nil {
+					closeAll()
+					return nil, nil, err
+				}
+				bind.reuse6[r] = append(bind.reuse6[r], sock6)
+			}
+		}
+
+		if options.dualStack || options.address != nil && addr4 == nil {
+			bound[i] = port
+			continue
+		}
+
+		sock4, port, err = create4(port, addr4, options.freebind, reusePort)
+		if err != nil {
+			closeAll()
+			return nil, nil, err
+		}
+		bind.sock4 = append(bind.sock4, sock4)
+
+		for r := range bind.reuse4 {
+			sock4, _, err = create4(port, addr4, options.freebind, true)
+			if err != nil {
+				closeAll()
+				return nil, nil, err
+			}
+			bind.reuse4[r] = append(bind.reuse4[r], sock4)
+		}
+
+		bound[i] = port
+	}
+
+	// started once all sockets are bound, as a failure closes the netlink socket
+	// (the number of which may be reused before a running listener observes the close)
+
+	if options.sticky {
+		bind.routeHealth.started()
+		go bind.routineRouteListener()
+	}
+
+	return &bind, bound, nil
+}
+
+/* Returns the IPv4 (IPv6) sockets of all receivers
+ */
+func (bind *NativeBind) socks4() []int {
+	socks := append([]int(nil), bind.sock4...)
+	for _, reuse := range bind.reuse4 {
+		socks = append(socks, reuse...)
 	}
+	return socks
+}
+
+func (bind *NativeBind) socks6() []int {
+	socks := append([]int(nil), bind.sock6...)
+	for _, reuse := range bind.reuse6 {
+		socks = append(socks, reuse...)
+	}
+	return socks
+}
 
-	go bind.routineRouteListener()
+func (bind *NativeBind) Receivers() int {
+	return len(bind.reuse4) + 1
+}
 
-	bind.sock6, port, err = create6(port)
+/* Returns the local port of the socket
+ */
+func sockPort(sock int) (uint16, error) {
+	sa, err := unix.Getsockname(sock)
 	if err != nil {
-		unix.Close(bind.netlinkSock)
-		return nil, port, err
+		return 0, err
+	}
+	switch sa := sa.(type) {
+	case *unix.SockaddrInet4:
+		return uint16(sa.Port), nil
+	case *unix.SockaddrInet6:
+		return uint16(sa.Port), nil
 	}
+	return 0, errors.New("Unexpected socket address family")
+}
 
-	bind.sock4, port, err = create4(port)
+/* Returns the port of the primary IPv4 and IPv6 sockets,
+ * as assigned by the kernel if port 0 was requested
+ */
+func (bind *NativeBind) Port() (uint16, error) {
+	if len(bind.sock4) == 0 {
+		return sockPort(bind.sock6[0])
+	}
+	if len(bind.sock6) == 0 {
+		return sockPort(bind.sock4[0])
+	}
+	port4, err := sockPort(bind.sock4[0])
+	if err != nil {
+		return 0, err
+	}
+	port6, err := sockPort(bind.sock6[0])
 	if err != nil {
-		unix.Close(bind.netlinkSock)
-		unix.Close(bind.sock6)
+		return 0, err
+	}
+	if port4 != port6 {
+		return 0, fmt.Errorf("IPv4 and IPv6 sockets bound to different ports (%d and %d)", port4, port6)
+	}
+	return port4, nil
+}
+
+/* Sets a socket option on every IPv4 and IPv6 socket,
+ * dual-stack sockets receive both the IPv4 and IPv6 option
+ */
+func (bind *NativeBind) setsockoptInt(level4, opt4, value4, level6, opt6, value6 int) error {
+	for _, sock := range bind.socks6() {
+		if err := unix.SetsockoptInt(sock, level6, opt6, value6); err != nil {
+			return err
+		}
+		if !bind.dualStack {
+			continue
+		}
+		if err := unix.SetsockoptInt(sock, level4, opt4, value4); err != nil {
+			return err
+		}
+	}
+	for _, sock := range bind.socks4() {
+		if err := unix.SetsockoptInt(sock, level4, opt4, value4); err != nil {
+			return err
+		}
 	}
-	return &bind, port, err
+	return nil
 }
 
 func (bind *NativeBind) SetMark(value uint32) error {
-	err := unix.SetsockoptInt(
-		bind.sock6,
-		unix.SOL_SOCKET,
-		unix.SO_MARK,
-		int(value),
+	err := bind.setsockoptInt(
+		unix.SOL_SOCKET, unix.SO_MARK, int(value),
+		unix.SOL_SOCKET, unix.SO_MARK, int(value),
 	)
 
 	if err != nil {
 		return err
 	}
 
-	err = unix.SetsockoptInt(
-		bind.sock4,
-		unix.SOL_SOCKET,
-		unix.SO_MARK,
-		int(value),
+	atomic.StoreUint32(&bind.lastMark, value)
+	return nil
+}
+
+func (bind *NativeBind) SetDontFragment(enabled bool) error {
+
+	// otherwise revert to the kernel default
+
+	mode4, mode6 := unix.IP_PMTUDISC_WANT, unix.IPV6_PMTUDISC_WANT
+	if enabled {
+		mode4, mode6 = unix.IP_PMTUDISC_DO, unix.IPV6_PMTUDISC_DO
+	}
+
+	return bind.setsockoptInt(
+		unix.IPPROTO_IP, unix.IP_MTU_DISCOVER, mode4,
+		unix.IPPROTO_IPV6, unix.IPV6_MTU_DISCOVER, mode6,
 	)
+}
 
-	if err != nil {
-		return err
+func (bind *NativeBind) SetTrafficClass(tc uint8) error {
+	return bind.setsockoptInt(
+		unix.IPPROTO_IP, unix.IP_TOS, int(tc),
+		unix.IPPROTO_IPV6, unix.IPV6_TCLASS, int(tc),
+	)
+}
+
+/* Passes the flow label with every IPv6 datagram (in sin6_flowinfo)
+ *
+ * Since Linux 5.1 the label need not be leased (IPV6_FLOWLABEL_MGR),
+ * unless a socket in the network namespace holds an exclusive lease
+ */
+func (bind *NativeBind) SetFlowLabel(label uint32) error {
+	var send int
+	if label != 0 {
+		send = 1
+	}
+	for _, sock := range bind.socks6() {
+		err := unix.SetsockoptInt(sock, unix.IPPROTO_IPV6, ipv6FlowInfoSend, send)
+		if err != nil {
+			return err
+		}
+	}
+	atomic.StoreUint32(&bind.flowLabel, label)
+	return nil
+}
+
+func (bind *NativeBind) SetNetworkChangeHandler(handler func()) {
+	bind.changed.Store(handler)
+}
+
+func (bind *NativeBind) SetSourceInvalidationHandler(handler func(end Endpoint)) {
+	bind.srcInvalid.Store(handler)
+}
+
+func (bind *NativeBind) sourceInvalidated(end *NativeEndpoint) {
+	if handler, _ := bind.srcInvalid.Load().(func(Endpoint)); handler != nil {
+		handler(end)
 	}
+}
 
-	bind.lastMark = value
+/* Connects the sockets of the endpoint's family to the endpoint,
+ * restricting reception to datagrams from the endpoint
+ */
+func (bind *NativeBind) SetPointToPoint(end Endpoint) error {
+	nend, _ := end.(*NativeEndpoint)
+
+	if conn, _ := bind.connected.Load().(*NativeEndpoint); conn == nend ||
+		conn != nil && nend != nil && conn.dstEqual(nend) {
+		return nil
+	}
+
+	// disconnect all sockets
+
+	bind.connected.Store((*NativeEndpoint)(nil))
+	for _, sock := range append(bind.socks4(), bind.socks6()...) {
+		if err := disconnect(sock); err != nil {
+			return err
+		}
+	}
+
+	if nend == nil {
+		return nil
+	}
+
+	// connect sockets of the family
+
+	socks, dst := bind.socks4(), unix.Sockaddr(nend.dst4())
+	if nend.isV6 {
+		socks, dst = bind.socks6(), nend.dst6()
+	} else if bind.dualStack {
+		socks, dst = bind.socks6(), mapV4(nend.dst4())
+	}
+	for _, sock := range socks {
+		if err := unix.Connect(sock, dst); err != nil {
+			return err
+		}
+	}
+
+	conn := &NativeEndpoint{isV6: nend.isV6}
+	conn.dst = nend.dst
+	bind.connected.Store(conn)
+	return nil
+}
+
+func disconnect(sock int) error {
+	addr := unix.RawSockaddr{Family: unix.AF_UNSPEC}
+	_, _, errno := unix.Syscall(
+		unix.SYS_CONNECT,
+		uintptr(sock),
+		uintptr(unsafe.Pointer(&addr)),
+		unsafe.Sizeof(addr),
+	)
+	if errno != 0 {
+		return errno
+	}
 	return nil
 }
 
+/* IP_MTU is only available on connected sockets,
+ * hence the path MTU is read from a temporary socket connected to the endpoint
+ */
+func (bind *NativeBind) PathMTU(end Endpoint) (int, error) {
+	nend := end.(*NativeEndpoint)
+
+	var (
+		dst      unix.Sockaddr
+		family   int
+		level    int
+		opt      int
+		overhead int
+	)
+
+	if !nend.isV6 {
+		dst, family, level, opt = nend.dst4(), unix.AF_INET, unix.IPPROTO_IP, unix.IP_MTU
+		overhead = ipv4.HeaderLen + 8
+	} else {
+		dst, family, level, opt = nend.dst6(), unix.AF_INET6, unix.IPPROTO_IPV6, unix.IPV6_MTU
+		overhead = ipv6.HeaderLen + 8
+	}
+
+	fd, err := unix.Socket(family, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer unix.Close(fd)
+
+	// use the same route as the bind
+
+	if mark := atomic.LoadUint32(&bind.lastMark); mark != 0 {
+		err = unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_MARK, int(mark))
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	if err := unix.Connect(fd, dst); err != nil {
+		return 0, err
+	}
+
+	mtu, err := unix.GetsockoptInt(fd, level, opt)
+	if err != nil {
+		return 0, err
+	}
+	return mtu - overhead, nil
+}
+
 func closeUnblock(fd int) error {
 	// shutdown to unblock readers
 	unix.Shutdown(fd, unix.SHUT_RD)
@@ -177,45 +585,282 @@ func closeUnblock(fd int) error {
 }
 
 func (bind *NativeBind) Close() error {
-	err1 := closeUnblock(bind.sock6)
-	err2 := closeUnblock(bind.sock4)
-	err3 := closeUnblock(bind.netlinkSock)
-	if err1 != nil {
-		return err1
+	var err error
+	select {
+	case <-bind.closing:
+	default:
+		close(bind.closing)
 	}
-	if err2 != nil {
-		return err2
+	for _, sock := range append(bind.socks6(), bind.socks4()...) {
+		if err1 := closeUnblock(sock); err == nil {
+			err = err1
+		}
+	}
+	if bind.netlinkSock < 0 {
+		return err
+	}
+	if err1 := closeUnblock(bind.netlinkSock); err == nil {
+		err = err1
 	}
-	return err3
+	return err
 }
 
 func (bind *NativeBind) ReceiveIPv6(buff []byte) (int, Endpoint, error) {
+	return bind.ReceiveIPv6On(0, buff)
+}
+
+func (bind *NativeBind) ReceiveIPv4(buff []byte) (int, Endpoint, error) {
+	return bind.ReceiveIPv4On(0, buff)
+}
+
+func (bind *NativeBind) ReceiveIPv6On(receiver int, buff []byte) (int, Endpoint, error) {
 	var end NativeEndpoint
+
+	socks := bind.sock6
+	if receiver > 0 {
+		socks = bind.reuse6[receiver-1]
+	}
+
+	if len(socks) == 0 {
+		<-bind.closing
+		return 0, nil, unix.EBADF
+	}
+
+	sock, err := pollSockets(socks)
+	if err != nil {
+		return 0, nil, err
+	}
 	n, err := receive6(
-		bind.sock6,
+		socks[sock],
 		buff,
 		&end,
 	)
+	bind.forgetSource(&end)
+	if bind.dualStack {
+		end.unmapV4()
+	}
+	end.sock = sock
 	return n, &end, err
 }
 
-func (bind *NativeBind) ReceiveIPv4(buff []byte) (int, Endpoint, error) {
+func (bind *NativeBind) ReceiveIPv4On(receiver int, buff []byte) (int, Endpoint, error) {
 	var end NativeEndpoint
+
+	socks := bind.sock4
+	if receiver > 0 {
+		socks = bind.reuse4[receiver-1]
+	}
+
+	// IPv4 datagrams arrive on the IPv6 sockets in dual-stack mode
+	// (and none are received when bound to an IPv6 address)
+
+	if len(socks) == 0 {
+		<-bind.closing
+		return 0, nil, unix.EBADF
+	}
+
+	sock, err := pollSockets(socks)
+	if err != nil {
+		return 0, nil, err
+	}
 	n, err := receive4(
-		bind.sock4,
+		socks[sock],
 		buff,
 		&end,
 	)
-	bind.lastEndpoint = &end
+	bind.forgetSource(&end)
+	end.sock = sock
 	return n, &end, err
 }
 
+/* Waits until one of the sockets is readable and returns its index
+ */
+func pollSockets(socks []int) (int, error) {
+	if len(socks) == 1 {
+		return 0, nil
+	}
+
+	fds := make([]unix.PollFd, len(socks))
+	for i, sock := range socks {
+		fds[i] = unix.PollFd{
+			Fd:     int32(sock),
+			Events: unix.POLLIN,
+		}
+	}
+
+	for {
+		_, err := unix.Poll(fds, -1)
+		if err == unix.EINTR {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		for i, fd := range fds {
+			if fd.Revents&unix.POLLNVAL != 0 {
+				return 0, unix.EBADF // closed
+			}
+			if fd.Revents != 0 {
+				return i, nil
+			}
+		}
+	}
+}
+
+/* Discards the source learned from a received datagram
+ * when sticky sockets are disabled, such that none is reported or passed
+ */
+func (bind *NativeBind) forgetSource(end *NativeEndpoint) {
+	if bind.noSticky {
+		end.src = [unsafe.Sizeof(IPv6Source{})]byte{}
+	}
+}
+
+/* Returns whether the source of the endpoint is passed with a datagram,
+ * without sticky sockets only a source fixed by SetSrc is
+ */
+func (bind *NativeBind) pinsSource(end *NativeEndpoint) bool {
+	return !bind.noSticky || end.isSrcFixed()
+}
+
+/* Called once a packet from the endpoint has been authenticated,
+ * unauthenticated datagrams must not influence the route listener
+ */
+func (bind *NativeBind) UpdateLastEndpoint(end Endpoint) {
+	if nend, ok := end.(*NativeEndpoint); ok {
+		bind.lastEndpoint.Store(nend)
+	}
+}
+
+/* Retries the send while the kernel reports transient buffer pressure,
+ * such that a burst exceeding the socket buffer does not lose datagrams
+ */
+func sendRetry(send func() error) error {
+	backoff := SendRetryBackoff
+	for attempt := 0; ; attempt++ {
+		err := send()
+		if (err != unix.ENOBUFS && err != unix.EAGAIN) || attempt == SendRetryAttempts {
+			return err
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
 func (bind *NativeBind) Send(buff []byte, end Endpoint) error {
 	nend := end.(*NativeEndpoint)
-	if !nend.isV6 {
-		return send4(bind.sock4, nend, buff)
+	return sendRetry(func() error {
+		err := bind.send(buff, nend)
+
+		// the sockets block, unless the send timeout elapsed
+
+		if err == unix.EAGAIN && atomic.LoadInt64(&bind.sendTimeout) != 0 {
+			return ErrSendTimeout
+		}
+		return err
+	})
+}
+
+func (bind *NativeBind) SetSendTimeout(timeout time.Duration) error {
+	tv := unix.NsecToTimeval(timeout.Nanoseconds())
+	for _, socks := range [][]int{bind.socks4(), bind.socks6()} {
+		for _, sock := range socks {
+			if err := unix.SetsockoptTimeval(sock, unix.SOL_SOCKET, unix.SO_SNDTIMEO, &tv); err != nil {
+				return err
+			}
+		}
+	}
+	atomic.StoreInt64(&bind.sendTimeout, timeout.Nanoseconds())
+	return nil
+}
+
+func (bind *NativeBind) send(buff []byte, nend *NativeEndpoint) error {
+	if atomic.LoadInt32(&nend.srcStale) == AtomicTrue && !bind.noSticky {
+		nend.ClearSrc()
+	}
+
+	// sockets bound to an address only send from it
+
+	if bind.address != nil && !bind.noSticky {
+		if src := nend.SrcIP(); !src.IsUnspecified() && !src.Equal(bind.address) {
+			nend.ClearSrc()
+		}
+	}
+
+	// prefer the port the endpoint was last seen on
+
+	socks := bind.sock4
+	if nend.isV6 || bind.dualStack {
+		socks = bind.sock6
+	}
+	if len(socks) == 0 {
+		return unix.EAFNOSUPPORT
+	}
+	sock := nend.sock
+	if sock >= len(socks) {
+		sock = 0
+	}
+
+	// connected sockets let the kernel choose the route
+	// (the flow label is only passed with the destination)
+
+	label := atomic.LoadUint32(&bind.flowLabel)
+	if conn, _ := bind.connected.Load().(*NativeEndpoint); conn != nil && conn.dstEqual(nend) &&
+		(!nend.isV6 || label == 0) {
+		fd := bind.sock6[sock]
+		if !nend.isV6 && !bind.dualStack {
+			fd = bind.sock4[sock]
+		}
+		_, err := unix.Write(fd, buff)
+		return err
+	}
+
+	if nend.isV6 && nend.dst6().Addr[0] == 0xff {
+		return bind.sendMulticast(bind.sock6[sock], nend, buff, label)
+	} else if nend.isV6 {
+		return bind.send6(bind.sock6[sock], nend, buff, label)
+	} else if bind.dualStack {
+		return bind.send4Mapped(bind.sock6[sock], nend, buff)
 	} else {
-		return send6(bind.sock6, nend, buff)
+		return bind.send4(bind.sock4[sock], nend, buff)
+	}
+}
+
+/* Returns the v4-mapped IPv6 socket address of an IPv4 address
+ */
+func mapV4(addr *unix.SockaddrInet4) *unix.SockaddrInet6 {
+	mapped := &unix.SockaddrInet6{Port: addr.Port}
+	mapped.Addr[10] = 0xff
+	mapped.Addr[11] = 0xff
+	copy(mapped.Addr[12:], addr.Addr[:])
+	return mapped
+}
+
+func isV4Mapped(addr [16]byte) bool {
+	return net.IP(addr[:]).To4() != nil
+}
+
+/* Turns an endpoint received on a dual-stack socket from a v4-mapped
+ * address into an IPv4 endpoint, such that it is indistinguishable
+ * from an endpoint received on an IPv4 socket
+ */
+func (end *NativeEndpoint) unmapV4() {
+	if !end.isV6 || !isV4Mapped(end.dst6().Addr) {
+		return
+	}
+
+	dst := *end.dst6()
+	src := *end.src6()
+
+	end.dst = [len(end.dst)]byte{}
+	end.src = [len(end.src)]byte{}
+	end.isV6 = false
+
+	end.dst4().Port = dst.Port
+	copy(end.dst4().Addr[:], dst.Addr[12:])
+	if isV4Mapped(src.src) {
+		copy(end.src4().src[:], src.src[12:])
+		end.src4().ifindex = int32(dst.ZoneId)
 	}
 }
 
@@ -245,6 +890,14 @@ func (end *NativeEndpoint) SrcIP() net.IP {
 	}
 }
 
+func (end *NativeEndpoint) SrcIfindex() int32 {
+	if !end.isV6 {
+		return end.src4().ifindex
+	} else {
+		return int32(end.dst6().ZoneId)
+	}
+}
+
 func (end *NativeEndpoint) DstIP() net.IP {
 	if !end.isV6 {
 		return net.IPv4(
@@ -277,10 +930,29 @@ func (end *NativeEndpoint) DstToString() string {
 		udpAddr.Port = end.dst4().Port
 	} else {
 		udpAddr.Port = end.dst6().Port
+		udpAddr.Zone = zoneToString(end.dst6().ZoneId)
 	}
 	return udpAddr.String()
 }
 
+/* Reports whether the endpoints have the same destination,
+ * the cached source is ignored
+ */
+func (end *NativeEndpoint) Equal(other Endpoint) bool {
+	nend, ok := other.(*NativeEndpoint)
+	return ok && end.dstEqual(nend)
+}
+
+func (end *NativeEndpoint) dstEqual(other *NativeEndpoint) bool {
+	if end.isV6 != other.isV6 {
+		return false
+	}
+	if !end.isV6 {
+		return end.dst4().Port == other.dst4().Port && end.dst4().Addr == other.dst4().Addr
+	}
+	return end.dst6().Port == other.dst6().Port && end.dst6().Addr == other.dst6().Addr && end.dst6().ZoneId == other.dst6().ZoneId
+}
+
 func (end *NativeEndpoint) ClearDst() {
 	for i := range end.dst {
 		end.dst[i] = 0
@@ -288,23 +960,72 @@ func (end *NativeEndpoint) ClearDst() {
 }
 
 func (end *NativeEndpoint) ClearSrc() {
-	for i := range end.src {
-		end.src[i] = 0
+	end.srcMutex.Lock()
+	if !end.srcFixed {
+		for i := range end.src {
+			end.src[i] = 0
+		}
 	}
+	atomic.StoreInt32(&end.srcStale, AtomicFalse)
+	end.srcMutex.Unlock()
 }
 
-func zoneToUint32(zone string) (uint32, error) {
-	if zone == "" {
-		return 0, nil
+/* Fixes the source address of datagrams sent to the endpoint,
+ * nil releases the source (which is then learned again)
+ */
+func (end *NativeEndpoint) SetSrc(ip net.IP) error {
+	end.srcMutex.Lock()
+	defer end.srcMutex.Unlock()
+
+	if ip == nil {
+		end.srcFixed = false
+		for i := range end.src {
+			end.src[i] = 0
+		}
+		return nil
+	}
+
+	if ip4 := ip.To4(); ip4 != nil && !end.isV6 {
+		copy(end.src4().src[:], ip4)
+		end.src4().ifindex = 0
+	} else if ip4 == nil && end.isV6 {
+		copy(end.src6().src[:], ip.To16())
+	} else {
+		return errors.New("Source address of different family than endpoint")
 	}
-	if intr, err := net.InterfaceByName(zone); err == nil {
-		return uint32(intr.Index), nil
+	end.srcFixed = true
+	atomic.StoreInt32(&end.srcStale, AtomicFalse)
+	return nil
+}
+
+func (end *NativeEndpoint) SetMark(mark uint32) {
+	atomic.StoreUint32(&end.mark, mark)
+}
+
+/* Appends a control message marking a single datagram (SO_MARK),
+ * unless the endpoint is unmarked
+ */
+func (end *NativeEndpoint) appendMark(oob []byte) []byte {
+	mark := atomic.LoadUint32(&end.mark)
+	if mark == 0 {
+		return oob
 	}
-	n, err := strconv.ParseUint(zone, 10, 32)
-	return uint32(n), err
+	cmsg := make([]byte, unix.CmsgSpace(4))
+	hdr := (*unix.Cmsghdr)(unsafe.Pointer(&cmsg[0]))
+	hdr.Level = unix.SOL_SOCKET
+	hdr.Type = unix.SO_MARK
+	hdr.SetLen(unix.CmsgLen(4))
+	*(*uint32)(unsafe.Pointer(&cmsg[unix.CmsgLen(0)])) = mark
+	return append(oob[:len(oob):len(oob)], cmsg...)
 }
 
-func create4(port uint16) (int, uint16, error) {
+func (end *NativeEndpoint) isSrcFixed() bool {
+	end.srcMutex.Lock()
+	defer end.srcMutex.Unlock()
+	return end.srcFixed
+}
+
+func create4(port uint16, addr net.IP, freebind bool, reusePort bool) (int, uint16, error) {
 
 	// create socket
 
@@ -318,9 +1039,10 @@ func create4(port uint16) (int, uint16, error) {
 		return -1, 0, err
 	}
 
-	addr := unix.SockaddrInet4{
+	sa := unix.SockaddrInet4{
 		Port: int(port),
 	}
+	copy(sa.Addr[:], addr.To4())
 
 	// set sockopts and bind
 
@@ -334,6 +1056,17 @@ func create4(port uint16) (int, uint16, error) {
 			return err
 		}
 
+		if reusePort {
+			if err := unix.SetsockoptInt(
+				fd,
+				unix.SOL_SOCKET,
+				unix.SO_REUSEPORT,
+				1,
+			); err != nil {
+				return err
+			}
+		}
+
 		if err := unix.SetsockoptInt(
 			fd,
 			unix.IPPROTO_IP,
@@ -343,16 +1076,35 @@ func create4(port uint16) (int, uint16, error) {
 			return err
 		}
 
-		return unix.Bind(fd, &addr)
+		if freebind {
+			if err := unix.SetsockoptInt(
+				fd,
+				unix.IPPROTO_IP,
+				unix.IP_FREEBIND,
+				1,
+			); err != nil {
+				return err
+			}
+		}
+
+		return unix.Bind(fd, &sa)
 	}(); err != nil {
 		unix.Close(fd)
 		return -1, 0, err
 	}
 
-	return fd, uint16(addr.Port), err
+	// retrieve port (assigned by the kernel if 0)
+
+	port, err = sockPort(fd)
+	if err != nil {
+		unix.Close(fd)
+		return -1, 0, err
+	}
+
+	return fd, port, nil
 }
 
-func create6(port uint16) (int, uint16, error) {
+func create6(port uint16, dualStack bool, addr net.IP, freebind bool, reusePort bool) (int, uint16, error) {
 
 	// create socket
 
@@ -368,9 +1120,10 @@ func create6(port uint16) (int, uint16, error) {
 
 	// set sockopts and bind
 
-	addr := unix.SockaddrInet6{
+	sa := unix.SockaddrInet6{
 		Port: int(port),
 	}
+	copy(sa.Addr[:], addr.To16())
 
 	if err := func() error {
 
@@ -383,6 +1136,17 @@ func create6(port uint16) (int, uint16, error) {
 			return err
 		}
 
+		if reusePort {
+			if err := unix.SetsockoptInt(
+				fd,
+				unix.SOL_SOCKET,
+				unix.SO_REUSEPORT,
+				1,
+			); err != nil {
+				return err
+			}
+		}
+
 		if err := unix.SetsockoptInt(
 			fd,
 			unix.IPPROTO_IPV6,
@@ -392,26 +1156,50 @@ func create6(port uint16) (int, uint16, error) {
 			return err
 		}
 
+		if freebind {
+			if err := unix.SetsockoptInt(
+				fd,
+				unix.IPPROTO_IPV6,
+				unix.IPV6_FREEBIND,
+				1,
+			); err != nil {
+				return err
+			}
+		}
+
+		v6only := 1
+		if dualStack {
+			v6only = 0
+		}
+
 		if err := unix.SetsockoptInt(
 			fd,
 			unix.IPPROTO_IPV6,
 			unix.IPV6_V6ONLY,
-			1,
+			v6only,
 		); err != nil {
 			return err
 		}
 
-		return unix.Bind(fd, &addr)
+		return unix.Bind(fd, &sa)
 
 	}(); err != nil {
 		unix.Close(fd)
 		return -1, 0, err
 	}
 
-	return fd, uint16(addr.Port), err
+	// retrieve port (assigned by the kernel if 0)
+
+	port, err = sockPort(fd)
+	if err != nil {
+		unix.Close(fd)
+		return -1, 0, err
+	}
+
+	return fd, port, nil
 }
 
-func send4(sock int, end *NativeEndpoint, buff []byte) error {
+func (bind *NativeBind) send4(sock int, end *NativeEndpoint, buff []byte) error {
 
 	// construct message header
 
@@ -430,24 +1218,44 @@ func send4(sock int, end *NativeEndpoint, buff []byte) error {
 		},
 	}
 
-	_, err := unix.SendmsgN(sock, buff, (*[unsafe.Sizeof(cmsg)]byte)(unsafe.Pointer(&cmsg))[:], end.dst4(), 0)
+	oob := (*[unsafe.Sizeof(cmsg)]byte)(unsafe.Pointer(&cmsg))[:]
+	if !bind.pinsSource(end) {
+		oob = nil
+	}
+	_, err := unix.SendmsgN(sock, buff, end.appendMark(oob), end.dst4(), 0)
 
 	if err == nil {
 		return nil
 	}
 
-	// clear src and retry
+	// clear src and retry (unless fixed, to not send from another source)
 
-	if err == unix.EINVAL {
+	if err == unix.EINVAL && oob != nil && !end.isSrcFixed() {
+		bind.sourceInvalidated(end)
 		end.ClearSrc()
 		cmsg.pktinfo = unix.Inet4Pktinfo{}
-		_, err = unix.SendmsgN(sock, buff, (*[unsafe.Sizeof(cmsg)]byte)(unsafe.Pointer(&cmsg))[:], end.dst4(), 0)
+		oob = end.appendMark((*[unsafe.Sizeof(cmsg)]byte)(unsafe.Pointer(&cmsg))[:])
+		_, err = unix.SendmsgN(sock, buff, oob, end.dst4(), 0)
 	}
 
 	return err
 }
 
-func send6(sock int, end *NativeEndpoint, buff []byte) error {
+/* Sends to an IPv6 multicast group on the interface of the endpoint's zone,
+ * the scope id alone only selects the interface of link-local groups
+ */
+func (bind *NativeBind) sendMulticast(sock int, end *NativeEndpoint, buff []byte, label uint32) error {
+	bind.multicast.Lock()
+	defer bind.multicast.Unlock()
+
+	err := unix.SetsockoptInt(sock, unix.IPPROTO_IPV6, unix.IPV6_MULTICAST_IF, int(end.dst6().ZoneId))
+	if err != nil {
+		return err
+	}
+	return bind.send6(sock, end, buff, label)
+}
+
+func (bind *NativeBind) send6(sock int, end *NativeEndpoint, buff []byte, label uint32) error {
 
 	// construct message header
 
@@ -470,18 +1278,113 @@ func send6(sock int, end *NativeEndpoint, buff []byte) error {
 		cmsg.pktinfo.Ifindex = 0
 	}
 
-	_, err := unix.SendmsgN(sock, buff, (*[unsafe.Sizeof(cmsg)]byte)(unsafe.Pointer(&cmsg))[:], end.dst6(), 0)
+	oob := (*[unsafe.Sizeof(cmsg)]byte)(unsafe.Pointer(&cmsg))[:]
+	if !bind.pinsSource(end) {
+		oob = nil
+	}
+	err := sendmsg6(sock, buff, end.appendMark(oob), end.dst6(), label)
 
 	if err == nil {
 		return nil
 	}
 
-	// clear src and retry
+	// clear src and retry (unless fixed, to not send from another source)
 
-	if err == unix.EINVAL {
+	if err == unix.EINVAL && oob != nil && !end.isSrcFixed() {
+		bind.sourceInvalidated(end)
 		end.ClearSrc()
 		cmsg.pktinfo = unix.Inet6Pktinfo{}
-		_, err = unix.SendmsgN(sock, buff, (*[unsafe.Sizeof(cmsg)]byte)(unsafe.Pointer(&cmsg))[:], end.dst6(), 0)
+		oob = end.appendMark((*[unsafe.Sizeof(cmsg)]byte)(unsafe.Pointer(&cmsg))[:])
+		err = sendmsg6(sock, buff, oob, end.dst6(), label)
+	}
+
+	return err
+}
+
+/* Sends to an IPv6 destination with the flow label in sin6_flowinfo,
+ * which unix.SockaddrInet6 does not expose
+ */
+func sendmsg6(sock int, buff, oob []byte, dst *unix.SockaddrInet6, label uint32) error {
+	if label == 0 {
+		_, err := unix.SendmsgN(sock, buff, oob, dst, 0)
+		return err
+	}
+
+	var addr unix.RawSockaddrInet6
+	addr.Family = unix.AF_INET6
+	binary.BigEndian.PutUint16((*[2]byte)(unsafe.Pointer(&addr.Port))[:], uint16(dst.Port))
+	binary.BigEndian.PutUint32((*[4]byte)(unsafe.Pointer(&addr.Flowinfo))[:], label)
+	addr.Addr = dst.Addr
+	addr.Scope_id = dst.ZoneId
+
+	var iov unix.Iovec
+	iov.Base = &buff[0]
+	iov.SetLen(len(buff))
+
+	var msg unix.Msghdr
+	msg.Name = (*byte)(unsafe.Pointer(&addr))
+	msg.Namelen = unix.SizeofSockaddrInet6
+	msg.Iov = &iov
+	msg.SetIovlen(1)
+	if len(oob) > 0 {
+		msg.Control = &oob[0]
+		msg.SetControllen(len(oob))
+	}
+
+	_, _, errno := unix.Syscall(
+		unix.SYS_SENDMSG,
+		uintptr(sock),
+		uintptr(unsafe.Pointer(&msg)),
+		0,
+	)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+/* Sends an IPv4 datagram from a dual-stack socket,
+ * the source is passed as a v4-mapped IPV6_PKTINFO
+ */
+func (bind *NativeBind) send4Mapped(sock int, end *NativeEndpoint, buff []byte) error {
+
+	// construct message header
+
+	cmsg := struct {
+		cmsghdr unix.Cmsghdr
+		pktinfo unix.Inet6Pktinfo
+	}{
+		unix.Cmsghdr{
+			Level: unix.IPPROTO_IPV6,
+			Type:  unix.IPV6_PKTINFO,
+			Len:   unix.SizeofInet6Pktinfo + unix.SizeofCmsghdr,
+		},
+		unix.Inet6Pktinfo{
+			Ifindex: uint32(end.src4().ifindex),
+		},
+	}
+	copy(cmsg.pktinfo.Addr[:], mapV4(&unix.SockaddrInet4{Addr: end.src4().src}).Addr[:])
+
+	// the kernel rejects a source which is not v4-mapped
+
+	oob := (*[unsafe.Sizeof(cmsg)]byte)(unsafe.Pointer(&cmsg))[:]
+	hasSrc := end.src4().src != [4]byte{} && bind.pinsSource(end)
+	if !hasSrc {
+		oob = nil
+	}
+
+	_, err := unix.SendmsgN(sock, buff, end.appendMark(oob), mapV4(end.dst4()), 0)
+
+	if err == nil {
+		return nil
+	}
+
+	// clear src and retry
+
+	if err == unix.EINVAL && hasSrc && !end.isSrcFixed() {
+		bind.sourceInvalidated(end)
+		end.ClearSrc()
+		_, err = unix.SendmsgN(sock, buff, end.appendMark(nil), mapV4(end.dst4()), 0)
 	}
 
 	return err
@@ -552,95 +1455,288 @@ func receive6(sock int, buff []byte, end *NativeEndpoint) (int, error) {
 }
 
 func (bind *NativeBind) routineRouteListener() {
-	// TODO: this function doesn't lock the endpoint it modifies
+	defer bind.routeHealth.stopped()
+
+	var reassembler netlinkReassembler
 
 	for msg := make([]byte, 1<<16); ; {
 		msgn, _, _, _, err := unix.Recvmsg(bind.netlinkSock, msg[:], nil, 0)
 		if err != nil {
 			return
 		}
+		bind.routeHealth.active()
+		if complete := reassembler.feed(msg[:msgn]); len(complete) > 0 {
+			bind.handleRouteMessages(complete)
+		}
+	}
+}
 
-		for remain := msg[:msgn]; len(remain) >= unix.SizeofNlMsghdr; {
+/* Bound on the accumulated parts of a multipart response,
+ * beyond which the response is discarded (e.g. as NLMSG_DONE was lost)
+ */
+const netlinkMultipartMax = 1 << 20
 
-			hdr := *(*unix.NlMsghdr)(unsafe.Pointer(&remain[0]))
+/* Reassembles the netlink messages received by the route listener:
+ * the parts of a multipart response (NLM_F_MULTI), possibly spread across reads,
+ * are accumulated until the response is terminated by NLMSG_DONE
+ */
+type netlinkReassembler struct {
+	pending []byte // parts of an unterminated multipart response
+}
+
+/* Returns the complete messages of a datagram, in order,
+ * followed by a multipart response terminated in the datagram
+ */
+func (r *netlinkReassembler) feed(datagram []byte) []byte {
+	var complete []byte
+	for remain := datagram; len(remain) >= unix.SizeofNlMsghdr; {
+
+		hdr := *(*unix.NlMsghdr)(unsafe.Pointer(&remain[0]))
+
+		if hdr.Len < unix.SizeofNlMsghdr || uint(hdr.Len) > uint(len(remain)) {
+			break
+		}
+		msg := remain[:hdr.Len]
+
+		switch {
+		case hdr.Type == unix.NLMSG_DONE:
+			complete = append(complete, r.pending...)
+			r.pending = r.pending[:0]
+
+		case hdr.Flags&unix.NLM_F_MULTI != 0:
+			if len(r.pending)+netlinkAlign(len(msg)) > netlinkMultipartMax {
+				r.pending = r.pending[:0]
+			}
+			r.pending = append(r.pending, msg...)
+			r.pending = append(r.pending, make([]byte, netlinkAlign(len(msg))-len(msg))...)
+
+		default:
+			complete = append(complete, msg...)
+			complete = append(complete, make([]byte, netlinkAlign(len(msg))-len(msg))...)
+		}
+
+		if netlinkAlign(int(hdr.Len)) >= len(remain) {
+			break
+		}
+		remain = remain[netlinkAlign(int(hdr.Len)):]
+	}
+	return complete
+}
+
+func netlinkAlign(n int) int {
+	return (n + unix.NLMSG_ALIGNTO - 1) &^ (unix.NLMSG_ALIGNTO - 1)
+}
 
-			if uint(hdr.Len) > uint(len(remain)) {
+func (bind *NativeBind) Health() map[string]RoutineState {
+	if bind.noSticky {
+		return map[string]RoutineState{}
+	}
+	return map[string]RoutineState{
+		"route_listener": bind.routeHealth.State(),
+	}
+}
+
+/* Checks whether the route to the last endpoint changed
+ * and if so marks its source address stale,
+ * changes of addresses and links are passed to the network change handler
+ */
+func (bind *NativeBind) handleRouteMessages(msg []byte) {
+	for remain := msg; len(remain) >= unix.SizeofNlMsghdr; {
+
+		hdr := *(*unix.NlMsghdr)(unsafe.Pointer(&remain[0]))
+
+		if hdr.Len < unix.SizeofNlMsghdr || uint(hdr.Len) > uint(len(remain)) {
+			break
+		}
+
+		switch hdr.Type {
+		case unix.RTM_NEWADDR, unix.RTM_DELADDR, unix.RTM_NEWLINK:
+
+			if handler, _ := bind.changed.Load().(func()); handler != nil {
+				handler()
+			}
+
+		case unix.RTM_NEWROUTE, unix.RTM_DELROUTE:
+
+			end, _ := bind.lastEndpoint.Load().(*NativeEndpoint)
+			if end == nil {
 				break
 			}
 
-			switch hdr.Type {
-			case unix.RTM_NEWROUTE, unix.RTM_DELROUTE:
+			// snapshot of the source cache,
+			// for IPv6 the interface is stored in the zone of the destination
+
+			var (
+				src4    IPv4Source
+				src6    IPv6Source
+				ifindex uint32
+			)
+
+			end.srcMutex.Lock()
+			if end.isV6 {
+				src6 = *end.src6()
+				ifindex = end.dst6().ZoneId
+			} else {
+				src4 = *end.src4()
+				ifindex = uint32(src4.ifindex)
+			}
+			end.srcMutex.Unlock()
 
-				if bind.lastEndpoint == nil || bind.lastEndpoint.isV6 || bind.lastEndpoint.src4().ifindex == 0 {
-					break
-				}
+			if end.isV6 {
+
+				// the interface of a link-local destination is not chosen by routing
 
-				if hdr.Seq == 0xff {
-					if uint(len(remain)) < uint(hdr.Len) {
-						break
-					}
-					if hdr.Len > unix.SizeofNlMsghdr+unix.SizeofRtMsg {
-						attr := remain[unix.SizeofNlMsghdr+unix.SizeofRtMsg:]
-						for {
-							if uint(len(attr)) < uint(unix.SizeofRtAttr) {
-								break
-							}
-							attrhdr := *(*unix.RtAttr)(unsafe.Pointer(&attr[0]))
-							if attrhdr.Len < unix.SizeofRtAttr || uint(len(attr)) < uint(attrhdr.Len) {
-								break
-							}
-							if attrhdr.Type == unix.RTA_OIF && attrhdr.Len == unix.SizeofRtAttr+4 {
-								ifidx := *(*uint32)(unsafe.Pointer(&attr[unix.SizeofRtAttr]))
-								if uint32(bind.lastEndpoint.src4().ifindex) != ifidx {
-									bind.lastEndpoint.ClearSrc()
-								}
-							}
-							attr = attr[attrhdr.Len:]
-						}
-					}
+				if src6.src == [16]byte{} || net.IP(end.dst6().Addr[:]).IsLinkLocalUnicast() {
 					break
 				}
+			} else if ifindex == 0 {
+				break
+			}
 
-				nlmsg := struct {
-					hdr     unix.NlMsghdr
-					msg     unix.RtMsg
-					dsthdr  unix.RtAttr
-					dst     [4]byte
-					srchdr  unix.RtAttr
-					src     [4]byte
-					markhdr unix.RtAttr
-					mark    uint32
-				}{
-					unix.NlMsghdr{
-						Type:  uint16(unix.RTM_GETROUTE),
-						Flags: unix.NLM_F_REQUEST,
-						Seq:   0xff,
-					},
-					unix.RtMsg{
-						Family:  unix.AF_INET,
-						Dst_len: 32,
-						Src_len: 32,
-					},
-					unix.RtAttr{
-						Len:  8,
-						Type: unix.RTA_DST,
-					},
-					bind.lastEndpoint.dst4().Addr,
-					unix.RtAttr{
-						Len:  8,
-						Type: unix.RTA_SRC,
-					},
-					bind.lastEndpoint.src4().src,
-					unix.RtAttr{
-						Len:  8,
-						Type: 0x10, //unix.RTA_MARK  TODO: add this to x/sys/unix
-					},
-					uint32(bind.lastMark),
+			if hdr.Seq == 0xff {
+				if oif, ok := routeOif(remain[:hdr.Len]); ok && oif != ifindex {
+					atomic.StoreInt32(&end.srcStale, AtomicTrue)
 				}
-				nlmsg.hdr.Len = uint32(unsafe.Sizeof(nlmsg))
-				unix.Write(bind.netlinkSock, (*[unsafe.Sizeof(nlmsg)]byte)(unsafe.Pointer(&nlmsg))[:])
+				break
+			}
+
+			if end.isV6 {
+				bind.requestRoute6(end.dst6().Addr, src6.src)
+			} else {
+				bind.requestRoute4(end.dst4().Addr, src4.src)
 			}
-			remain = remain[hdr.Len:]
 		}
+		if netlinkAlign(int(hdr.Len)) >= len(remain) {
+			break
+		}
+		remain = remain[netlinkAlign(int(hdr.Len)):]
+	}
+}
+
+/* Extracts the output interface (RTA_OIF) of a route message
+ */
+func routeOif(msg []byte) (uint32, bool) {
+	if len(msg) <= unix.SizeofNlMsghdr+unix.SizeofRtMsg {
+		return 0, false
+	}
+	for attr := msg[unix.SizeofNlMsghdr+unix.SizeofRtMsg:]; len(attr) >= unix.SizeofRtAttr; {
+		attrhdr := *(*unix.RtAttr)(unsafe.Pointer(&attr[0]))
+		if attrhdr.Len < unix.SizeofRtAttr || uint(len(attr)) < uint(attrhdr.Len) {
+			break
+		}
+		if attrhdr.Type == unix.RTA_OIF && attrhdr.Len == unix.SizeofRtAttr+4 {
+			return *(*uint32)(unsafe.Pointer(&attr[unix.SizeofRtAttr])), true
+		}
+		if netlinkAlign(int(attrhdr.Len)) >= len(attr) {
+			break
+		}
+		attr = attr[netlinkAlign(int(attrhdr.Len)):]
+	}
+	return 0, false
+}
+
+/* Queries the route from src to dst,
+ * the reply is handled by the route listener
+ */
+func (bind *NativeBind) requestRoute4(dst [4]byte, src [4]byte) {
+	unix.Write(bind.netlinkSock, routeRequest4(dst, src, atomic.LoadUint32(&bind.lastMark)))
+}
+
+func (bind *NativeBind) requestRoute6(dst [16]byte, src [16]byte) {
+	unix.Write(bind.netlinkSock, routeRequest6(dst, src, atomic.LoadUint32(&bind.lastMark)))
+}
+
+/* Creates a route query message,
+ * the mark attribute is omitted for a mark of 0
+ */
+func routeRequest4(dst [4]byte, src [4]byte, mark uint32) []byte {
+	nlmsg := struct {
+		hdr     unix.NlMsghdr
+		msg     unix.RtMsg
+		dsthdr  unix.RtAttr
+		dst     [4]byte
+		srchdr  unix.RtAttr
+		src     [4]byte
+		markhdr unix.RtAttr
+		mark    uint32
+	}{
+		unix.NlMsghdr{
+			Type:  uint16(unix.RTM_GETROUTE),
+			Flags: unix.NLM_F_REQUEST,
+			Seq:   0xff,
+		},
+		unix.RtMsg{
+			Family:  unix.AF_INET,
+			Dst_len: 32,
+			Src_len: 32,
+		},
+		unix.RtAttr{
+			Len:  8,
+			Type: unix.RTA_DST,
+		},
+		dst,
+		unix.RtAttr{
+			Len:  8,
+			Type: unix.RTA_SRC,
+		},
+		src,
+		unix.RtAttr{
+			Len:  8,
+			Type: unix.RTA_MARK,
+		},
+		mark,
+	}
+	nlmsg.hdr.Len = uint32(unsafe.Sizeof(nlmsg))
+	if mark == 0 {
+		nlmsg.hdr.Len -= uint32(unsafe.Sizeof(nlmsg.markhdr) + unsafe.Sizeof(nlmsg.mark))
+	}
+	msg := make([]byte, nlmsg.hdr.Len)
+	copy(msg, (*[unsafe.Sizeof(nlmsg)]byte)(unsafe.Pointer(&nlmsg))[:])
+	return msg
+}
+
+func routeRequest6(dst [16]byte, src [16]byte, mark uint32) []byte {
+	nlmsg := struct {
+		hdr     unix.NlMsghdr
+		msg     unix.RtMsg
+		dsthdr  unix.RtAttr
+		dst     [16]byte
+		srchdr  unix.RtAttr
+		src     [16]byte
+		markhdr unix.RtAttr
+		mark    uint32
+	}{
+		unix.NlMsghdr{
+			Type:  uint16(unix.RTM_GETROUTE),
+			Flags: unix.NLM_F_REQUEST,
+			Seq:   0xff,
+		},
+		unix.RtMsg{
+			Family:  unix.AF_INET6,
+			Dst_len: 128,
+			Src_len: 128,
+		},
+		unix.RtAttr{
+			Len:  20,
+			Type: unix.RTA_DST,
+		},
+		dst,
+		unix.RtAttr{
+			Len:  20,
+			Type: unix.RTA_SRC,
+		},
+		src,
+		unix.RtAttr{
+			Len:  8,
+			Type: unix.RTA_MARK,
+		},
+		mark,
+	}
+	nlmsg.hdr.Len = uint32(unsafe.Sizeof(nlmsg))
+	if mark == 0 {
+		nlmsg.hdr.Len -= uint32(unsafe.Sizeof(nlmsg.markhdr) + unsafe.Sizeof(nlmsg.mark))
 	}
+	msg := make([]byte, nlmsg.hdr.Len)
+	copy(msg, (*[unsafe.Sizeof(nlmsg)]byte)(unsafe.Pointer(&nlmsg))[:])
+	return msg
 }
@@ -0,0 +1,1554 @@
+/* SPDX-License-Identifier: GPL-2.0
+ *
+ * Copyright (C) 2017-2018 Jason A. Donenfeld <Jason@zx2c4.com>. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"golang.org/x/net/bpf"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+	"golang.org/x/sys/unix"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+	"unsafe"
+)
+
+func TestLastEndpointAuthenticated(t *testing.T) {
+	dev1, dev2 := genTestPair(t)
+	defer dev1.Close()
+	defer dev2.Close()
+
+	bind := func() *NativeBind {
+		dev2.net.mutex.RLock()
+		defer dev2.net.mutex.RUnlock()
+		return dev2.net.bind.(*NativeBind)
+	}()
+
+	// unauthenticated datagrams of every message type
+
+	conn, err := net.Dial("udp4", fmt.Sprintf("127.0.0.1:%d", dev2.net.port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	for _, msg := range []struct {
+		msgType uint32
+		size    int
+	}{
+		{MessageInitiationType, MessageInitiationSize},
+		{MessageResponseType, MessageResponseSize},
+		{MessageCookieReplyType, MessageCookieReplySize},
+		{MessageTransportType, MessageTransportSize + 64},
+	} {
+		packet := make([]byte, msg.size)
+		rand.Read(packet)
+		binary.LittleEndian.PutUint32(packet, msg.msgType)
+		if _, err := conn.Write(packet); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	time.Sleep(time.Millisecond * 100)
+	if bind.lastEndpoint.Load() != nil {
+		t.Fatal("last endpoint updated by unauthenticated datagram")
+	}
+
+	// authenticated transport message
+
+	src, dst := net.IPv4(10, 0, 0, 1), net.IPv4(10, 0, 0, 2)
+	packet := genIPv4Packet(src, dst, 100)
+	dev1.tun.device.(*DummyTUN).packets <- packet
+	recvPacket(t, dev2.tun.device, time.Second*5)
+
+	end, _ := bind.lastEndpoint.Load().(*NativeEndpoint)
+	if end == nil {
+		t.Fatal("last endpoint not updated by transport message")
+	}
+	if addr := end.DstToString(); addr != fmt.Sprintf("127.0.0.1:%d", dev1.net.port) {
+		t.Fatal("last endpoint has unexpected address:", addr)
+	}
+}
+
+/* Injects route changes while sending to an endpoint whose source
+ * is cached on an interface other than the route to the endpoint,
+ * until the route listener invalidates the source
+ */
+func TestListenAddress(t *testing.T) {
+	bind, ports, err := CreateBindAddress([]uint16{0}, net.IPv4(127, 0, 0, 1), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bind.Close()
+
+	// only the socket of the family is opened, bound to the address
+
+	if len(bind.sock4) != 1 || len(bind.sock6) != 0 {
+		t.Fatal("opened", len(bind.sock4), "IPv4 and", len(bind.sock6), "IPv6 sockets")
+	}
+	sa, err := unix.Getsockname(bind.sock4[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr := sa.(*unix.SockaddrInet4); addr.Addr != [4]byte{127, 0, 0, 1} || addr.Port != int(ports[0]) {
+		t.Fatal("socket bound to", addr.Addr, addr.Port)
+	}
+
+	// sends originate from the address, regardless of a cached source
+
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	endpoint, err := CreateEndpoint(conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	end := endpoint.(*NativeEndpoint)
+	end.src4().src = [4]byte{127, 0, 0, 2}
+
+	if err := bind.Send([]byte("ping"), end); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, from, err := conn.ReadFromUDP(make([]byte, 64))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !from.IP.Equal(net.IPv4(127, 0, 0, 1)) || from.Port != int(ports[0]) {
+		t.Fatal("sent from", from)
+	}
+
+	// the other family is neither sent to nor received
+
+	endpoint6, _ := CreateEndpoint("[::1]:51820")
+	if bind.Send([]byte("ping"), endpoint6) == nil {
+		t.Fatal("sent to IPv6 endpoint")
+	}
+
+	done := make(chan error)
+	go func() {
+		_, _, err := bind.ReceiveIPv6(make([]byte, 64))
+		done <- err
+	}()
+	bind.Close()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("IPv6 receive returned without error")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("IPv6 receive not unblocked by close")
+	}
+}
+
+func TestReusePortReceivers(t *testing.T) {
+	bind, ports, err := createBindWithOptions([]uint16{0}, bindOptions{address: net.IPv4(127, 0, 0, 1), receivers: 2, sticky: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if bind.Receivers() != 2 || len(bind.sock4) != 1 || len(bind.reuse4) != 1 || len(bind.reuse4[0]) != 1 {
+		t.Fatal("unexpected sockets of receivers:", bind.sock4, bind.reuse4)
+	}
+	port, err := sockPort(bind.reuse4[0][0])
+	if err != nil || port != ports[0] {
+		t.Fatal("second receiver bound to port", port, "not", ports[0])
+	}
+
+	// datagrams of distinct flows are balanced across both receivers
+
+	var wg sync.WaitGroup
+	received := make(chan int, 256)
+	for i := 0; i < bind.Receivers(); i++ {
+		wg.Add(1)
+		go func(receiver int) {
+			defer wg.Done()
+			buff := make([]byte, 64)
+			for {
+				n, _, err := bind.ReceiveIPv4On(receiver, buff)
+				if err != nil || n == 0 { // closed
+					return
+				}
+				received <- receiver
+			}
+		}(i)
+	}
+
+	dst := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: int(ports[0])}
+	for i := 0; i < 32; i++ {
+		conn, err := net.DialUDP("udp4", nil, dst)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Write([]byte("ping"))
+		conn.Close()
+	}
+
+	var counts [2]int
+	timeout := time.After(time.Second * 5)
+	for counts[0] == 0 || counts[1] == 0 {
+		select {
+		case receiver := <-received:
+			counts[receiver]++
+		case <-timeout:
+			t.Fatal("datagrams not received by both receivers:", counts)
+		}
+	}
+	bind.Close()
+	wg.Wait()
+
+	// the device starts a receive routine per receiver and family
+
+	device := randDevice(t)
+	defer device.Close()
+	device.Up()
+	uapiSet(t, device, "receivers=2")
+	if get := uapiRequest(t, device, "get=1\n\n"); !strings.Contains(get, "receivers=2\n") {
+		t.Fatal("receivers not reported:", get)
+	}
+	deadline := time.Now().Add(time.Second * 5)
+	for device.health.receive.State().Running != 4 {
+		if time.Now().After(deadline) {
+			t.Fatal("running receive routines:", device.health.receive.State().Running)
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	if response := uapiRequest(t, device, "set=1\nreceivers=0\n\n"); strings.HasSuffix(response, "errno=0\n\n") {
+		t.Fatal("accepted zero receivers")
+	}
+}
+
+func TestListenFreebind(t *testing.T) {
+	for _, addr := range []net.IP{net.ParseIP("192.0.2.1"), net.ParseIP("2001:db8::1")} {
+
+		// binding to an address which is not assigned fails, unless permitted system wide
+
+		if bind, _, err := CreateBindAddress([]uint16{0}, addr, false); err == nil {
+			bind.Close()
+			t.Log("binding to unassigned", addr, "permitted without freebind")
+		}
+
+		bind, _, err := CreateBindAddress([]uint16{0}, addr, true)
+		if err != nil {
+			t.Fatal("failed to bind to", addr, "with freebind:", err)
+		}
+		socks, level, opt := bind.sock4, unix.IPPROTO_IP, unix.IP_FREEBIND
+		if addr.To4() == nil {
+			socks, level, opt = bind.sock6, unix.IPPROTO_IPV6, unix.IPV6_FREEBIND
+		}
+		value, err := unix.GetsockoptInt(socks[0], level, opt)
+		bind.Close()
+		if err != nil || value != 1 {
+			t.Fatal("freebind not enabled on socket of", addr, ":", value, err)
+		}
+	}
+
+	// freebind is applied to the listen address set after it
+
+	device := randDevice(t)
+	defer device.Close()
+	device.Up()
+
+	uapiSet(t, device, "listen_freebind=true\nlisten_address=192.0.2.1")
+	if get := uapiRequest(t, device, "get=1\n\n"); !strings.Contains(get, "listen_freebind=true\nlisten_address=192.0.2.1\n") {
+		t.Fatal("freebind not reported:", get)
+	}
+}
+
+func TestUAPIListenAddress(t *testing.T) {
+	dev1, dev2 := genTestPair(t)
+	defer dev1.Close()
+	defer dev2.Close()
+
+	response := uapiRequest(t, dev1, "set=1\nlisten_address=localhost\n\n")
+	if strings.HasSuffix(response, "errno=0\n\n") {
+		t.Fatal("accepted listen address", response)
+	}
+
+	socks := func() (int, int) {
+		dev1.net.mutex.RLock()
+		defer dev1.net.mutex.RUnlock()
+		bind := dev1.net.bind.(*NativeBind)
+		return len(bind.sock4), len(bind.sock6)
+	}
+
+	uapiSet(t, dev1, "listen_address=127.0.0.1")
+	if get := uapiRequest(t, dev1, "get=1\n\n"); !strings.Contains(get, "listen_address=127.0.0.1\n") {
+		t.Fatal("listen address not reported:", get)
+	}
+	if n4, n6 := socks(); n4 != 1 || n6 != 0 {
+		t.Fatal("opened", n4, "IPv4 and", n6, "IPv6 sockets")
+	}
+
+	// the peers are reached from the address
+
+	src, dst := net.IPv4(10, 0, 0, 2), net.IPv4(10, 0, 0, 1)
+	packet := genIPv4Packet(src, dst, 100)
+	dev2.tun.device.(*DummyTUN).packets <- packet
+	assertEqual(t, recvPacket(t, dev1.tun.device, time.Second*5), packet)
+
+	// an empty value restores the wildcard address
+
+	uapiSet(t, dev1, "listen_address=")
+	if get := uapiRequest(t, dev1, "get=1\n\n"); strings.Contains(get, "listen_address=") {
+		t.Fatal("listen address still reported:", get)
+	}
+	if n4, n6 := socks(); n4 != 1 || n6 != 1 {
+		t.Fatal("opened", n4, "IPv4 and", n6, "IPv6 sockets")
+	}
+}
+
+func testRouteChange(t *testing.T, family uint8, host string, setSrc func(*NativeEndpoint)) {
+	ports := freePorts(t, 2)
+
+	bind, _, err := CreateBind(ports[:1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bind.Close()
+
+	endpoint, err := CreateEndpoint(net.JoinHostPort(host, fmt.Sprint(ports[1])))
+	if err != nil {
+		t.Fatal(err)
+	}
+	end := endpoint.(*NativeEndpoint)
+	setSrc(end)
+	bind.UpdateLastEndpoint(end)
+
+	// send concurrently with route changes
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		packet := make([]byte, 100)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				bind.Send(packet, end)
+			}
+		}
+	}()
+
+	msg := struct {
+		hdr unix.NlMsghdr
+		msg unix.RtMsg
+	}{
+		unix.NlMsghdr{
+			Type: unix.RTM_NEWROUTE,
+		},
+		unix.RtMsg{
+			Family: family,
+		},
+	}
+	msg.hdr.Len = uint32(unsafe.Sizeof(msg))
+
+	cleared := func() bool {
+		end.srcMutex.Lock()
+		defer end.srcMutex.Unlock()
+		return end.src == [len(end.src)]byte{}
+	}
+
+	deadline := time.Now().Add(time.Second * 5)
+	for !cleared() {
+		if time.Now().After(deadline) {
+			t.Fatal("source not cleared after route change")
+		}
+		bind.handleRouteMessages((*[unsafe.Sizeof(msg)]byte)(unsafe.Pointer(&msg))[:])
+		time.Sleep(time.Millisecond)
+	}
+
+	close(stop)
+	wg.Wait()
+}
+
+func TestRouteListenerRace(t *testing.T) {
+	testRouteChange(t, unix.AF_INET, "127.0.0.1", func(end *NativeEndpoint) {
+		end.src4().src = [4]byte{127, 0, 0, 1}
+		end.src4().ifindex = 1 << 20
+	})
+}
+
+func TestRouteListenerIPv6(t *testing.T) {
+	testRouteChange(t, unix.AF_INET6, "::1", func(end *NativeEndpoint) {
+		copy(end.src6().src[:], net.IPv6loopback)
+		end.dst6().ZoneId = 1 << 20
+	})
+}
+
+func TestDontFragment(t *testing.T) {
+	dev1, dev2 := genTestPair(t)
+	defer dev1.Close()
+	defer dev2.Close()
+
+	assertMode := func(mode4, mode6 int) {
+		dev1.net.mutex.RLock()
+		defer dev1.net.mutex.RUnlock()
+		bind := dev1.net.bind.(*NativeBind)
+
+		value, err := unix.GetsockoptInt(bind.sock4[0], unix.IPPROTO_IP, unix.IP_MTU_DISCOVER)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if value != mode4 {
+			t.Fatal("unexpected IP_MTU_DISCOVER:", value)
+		}
+
+		value, err = unix.GetsockoptInt(bind.sock6[0], unix.IPPROTO_IPV6, unix.IPV6_MTU_DISCOVER)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if value != mode6 {
+			t.Fatal("unexpected IPV6_MTU_DISCOVER:", value)
+		}
+	}
+
+	uapiSet(t, dev1, "dont_fragment=true")
+	assertMode(unix.IP_PMTUDISC_DO, unix.IPV6_PMTUDISC_DO)
+
+	// preserved when rebinding
+
+	if err := dev1.BindUpdate(); err != nil {
+		t.Fatal(err)
+	}
+	assertMode(unix.IP_PMTUDISC_DO, unix.IPV6_PMTUDISC_DO)
+
+	uapiSet(t, dev1, "dont_fragment=false")
+	assertMode(unix.IP_PMTUDISC_WANT, unix.IPV6_PMTUDISC_WANT)
+}
+
+func TestPathMTU(t *testing.T) {
+	ports := freePorts(t, 2)
+
+	bind, _, err := CreateBind(ports[:1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bind.Close()
+
+	lo, err := net.InterfaceByName("lo")
+	if err != nil {
+		t.Skip("no loopback interface:", err)
+	}
+
+	for _, host := range []string{"127.0.0.1", "::1"} {
+		end, err := CreateEndpoint(net.JoinHostPort(host, fmt.Sprint(ports[1])))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// IPv4 path MTUs are limited to the maximum datagram size
+
+		expected := lo.MTU - (ipv6.HeaderLen + 8)
+		if !end.(*NativeEndpoint).isV6 {
+			expected = lo.MTU - (ipv4.HeaderLen + 8)
+			if lo.MTU > 0xffff {
+				expected = 0xffff - (ipv4.HeaderLen + 8)
+			}
+		}
+
+		mtu, err := bind.PathMTU(end)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if mtu != expected {
+			t.Fatal("unexpected path MTU to", host, ":", mtu)
+		}
+	}
+}
+
+func TestTrafficClass(t *testing.T) {
+	dev1, dev2 := genTestPair(t)
+	defer dev1.Close()
+	defer dev2.Close()
+
+	const tc = 46 << 2 // DSCP expedited forwarding
+
+	uapiSet(t, dev1, fmt.Sprintf("traffic_class=%d", tc))
+
+	dev1.net.mutex.RLock()
+	defer dev1.net.mutex.RUnlock()
+	bind := dev1.net.bind.(*NativeBind)
+
+	value, err := unix.GetsockoptInt(bind.sock4[0], unix.IPPROTO_IP, unix.IP_TOS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value != tc {
+		t.Fatal("unexpected IP_TOS:", value)
+	}
+
+	value, err = unix.GetsockoptInt(bind.sock6[0], unix.IPPROTO_IPV6, unix.IPV6_TCLASS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value != tc {
+		t.Fatal("unexpected IPV6_TCLASS:", value)
+	}
+}
+
+func TestMultipleListenPorts(t *testing.T) {
+	dev1, dev2 := genTestPair(t)
+	defer dev1.Close()
+	defer dev2.Close()
+
+	extra := freePorts(t, 1)[0]
+	uapiSet(t, dev2, fmt.Sprintf("listen_port=%d,%d", dev2.net.port, extra))
+
+	pk1, pk2 := dev1.noise.publicKey, dev2.noise.publicKey
+	src, dst := net.IPv4(10, 0, 0, 1), net.IPv4(10, 0, 0, 2)
+
+	for _, port := range []uint16{dev2.net.port, extra} {
+		uapiSet(t, dev1, fmt.Sprintf("public_key=%s\nendpoint=127.0.0.1:%d", pk2.ToHex(), port))
+
+		// receiving on either port reaches the same peer
+
+		packet := genIPv4Packet(src, dst, 100)
+		dev1.tun.device.(*DummyTUN).packets <- packet
+		assertEqual(t, recvPacket(t, dev2.tun.device, time.Second*5), packet)
+
+		// replies are sent from the port the peer was seen on
+
+		reply := genIPv4Packet(dst, src, 100)
+		dev2.tun.device.(*DummyTUN).packets <- reply
+		assertEqual(t, recvPacket(t, dev1.tun.device, time.Second*5), reply)
+
+		peer := dev1.LookupPeer(pk2)
+		peer.mutex.RLock()
+		addr := peer.endpoint.DstToString()
+		peer.mutex.RUnlock()
+		if addr != fmt.Sprintf("127.0.0.1:%d", port) {
+			t.Fatal("reply sent from unexpected address:", addr)
+		}
+	}
+
+	dev2.peers.mutex.RLock()
+	peers := len(dev2.peers.keyMap)
+	dev2.peers.mutex.RUnlock()
+	if peers != 1 || dev2.LookupPeer(pk1) == nil {
+		t.Fatal("unexpected peers:", peers)
+	}
+
+	// listening ports are reported
+
+	if get := uapiRequest(t, dev2, "get=1\n\n"); !strings.Contains(get, fmt.Sprintf("listen_port=%d,%d\n", dev2.net.port, extra)) {
+		t.Fatal("listening ports not reported:", get)
+	}
+}
+
+func TestPointToPoint(t *testing.T) {
+	dev1, dev2 := genTestPair(t)
+	defer dev1.Close()
+	defer dev2.Close()
+
+	if err := dev1.SetLogRingSize(64); err != nil {
+		t.Fatal(err)
+	}
+	uapiSet(t, dev1, "point_to_point=true")
+	uapiSet(t, dev2, "point_to_point=true")
+
+	// enabling is logged once, not on every update
+
+	uapiSet(t, dev1, "point_to_point=true")
+	logged := 0
+	for _, line := range dev1.RecentLogs() {
+		if strings.Contains(line, "Point-to-point mode enabled") {
+			logged++
+		}
+	}
+	if logged != 1 {
+		t.Fatal("enabling point-to-point mode logged", logged, "times")
+	}
+
+	peerName := func(device *Device) (unix.Sockaddr, error) {
+		device.net.mutex.RLock()
+		defer device.net.mutex.RUnlock()
+		return unix.Getpeername(device.net.bind.(*NativeBind).sock4[0])
+	}
+
+	exchange := func() {
+		src, dst := net.IPv4(10, 0, 0, 1), net.IPv4(10, 0, 0, 2)
+		packet := genIPv4Packet(src, dst, 100)
+		dev1.tun.device.(*DummyTUN).packets <- packet
+		assertEqual(t, recvPacket(t, dev2.tun.device, time.Second*5), packet)
+
+		reply := genIPv4Packet(dst, src, 100)
+		dev2.tun.device.(*DummyTUN).packets <- reply
+		assertEqual(t, recvPacket(t, dev1.tun.device, time.Second*5), reply)
+	}
+
+	// connected to the single peer
+
+	for _, device := range []*Device{dev1, dev2} {
+		other := dev1
+		if device == dev1 {
+			other = dev2
+		}
+		addr, err := peerName(device)
+		if err != nil {
+			t.Fatal("socket not connected:", err)
+		}
+		if port := addr.(*unix.SockaddrInet4).Port; port != int(other.net.port) {
+			t.Fatal("socket connected to unexpected port:", port)
+		}
+	}
+
+	exchange()
+
+	// a second peer restores the unconnected mode
+
+	sk, err := newPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pk := sk.publicKey()
+	uapiSet(t, dev1, "public_key="+pk.ToHex())
+
+	if _, err := peerName(dev1); err != unix.ENOTCONN {
+		t.Fatal("socket still connected with multiple peers:", err)
+	}
+
+	exchange()
+}
+
+func TestNetworkChangeRebind(t *testing.T) {
+	dev1, dev2 := genTestPair(t)
+	defer dev1.Close()
+	defer dev2.Close()
+
+	currentBind := func() (*NativeBind, uint16) {
+		dev1.net.mutex.RLock()
+		defer dev1.net.mutex.RUnlock()
+		return dev1.net.bind.(*NativeBind), dev1.net.port
+	}
+	bind, port := currentBind()
+
+	// simulate an address change
+
+	msg := struct {
+		hdr unix.NlMsghdr
+		msg unix.IfAddrmsg
+	}{
+		unix.NlMsghdr{
+			Type: unix.RTM_NEWADDR,
+		},
+		unix.IfAddrmsg{
+			Family: unix.AF_INET,
+		},
+	}
+	msg.hdr.Len = uint32(unsafe.Sizeof(msg))
+	bind.handleRouteMessages((*[unsafe.Sizeof(msg)]byte)(unsafe.Pointer(&msg))[:])
+
+	deadline := time.Now().Add(NetworkChangeDelay * 20)
+	for {
+		rebound, newPort := currentBind()
+		if rebound != bind {
+			if newPort != port {
+				t.Fatal("rebound to different port:", newPort)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("no rebind after network change")
+		}
+		time.Sleep(NetworkChangeDelay / 5)
+	}
+
+	// traffic continues on the new sockets
+
+	src, dst := net.IPv4(10, 0, 0, 2), net.IPv4(10, 0, 0, 1)
+	packet := genIPv4Packet(src, dst, 100)
+	dev2.tun.device.(*DummyTUN).packets <- packet
+	assertEqual(t, recvPacket(t, dev1.tun.device, time.Second*5), packet)
+}
+
+func TestBindPort(t *testing.T) {
+	bind, ports, err := CreateBind([]uint16{0, 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bind.Close()
+
+	port, err := bind.Port()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if port == 0 || port != ports[0] {
+		t.Fatal("unexpected port", port, "reported on creation", ports[0])
+	}
+
+	// every family is bound to the assigned port
+
+	for i := range ports {
+		port4, err := sockPort(bind.sock4[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		port6, err := sockPort(bind.sock6[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if port4 != ports[i] || port6 != ports[i] {
+			t.Fatal("sockets bound to", port4, "and", port6, "instead of", ports[i])
+		}
+	}
+}
+
+func TestDualStack(t *testing.T) {
+	bind, ports, err := CreateDualStackBind([]uint16{0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bind.Close()
+
+	receive := func(network, host string, v6 bool) {
+		conn, err := net.DialUDP(network, nil, &net.UDPAddr{
+			IP:   net.ParseIP(host),
+			Port: int(ports[0]),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		if _, err := conn.Write([]byte("ping")); err != nil {
+			t.Fatal(err)
+		}
+
+		buff := make([]byte, 64)
+		n, end, err := bind.ReceiveIPv6(buff)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(buff[:n]) != "ping" {
+			t.Fatal("unexpected datagram", buff[:n])
+		}
+
+		// endpoint must be of the sender's family
+
+		nend := end.(*NativeEndpoint)
+		if nend.isV6 != v6 {
+			t.Fatal("endpoint of", host, "has isV6 =", nend.isV6)
+		}
+		if !end.DstIP().Equal(net.ParseIP(host)) {
+			t.Fatal("endpoint", end.DstToString(), "expected", host)
+		}
+		if !end.SrcIP().Equal(net.ParseIP(host)) {
+			t.Fatal("source", end.SrcIP(), "expected", host)
+		}
+
+		// reply through the same socket
+
+		if err := bind.Send([]byte("pong"), end); err != nil {
+			t.Fatal(err)
+		}
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, err = conn.Read(buff)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(buff[:n]) != "pong" {
+			t.Fatal("unexpected reply", buff[:n])
+		}
+	}
+
+	receive("udp4", "127.0.0.1", false)
+	receive("udp6", "::1", true)
+
+	// the IPv4 receive routine only returns once closed
+
+	done := make(chan error)
+	go func() {
+		_, _, err := bind.ReceiveIPv4(make([]byte, 64))
+		done <- err
+	}()
+	bind.Close()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("IPv4 receive returned without error")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("IPv4 receive not unblocked by close")
+	}
+}
+
+func TestSendRetry(t *testing.T) {
+
+	// transient errors are retried
+
+	calls := 0
+	err := sendRetry(func() error {
+		calls++
+		if calls < 3 {
+			return unix.ENOBUFS
+		}
+		return nil
+	})
+	if err != nil || calls != 3 {
+		t.Fatal("send failed after", calls, "calls:", err)
+	}
+
+	// retries are bounded
+
+	calls = 0
+	err = sendRetry(func() error {
+		calls++
+		return unix.EAGAIN
+	})
+	if err != unix.EAGAIN || calls != SendRetryAttempts+1 {
+		t.Fatal("gave up after", calls, "calls:", err)
+	}
+
+	// other errors are returned immediately
+
+	calls = 0
+	err = sendRetry(func() error {
+		calls++
+		return unix.EHOSTUNREACH
+	})
+	if err != unix.EHOSTUNREACH || calls != 1 {
+		t.Fatal("retried", calls, "calls:", err)
+	}
+}
+
+func TestSendBufferPressure(t *testing.T) {
+	bind, _, err := CreateBind([]uint16{0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bind.Close()
+
+	// shrink the send buffer (clamped to the kernel minimum)
+
+	if err := unix.SetsockoptInt(bind.sock4[0], unix.SOL_SOCKET, unix.SO_SNDBUF, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadBuffer(1 << 22)
+
+	end, err := CreateEndpoint(conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const count = 256
+	received := make(chan int)
+	go func() {
+		n := 0
+		buff := make([]byte, 2048)
+		conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+		for n < count {
+			if _, err := conn.Read(buff); err != nil {
+				break
+			}
+			n++
+		}
+		received <- n
+	}()
+
+	packet := make([]byte, 1400)
+	for i := 0; i < count; i++ {
+		if err := bind.Send(packet, end); err != nil {
+			t.Fatal("send", i, "failed:", err)
+		}
+	}
+
+	if n := <-received; n != count {
+		t.Fatal("received", n, "of", count, "datagrams")
+	}
+}
+
+const ipv6FlowInfo = 11 // IPV6_FLOWINFO
+
+func TestFlowLabel(t *testing.T) {
+	const label = 0x12345
+
+	bind, _, err := CreateBind([]uint16{0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bind.Close()
+
+	// receiver reporting the flow information of datagrams
+
+	conn, err := net.ListenUDP("udp6", &net.UDPAddr{IP: net.IPv6loopback})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw.Control(func(fd uintptr) {
+		err = unix.SetsockoptInt(int(fd), unix.IPPROTO_IPV6, ipv6FlowInfo, 1)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	end, err := CreateEndpoint(conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	receiveLabel := func() uint32 {
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		buff := make([]byte, 64)
+		oob := make([]byte, 64)
+		_, oobn, _, _, err := conn.ReadMsgUDP(buff, oob)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msgs, err := unix.ParseSocketControlMessage(oob[:oobn])
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, msg := range msgs {
+			if msg.Header.Level == unix.IPPROTO_IPV6 && msg.Header.Type == ipv6FlowInfo {
+				return binary.BigEndian.Uint32(msg.Data) & FlowLabelMask
+			}
+		}
+		t.Fatal("no flow information received")
+		return 0
+	}
+
+	if err := bind.SetFlowLabel(label); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := bind.Send([]byte("ping"), end); err != nil {
+			t.Fatal(err)
+		}
+		if value := receiveLabel(); value != label {
+			t.Fatalf("flow label is %#x, expected %#x", value, label)
+		}
+	}
+
+	// label also applies to connected sockets
+
+	if err := bind.SetPointToPoint(end); err != nil {
+		t.Fatal(err)
+	}
+	if err := bind.Send([]byte("ping"), end); err != nil {
+		t.Fatal(err)
+	}
+	if value := receiveLabel(); value != label {
+		t.Fatalf("flow label of connected socket is %#x", value)
+	}
+}
+
+func TestUAPIFlowLabel(t *testing.T) {
+	dev1, dev2 := genTestPair(t)
+	defer dev1.Close()
+	defer dev2.Close()
+
+	for _, value := range []string{"0x100000", "-1", "label"} {
+		response := uapiRequest(t, dev1, "set=1\nflow_label="+value+"\n\n")
+		if strings.HasSuffix(response, "errno=0\n\n") {
+			t.Fatal("accepted flow label", value)
+		}
+	}
+
+	uapiSet(t, dev1, "flow_label=0xbeef")
+	if get := uapiRequest(t, dev1, "get=1\n\n"); !strings.Contains(get, "flow_label=48879\n") {
+		t.Fatal("flow label not reported:", get)
+	}
+
+	// label is restored when rebinding
+
+	if err := dev1.BindUpdate(); err != nil {
+		t.Fatal(err)
+	}
+	dev1.net.mutex.RLock()
+	defer dev1.net.mutex.RUnlock()
+	bind := dev1.net.bind.(*NativeBind)
+	if label := atomic.LoadUint32(&bind.flowLabel); label != 0xbeef {
+		t.Fatalf("flow label of bind is %#x", label)
+	}
+	value, err := unix.GetsockoptInt(bind.sock6[0], unix.IPPROTO_IPV6, ipv6FlowInfoSend)
+	if err != nil || value != 1 {
+		t.Fatal("IPV6_FLOWINFO_SEND not enabled:", value, err)
+	}
+}
+
+func TestMulticastEndpoint(t *testing.T) {
+	if _, err := CreateEndpoint("[ff02::1]:51820"); err == nil {
+		t.Fatal("accepted multicast endpoint without zone")
+	}
+
+	var intr *net.Interface
+	intrs, err := net.Interfaces()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range intrs {
+		if intrs[i].Flags&net.FlagMulticast != 0 && intrs[i].Flags&net.FlagUp != 0 {
+			intr = &intrs[i]
+			break
+		}
+	}
+	if intr == nil {
+		t.Skip("no multicast interface")
+	}
+
+	// receiver of the all-nodes group (looped back by the kernel)
+
+	conn, err := net.ListenUDP("udp6", &net.UDPAddr{IP: net.IPv6unspecified})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	port := conn.LocalAddr().(*net.UDPAddr).Port
+
+	bind, _, err := CreateBind([]uint16{0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bind.Close()
+
+	end, err := CreateEndpoint(fmt.Sprintf("[ff02::1%%%s]:%d", intr.Name, port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := bind.Send([]byte("discover"), end); err != nil {
+		t.Fatal(err)
+	}
+
+	index, err := unix.GetsockoptInt(bind.sock6[0], unix.IPPROTO_IPV6, unix.IPV6_MULTICAST_IF)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if index != intr.Index {
+		t.Fatal("IPV6_MULTICAST_IF is", index, "expected", intr.Index)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	buff := make([]byte, 64)
+	n, err := conn.Read(buff)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buff[:n]) != "discover" {
+		t.Fatal("unexpected datagram", buff[:n])
+	}
+}
+
+func TestClearMark(t *testing.T) {
+	dev1, dev2 := genTestPair(t)
+	defer dev1.Close()
+	defer dev2.Close()
+
+	// reports the mark attribute of a route query, if present
+
+	routeMark := func(msg []byte) (uint32, bool) {
+		hdr := (*unix.NlMsghdr)(unsafe.Pointer(&msg[0]))
+		if int(hdr.Len) != len(msg) {
+			t.Fatal("route query length mismatch:", hdr.Len, len(msg))
+		}
+		attrs := msg[unix.SizeofNlMsghdr+unix.SizeofRtMsg:]
+		for len(attrs) >= unix.SizeofRtAttr {
+			attr := (*unix.RtAttr)(unsafe.Pointer(&attrs[0]))
+			if attr.Type == unix.RTA_MARK {
+				return *(*uint32)(unsafe.Pointer(&attrs[unix.SizeofRtAttr])), true
+			}
+			attrs = attrs[(int(attr.Len)+unix.RTA_ALIGNTO-1)&^(unix.RTA_ALIGNTO-1):]
+		}
+		return 0, false
+	}
+
+	assertMark := func(mark uint32) {
+		dev1.net.mutex.RLock()
+		defer dev1.net.mutex.RUnlock()
+		bind := dev1.net.bind.(*NativeBind)
+
+		for _, fd := range []int{bind.sock4[0], bind.sock6[0]} {
+			value, err := unix.GetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_MARK)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if uint32(value) != mark {
+				t.Fatal("unexpected SO_MARK:", value)
+			}
+		}
+
+		lastMark := atomic.LoadUint32(&bind.lastMark)
+		for _, msg := range [][]byte{
+			routeRequest4([4]byte{192, 0, 2, 1}, [4]byte{}, lastMark),
+			routeRequest6([16]byte{0x20, 0x01, 0x0d, 0xb8}, [16]byte{}, lastMark),
+		} {
+			value, ok := routeMark(msg)
+			if ok != (mark != 0) || value != mark {
+				t.Fatal("unexpected RTA_MARK in route query:", value, ok)
+			}
+		}
+	}
+
+	uapiSet(t, dev1, "fwmark=42")
+	assertMark(42)
+	if get := uapiRequest(t, dev1, "get=1\n\n"); !strings.Contains(get, "fwmark=42\n") {
+		t.Fatal("fwmark not reported:", get)
+	}
+
+	uapiSet(t, dev1, "fwmark=0")
+	assertMark(0)
+	if get := uapiRequest(t, dev1, "get=1\n\n"); strings.Contains(get, "fwmark=") {
+		t.Fatal("cleared fwmark reported:", get)
+	}
+}
+
+func TestSendTimeoutSockopt(t *testing.T) {
+	dev1, dev2 := genTestPair(t)
+	defer dev1.Close()
+	defer dev2.Close()
+
+	uapiSet(t, dev1, "send_timeout_ms=250")
+
+	// timeout is restored when rebinding
+
+	if err := dev1.BindUpdate(); err != nil {
+		t.Fatal(err)
+	}
+	dev1.net.mutex.RLock()
+	defer dev1.net.mutex.RUnlock()
+	bind := dev1.net.bind.(*NativeBind)
+
+	for _, fd := range []int{bind.sock4[0], bind.sock6[0]} {
+		var tv unix.Timeval
+		size := uint32(unsafe.Sizeof(tv))
+		_, _, errno := unix.Syscall6(unix.SYS_GETSOCKOPT, uintptr(fd), unix.SOL_SOCKET, unix.SO_SNDTIMEO,
+			uintptr(unsafe.Pointer(&tv)), uintptr(unsafe.Pointer(&size)), 0)
+		if errno != 0 {
+			t.Fatal(errno)
+		}
+
+		// the kernel rounds the timeout up to jiffies
+
+		if timeout := time.Duration(tv.Nano()); timeout < time.Millisecond*250 || timeout > time.Millisecond*260 {
+			t.Fatal("unexpected SO_SNDTIMEO:", timeout)
+		}
+	}
+}
+
+func TestRecordRxInterface(t *testing.T) {
+	dev1, dev2 := genTestPair(t)
+	defer dev1.Close()
+	defer dev2.Close()
+
+	lo, err := net.InterfaceByName("lo")
+	if err != nil {
+		t.Skip("no loopback interface:", err)
+	}
+
+	src, dst := net.IPv4(10, 0, 0, 1), net.IPv4(10, 0, 0, 2)
+	exchange := func() {
+		packet := genIPv4Packet(src, dst, 100)
+		dev1.tun.device.(*DummyTUN).packets <- packet
+		assertEqual(t, recvPacket(t, dev2.tun.device, time.Second*5), packet)
+	}
+
+	// not recorded unless enabled
+
+	exchange()
+	if get := uapiRequest(t, dev2, "get=1\n\n"); strings.Contains(get, "rx_interface=") {
+		t.Fatal("receive interface reported while disabled:", get)
+	}
+
+	uapiSet(t, dev2, "record_rx_interface=true")
+	exchange()
+	expected := fmt.Sprintf("rx_interface=%d\n", lo.Index)
+	if get := uapiRequest(t, dev2, "get=1\n\n"); !strings.Contains(get, expected) {
+		t.Fatal("receive interface not reported:", get)
+	}
+	if get := uapiRequest(t, dev2, "get=1\n\n"); !strings.Contains(get, "record_rx_interface=true\n") {
+		t.Fatal("recording of receive interfaces not reported:", get)
+	}
+}
+
+func TestPeerSourceAddress(t *testing.T) {
+	dev1, dev2 := genTestPair(t)
+	defer dev1.Close()
+	defer dev2.Close()
+
+	peer1 := dev1.LookupPeer(dev2.noise.publicKey)
+	peer2 := dev2.LookupPeer(dev1.noise.publicKey)
+	uapiSet(t, dev1, "public_key="+peer1.handshake.remoteStatic.ToHex()+"\nsrc_address=127.0.0.2")
+	if get := uapiRequest(t, dev1, "get=1\n\n"); !strings.Contains(get, "src_address=127.0.0.2\n") {
+		t.Fatal("source address not reported:", get)
+	}
+
+	// the peer sees datagrams arrive from the source address
+
+	src, dst := net.IPv4(10, 0, 0, 1), net.IPv4(10, 0, 0, 2)
+	packet := genIPv4Packet(src, dst, 100)
+	dev1.tun.device.(*DummyTUN).packets <- packet
+	assertEqual(t, recvPacket(t, dev2.tun.device, time.Second*5), packet)
+
+	endpoint := func(peer *Peer) Endpoint {
+		peer.mutex.RLock()
+		defer peer.mutex.RUnlock()
+		return peer.endpoint
+	}
+	if addr := endpoint(peer2).DstToString(); addr != fmt.Sprintf("127.0.0.2:%d", dev1.net.port) {
+		t.Fatal("datagrams not sent from source address:", addr)
+	}
+
+	// the source is retained when the cache is cleared (e.g. on handshake retries)
+
+	endpoint(peer1).ClearSrc()
+	if ip := endpoint(peer1).SrcIP(); !ip.Equal(net.IPv4(127, 0, 0, 2)) {
+		t.Fatal("source address cleared:", ip)
+	}
+
+	// once removed, the source is learned again
+
+	uapiSet(t, dev1, "public_key="+peer1.handshake.remoteStatic.ToHex()+"\nsrc_address=")
+	packet = genIPv4Packet(src, dst, 200)
+	dev1.tun.device.(*DummyTUN).packets <- packet
+	assertEqual(t, recvPacket(t, dev2.tun.device, time.Second*5), packet)
+	if addr := endpoint(peer2).DstToString(); addr != fmt.Sprintf("127.0.0.1:%d", dev1.net.port) {
+		t.Fatal("datagrams still sent from source address:", addr)
+	}
+}
+
+func TestSourceInvalidations(t *testing.T) {
+	dev1, dev2 := genTestPair(t)
+	defer dev1.Close()
+	defer dev2.Close()
+
+	peer1 := dev1.LookupPeer(dev2.noise.publicKey)
+	src, dst := net.IPv4(10, 0, 0, 1), net.IPv4(10, 0, 0, 2)
+	packet := genIPv4Packet(src, dst, 100)
+	dev1.tun.device.(*DummyTUN).packets <- packet
+	assertEqual(t, recvPacket(t, dev2.tun.device, time.Second*5), packet)
+	if get := uapiRequest(t, dev1, "get=1\n\n"); strings.Contains(get, "src_invalidations=") {
+		t.Fatal("source invalidation reported:", get)
+	}
+
+	// cache a source rejected by the kernel (a broadcast source fails with EINVAL)
+
+	peer1.mutex.RLock()
+	end := peer1.endpoint.(*NativeEndpoint)
+	peer1.mutex.RUnlock()
+	end.srcMutex.Lock()
+	copy(end.src4().src[:], net.IPv4bcast.To4())
+	end.src4().ifindex = 0
+	end.srcMutex.Unlock()
+
+	// the send is retried without the source, and the invalidation counted
+
+	packet = genIPv4Packet(src, dst, 200)
+	dev1.tun.device.(*DummyTUN).packets <- packet
+	assertEqual(t, recvPacket(t, dev2.tun.device, time.Second*5), packet)
+	if get := uapiRequest(t, dev1, "get=1\n\n"); !strings.Contains(get, "src_invalidations=1\n") {
+		t.Fatal("source invalidation not reported:", get)
+	}
+	if ip := end.SrcIP(); ip.Equal(net.IPv4bcast) {
+		t.Fatal("invalid source not cleared:", ip)
+	}
+}
+
+func TestRouteListenerMultipart(t *testing.T) {
+
+	// route reply, with an unaligned attribute preceding the interface
+
+	routeReply := func(flags uint16, oif uint32) []byte {
+		reply := struct {
+			hdr    unix.NlMsghdr
+			msg    unix.RtMsg
+			padhdr unix.RtAttr
+			pad    [4]byte
+			oifhdr unix.RtAttr
+			oif    uint32
+		}{
+			hdr:    unix.NlMsghdr{Type: unix.RTM_NEWROUTE, Flags: flags, Seq: 0xff},
+			msg:    unix.RtMsg{Family: unix.AF_INET, Dst_len: 32},
+			padhdr: unix.RtAttr{Len: unix.SizeofRtAttr + 1, Type: unix.RTA_UNSPEC},
+			oifhdr: unix.RtAttr{Len: unix.SizeofRtAttr + 4, Type: unix.RTA_OIF},
+			oif:    oif,
+		}
+		reply.hdr.Len = uint32(unsafe.Sizeof(reply))
+		return append([]byte(nil), (*[unsafe.Sizeof(reply)]byte)(unsafe.Pointer(&reply))[:]...)
+	}
+	done := func() []byte {
+		done := struct {
+			hdr   unix.NlMsghdr
+			error int32
+		}{
+			hdr: unix.NlMsghdr{Type: unix.NLMSG_DONE, Flags: unix.NLM_F_MULTI, Seq: 0xff},
+		}
+		done.hdr.Len = uint32(unsafe.Sizeof(done))
+		return append([]byte(nil), (*[unsafe.Sizeof(done)]byte)(unsafe.Pointer(&done))[:]...)
+	}
+
+	if oif, ok := routeOif(routeReply(0, 2)); !ok || oif != 2 {
+		t.Fatal("interface not extracted:", oif, ok)
+	}
+
+	end, err := CreateEndpoint("192.0.2.1:51820")
+	if err != nil {
+		t.Fatal(err)
+	}
+	nend := end.(*NativeEndpoint)
+	copy(nend.src4().src[:], net.IPv4(127, 0, 0, 1).To4())
+	nend.src4().ifindex = 1
+
+	bind := &NativeBind{netlinkSock: -1}
+	bind.lastEndpoint.Store(nend)
+	stale := func() bool {
+		return atomic.LoadInt32(&nend.srcStale) == AtomicTrue
+	}
+
+	// the parts of a multipart reply (in separate reads) are handled once complete
+
+	var reassembler netlinkReassembler
+	for _, datagram := range [][]byte{
+		routeReply(unix.NLM_F_MULTI, 1),
+		append(routeReply(unix.NLM_F_MULTI, 1), routeReply(unix.NLM_F_MULTI, 2)...),
+	} {
+		if complete := reassembler.feed(datagram); len(complete) != 0 {
+			t.Fatal("incomplete multipart reply handled")
+		}
+	}
+	complete := reassembler.feed(done())
+	if len(complete) != 3*len(routeReply(0, 0)) {
+		t.Fatal("parts of multipart reply lost:", len(complete))
+	}
+	bind.handleRouteMessages(complete)
+	if !stale() {
+		t.Fatal("change of interface not detected")
+	}
+
+	// single messages are handled immediately
+
+	atomic.StoreInt32(&nend.srcStale, AtomicFalse)
+	bind.handleRouteMessages(reassembler.feed(routeReply(0, 1)))
+	if stale() {
+		t.Fatal("source marked stale for unchanged interface")
+	}
+	bind.handleRouteMessages(reassembler.feed(routeReply(0, 3)))
+	if !stale() {
+		t.Fatal("change of interface not detected")
+	}
+}
+
+func TestRouteRequestMark(t *testing.T) {
+	attribute := func(msg []byte, typ uint16) (uint32, bool) {
+		for attrs := msg[unix.SizeofNlMsghdr+unix.SizeofRtMsg:]; len(attrs) >= unix.SizeofRtAttr; {
+			attr := (*unix.RtAttr)(unsafe.Pointer(&attrs[0]))
+			if attr.Len < unix.SizeofRtAttr || int(attr.Len) > len(attrs) {
+				break
+			}
+			if attr.Type == typ && attr.Len == unix.SizeofRtAttr+4 {
+				return *(*uint32)(unsafe.Pointer(&attrs[unix.SizeofRtAttr])), true
+			}
+			attrs = attrs[netlinkAlign(int(attr.Len)):]
+		}
+		return 0, false
+	}
+
+	// the mark is carried in the last attribute, of type RTA_MARK (16)
+
+	msg := routeRequest4([4]byte{127, 0, 0, 1}, [4]byte{}, 42)
+	attr := (*unix.RtAttr)(unsafe.Pointer(&msg[len(msg)-unix.SizeofRtAttr-4]))
+	if attr.Type != 16 {
+		t.Fatal("unexpected type of mark attribute:", attr.Type)
+	}
+
+	// the kernel resolves the route for the mark (and reports the mark in the reply)
+
+	sock, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW, unix.NETLINK_ROUTE)
+	if err != nil {
+		t.Skip("netlink unavailable:", err)
+	}
+	defer unix.Close(sock)
+	if err := unix.Bind(sock, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := unix.Write(sock, msg); err != nil {
+		t.Fatal(err)
+	}
+	reply := make([]byte, 1<<16)
+	n, _, _, _, err := unix.Recvmsg(sock, reply, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply = reply[:n]
+	if hdr := (*unix.NlMsghdr)(unsafe.Pointer(&reply[0])); hdr.Type != unix.RTM_NEWROUTE {
+		t.Fatal("route query failed, reply of type", hdr.Type)
+	}
+
+	lo, err := net.InterfaceByName("lo")
+	if err != nil {
+		t.Skip("no loopback interface:", err)
+	}
+	if oif, ok := routeOif(reply); !ok || oif != uint32(lo.Index) {
+		t.Fatal("unexpected interface of route:", oif, ok)
+	}
+	if mark, ok := attribute(reply, unix.RTA_MARK); !ok || mark != 42 {
+		t.Fatal("mark not applied to route query:", mark, ok)
+	}
+}
+
+func TestPeerFwmark(t *testing.T) {
+
+	// listener accepting only datagrams of the mark (filtered on skb->mark)
+
+	listen := func(network string, addr net.IP, mark uint32) *net.UDPConn {
+		conn, err := net.ListenUDP(network, &net.UDPAddr{IP: addr})
+		if err != nil {
+			t.Skip("no loopback address:", err)
+		}
+		program, err := bpf.Assemble([]bpf.Instruction{
+			bpf.LoadExtension{Num: bpf.ExtMark},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: mark, SkipFalse: 1},
+			bpf.RetConstant{Val: 0xffff},
+			bpf.RetConstant{Val: 0},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		filter := make([]unix.SockFilter, len(program))
+		for i, ins := range program {
+			filter[i] = unix.SockFilter{Code: ins.Op, Jt: ins.Jt, Jf: ins.Jf, K: ins.K}
+		}
+		raw, err := conn.SyscallConn()
+		if err != nil {
+			t.Fatal(err)
+		}
+		raw.Control(func(fd uintptr) {
+			err = unix.SetsockoptSockFprog(int(fd), unix.SOL_SOCKET, unix.SO_ATTACH_FILTER, &unix.SockFprog{
+				Len:    uint16(len(filter)),
+				Filter: &filter[0],
+			})
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn
+	}
+	received := func(conn *net.UDPConn) bool {
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		_, _, err := conn.ReadFromUDP(make([]byte, MaxMessageSize))
+		return err == nil
+	}
+
+	device := randDevice(t)
+	defer device.Close()
+	device.Up()
+	if !device.isUp.Get() {
+		t.Fatal("failed to bring up device")
+	}
+
+	peers := []struct {
+		network string
+		addr    net.IP
+		mark    uint32
+	}{
+		{"udp4", net.IPv4(127, 0, 0, 1), 0x1001},
+		{"udp4", net.IPv4(127, 0, 0, 1), 0x1002},
+		{"udp6", net.IPv6loopback, 0x1003},
+	}
+	for _, p := range peers {
+		conn := listen(p.network, p.addr, p.mark)
+		defer conn.Close()
+
+		// the filter rejects unmarked datagrams
+
+		sender, err := net.DialUDP(p.network, nil, conn.LocalAddr().(*net.UDPAddr))
+		if err != nil {
+			t.Fatal(err)
+		}
+		sender.Write([]byte{1})
+		sender.Close()
+		if received(conn) {
+			t.Fatal("unmarked datagram accepted")
+		}
+
+		// handshake initiations to the peer carry its mark
+
+		peer := randPeer(t, device)
+		uapiSet(t, device, fmt.Sprintf("public_key=%s\nendpoint=%s\nfwmark=%d",
+			peer.handshake.remoteStatic.ToHex(), conn.LocalAddr(), p.mark))
+		if get := uapiRequest(t, device, "get=1\n\n"); !strings.Contains(get, fmt.Sprintf("fwmark=%d\n", p.mark)) {
+			t.Fatal("fwmark of peer not reported:", get)
+		}
+		peer.SendHandshakeInitiation(false, false)
+		if !received(conn) {
+			t.Fatal("datagram to peer not marked with", p.mark)
+		}
+	}
+}
+
+func TestDisableStickySockets(t *testing.T) {
+	dev1, dev2 := genTestPair(t)
+	defer dev1.Close()
+	defer dev2.Close()
+
+	uapiSet(t, dev1, "disable_sticky_sockets=true")
+	if get := uapiRequest(t, dev1, "get=1\n\n"); !strings.Contains(get, "disable_sticky_sockets=true\n") {
+		t.Fatal("disabled sticky sockets not reported:", get)
+	}
+
+	bind := func() *NativeBind {
+		dev1.net.mutex.RLock()
+		defer dev1.net.mutex.RUnlock()
+		return dev1.net.bind.(*NativeBind)
+	}
+	if sock := bind().netlinkSock; sock != -1 {
+		t.Fatal("netlink socket created:", sock)
+	}
+	if health := bind().Health(); len(health) != 0 {
+		t.Fatal("route listener started:", health)
+	}
+
+	// datagrams pass in both directions
+
+	src, dst := net.IPv4(10, 0, 0, 1), net.IPv4(10, 0, 0, 2)
+	packet := genIPv4Packet(src, dst, 100)
+	dev1.tun.device.(*DummyTUN).packets <- packet
+	assertEqual(t, recvPacket(t, dev2.tun.device, time.Second*5), packet)
+
+	packet = genIPv4Packet(dst, src, 100)
+	dev2.tun.device.(*DummyTUN).packets <- packet
+	assertEqual(t, recvPacket(t, dev1.tun.device, time.Second*5), packet)
+
+	// no source is learned from the datagrams received
+
+	peer := dev1.LookupPeer(dev2.noise.publicKey)
+	peer.mutex.RLock()
+	srcIP := peer.endpoint.SrcIP()
+	peer.mutex.RUnlock()
+	if !srcIP.IsUnspecified() {
+		t.Fatal("source learned:", srcIP)
+	}
+
+	// enabled again, the route listener is restored
+
+	uapiSet(t, dev1, "disable_sticky_sockets=false")
+	if sock := bind().netlinkSock; sock < 0 {
+		t.Fatal("netlink socket not created")
+	}
+}
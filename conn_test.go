@@ -0,0 +1,348 @@
+/* SPDX-License-Identifier: GPL-2.0
+ *
+ * Copyright (C) 2017-2018 Jason A. Donenfeld <Jason@zx2c4.com>. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestScopedEndpoint(t *testing.T) {
+	var loopback *net.Interface
+	intrs, err := net.Interfaces()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range intrs {
+		if intrs[i].Flags&net.FlagLoopback != 0 {
+			loopback = &intrs[i]
+			break
+		}
+	}
+	if loopback == nil {
+		t.Skip("no loopback interface")
+	}
+
+	// named and numeric zones survive round-tripping
+
+	for _, zone := range []string{loopback.Name, strconv.Itoa(loopback.Index)} {
+		s := "[fe80::1%" + zone + "]:51820"
+		end, err := CreateEndpoint(s)
+		if err != nil {
+			t.Fatal("failed to parse", s, ":", err)
+		}
+		str := end.DstToString()
+		if !strings.Contains(str, "%") {
+			t.Fatal("zone lost from", s, ":", str)
+		}
+		again, err := CreateEndpoint(str)
+		if err != nil {
+			t.Fatal("failed to parse", str, ":", err)
+		}
+		if again.DstToString() != str {
+			t.Fatal("round-trip changed endpoint:", str, "!=", again.DstToString())
+		}
+	}
+
+	// malformed zones are rejected
+
+	for _, s := range []string{
+		"[fe80::1%nosuchif0]:51820",
+		"[fe80::1%]:51820",
+		"192.0.2.1%" + loopback.Name + ":51820",
+	} {
+		if _, err := CreateEndpoint(s); err == nil {
+			t.Fatal("accepted malformed endpoint", s)
+		}
+	}
+
+	_, err = CreateEndpoint("[fe80::1%nosuchif0]:51820")
+	if !strings.Contains(err.Error(), "nosuchif0") {
+		t.Fatal("unclear error for unknown interface:", err)
+	}
+}
+
+func TestEndpointEqual(t *testing.T) {
+	for _, c := range []struct {
+		a, b  string
+		equal bool
+	}{
+		{"192.0.2.1:51820", "192.0.2.1:51820", true},
+		{"192.0.2.1:51820", "192.0.2.2:51820", false},
+		{"192.0.2.1:51820", "192.0.2.1:51821", false},
+		{"192.0.2.1:51820", "[::ffff:192.0.2.1]:51820", true},
+		{"192.0.2.1:51820", "[::ffff:c000:201]:51820", true},
+		{"[2001:db8::1]:51820", "[2001:db8::1]:51820", true},
+		{"[2001:db8::1]:51820", "[2001:db8::2]:51820", false},
+		{"[2001:db8::1]:51820", "[2001:db8::1]:51821", false},
+		{"[2001:db8::1]:51820", "[::ffff:192.0.2.1]:51820", false},
+		{"[fe80::1%1]:51820", "[fe80::1%1]:51820", true},
+		{"[fe80::1%1]:51820", "[fe80::1%2]:51820", false},
+		{"[fe80::1%1]:51820", "[fe80::1]:51820", false},
+	} {
+		a, err := CreateEndpoint(c.a)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := CreateEndpoint(c.b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if a.Equal(b) != c.equal || b.Equal(a) != c.equal {
+			t.Fatal("unexpected equality of", c.a, "and", c.b, ", expected", c.equal)
+		}
+	}
+
+	a, _ := CreateEndpoint("192.0.2.1:51820")
+	dummy, _ := CreateDummyEndpoint()
+	if a.Equal(dummy) {
+		t.Fatal("endpoints of distinct types are equal")
+	}
+}
+
+func TestCreateBindInRange(t *testing.T) {
+	listen := func(port uint16) *net.UDPConn {
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{Port: int(port)})
+		if err != nil {
+			t.Skip("port of range in use:", err)
+		}
+		return conn
+	}
+
+	low := freePorts(t, 1)[0]
+	if low == 65535 {
+		low--
+	}
+	high := low + 1
+
+	// the only available port of the range is chosen
+
+	conn := listen(high)
+	defer conn.Close()
+
+	bind, port, err := CreateBindInRange(low, high)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bind.Close()
+	if port != low {
+		t.Fatal("unexpected port:", port)
+	}
+
+	// exhaustion
+
+	conn = listen(low)
+	defer conn.Close()
+
+	if _, _, err := CreateBindInRange(low, high); err == nil {
+		t.Fatal("bind created in exhausted range")
+	}
+	if _, _, err := CreateBindInRange(high, low); err == nil {
+		t.Fatal("bind created in invalid range")
+	}
+}
+
+/* Endpoint factory of an embedder, naming the paired bind "channel:1"
+ */
+type ChannelEndpointFactory struct {
+	bind      *ChannelBind
+	endpoints int32 // endpoints created
+	binds     int32 // binds created
+}
+
+func (factory *ChannelEndpointFactory) CreateEndpoint(s string) (Endpoint, error) {
+	if s != "channel:1" {
+		return nil, errors.New("unknown endpoint: " + s)
+	}
+	atomic.AddInt32(&factory.endpoints, 1)
+	return factory.bind.remote, nil
+}
+
+func (factory *ChannelEndpointFactory) CreateBind(ports []uint16) (Bind, []uint16, error) {
+	atomic.AddInt32(&factory.binds, 1)
+	select {
+	case <-factory.bind.closed:
+		factory.bind.closed = make(chan struct{})
+	default:
+	}
+	return factory.bind, ports, nil
+}
+
+func TestEndpointFactory(t *testing.T) {
+	dev1, dev2 := genChannelPair(t)
+	defer dev1.Close()
+	defer dev2.Close()
+
+	factory := &ChannelEndpointFactory{bind: dev1.net.bind.(*ChannelBind)}
+	if err := dev1.SetEndpointFactory(factory); err != nil {
+		t.Fatal(err)
+	}
+	if atomic.LoadInt32(&factory.binds) != 1 || dev1.EndpointFactory() != factory {
+		t.Fatal("bind not created by factory")
+	}
+
+	// endpoints of peers are created by the factory
+
+	uapiSet(t, dev1, "public_key="+dev2.noise.publicKey.ToHex()+"\nendpoint=channel:1")
+	if atomic.LoadInt32(&factory.endpoints) != 1 {
+		t.Fatal("endpoint not created by factory")
+	}
+	peer := dev1.LookupPeer(dev2.noise.publicKey)
+	peer.mutex.RLock()
+	endpoint := peer.endpoint
+	peer.mutex.RUnlock()
+	if endpoint != factory.bind.remote {
+		t.Fatal("unexpected endpoint:", endpoint)
+	}
+
+	packet := genIPv4Packet(net.IPv4(10, 0, 0, 1), net.IPv4(10, 0, 0, 2), 100)
+	dev1.tun.device.(*DummyTUN).packets <- packet
+	assertEqual(t, recvPacket(t, dev2.tun.device, time.Second*5), packet)
+
+	// the native factory is restored
+
+	if err := dev1.SetEndpointFactory(nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := dev1.EndpointFactory().(nativeEndpointFactory); !ok {
+		t.Fatal("native factory not restored")
+	}
+}
+
+func TestBindMigrate(t *testing.T) {
+	dev1, dev2 := genTestPair(t)
+	defer dev1.Close()
+	defer dev2.Close()
+
+	peer1 := dev1.LookupPeer(dev2.noise.publicKey)
+	peer2 := dev2.LookupPeer(dev1.noise.publicKey)
+	tun1 := dev1.tun.device.(*DummyTUN)
+	tun2 := dev2.tun.device.(*DummyTUN)
+
+	src, dst := net.IPv4(10, 0, 0, 1), net.IPv4(10, 0, 0, 2)
+	packet := genIPv4Packet(src, dst, 100)
+	tun1.packets <- packet
+	assertEqual(t, recvPacket(t, tun2, time.Second*5), packet)
+	keypair := peer1.keyPairs.Current()
+
+	// sends continue throughout the migration
+
+	stop := make(chan struct{})
+	sending := make(chan struct{})
+	go func() {
+		defer close(sending)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				peer1.SendKeepalive()
+			}
+		}
+	}()
+
+	port := freePorts(t, 1)[0]
+	uapiSet(t, dev1, fmt.Sprintf("listen_port=%d", port))
+	close(stop)
+	<-sending
+
+	if dev1.net.port != port {
+		t.Fatal("listen port not migrated:", dev1.net.port)
+	}
+	if peer1.keyPairs.Current() != keypair {
+		t.Fatal("keypair not retained")
+	}
+
+	// traffic flows from the new port, in both directions
+
+	packet = genIPv4Packet(src, dst, 200)
+	tun1.packets <- packet
+	assertEqual(t, recvPacket(t, tun2, time.Second*5), packet)
+
+	peer2.mutex.RLock()
+	addr := peer2.endpoint.DstToString()
+	peer2.mutex.RUnlock()
+	if addr != fmt.Sprintf("127.0.0.1:%d", port) {
+		t.Fatal("traffic not received from new port:", addr)
+	}
+
+	reply := genIPv4Packet(dst, src, 200)
+	tun2.packets <- reply
+	assertEqual(t, recvPacket(t, tun1, time.Second*5), reply)
+
+	// an unavailable port retains the existing bind
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	busy := conn.LocalAddr().(*net.UDPAddr).Port
+
+	if response := uapiRequest(t, dev1, fmt.Sprintf("set=1\nlisten_port=%d\n\n", busy)); strings.Contains(response, "errno=0") {
+		t.Fatal("migrated to port in use")
+	}
+	if dev1.net.port != port {
+		t.Fatal("listen port changed:", dev1.net.port)
+	}
+	tun1.packets <- packet
+	assertEqual(t, recvPacket(t, tun2, time.Second*5), packet)
+}
+
+/* A bind on which no fwmark can be set
+ */
+type unmarkableBind struct {
+	*ChannelBind
+}
+
+func (b *unmarkableBind) SetMark(v uint32) error {
+	return errors.New("Fwmark not supported")
+}
+
+func TestBindMigrateConfigureFailure(t *testing.T) {
+	dev1, dev2 := genChannelPair(t)
+	defer dev1.Close()
+	defer dev2.Close()
+
+	tun1 := dev1.tun.device.(*DummyTUN)
+	tun2 := dev2.tun.device.(*DummyTUN)
+	packet := genIPv4Packet(net.IPv4(10, 0, 0, 1), net.IPv4(10, 0, 0, 2), 100)
+
+	if err := dev1.BindSetMark(1); err != nil {
+		t.Fatal(err)
+	}
+
+	dev1.net.mutex.Lock()
+	bind := dev1.net.bind
+	failing := &unmarkableBind{&ChannelBind{closed: make(chan struct{})}}
+	dev1.net.createBind = func(ports []uint16) (Bind, []uint16, error) {
+		return failing, ports, nil
+	}
+	dev1.net.mutex.Unlock()
+
+	// the new bind is closed, the existing bind continues to be used
+
+	if err := dev1.BindMigrate([]uint16{1}); err == nil {
+		t.Fatal("migrated to bind failing configuration")
+	}
+	select {
+	case <-failing.closed:
+	default:
+		t.Fatal("new bind not closed")
+	}
+	if dev1.net.bind != bind {
+		t.Fatal("existing bind replaced")
+	}
+
+	tun1.packets <- packet
+	assertEqual(t, recvPacket(t, tun2, time.Second*5), packet)
+}
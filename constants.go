@@ -32,6 +32,7 @@ const (
 	QueueOutboundSize  = 1024
 	QueueInboundSize   = 1024
 	QueueHandshakeSize = 1024
+	MaxBufferRingSize  = 1024                                  // maximum number of pre-allocated message buffers
 	MaxSegmentSize     = (1 << 16) - 1                         // largest possible UDP datagram
 	MinMessageSize     = MessageKeepaliveSize                  // minimum size of transport message (keepalive)
 	MaxMessageSize     = MaxSegmentSize                        // maximum size of transport message
@@ -42,4 +43,23 @@ const (
 	UnderLoadQueueSize = QueueHandshakeSize / 8
 	UnderLoadAfterTime = time.Second // how long does the device remain under load after detected
 	MaxPeers           = 1 << 16     // maximum number of configured peers
+
+	MaxPersistentKeepaliveInterval = (1 << 16) - 1 // seconds
+
+	MaxKeepaliveJitter = 50 // percent of the persistent keepalive interval
+
+	HandshakeFailoverAttempts = 3 // failed handshake attempts after which the backup endpoint is tried
+
+	DefaultMaxHandshakeAttempts = MaxTimerHandshakes + 2 // attempts after which a peer is marked unreachable
+
+	MaxTUNReadBatch = 64 // packets read from the TUN device at once (if supported)
+
+	MaxReceivers = 64 // receive routines (SO_REUSEPORT sockets) per family
+
+	PathMTUExpiry = time.Minute * 10 // discovered path MTUs are forgotten, such that increases are noticed
+)
+
+const (
+	SendRetryAttempts = 5                     // retries of a datagram on transient buffer pressure
+	SendRetryBackoff  = time.Microsecond * 50 // delay before the first retry, doubled for each
 )
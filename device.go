@@ -7,23 +7,40 @@ package main
 
 import (
 	"./ratelimiter"
+	"errors"
+	"net"
 	"runtime"
 	"sync"
 	"sync/atomic"
 	"time"
 )
 
+/* Clearing of message buffers returned to the pool,
+ * by default enabled once a peer is configured with a preshared key
+ */
+const (
+	BufferClearingAuto = int32(iota)
+	BufferClearingOn
+	BufferClearingOff
+)
+
 const (
 	DeviceRoutineNumberPerCPU = 3
+	DeviceShutdownTimeout     = time.Second // time allowed to send queued packets on shutdown
 )
 
 type Device struct {
-	isUp     AtomicBool // device is (going) up
-	isClosed AtomicBool // device is closed? (acting as guard)
-	log      *Logger
+	isUp       AtomicBool // device is (going) up
+	isClosed   AtomicBool // device is closed? (acting as guard)
+	isDraining AtomicBool // device is shutting down (admits no new packets)
+	log        *Logger
 
 	// synchronized resources (locks acquired in order)
 
+	ipc struct {
+		mutex sync.Mutex // serialises set operations, held from validation until applied
+	}
+
 	state struct {
 		stopping sync.WaitGroup
 		mutex    sync.Mutex
@@ -32,10 +49,28 @@ type Device struct {
 	}
 
 	net struct {
-		mutex  sync.RWMutex
-		bind   Bind   // bind interface
-		port   uint16 // listening port
-		fwmark uint32 // mark value (0 = disabled)
+		mutex    sync.RWMutex
+		stopping sync.WaitGroup // receive routines pending stop
+		bind     Bind           // bind interface
+		port     uint16         // listening port
+		extra    []uint16       // additional listening ports
+		bindErr  int64          // ipcError of the last failed bind (0 = none)
+		address  net.IP         // local address to listen on (nil = wildcard)
+		freebind bool           // bind to the address before it is assigned
+		fwmark   uint32         // mark value (0 = disabled)
+		dontFrag bool           // set DF bit on outbound datagrams
+		tclass   uint8          // IPv4 TOS / IPv6 traffic class
+		p2p      bool           // connect to the endpoint of a single peer (which then cannot roam)
+		dual     bool           // single dual-stack socket per port
+		flow     uint32         // IPv6 flow label (0 = kernel default)
+		noSticky bool           // the kernel chooses the source of datagrams (settings are saved by bindSettings)
+		monitor  *NetworkChangeMonitor
+
+		sndTimeout time.Duration // bound on blocking sends (0 = none)
+		receivers  int           // receive routines per family (SO_REUSEPORT sockets if > 1)
+
+		createBind func(ports []uint16) (Bind, []uint16, error) // (replaced by tests)
+		factory    EndpointFactory                              // creates endpoints and binds (native unless replaced)
 	}
 
 	noise struct {
@@ -45,13 +80,15 @@ type Device struct {
 	}
 
 	routing struct {
-		mutex sync.RWMutex
-		table RoutingTable
+		mutex  sync.RWMutex
+		table  RoutingTable
+		strict bool // reject allowed IPs assigned to other peers
 	}
 
 	peers struct {
 		mutex  sync.RWMutex
 		keyMap map[NoisePublicKey]*Peer
+		limit  int // maximum number of peers (0 = MaxPeers)
 	}
 
 	// unprotected / "self-synchronising resources"
@@ -62,10 +99,25 @@ type Device struct {
 	rate struct {
 		underLoadUntil atomic.Value
 		limiter        ratelimiter.Ratelimiter
+		cookieLimiter  ratelimiter.Ratelimiter // throttles cookie replies
+	}
+
+	timers struct {
+		handshakeBackoffMax int64        // ceiling of handshake retry backoff in ns (0 = disabled)
+		keepaliveJitter     int32        // spread of persistent keepalives in percent of the interval
+		config              atomic.Value // TimerConfig (unset = DefaultTimerConfig)
+
+		handshakeTimeout     int64 // ns after the first attempt handshakes give up (0 = disabled)
+		maxHandshakeAttempts int32 // attempts after which handshakes give up (0 = DefaultMaxHandshakeAttempts)
 	}
 
 	pool struct {
 		messageBuffers sync.Pool
+		ring           atomic.Value // chan *[MaxMessageSize]byte, pre-allocated buffers (nil = disabled)
+		clearing       int32        // clearing of returned buffers (BufferClearing*)
+		psk            AtomicBool   // a preshared key has been configured
+
+		outstanding int64 // buffers handed out and not yet returned, accessed atomically
 	}
 
 	queue struct {
@@ -78,9 +130,95 @@ type Device struct {
 		stop chan struct{}
 	}
 
+	roaming struct {
+		handler atomic.Value // EndpointChangeHandler
+		queue   chan endpointChange
+
+		rxInterface AtomicBool // record the interface on which peers are received
+	}
+
+	handshakes struct {
+		handler atomic.Value // HandshakeCompleteHandler
+		queue   chan *Peer
+	}
+
+	events struct {
+		mutex       sync.Mutex
+		subscribers map[chan Event]struct{}
+	}
+
+	logs struct {
+		ring atomic.Value // *logRing (nil = disabled)
+	}
+
+	reaper struct {
+		maxAge int64 // age in ns after which peers are removed (0 = disabled)
+	}
+
+	suspend struct {
+		mutex   sync.Mutex
+		active  AtomicBool    // TUN reads and timers are paused
+		resumed chan struct{} // closed on resume (nil = not suspended)
+	}
+
+	down struct {
+		mutex sync.Mutex
+		up    chan struct{} // closed once brought up (nil = up), pauses TUN reads
+	}
+
+	resolver struct {
+		resolve  atomic.Value  // EndpointResolver
+		interval int64         // ns between resolutions of hostname endpoints (0 = disabled)
+		queue    chan *Peer    // peers to resolve (e.g. after handshake timeouts)
+		reset    chan struct{} // interval changed
+	}
+
+	replay struct {
+		size uint64 // size in bits of the replay filter of new key pairs (0 = CounterBitsTotal)
+	}
+
+	workers struct {
+		encryptionExtra int32         // additional encryption workers running
+		encryptionMax   int32         // limit on additional encryption workers
+		retire          chan struct{} // stops an additional encryption worker
+	}
+
+	affinity struct {
+		mutex   sync.Mutex
+		enabled bool             // pin workers to CPUs
+		cpus    []int            // CPUs the workers are spread across
+		changed chan struct{}    // closed (and replaced) on change
+		workers map[string][]int // CPUs of the running workers (nil = not pinned)
+	}
+
+	stats struct {
+		handshakeFailures uint64 // handshake messages failing validation
+		decryptFailures   uint64 // transport messages failing authentication
+		invalidMAC        uint64 // handshake messages with an invalid mac1
+		srcInvalidations  uint64 // cached sources of endpoints found invalid on send
+
+		replayedInitiations uint64 // initiations rejected for a timestamp not after the last
+	}
+
 	tun struct {
 		device TUNDevice
 		mtu    int32
+		offset int // offset of packets read into message buffers
+
+		gso AtomicBool // packets are prefixed by a virtio_net_hdr, GSO packets are split
+	}
+
+	transport struct {
+		extended bool // XChaCha20-Poly1305 with random nonces (fixed at creation)
+	}
+
+	health struct {
+		encryption RoutineHealth
+		decryption RoutineHealth
+		handshake  RoutineHealth
+		receive    RoutineHealth
+		readTUN    RoutineHealth
+		tunEvents  RoutineHealth
 	}
 }
 
@@ -101,6 +239,8 @@ func unsafeRemovePeer(device *Device, peer *Peer, key NoisePublicKey) {
 	// remove from peer map
 
 	delete(device.peers.keyMap, key)
+
+	device.publishEvent(Event{Kind: EventPeerRemoved, PublicKey: key})
 }
 
 func deviceUpdateState(device *Device) {
@@ -136,8 +276,10 @@ func deviceUpdateState(device *Device) {
 			peer.Start()
 		}
 		device.peers.mutex.Unlock()
+		device.signalUp(true)
 
 	case false:
+		device.signalUp(false)
 		device.BindClose()
 		device.peers.mutex.Lock()
 		for _, peer := range device.peers.keyMap {
@@ -157,6 +299,9 @@ func deviceUpdateState(device *Device) {
 	deviceUpdateState(device)
 }
 
+/* Brings the device up, recreating the bind (on the configured port)
+ * and starting the peers
+ */
 func (device *Device) Up() {
 
 	// closed device cannot be brought up
@@ -171,6 +316,12 @@ func (device *Device) Up() {
 	deviceUpdateState(device)
 }
 
+/* Brings the device down, closing the bind (releasing the port)
+ * and pausing reads of the TUN device, while the configuration
+ * of the device and its peers is retained.
+ *
+ * Unlike Suspend, the sessions of peers are not retained.
+ */
 func (device *Device) Down() {
 	device.state.mutex.Lock()
 	device.isUp.Set(false)
@@ -178,6 +329,100 @@ func (device *Device) Down() {
 	deviceUpdateState(device)
 }
 
+func (device *Device) signalUp(up bool) {
+	device.down.mutex.Lock()
+	defer device.down.mutex.Unlock()
+
+	if up && device.down.up != nil {
+		close(device.down.up)
+		device.down.up = nil
+	} else if !up && device.down.up == nil {
+		device.down.up = make(chan struct{})
+	}
+}
+
+/* Returns a channel closed once the device is brought up,
+ * nil if the device is up
+ */
+func (device *Device) awaitingUp() chan struct{} {
+	device.down.mutex.Lock()
+	defer device.down.mutex.Unlock()
+	return device.down.up
+}
+
+/* Pauses the traffic of the device (e.g. while the screen of a phone is off):
+ * no packets are read from the TUN device and no keepalives or handshakes
+ * are sent by timers, while peers and their keys are retained.
+ *
+ * Packets staged for peers are dropped, received packets are still delivered.
+ */
+func (device *Device) Suspend() {
+	device.suspend.mutex.Lock()
+	defer device.suspend.mutex.Unlock()
+
+	if device.suspend.resumed != nil {
+		return
+	}
+	device.log.Info.Println("Device suspending")
+	device.suspend.resumed = make(chan struct{})
+	device.suspend.active.Set(true)
+
+	device.peers.mutex.RLock()
+	for _, peer := range device.peers.keyMap {
+		peer.routines.mutex.Lock()
+		if peer.isRunning.Get() {
+			peer.timersStop()
+			peer.FlushNonceQueue()
+		}
+		peer.routines.mutex.Unlock()
+	}
+	device.peers.mutex.RUnlock()
+}
+
+/* Resumes the traffic of a suspended device,
+ * peers with a persistent keepalive send one immediately
+ */
+func (device *Device) Resume() {
+	device.suspend.mutex.Lock()
+	defer device.suspend.mutex.Unlock()
+
+	if device.suspend.resumed == nil {
+		return
+	}
+	device.log.Info.Println("Device resuming")
+	device.suspend.active.Set(false)
+	close(device.suspend.resumed)
+	device.suspend.resumed = nil
+
+	if !device.isUp.Get() {
+		return
+	}
+
+	device.peers.mutex.RLock()
+	for _, peer := range device.peers.keyMap {
+		if peer.persistentKeepaliveInterval > 0 && peer.isRunning.Get() {
+			peer.SendKeepalive()
+		}
+	}
+	device.peers.mutex.RUnlock()
+}
+
+func (device *Device) IsSuspended() bool {
+	return device.suspend.active.Get()
+}
+
+/* Returns a channel closed once the device is resumed,
+ * nil if the device is not suspended
+ */
+func (device *Device) suspended() chan struct{} {
+	if !device.suspend.active.Get() {
+		return nil
+	}
+	device.suspend.mutex.Lock()
+	defer device.suspend.mutex.Unlock()
+	return device.suspend.resumed
+}
+
 func (device *Device) IsUnderLoad() bool {
 
 	// check if currently under load
@@ -250,21 +495,134 @@ func (device *Device) SetPrivateKey(sk NoisePrivateKey) error {
 	return nil
 }
 
+/* Message buffers are taken from the ring of pre-allocated buffers (if enabled),
+ * falling back to the sync.Pool once the ring is exhausted
+ */
 func (device *Device) GetMessageBuffer() *[MaxMessageSize]byte {
+	atomic.AddInt64(&device.pool.outstanding, 1)
+	if ring := device.messageBufferRing(); ring != nil {
+		select {
+		case msg := <-ring:
+			return msg
+		default:
+		}
+	}
 	return device.pool.messageBuffers.Get().(*[MaxMessageSize]byte)
 }
 
+/* Returns the buffer to the ring, or to the sync.Pool if the ring is full
+ *
+ * The buffer is cleared first if enabled,
+ * such that no plaintext of one peer lingers in a buffer handed to another
+ */
 func (device *Device) PutMessageBuffer(msg *[MaxMessageSize]byte) {
+	atomic.AddInt64(&device.pool.outstanding, -1)
+	if device.clearingMessageBuffers() {
+		*msg = [MaxMessageSize]byte{}
+	}
+	if ring := device.messageBufferRing(); ring != nil {
+		select {
+		case ring <- msg:
+			return
+		default:
+		}
+	}
 	device.pool.messageBuffers.Put(msg)
 }
 
+func (device *Device) SetMessageBufferClearing(mode int32) {
+	atomic.StoreInt32(&device.pool.clearing, mode)
+}
+
+func (device *Device) MessageBufferClearing() int32 {
+	return atomic.LoadInt32(&device.pool.clearing)
+}
+
+func (device *Device) clearingMessageBuffers() bool {
+	switch device.MessageBufferClearing() {
+	case BufferClearingOn:
+		return true
+	case BufferClearingOff:
+		return false
+	default:
+		return device.pool.psk.Get()
+	}
+}
+
+func (device *Device) messageBufferRing() chan *[MaxMessageSize]byte {
+	return device.pool.ring.Load().(chan *[MaxMessageSize]byte)
+}
+
+/* Pre-allocates a ring of message buffers, reducing the GC pressure
+ * of a sync.Pool emptied by every collection under sustained load
+ * (0 restores the sync.Pool)
+ */
+func (device *Device) SetMessageBufferRing(capacity int) error {
+	if capacity < 0 || capacity > MaxBufferRingSize {
+		return errors.New("Invalid buffer ring size")
+	}
+	var ring chan *[MaxMessageSize]byte
+	if capacity > 0 {
+		ring = make(chan *[MaxMessageSize]byte, capacity)
+		for i := 0; i < capacity; i++ {
+			ring <- new([MaxMessageSize]byte)
+		}
+	}
+	device.pool.ring.Store(ring)
+	return nil
+}
+
+func (device *Device) MessageBufferRingSize() int {
+	return cap(device.messageBufferRing())
+}
+
+/* Returns the MTU used for padding decisions (unless limited by the path MTU of a peer):
+ * the MTU of the TUN device
+ */
+func (device *Device) EffectiveMTU() int {
+	return int(atomic.LoadInt32(&device.tun.mtu))
+}
+
+/* Returns the size of the header preceding the content of transport messages
+ */
+func (device *Device) transportHeaderSize() int {
+	if device.transport.extended {
+		return MessageTransportExtendedHeaderSize
+	}
+	return MessageTransportHeaderSize
+}
+
+/* Returns the size of an empty transport message (e.g. a keepalive)
+ */
+func (device *Device) transportOverhead() int {
+	if device.transport.extended {
+		return MessageTransportExtendedSize
+	}
+	return MessageTransportSize
+}
+
 func NewDevice(tun TUNDevice, logger *Logger) *Device {
+	return newDevice(tun, logger, false)
+}
+
+/* Creates a device which encrypts transport messages using XChaCha20-Poly1305
+ * with random nonces, such that sessions are not limited by RejectAfterMessages
+ *
+ * This is a non-standard extension of the protocol (adding 24 bytes to every message),
+ * the device only interoperates with peers using the extension
+ */
+func NewDeviceExtendedNonce(tun TUNDevice, logger *Logger) *Device {
+	return newDevice(tun, logger, true)
+}
+
+func newDevice(tun TUNDevice, logger *Logger, extended bool) *Device {
 	device := new(Device)
 
 	device.isUp.Set(false)
 	device.isClosed.Set(false)
 
-	device.log = logger
+	device.SetLogRingSize(DefaultLogRingSize)
+	device.log = device.ringLogger(logger)
 
 	device.tun.device = tun
 	mtu, err := device.tun.device.MTU()
@@ -272,13 +630,16 @@ func NewDevice(tun TUNDevice, logger *Logger) *Device {
 		logger.Error.Println("Trouble determining MTU, assuming default:", err)
 		mtu = DefaultMTU
 	}
-	device.tun.mtu = int32(mtu)
+	device.tun.mtu = clampMTU(mtu)
+	device.transport.extended = extended
+	device.tun.offset = tunReadOffset(tun, device.transportHeaderSize())
 
 	device.peers.keyMap = make(map[NoisePublicKey]*Peer)
 
 	// initialize anti-DoS / anti-scanning features
 
 	device.rate.limiter.Init()
+	device.rate.cookieLimiter.Init()
 	device.rate.underLoadUntil.Store(time.Time{})
 
 	// initialize noise & crypt-key routine
@@ -293,38 +654,107 @@ func NewDevice(tun TUNDevice, logger *Logger) *Device {
 			return new([MaxMessageSize]byte)
 		},
 	}
+	device.pool.ring.Store((chan *[MaxMessageSize]byte)(nil))
 
 	// create queues
 
 	device.queue.handshake = make(chan QueueHandshakeElement, QueueHandshakeSize)
 	device.queue.encryption = make(chan *QueueOutboundElement, QueueOutboundSize)
 	device.queue.decryption = make(chan *QueueInboundElement, QueueInboundSize)
+	device.roaming.queue = make(chan endpointChange, QueueEndpointChangeSize)
+	device.handshakes.queue = make(chan *Peer, QueueHandshakeCompleteSize)
+	device.events.subscribers = make(map[chan Event]struct{})
+	device.resolver.queue = make(chan *Peer, QueueResolveSize)
+	device.resolver.reset = make(chan struct{}, 1)
+	device.resolver.interval = int64(DefaultResolveInterval)
 
 	// prepare signals
 
 	device.signals.stop = make(chan struct{}, 1)
+	device.down.up = make(chan struct{})
 
 	// prepare net
 
 	device.net.port = 0
 	device.net.bind = nil
+	device.net.receivers = 1
+	device.net.createBind = func(ports []uint16) (Bind, []uint16, error) {
+		return createBindWithOptions(ports, device.bindOptions())
+	}
+	device.net.factory = nativeEndpointFactory{device}
+	device.net.monitor = newNetworkChangeMonitor(device)
 
 	// start workers
 
+	device.affinity.changed = make(chan struct{})
+	device.affinity.workers = make(map[string][]int)
+
 	cpus := runtime.NumCPU()
 	device.state.stopping.Add(DeviceRoutineNumberPerCPU * cpus)
 	for i := 0; i < cpus; i += 1 {
-		go device.RoutineEncryption()
+		go device.RoutineEncryption(nil)
 		go device.RoutineDecryption()
 		go device.RoutineHandshake()
 	}
 
+	device.workers.encryptionMax = int32(EncryptionExtraWorkersPerCPU * cpus)
+	device.workers.retire = make(chan struct{})
+	device.state.stopping.Add(1)
+	go device.RoutineEncryptionScaler()
+
+	device.state.stopping.Add(1)
+	go device.RoutineEndpointChange()
+
+	device.state.stopping.Add(1)
+	go device.RoutineHandshakeComplete()
+
+	device.state.stopping.Add(1)
+	go device.RoutinePeerReaper()
+
+	device.state.stopping.Add(1)
+	go device.RoutineResolveEndpoints()
+
 	go device.RoutineReadFromTUN()
 	go device.RoutineTUNEventReader()
 
 	return device
 }
 
+/* Limits the number of peers which may be added (0 = unlimited),
+ * existing peers beyond the limit are retained
+ */
+func (device *Device) SetMaxPeers(limit int) error {
+	if limit < 0 || limit > MaxPeers {
+		return errors.New("Peer limit out of range")
+	}
+	device.peers.mutex.Lock()
+	device.peers.limit = limit
+	device.peers.mutex.Unlock()
+	return nil
+}
+
+/* Sets the size of the replay filter (0 = default),
+ * larger filters tolerate more reordering between packets.
+ *
+ * Applies to key pairs derived by subsequent handshakes.
+ */
+func (device *Device) SetReplayWindowSize(bits uint64) error {
+	if bits != 0 {
+		if err := ValidateReplayWindowSize(bits); err != nil {
+			return err
+		}
+	}
+	atomic.StoreUint64(&device.replay.size, bits)
+	return nil
+}
+
+func (device *Device) ReplayWindowSize() uint64 {
+	if bits := atomic.LoadUint64(&device.replay.size); bits != 0 {
+		return bits
+	}
+	return CounterBitsTotal
+}
+
 func (device *Device) LookupPeer(pk NoisePublicKey) *Peer {
 	device.peers.mutex.RLock()
 	defer device.peers.mutex.RUnlock()
@@ -332,6 +762,28 @@ func (device *Device) LookupPeer(pk NoisePublicKey) *Peer {
 	return device.peers.keyMap[pk]
 }
 
+/* Returns the entries of the routing table which route to the peer
+ * (the allowed IPs of the peer)
+ */
+func (device *Device) AllowedIPs(peer *Peer) []net.IPNet {
+	return device.routing.table.AllowedIPs(peer)
+}
+
+/* In strict mode allowed IPs are not moved between peers,
+ * unless explicitly overridden (see ipcSetOperation)
+ */
+func (device *Device) SetStrictAllowedIPs(enabled bool) {
+	device.routing.mutex.Lock()
+	defer device.routing.mutex.Unlock()
+	device.routing.strict = enabled
+}
+
+func (device *Device) StrictAllowedIPs() bool {
+	device.routing.mutex.RLock()
+	defer device.routing.mutex.RUnlock()
+	return device.routing.strict
+}
+
 func (device *Device) RemovePeer(key NoisePublicKey) {
 	device.noise.mutex.Lock()
 	defer device.noise.mutex.Unlock()
@@ -373,10 +825,12 @@ func (device *Device) FlushPacketQueues() {
 		case elem, ok := <-device.queue.decryption:
 			if ok {
 				elem.Drop()
+				elem.mutex.Unlock()
 			}
 		case elem, ok := <-device.queue.encryption:
 			if ok {
 				elem.Drop()
+				elem.mutex.Unlock()
 			}
 		case <-device.queue.handshake:
 		default:
@@ -396,6 +850,7 @@ func (device *Device) Close() {
 	defer device.state.mutex.Unlock()
 
 	device.tun.device.Close()
+	device.net.monitor.Stop()
 	device.BindClose()
 
 	device.isUp.Set(false)
@@ -407,11 +862,73 @@ func (device *Device) Close() {
 
 	device.RemoveAllPeers()
 	device.rate.limiter.Close()
+	device.rate.cookieLimiter.Close()
 
 	device.state.changing.Set(false)
 	device.log.Info.Println("Interface closed")
 }
 
+/* Closes the device once the packets queued for transmission have been sent,
+ * or the timeout has elapsed.
+ *
+ * No further packets are read from the TUN device.
+ */
+func (device *Device) Shutdown(timeout time.Duration) {
+	if device.isClosed.Get() || device.isDraining.Swap(true) {
+		return
+	}
+	device.log.Info.Println("Device shutting down, sending queued packets")
+
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+
+	timedOut := func() {
+		device.log.Info.Println("Timed out sending queued packets")
+		device.Close()
+	}
+
+	device.peers.mutex.RLock()
+	peers := make([]*Peer, 0, len(device.peers.keyMap))
+	for _, peer := range device.peers.keyMap {
+		if peer.isRunning.Get() {
+			peers = append(peers, peer)
+		}
+	}
+	device.peers.mutex.RUnlock()
+
+	// queue a marker behind the pending packets of every peer
+	// (blocking, such that the marker drops no pending packet)
+
+	var markers []chan struct{}
+
+	for _, peer := range peers {
+		marker := &QueueOutboundElement{
+			dropped: AtomicFalse,
+			flushed: make(chan struct{}),
+		}
+		select {
+		case peer.queue.nonce <- marker:
+			markers = append(markers, marker.flushed)
+		case <-deadline.C:
+			timedOut()
+			return
+		}
+	}
+
+	// wait for the markers to reach the sequential senders
+
+	for _, flushed := range markers {
+		select {
+		case <-flushed:
+		case <-deadline.C:
+			timedOut()
+			return
+		}
+	}
+
+	device.Close()
+}
+
 func (device *Device) Wait() chan struct{} {
 	return device.signals.stop
 }
@@ -9,18 +9,26 @@ package main
  * without network dependencies
  */
 
-import "testing"
+import (
+	"fmt"
+	"golang.org/x/crypto/chacha20poly1305"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
 
 func TestDevice(t *testing.T) {
 
 	// prepare tun devices for generating traffic
 
-	tun1, err := CreateDummyTUN("tun1")
+	tun1, err := CreateDummyTUN("tun1", 0)
 	if err != nil {
 		t.Error("failed to create tun:", err.Error())
 	}
 
-	tun2, err := CreateDummyTUN("tun2")
+	tun2, err := CreateDummyTUN("tun2", 0)
 	if err != nil {
 		t.Error("failed to create tun:", err.Error())
 	}
@@ -46,3 +54,423 @@ func TestDevice(t *testing.T) {
 	// create binds
 
 }
+
+func TestDevicePair(t *testing.T) {
+	dev1, dev2 := genTestPair(t)
+	defer dev1.Close()
+	defer dev2.Close()
+
+	src, dst := net.IPv4(10, 0, 0, 1), net.IPv4(10, 0, 0, 2)
+	packet := genIPv4Packet(src, dst, 100)
+	dev1.tun.device.(*DummyTUN).packets <- packet
+	assertEqual(t, recvPacket(t, dev2.tun.device, time.Second*5), packet)
+}
+
+func TestShutdownSendsQueued(t *testing.T) {
+	dev1, dev2 := genTestPair(t)
+	defer dev2.Close()
+
+	const packets = 50
+
+	src, dst := net.IPv4(10, 0, 0, 1), net.IPv4(10, 0, 0, 2)
+	tun1 := dev1.tun.device.(*DummyTUN)
+	peer := dev1.LookupPeer(dev2.noise.publicKey)
+
+	// complete a handshake, then slow down the sender to keep packets queued
+
+	tun1.packets <- genIPv4Packet(src, dst, 100)
+	recvPacket(t, dev2.tun.device, time.Second*5)
+	uapiSet(t, dev1, "public_key="+dev2.noise.publicKey.ToHex()+"\ntx_rate_limit=4000")
+
+	for i := 0; i < packets; i++ {
+		tun1.packets <- genIPv4Packet(src, dst, 100)
+	}
+	for len(tun1.packets) != 0 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(time.Millisecond * 10)
+
+	dev1.Shutdown(time.Second * 5)
+
+	if !dev1.isClosed.Get() {
+		t.Fatal("device not closed")
+	}
+	if drops := atomic.LoadUint64(&peer.stats.nonceDrops) + atomic.LoadUint64(&peer.stats.outboundDrops); drops != 0 {
+		t.Fatal("dropped", drops, "packets")
+	}
+	for i := 0; i < packets; i++ {
+		recvPacket(t, dev2.tun.device, time.Second*5)
+	}
+
+	// packets are no longer admitted
+
+	tun1.packets <- genIPv4Packet(src, dst, 100)
+	select {
+	case <-dev2.tun.device.(*DummyTUN).written:
+		t.Fatal("packet sent after shutdown")
+	case <-time.After(time.Millisecond * 100):
+	}
+}
+
+func TestShutdownMarkerDropped(t *testing.T) {
+	var drops uint64
+	queue := make(chan *QueueOutboundElement, 1)
+	marker := &QueueOutboundElement{
+		dropped: AtomicFalse,
+		flushed: make(chan struct{}),
+	}
+	queue <- marker
+
+	// a marker pushed out of a full queue releases its waiter
+
+	addToOutboundQueue(queue, &QueueOutboundElement{dropped: AtomicFalse}, &drops)
+	select {
+	case <-marker.flushed:
+	default:
+		t.Fatal("dropped marker not released")
+	}
+	if drops != 0 {
+		t.Fatal("dropped marker counted as packet drop")
+	}
+}
+
+func TestSuspendResume(t *testing.T) {
+	dev1, dev2 := genTestPair(t)
+	defer dev1.Close()
+	defer dev2.Close()
+
+	src, dst := net.IPv4(10, 0, 0, 1), net.IPv4(10, 0, 0, 2)
+	tun1 := dev1.tun.device.(*DummyTUN)
+	tun2 := dev2.tun.device.(*DummyTUN)
+	peer := dev1.LookupPeer(dev2.noise.publicKey)
+
+	tun1.packets <- genIPv4Packet(src, dst, 100)
+	recvPacket(t, tun2, time.Second*5)
+	uapiSet(t, dev1, "public_key="+dev2.noise.publicKey.ToHex()+"\npersistent_keepalive_interval=1")
+
+	time.Sleep(time.Millisecond * 100)
+	idle := atomic.LoadInt64(&dev1.pool.outstanding)
+
+	// no packets or keepalives are sent while suspended,
+	// received packets are delivered
+
+	dev1.Suspend()
+	if !dev1.IsSuspended() {
+		t.Fatal("device not suspended")
+	}
+	tx := atomic.LoadUint64(&peer.stats.txBytes)
+	tun2.packets <- genIPv4Packet(dst, src, 100)
+	recvPacket(t, tun1, time.Second*5)
+	for i := 0; i < 3; i++ {
+		tun1.packets <- genIPv4Packet(src, dst, 100)
+	}
+	select {
+	case <-tun2.written:
+		t.Fatal("packet sent while suspended")
+	case <-time.After(time.Millisecond * 1500):
+	}
+	if atomic.LoadUint64(&peer.stats.txBytes) != tx {
+		t.Fatal("keepalive sent while suspended")
+	}
+
+	// the buffers of the TUN reader are returned
+
+	if atomic.LoadInt64(&dev1.pool.outstanding) >= idle {
+		t.Fatal("buffers held while suspended")
+	}
+
+	// traffic continues on the existing session
+
+	dev1.Resume()
+	if dev1.IsSuspended() {
+		t.Fatal("device not resumed")
+	}
+	current := peer.keyPairs.Current()
+	tun1.packets <- genIPv4Packet(src, dst, 100)
+	recvPacket(t, tun2, time.Second*5)
+	if peer.keyPairs.Current() != current {
+		t.Fatal("session not retained")
+	}
+
+	deadline := time.Now().Add(time.Second * 5)
+	for len(tun1.packets) > 0 || atomic.LoadInt64(&dev1.pool.outstanding) != idle {
+		if time.Now().After(deadline) {
+			t.Fatal("leaked", atomic.LoadInt64(&dev1.pool.outstanding)-idle, "buffers")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+func TestDownUp(t *testing.T) {
+	dev1, dev2 := genTestPair(t)
+	defer dev1.Close()
+	defer dev2.Close()
+
+	src, dst := net.IPv4(10, 0, 0, 1), net.IPv4(10, 0, 0, 2)
+	tun1 := dev1.tun.device.(*DummyTUN)
+	tun2 := dev2.tun.device.(*DummyTUN)
+
+	tun1.packets <- genIPv4Packet(src, dst, 100)
+	recvPacket(t, tun2, time.Second*5)
+
+	// the port is released and the TUN device no longer read
+	// (but for a read pending when brought down)
+
+	port := dev1.net.port
+	dev1.Down()
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{Port: int(port)})
+	if err != nil {
+		t.Fatal("port not released:", err)
+	}
+	conn.Close()
+
+	for i := 0; i < 2; i++ {
+		tun1.packets <- genIPv4Packet(src, dst, 100)
+	}
+	time.Sleep(time.Millisecond * 200)
+	if len(tun1.packets) == 0 {
+		t.Fatal("TUN device read while down")
+	}
+
+	// the configuration is retained
+
+	get := uapiRequest(t, dev1, "get=1\n\n")
+	for _, line := range []string{
+		fmt.Sprintf("listen_port=%d\n", port),
+		"public_key=" + dev2.noise.publicKey.ToHex() + "\n",
+		"allowed_ip=10.0.0.2/32\n",
+	} {
+		if !strings.Contains(get, line) {
+			t.Fatal("configuration not retained:", line, get)
+		}
+	}
+
+	// traffic resumes on the same port
+
+	dev1.Up()
+	if !dev1.isUp.Get() || dev1.net.port != port {
+		t.Fatal("device not brought up on port", port)
+	}
+	recvPacket(t, tun2, time.Second*5)
+	tun2.packets <- genIPv4Packet(dst, src, 100)
+	recvPacket(t, tun1, time.Second*5)
+}
+
+func TestDeviceAllowedIPs(t *testing.T) {
+	device := randDevice(t)
+	defer device.Close()
+
+	peer1 := randPeer(t, device)
+	peer2 := randPeer(t, device)
+
+	allowed := []string{
+		"10.0.0.0/24",
+		"192.168.1.1/32",
+		"fd00::/64",
+		"2001:db8::1/128",
+	}
+	for _, ip := range allowed {
+		uapiSet(t, device, fmt.Sprintf(
+			"public_key=%s\nallowed_ip=%s",
+			peer1.handshake.remoteStatic.ToHex(), ip,
+		))
+	}
+	uapiSet(t, device, "public_key="+peer2.handshake.remoteStatic.ToHex()+"\nallowed_ip=10.0.1.0/24")
+
+	found := make(map[string]bool)
+	for _, ipnet := range device.AllowedIPs(peer1) {
+		found[ipnet.String()] = true
+	}
+	if len(found) != len(allowed) {
+		t.Fatal("enumerated", len(found), "of", len(allowed), "allowed IPs")
+	}
+	for _, ip := range allowed {
+		if !found[ip] {
+			t.Fatal("allowed IP", ip, "not enumerated")
+		}
+	}
+
+	if ips := device.AllowedIPs(peer2); len(ips) != 1 || ips[0].String() != "10.0.1.0/24" {
+		t.Fatal("unexpected allowed IPs for second peer:", ips)
+	}
+
+	device.RemovePeer(peer1.handshake.remoteStatic)
+	if ips := device.AllowedIPs(peer1); len(ips) != 0 {
+		t.Fatal("allowed IPs remain after removal:", ips)
+	}
+}
+
+func TestMessageBufferRing(t *testing.T) {
+	device := randDevice(t)
+	defer device.Close()
+
+	if err := device.SetMessageBufferRing(MaxBufferRingSize + 1); err == nil {
+		t.Fatal("accepted oversized buffer ring")
+	}
+
+	uapiSet(t, device, "buffer_ring_size=4")
+	if device.MessageBufferRingSize() != 4 {
+		t.Fatal("buffer ring not enabled")
+	}
+
+	// buffers beyond the ring are taken from the pool
+
+	ring := make(map[*[MaxMessageSize]byte]bool)
+	var buffers []*[MaxMessageSize]byte
+	for i := 0; i < 6; i++ {
+		msg := device.GetMessageBuffer()
+		if i < 4 {
+			ring[msg] = true
+		} else if ring[msg] {
+			t.Fatal("ring buffer handed out twice")
+		}
+		buffers = append(buffers, msg)
+	}
+
+	// returned buffers refill the ring first
+
+	for _, msg := range buffers {
+		device.PutMessageBuffer(msg)
+	}
+	if n := len(device.messageBufferRing()); n != 4 {
+		t.Fatal("ring holds", n, "of 4 buffers")
+	}
+
+	uapiSet(t, device, "buffer_ring_size=0")
+	if device.MessageBufferRingSize() != 0 {
+		t.Fatal("buffer ring not disabled")
+	}
+}
+
+/* Cycles message buffers through the device,
+ * keeping a window of buffers in flight (as the queues do)
+ */
+func benchmarkMessageBuffers(b *testing.B, ringSize int) {
+	device := randDevice(b)
+	defer device.Close()
+
+	if err := device.SetMessageBufferRing(ringSize); err != nil {
+		b.Fatal(err)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		var inflight [64]*[MaxMessageSize]byte
+		for pb.Next() {
+			for i := range inflight {
+				inflight[i] = device.GetMessageBuffer()
+			}
+			for i, msg := range inflight {
+				device.PutMessageBuffer(msg)
+				inflight[i] = nil
+			}
+		}
+	})
+}
+
+func BenchmarkMessageBufferPool(b *testing.B) {
+	benchmarkMessageBuffers(b, 0)
+}
+
+func BenchmarkMessageBufferRing(b *testing.B) {
+	benchmarkMessageBuffers(b, MaxBufferRingSize)
+}
+
+func TestMessageBufferClearing(t *testing.T) {
+	device := randDevice(t)
+	defer device.Close()
+
+	// a single ring buffer is handed out again after its return
+
+	if err := device.SetMessageBufferRing(1); err != nil {
+		t.Fatal(err)
+	}
+
+	reuse := func() bool {
+		msg := device.GetMessageBuffer()
+		for i := range msg {
+			msg[i] = 0xaa
+		}
+		device.PutMessageBuffer(msg)
+		if device.GetMessageBuffer() != msg {
+			t.Fatal("buffer not reused")
+		}
+		defer device.PutMessageBuffer(msg)
+		return isZero(msg[:])
+	}
+
+	if reuse() {
+		t.Fatal("buffer cleared without preshared key")
+	}
+
+	// enabled by default once a preshared key is configured
+
+	peer := randPeer(t, device)
+	uapiSet(t, device, fmt.Sprintf(
+		"public_key=%s\npreshared_key=%s",
+		peer.handshake.remoteStatic.ToHex(), strings.Repeat("01", chacha20poly1305.KeySize),
+	))
+	if !reuse() {
+		t.Fatal("buffer not cleared with preshared key")
+	}
+
+	uapiSet(t, device, "clear_buffers=false")
+	if reuse() {
+		t.Fatal("buffer cleared when disabled")
+	}
+	uapiSet(t, device, "clear_buffers=true")
+	if !reuse() {
+		t.Fatal("buffer not cleared when enabled")
+	}
+}
+
+func benchmarkMessageBufferClearing(b *testing.B, mode int32) {
+	device := randDevice(b)
+	defer device.Close()
+
+	device.SetMessageBufferClearing(mode)
+
+	b.SetBytes(MaxMessageSize)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		device.PutMessageBuffer(device.GetMessageBuffer())
+	}
+}
+
+func BenchmarkMessageBufferNoClearing(b *testing.B) {
+	benchmarkMessageBufferClearing(b, BufferClearingOff)
+}
+
+func BenchmarkMessageBufferClearing(b *testing.B) {
+	benchmarkMessageBufferClearing(b, BufferClearingOn)
+}
+
+func TestTUNEventMTU(t *testing.T) {
+	tun, _ := CreateDummyTUN("tun0", 1420)
+	device := NewDevice(tun, NewLogger(LogLevelError, ""))
+	defer device.Close()
+
+	waitMTU := func(mtu int) {
+		deadline := time.Now().Add(time.Second * 5)
+		for device.EffectiveMTU() != mtu {
+			if time.Now().After(deadline) {
+				t.Fatal("expected MTU", mtu, "got", device.EffectiveMTU())
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	// a lowered MTU caps padding
+
+	tun.(*DummyTUN).SetMTU(1280)
+	waitMTU(1280)
+
+	// an MTU beyond the transport message is clamped
+
+	tun.(*DummyTUN).SetMTU(MaxContentSize + 100)
+	waitMTU(MaxContentSize)
+
+	tun.(*DummyTUN).SetMTU(-1)
+	waitMTU(0)
+}
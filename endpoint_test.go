@@ -44,6 +44,15 @@ func (e *DummyEndpoint) SrcToBytes() []byte {
 	return e.src[:]
 }
 
+func (e *DummyEndpoint) DstToBytes() []byte {
+	return e.dst[:]
+}
+
+func (e *DummyEndpoint) Equal(other Endpoint) bool {
+	o, ok := other.(*DummyEndpoint)
+	return ok && e.dst == o.dst
+}
+
 func (e *DummyEndpoint) DstIP() net.IP {
 	return e.dst[:]
 }
@@ -0,0 +1,76 @@
+/* SPDX-License-Identifier: GPL-2.0
+ *
+ * Copyright (C) 2017-2018 Jason A. Donenfeld <Jason@zx2c4.com>. All Rights Reserved.
+ */
+
+package main
+
+const (
+	QueueEventSize = 128 // pending events per subscriber
+)
+
+const (
+	EventHandshakeComplete = "handshake_complete"
+	EventPeerAdded         = "peer_added"
+	EventPeerRemoved       = "peer_removed"
+	EventEndpointRoamed    = "endpoint_roamed"
+	EventError             = "error"
+)
+
+/* A change of state, as streamed to subscribers
+ */
+type Event struct {
+	Kind      string         // one of the Event constants
+	PublicKey NoisePublicKey // peer of the event (zero for errors)
+	Endpoint  string         // new endpoint of the peer (endpoint_roamed)
+	Message   string         // description of the error (error)
+}
+
+/* Returns the UAPI lines of the event,
+ * an error message is not named errno (which terminates a response)
+ */
+func (event Event) lines() []string {
+	lines := []string{"event=" + event.Kind}
+	if event.Kind != EventError {
+		lines = append(lines, "public_key="+event.PublicKey.ToHex())
+	}
+	if event.Endpoint != "" {
+		lines = append(lines, "endpoint="+event.Endpoint)
+	}
+	if event.Message != "" {
+		lines = append(lines, "message="+event.Message)
+	}
+	return lines
+}
+
+/* Registers a subscriber to the events of the device,
+ * the returned function ends the subscription
+ *
+ * Events are dropped while the subscriber is unable to keep up.
+ */
+func (device *Device) Subscribe() (<-chan Event, func()) {
+	events := make(chan Event, QueueEventSize)
+
+	device.events.mutex.Lock()
+	device.events.subscribers[events] = struct{}{}
+	device.events.mutex.Unlock()
+
+	return events, func() {
+		device.events.mutex.Lock()
+		delete(device.events.subscribers, events)
+		device.events.mutex.Unlock()
+	}
+}
+
+func (device *Device) publishEvent(event Event) {
+	device.events.mutex.Lock()
+	defer device.events.mutex.Unlock()
+
+	for events := range device.events.subscribers {
+		select {
+		case events <- event:
+		default:
+			device.log.Debug.Println("Dropping", event.Kind, "event of subscriber")
+		}
+	}
+}
@@ -0,0 +1,247 @@
+/* SPDX-License-Identifier: GPL-2.0
+ *
+ * Copyright (C) 2017-2018 Jason A. Donenfeld <Jason@zx2c4.com>. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+/* Software segmentation of packets read from TUN devices with offloads enabled
+ * (IFF_VNET_HDR), which prefix every packet by a virtio_net_hdr and may
+ * deliver a TCP stream coalesced into a single super-packet
+ */
+
+const (
+	virtioNetHdrLen           = 10
+	virtioNetHdrFlagNeedsCsum = 1
+	virtioNetHdrGSONone       = 0
+	virtioNetHdrGSOTCPv4      = 1
+	virtioNetHdrGSOTCPv6      = 4
+	virtioNetHdrGSOECN        = 0x80
+)
+
+const (
+	tcpOffsetSeq      = 4
+	tcpOffsetDataOff  = 12
+	tcpOffsetFlags    = 13
+	tcpOffsetChecksum = 16
+	tcpHeaderLenMin   = 20
+	tcpFlagFIN        = 0x01
+	tcpFlagPSH        = 0x08
+	tcpFlagCWR        = 0x80
+)
+
+type virtioNetHdr struct {
+	flags      uint8
+	gsoType    uint8
+	hdrLen     uint16
+	gsoSize    uint16
+	csumStart  uint16
+	csumOffset uint16
+}
+
+func (hdr *virtioNetHdr) decode(b []byte) error {
+	if len(b) < virtioNetHdrLen {
+		return errors.New("Packet too short for virtio_net_hdr")
+	}
+	hdr.flags = b[0]
+	hdr.gsoType = b[1]
+	hdr.hdrLen = binary.LittleEndian.Uint16(b[2:])
+	hdr.gsoSize = binary.LittleEndian.Uint16(b[4:])
+	hdr.csumStart = binary.LittleEndian.Uint16(b[6:])
+	hdr.csumOffset = binary.LittleEndian.Uint16(b[8:])
+	return nil
+}
+
+/* Enables splitting of packets read from the TUN device,
+ * which must prefix every packet by a virtio_net_hdr
+ */
+func (device *Device) SetTUNSegmentationOffload(enabled bool) {
+	device.tun.gso.Set(enabled)
+}
+
+func (device *Device) TUNSegmentationOffload() bool {
+	return device.tun.gso.Get()
+}
+
+/* Reads a packet prefixed by a virtio_net_hdr into the scratch buffer
+ * and splits it into the buffers (at offset), returning the sizes of the segments
+ *
+ * Malformed packets are discarded, no segments are returned
+ */
+func (device *Device) readTUNSegments(scratch []byte, bufs [][]byte, offset int) ([]int, error) {
+	size, err := device.tun.device.Read(scratch, offset)
+	if err != nil {
+		return nil, err
+	}
+	sizes, err := gsoSplit(scratch[offset:offset+size], bufs, offset)
+	if err != nil {
+		device.log.Debug.Println("Discarding packet read from TUN device:", err)
+		return nil, nil
+	}
+	return sizes, nil
+}
+
+/* Splits a packet prefixed by a virtio_net_hdr into segments,
+ * copied into the buffers at offset
+ *
+ * Packets without GSO are copied as is (completing a partial checksum),
+ * TCP super-packets are divided into segments of the GSO size,
+ * with the lengths, sequence numbers and checksums of the headers adjusted
+ */
+func gsoSplit(in []byte, bufs [][]byte, offset int) ([]int, error) {
+	var hdr virtioNetHdr
+	if err := hdr.decode(in); err != nil {
+		return nil, err
+	}
+	packet := in[virtioNetHdrLen:]
+
+	switch hdr.gsoType &^ virtioNetHdrGSOECN {
+	case virtioNetHdrGSONone:
+		if len(bufs) == 0 || len(bufs[0]) < offset+len(packet) {
+			return nil, errors.New("Packet exceeds buffer")
+		}
+		out := bufs[0][offset : offset+len(packet)]
+		copy(out, packet)
+		if hdr.flags&virtioNetHdrFlagNeedsCsum != 0 {
+			start, field := int(hdr.csumStart), int(hdr.csumStart)+int(hdr.csumOffset)
+			if field+2 > len(out) {
+				return nil, errors.New("Invalid checksum offset")
+			}
+			binary.BigEndian.PutUint16(out[field:], checksumFold(checksumAdd(0, out[start:])))
+		}
+		return []int{len(out)}, nil
+
+	case virtioNetHdrGSOTCPv4:
+		return gsoSplitTCP(packet, hdr, bufs, offset, true)
+
+	case virtioNetHdrGSOTCPv6:
+		return gsoSplitTCP(packet, hdr, bufs, offset, false)
+
+	default:
+		return nil, fmt.Errorf("Unsupported GSO type %d", hdr.gsoType)
+	}
+}
+
+func gsoSplitTCP(packet []byte, hdr virtioNetHdr, bufs [][]byte, offset int, isV4 bool) ([]int, error) {
+
+	// locate headers
+
+	if len(packet) == 0 {
+		return nil, errors.New("Empty GSO packet")
+	}
+	transport := int(hdr.csumStart)
+	ihl := int(packet[0]&0x0f) * 4
+	if isV4 {
+		if len(packet) < ipv4.HeaderLen || packet[0]>>4 != ipv4.Version || ihl < ipv4.HeaderLen || transport < ihl {
+			return nil, errors.New("Invalid IPv4 header of GSO packet")
+		}
+	} else {
+		if len(packet) < ipv6.HeaderLen || packet[0]>>4 != ipv6.Version || transport < ipv6.HeaderLen {
+			return nil, errors.New("Invalid IPv6 header of GSO packet")
+		}
+	}
+	if len(packet) < transport+tcpHeaderLenMin {
+		return nil, errors.New("Invalid TCP header of GSO packet")
+	}
+	headers := transport + int(packet[transport+tcpOffsetDataOff]>>4)*4
+	if headers < transport+tcpHeaderLenMin || headers > len(packet) {
+		return nil, errors.New("Invalid TCP header of GSO packet")
+	}
+	if hdr.gsoSize == 0 {
+		return nil, errors.New("Invalid GSO size")
+	}
+
+	payload := packet[headers:]
+	mss := int(hdr.gsoSize)
+	count := (len(payload) + mss - 1) / mss
+	if count > len(bufs) {
+		return nil, fmt.Errorf("GSO packet of %d segments exceeds %d buffers", count, len(bufs))
+	}
+
+	seq := binary.BigEndian.Uint32(packet[transport+tcpOffsetSeq:])
+	flags := packet[transport+tcpOffsetFlags]
+	var id uint16
+	if isV4 {
+		id = binary.BigEndian.Uint16(packet[4:])
+	}
+
+	sizes := make([]int, count)
+	for i := range sizes {
+		start := i * mss
+		end := start + mss
+		if end > len(payload) {
+			end = len(payload)
+		}
+		size := headers + end - start
+		if len(bufs[i]) < offset+size {
+			return nil, errors.New("Segment exceeds buffer")
+		}
+		seg := bufs[i][offset : offset+size]
+		copy(seg, packet[:headers])
+		copy(seg[headers:], payload[start:end])
+
+		// IP header
+
+		var pseudo uint64
+		if isV4 {
+			binary.BigEndian.PutUint16(seg[IPv4offsetTotalLength:], uint16(size))
+			binary.BigEndian.PutUint16(seg[4:], id+uint16(i))
+			seg[10], seg[11] = 0, 0
+			binary.BigEndian.PutUint16(seg[10:], checksumFold(checksumAdd(0, seg[:ihl])))
+			pseudo = checksumAdd(0, seg[IPv4offsetSrc:IPv4offsetDst+4])
+		} else {
+			binary.BigEndian.PutUint16(seg[IPv6offsetPayloadLength:], uint16(size-ipv6.HeaderLen))
+			pseudo = checksumAdd(0, seg[IPv6offsetSrc:IPv6offsetDst+16])
+		}
+
+		// TCP header, FIN and PSH only on the last segment, CWR only on the first
+
+		tcp := seg[transport:]
+		binary.BigEndian.PutUint32(tcp[tcpOffsetSeq:], seq+uint32(start))
+		segFlags := flags
+		if i != count-1 {
+			segFlags &^= tcpFlagFIN | tcpFlagPSH
+		}
+		if i != 0 {
+			segFlags &^= tcpFlagCWR
+		}
+		tcp[tcpOffsetFlags] = segFlags
+
+		tcp[tcpOffsetChecksum], tcp[tcpOffsetChecksum+1] = 0, 0
+		pseudo += 6 + uint64(len(tcp)) // protocol (TCP) and length
+		binary.BigEndian.PutUint16(tcp[tcpOffsetChecksum:], checksumFold(checksumAdd(pseudo, tcp)))
+
+		sizes[i] = size
+	}
+	return sizes, nil
+}
+
+/* Adds the 16-bit big endian words of the data to the (unfolded) sum
+ */
+func checksumAdd(sum uint64, b []byte) uint64 {
+	for len(b) >= 2 {
+		sum += uint64(binary.BigEndian.Uint16(b))
+		b = b[2:]
+	}
+	if len(b) == 1 {
+		sum += uint64(b[0]) << 8
+	}
+	return sum
+}
+
+/* Folds the sum into the ones' complement checksum
+ */
+func checksumFold(sum uint64) uint16 {
+	for sum > 0xffff {
+		sum = (sum >> 16) + (sum & 0xffff)
+	}
+	return ^uint16(sum)
+}
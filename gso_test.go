@@ -0,0 +1,228 @@
+/* SPDX-License-Identifier: GPL-2.0
+ *
+ * Copyright (C) 2017-2018 Jason A. Donenfeld <Jason@zx2c4.com>. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+/* Generates a TCP super-packet prefixed by a virtio_net_hdr,
+ * carrying the payload in segments of the GSO size
+ */
+func genGSOPacket(src, dst net.IP, payload []byte, gsoSize int, flags byte) []byte {
+	var ip []byte
+	hdr := make([]byte, virtioNetHdrLen)
+	if src.To4() != nil {
+		ip = make([]byte, ipv4.HeaderLen)
+		ip[0] = 0x45
+		binary.BigEndian.PutUint16(ip[IPv4offsetTotalLength:], 0xffff)
+		binary.BigEndian.PutUint16(ip[4:], 0x1234) // identification
+		ip[8], ip[9] = 64, 6
+		copy(ip[IPv4offsetSrc:], src.To4())
+		copy(ip[IPv4offsetDst:], dst.To4())
+		hdr[1] = virtioNetHdrGSOTCPv4
+	} else {
+		ip = make([]byte, ipv6.HeaderLen)
+		ip[0] = 0x60
+		ip[6], ip[7] = 6, 64
+		copy(ip[IPv6offsetSrc:], src.To16())
+		copy(ip[IPv6offsetDst:], dst.To16())
+		hdr[1] = virtioNetHdrGSOTCPv6
+	}
+	tcp := make([]byte, tcpHeaderLenMin)
+	binary.BigEndian.PutUint16(tcp[0:], 51820)
+	binary.BigEndian.PutUint16(tcp[2:], 443)
+	binary.BigEndian.PutUint32(tcp[tcpOffsetSeq:], 0xfffffc00) // wraps
+	tcp[tcpOffsetDataOff] = (tcpHeaderLenMin / 4) << 4
+	tcp[tcpOffsetFlags] = flags
+
+	hdr[0] = virtioNetHdrFlagNeedsCsum
+	binary.LittleEndian.PutUint16(hdr[2:], uint16(len(ip)+len(tcp)))
+	binary.LittleEndian.PutUint16(hdr[4:], uint16(gsoSize))
+	binary.LittleEndian.PutUint16(hdr[6:], uint16(len(ip)))
+	binary.LittleEndian.PutUint16(hdr[8:], tcpOffsetChecksum)
+
+	packet := append(hdr, ip...)
+	packet = append(packet, tcp...)
+	return append(packet, payload...)
+}
+
+func checkTCPSegment(t *testing.T, seg []byte, payload []byte, seq uint32, flags byte, id uint16) {
+	var transport int
+	var pseudo uint64
+	if seg[0]>>4 == ipv4.Version {
+		transport = ipv4.HeaderLen
+		if int(binary.BigEndian.Uint16(seg[IPv4offsetTotalLength:])) != len(seg) {
+			t.Fatal("invalid total length:", binary.BigEndian.Uint16(seg[IPv4offsetTotalLength:]))
+		}
+		if binary.BigEndian.Uint16(seg[4:]) != id {
+			t.Fatal("invalid identification:", binary.BigEndian.Uint16(seg[4:]))
+		}
+		if checksumFold(checksumAdd(0, seg[:transport])) != 0 {
+			t.Fatal("invalid IPv4 header checksum")
+		}
+		pseudo = checksumAdd(0, seg[IPv4offsetSrc:IPv4offsetDst+4])
+	} else {
+		transport = ipv6.HeaderLen
+		if int(binary.BigEndian.Uint16(seg[IPv6offsetPayloadLength:])) != len(seg)-ipv6.HeaderLen {
+			t.Fatal("invalid payload length:", binary.BigEndian.Uint16(seg[IPv6offsetPayloadLength:]))
+		}
+		pseudo = checksumAdd(0, seg[IPv6offsetSrc:IPv6offsetDst+16])
+	}
+	tcp := seg[transport:]
+	if binary.BigEndian.Uint32(tcp[tcpOffsetSeq:]) != seq {
+		t.Fatal("invalid sequence number:", binary.BigEndian.Uint32(tcp[tcpOffsetSeq:]), "expected", seq)
+	}
+	if tcp[tcpOffsetFlags] != flags {
+		t.Fatalf("invalid flags: %#x, expected %#x", tcp[tcpOffsetFlags], flags)
+	}
+	if checksumFold(checksumAdd(pseudo+6+uint64(len(tcp)), tcp)) != 0 {
+		t.Fatal("invalid TCP checksum")
+	}
+	if !bytes.Equal(tcp[tcpHeaderLenMin:], payload) {
+		t.Fatal("invalid payload")
+	}
+}
+
+func TestGSOSplit(t *testing.T) {
+	payload := make([]byte, 3500)
+	for i := range payload {
+		payload[i] = byte(i * 7)
+	}
+	bufs := make([][]byte, 8)
+	for i := range bufs {
+		bufs[i] = make([]byte, MaxMessageSize)
+	}
+	offset := MessageTransportHeaderSize
+
+	for _, addrs := range [][2]net.IP{
+		{net.IPv4(10, 0, 0, 1), net.IPv4(10, 0, 0, 2)},
+		{net.ParseIP("fd00::1"), net.ParseIP("fd00::2")},
+	} {
+		flags := byte(tcpFlagCWR | tcpFlagPSH | tcpFlagFIN | 0x10) // ACK
+		packet := genGSOPacket(addrs[0], addrs[1], payload, 1000, flags)
+
+		sizes, err := gsoSplit(packet, bufs, offset)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(sizes) != 4 {
+			t.Fatal("expected 4 segments, got", len(sizes))
+		}
+		for i, size := range sizes {
+			segFlags := byte(0x10)
+			if i == 0 {
+				segFlags |= tcpFlagCWR
+			}
+			if i == len(sizes)-1 {
+				segFlags |= tcpFlagPSH | tcpFlagFIN
+			}
+			end := (i + 1) * 1000
+			if end > len(payload) {
+				end = len(payload)
+			}
+			checkTCPSegment(
+				t,
+				bufs[i][offset:offset+size],
+				payload[i*1000:end],
+				0xfffffc00+uint32(i*1000),
+				segFlags,
+				0x1234+uint16(i),
+			)
+		}
+	}
+
+	// packets without GSO are copied, completing the checksum
+
+	packet := genGSOPacket(net.IPv4(10, 0, 0, 1), net.IPv4(10, 0, 0, 2), payload[:500], 0, 0x10)
+	packet[1] = virtioNetHdrGSONone
+	ip := packet[virtioNetHdrLen:]
+	binary.BigEndian.PutUint16(ip[IPv4offsetTotalLength:], uint16(len(ip)))
+	binary.BigEndian.PutUint16(ip[10:], checksumFold(checksumAdd(0, ip[:ipv4.HeaderLen])))
+	partial := ^checksumFold(checksumAdd(6+uint64(len(ip)-ipv4.HeaderLen), ip[IPv4offsetSrc:IPv4offsetDst+4]))
+	binary.BigEndian.PutUint16(ip[ipv4.HeaderLen+tcpOffsetChecksum:], partial)
+
+	sizes, err := gsoSplit(packet, bufs, offset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sizes) != 1 {
+		t.Fatal("expected a single packet, got", len(sizes))
+	}
+	checkTCPSegment(t, bufs[0][offset:offset+sizes[0]], payload[:500], 0xfffffc00, 0x10, 0x1234)
+
+	// malformed packets are rejected
+
+	packet = genGSOPacket(net.IPv4(10, 0, 0, 1), net.IPv4(10, 0, 0, 2), payload, 100, 0x10)
+	if _, err := gsoSplit(packet, bufs, offset); err == nil {
+		t.Fatal("split packet exceeding the buffers")
+	}
+	packet = genGSOPacket(net.IPv4(10, 0, 0, 1), net.IPv4(10, 0, 0, 2), payload, 0, 0x10)
+	if _, err := gsoSplit(packet, bufs, offset); err == nil {
+		t.Fatal("split packet with GSO size of zero")
+	}
+	if _, err := gsoSplit(packet[:virtioNetHdrLen+30], bufs, offset); err == nil {
+		t.Fatal("split truncated packet")
+	}
+}
+
+func TestTUNSegmentationOffload(t *testing.T) {
+	dev1, dev2 := genChannelPair(t)
+	defer dev1.Close()
+	defer dev2.Close()
+
+	src, dst := net.IPv4(10, 0, 0, 1), net.IPv4(10, 0, 0, 2)
+	tun1 := dev1.tun.device.(*DummyTUN)
+
+	uapiSet(t, dev1, "tun_gso=true")
+	if !dev1.TUNSegmentationOffload() {
+		t.Fatal("segmentation offload not enabled")
+	}
+
+	// wait for the reader to pick up the flag,
+	// packets read before are discarded (not valid IP)
+
+	ping := genGSOPacket(src, dst, nil, 0, 0x10)
+	ping[0], ping[1] = 0, virtioNetHdrGSONone
+	binary.BigEndian.PutUint16(ping[virtioNetHdrLen+IPv4offsetTotalLength:], uint16(len(ping)-virtioNetHdrLen))
+	for {
+		tun1.packets <- ping
+		select {
+		case <-dev2.tun.device.(*DummyTUN).written:
+		case <-time.After(time.Millisecond * 100):
+			continue
+		}
+		break
+	}
+
+	// a coalesced stream arrives as individual segments
+
+	payload := make([]byte, 4000)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+	tun1.packets <- genGSOPacket(src, dst, payload, 1200, tcpFlagPSH|0x10)
+
+	for i := 0; i < 4; i++ {
+		end := (i + 1) * 1200
+		if end > len(payload) {
+			end = len(payload)
+		}
+		flags := byte(0x10)
+		if i == 3 {
+			flags |= tcpFlagPSH
+		}
+		seg := recvPacket(t, dev2.tun.device, time.Second*5)
+		checkTCPSegment(t, seg, payload[i*1200:end], 0xfffffc00+uint32(i*1200), flags, 0x1234+uint16(i))
+	}
+}
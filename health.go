@@ -0,0 +1,112 @@
+/* SPDX-License-Identifier: GPL-2.0
+ *
+ * Copyright (C) 2017-2018 Jason A. Donenfeld <Jason@zx2c4.com>. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+/* Liveness of the instances of a routine,
+ * maintained by the routine itself
+ */
+type RoutineHealth struct {
+	activity int64 // time of last activity (unix nano), accessed atomically
+	running  int32 // instances running, accessed atomically
+}
+
+func (h *RoutineHealth) started() {
+	atomic.AddInt32(&h.running, 1)
+	h.active()
+}
+
+func (h *RoutineHealth) stopped() {
+	atomic.AddInt32(&h.running, -1)
+}
+
+func (h *RoutineHealth) active() {
+	atomic.StoreInt64(&h.activity, time.Now().UnixNano())
+}
+
+func (h *RoutineHealth) State() RoutineState {
+	state := RoutineState{
+		Running: int(atomic.LoadInt32(&h.running)),
+	}
+	if activity := atomic.LoadInt64(&h.activity); activity != 0 {
+		state.LastActivity = time.Unix(0, activity)
+	}
+	return state
+}
+
+type RoutineState struct {
+	Running      int       // number of running instances
+	LastActivity time.Time // zero if never started
+}
+
+func (state RoutineState) IsRunning() bool {
+	return state.Running > 0
+}
+
+/* A Bind which runs routines of its own
+ */
+type HealthReporter interface {
+	Health() map[string]RoutineState
+}
+
+type PeerHealth struct {
+	Nonce              RoutineState
+	SequentialSender   RoutineState
+	SequentialReceiver RoutineState
+}
+
+type DeviceHealth struct {
+	Encryption      RoutineState
+	Decryption      RoutineState
+	Handshake       RoutineState
+	ReceiveIncoming RoutineState
+	ReadFromTUN     RoutineState
+	TUNEventReader  RoutineState
+	Bind            map[string]RoutineState // routines of the bind (if reported)
+	Peers           map[NoisePublicKey]PeerHealth
+}
+
+/* Reports which routines of the device and its peers are running,
+ * for use in health checks of embedders
+ */
+func (device *Device) Health() DeviceHealth {
+	health := DeviceHealth{
+		Encryption:      device.health.encryption.State(),
+		Decryption:      device.health.decryption.State(),
+		Handshake:       device.health.handshake.State(),
+		ReceiveIncoming: device.health.receive.State(),
+		ReadFromTUN:     device.health.readTUN.State(),
+		TUNEventReader:  device.health.tunEvents.State(),
+		Peers:           make(map[NoisePublicKey]PeerHealth),
+	}
+
+	device.net.mutex.RLock()
+	if reporter, ok := device.net.bind.(HealthReporter); ok {
+		health.Bind = reporter.Health()
+	}
+	device.net.mutex.RUnlock()
+
+	device.peers.mutex.RLock()
+	defer device.peers.mutex.RUnlock()
+
+	for key, peer := range device.peers.keyMap {
+		health.Peers[key] = peer.Health()
+	}
+
+	return health
+}
+
+func (peer *Peer) Health() PeerHealth {
+	return PeerHealth{
+		Nonce:              peer.health.nonce.State(),
+		SequentialSender:   peer.health.sender.State(),
+		SequentialReceiver: peer.health.receiver.State(),
+	}
+}
@@ -0,0 +1,65 @@
+/* SPDX-License-Identifier: GPL-2.0
+ *
+ * Copyright (C) 2017-2018 Jason A. Donenfeld <Jason@zx2c4.com>. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestHealth(t *testing.T) {
+	dev1, dev2 := genTestPair(t)
+	defer dev1.Close()
+	defer dev2.Close()
+
+	health := dev1.Health()
+	for name, state := range map[string]RoutineState{
+		"encryption":       health.Encryption,
+		"decryption":       health.Decryption,
+		"handshake":        health.Handshake,
+		"receive incoming": health.ReceiveIncoming,
+		"TUN reader":       health.ReadFromTUN,
+		"TUN event reader": health.TUNEventReader,
+		"route listener":   health.Bind["route_listener"],
+	} {
+		if !state.IsRunning() || state.LastActivity.IsZero() {
+			t.Fatal(name, "not running")
+		}
+	}
+
+	peer := dev1.LookupPeer(dev2.noise.publicKey)
+	before := dev1.Health().Peers[dev2.noise.publicKey]
+	if !before.Nonce.IsRunning() || !before.SequentialSender.IsRunning() || !before.SequentialReceiver.IsRunning() {
+		t.Fatal("peer routines not running")
+	}
+
+	// sending records activity
+
+	time.Sleep(time.Millisecond * 10)
+	dev1.tun.device.(*DummyTUN).packets <- genIPv4Packet(net.IPv4(10, 0, 0, 1), net.IPv4(10, 0, 0, 2), 100)
+	recvPacket(t, dev2.tun.device, time.Second*10)
+
+	after := peer.Health()
+	if !after.Nonce.LastActivity.After(before.Nonce.LastActivity) ||
+		!after.SequentialSender.LastActivity.After(before.SequentialSender.LastActivity) {
+		t.Fatal("activity of peer routines not recorded")
+	}
+
+	// stopped routines are reported
+
+	peer.Stop()
+	stopped := dev1.Health().Peers[dev2.noise.publicKey]
+	if stopped.Nonce.IsRunning() || stopped.SequentialSender.IsRunning() || stopped.SequentialReceiver.IsRunning() {
+		t.Fatal("routines of stopped peer reported running")
+	}
+
+	dev1.Close()
+	health = dev1.Health()
+	if health.Encryption.IsRunning() || health.Decryption.IsRunning() || health.Handshake.IsRunning() {
+		t.Fatal("workers of closed device reported running")
+	}
+}
@@ -6,35 +6,63 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
 	"os"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 /* Helpers for writing unit tests
  */
 
 type DummyTUN struct {
-	name    string
-	mtu     int
-	packets chan []byte
-	events  chan TUNEvent
+	name     string
+	mtu      int32       // largest packet accepted by Write (0 = unlimited)
+	headroom int         // bytes filled with junk in front of read packets
+	packets  chan []byte // packets read by the device
+	written  chan []byte // packets written by the device
+	events   chan TUNEvent
+
+	batches chan [][]byte // packets read at once by ReadBatch
 }
 
 func (tun *DummyTUN) File() *os.File {
 	return nil
 }
 
-func (tun *DummyTUN) Name() string {
-	return tun.name
+func (tun *DummyTUN) Name() (string, error) {
+	return tun.name, nil
 }
 
 func (tun *DummyTUN) MTU() (int, error) {
-	return tun.mtu, nil
+	return int(atomic.LoadInt32(&tun.mtu)), nil
+}
+
+/* Changes the MTU and notifies the device
+ */
+func (tun *DummyTUN) SetMTU(mtu int) {
+	atomic.StoreInt32(&tun.mtu, int32(mtu))
+	select {
+	case tun.events <- TUNEventMTUUpdate:
+	default:
+	}
 }
 
 func (tun *DummyTUN) Write(d []byte, offset int) (int, error) {
-	tun.packets <- d[offset:]
+	if mtu := int(atomic.LoadInt32(&tun.mtu)); mtu > 0 && len(d)-offset > mtu {
+		return 0, fmt.Errorf("packet of %d bytes exceeds MTU of %d", len(d)-offset, mtu)
+	}
+	packet := make([]byte, len(d)-offset)
+	copy(packet, d[offset:])
+	tun.written <- packet
 	return len(d), nil
 }
 
@@ -46,16 +74,59 @@ func (tun *DummyTUN) Events() chan TUNEvent {
 	return tun.events
 }
 
+func (tun *DummyTUN) HeadroomBytes() int {
+	return tun.headroom
+}
+
 func (tun *DummyTUN) Read(d []byte, offset int) (int, error) {
-	t := <-tun.packets
-	copy(d[offset:], t)
-	return len(t), nil
+	if offset < tun.headroom {
+		return 0, errors.New("insufficient headroom")
+	}
+	return tun.fill(d, offset, <-tun.packets), nil
+}
+
+/* Reads either a single packet or a batch of packets,
+ * as delivered by a TUN device coalescing reads
+ */
+func (tun *DummyTUN) ReadBatch(bufs [][]byte, offset int) ([]int, error) {
+	if offset < tun.headroom {
+		return nil, errors.New("insufficient headroom")
+	}
+	var packets [][]byte
+	select {
+	case packet := <-tun.packets:
+		packets = [][]byte{packet}
+	case packets = <-tun.batches:
+	}
+	if len(packets) > len(bufs) {
+		return nil, fmt.Errorf("batch of %d packets exceeds %d buffers", len(packets), len(bufs))
+	}
+	sizes := make([]int, len(packets))
+	for i, packet := range packets {
+		sizes[i] = tun.fill(bufs[i], offset, packet)
+	}
+	return sizes, nil
+}
+
+func (tun *DummyTUN) fill(d []byte, offset int, packet []byte) int {
+	for i := offset - tun.headroom; i < offset; i++ {
+		d[i] = 0xff
+	}
+	copy(d[offset:], packet)
+	return len(packet)
 }
 
-func CreateDummyTUN(name string) (TUNDevice, error) {
+/* Creates a TUN device for testing,
+ * an MTU of 0 leaves the size of written packets unlimited
+ */
+func CreateDummyTUN(name string, mtu int) (TUNDevice, error) {
 	var dummy DummyTUN
-	dummy.mtu = 0
+	dummy.name = name
+	dummy.mtu = int32(mtu)
 	dummy.packets = make(chan []byte, 100)
+	dummy.written = make(chan []byte, 100)
+	dummy.events = make(chan TUNEvent, 10)
+	dummy.batches = make(chan [][]byte, 10)
 	return &dummy, nil
 }
 
@@ -71,14 +142,123 @@ func assertEqual(t *testing.T, a []byte, b []byte) {
 	}
 }
 
-func randDevice(t *testing.T) *Device {
+func randDevice(t testing.TB) *Device {
 	sk, err := newPrivateKey()
 	if err != nil {
 		t.Fatal(err)
 	}
-	tun, _ := CreateDummyTUN("dummy")
+	tun, _ := CreateDummyTUN("dummy", 0)
 	logger := NewLogger(LogLevelError, "")
 	device := NewDevice(tun, logger)
 	device.SetPrivateKey(sk)
 	return device
 }
+
+func randPeer(t testing.TB, device *Device) *Peer {
+	sk, err := newPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer, err := device.NewPeer(sk.publicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return peer
+}
+
+/* Applies a UAPI set operation to the device
+ */
+func uapiSet(t *testing.T, device *Device, config string) {
+	socket := bufio.NewReadWriter(
+		bufio.NewReader(strings.NewReader(config+"\n")),
+		bufio.NewWriter(ioutil.Discard),
+	)
+	if err := ipcSetOperation(device, socket); err != nil {
+		t.Fatal(err)
+	}
+}
+
+/* Returns a minimal IPv4 packet of the given total size
+ */
+func genIPv4Packet(src, dst net.IP, size int) []byte {
+	packet := make([]byte, size)
+	packet[0] = 0x45
+	binary.BigEndian.PutUint16(packet[IPv4offsetTotalLength:], uint16(size))
+	copy(packet[IPv4offsetSrc:], src.To4())
+	copy(packet[IPv4offsetDst:], dst.To4())
+	return packet
+}
+
+/* Returns distinct currently unused UDP ports
+ */
+func freePorts(t *testing.T, n int) []uint16 {
+	ports := make([]uint16, n)
+	for i := range ports {
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		ports[i] = uint16(conn.LocalAddr().(*net.UDPAddr).Port)
+	}
+	return ports
+}
+
+/* Creates two devices peered over the loopback interface,
+ * the devices own the tunnel addresses 10.0.0.1 and 10.0.0.2
+ */
+func genTestPair(t *testing.T) (*Device, *Device) {
+	var tuns [2]TUNDevice
+	for i := range tuns {
+		tuns[i], _ = CreateDummyTUN(fmt.Sprintf("tun%d", i), 0)
+	}
+	return genTestPairTUN(t, tuns)
+}
+
+/* Creates two devices peered over the loopback interface,
+ * using the provided TUN devices
+ */
+func genTestPairTUN(t *testing.T, tuns [2]TUNDevice) (*Device, *Device) {
+	var devices [2]*Device
+	var keys [2]NoisePrivateKey
+
+	ports := freePorts(t, len(devices))
+
+	for i := range devices {
+		var err error
+		keys[i], err = newPrivateKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		devices[i] = NewDevice(tuns[i], NewLogger(LogLevelDebug, fmt.Sprintf("dev%d ", i)))
+		devices[i].SetPrivateKey(keys[i])
+		devices[i].net.port = ports[i]
+		devices[i].Up()
+		if !devices[i].isUp.Get() {
+			t.Fatal("failed to bring up device")
+		}
+	}
+
+	for i, device := range devices {
+		other := devices[1-i]
+		pk := keys[1-i].publicKey()
+		uapiSet(t, device, fmt.Sprintf(
+			"public_key=%s\nendpoint=127.0.0.1:%d\nallowed_ip=10.0.0.%d/32",
+			pk.ToHex(), other.net.port, 2-i,
+		))
+	}
+
+	return devices[0], devices[1]
+}
+
+/* Waits for a packet written to the TUN device
+ */
+func recvPacket(t *testing.T, tun TUNDevice, timeout time.Duration) []byte {
+	select {
+	case packet := <-tun.(*DummyTUN).written:
+		return packet
+	case <-time.After(timeout):
+		t.Fatal("timed out waiting for packet")
+	}
+	return nil
+}
@@ -0,0 +1,30 @@
+/* SPDX-License-Identifier: GPL-2.0
+ *
+ * Copyright (C) 2017-2018 Jason A. Donenfeld <Jason@zx2c4.com>. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"golang.org/x/sys/unix"
+	"os"
+)
+
+/* Watches the path for the inotify events of the mask,
+ * the events are read through the runtime poller, such that closing the file unblocks reads
+ */
+func inotifyWatch(path string, mask uint32) (*os.File, error) {
+
+	fd, err := unix.InotifyInit1(unix.IN_NONBLOCK | unix.IN_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = unix.InotifyAddWatch(fd, path, mask)
+	if err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+
+	return os.NewFile(uintptr(fd), "inotify"), nil
+}
@@ -0,0 +1,158 @@
+/* SPDX-License-Identifier: GPL-2.0
+ *
+ * Copyright (C) 2017-2018 Jason A. Donenfeld <Jason@zx2c4.com>. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/scrypt"
+)
+
+/* Private keys encrypted at rest
+ *
+ * The key is sealed by secretbox (XSalsa20-Poly1305),
+ * keyed by scrypt from a passphrase. The file holds a single line:
+ *
+ *   base64(version || salt || nonce || sealed key)
+ */
+
+const (
+	keyFileVersion   = 1
+	keyFileSaltSize  = 32
+	keyFileNonceSize = 24
+	keyFileScryptN   = 1 << 15
+	keyFileScryptR   = 8
+	keyFileScryptP   = 1
+	keyFileSize      = 1 + keyFileSaltSize + keyFileNonceSize + NoisePrivateKeySize + secretbox.Overhead
+)
+
+var ErrWrongPassphrase = errors.New("Wrong passphrase for private key")
+
+func keyFileKey(passphrase []byte, salt []byte) (*[32]byte, error) {
+	derived, err := scrypt.Key(passphrase, salt, keyFileScryptN, keyFileScryptR, keyFileScryptP, 32)
+	if err != nil {
+		return nil, err
+	}
+	var key [32]byte
+	copy(key[:], derived)
+	setZero(derived)
+	return &key, nil
+}
+
+/* Seals the private key by the passphrase
+ */
+func sealPrivateKey(sk NoisePrivateKey, passphrase []byte) (string, error) {
+	var salt [keyFileSaltSize]byte
+	var nonce [keyFileNonceSize]byte
+	if _, err := rand.Read(salt[:]); err != nil {
+		return "", err
+	}
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return "", err
+	}
+
+	key, err := keyFileKey(passphrase, salt[:])
+	if err != nil {
+		return "", err
+	}
+	defer setZero(key[:])
+
+	envelope := make([]byte, 0, keyFileSize)
+	envelope = append(envelope, keyFileVersion)
+	envelope = append(envelope, salt[:]...)
+	envelope = append(envelope, nonce[:]...)
+	envelope = secretbox.Seal(envelope, sk[:], &nonce, key)
+	return base64.StdEncoding.EncodeToString(envelope), nil
+}
+
+/* Opens the private key sealed by the passphrase,
+ * returns ErrWrongPassphrase if authentication fails
+ */
+func openPrivateKey(sealed string, passphrase []byte) (sk NoisePrivateKey, err error) {
+	envelope, err := base64.StdEncoding.DecodeString(strings.TrimSpace(sealed))
+	if err != nil {
+		return sk, err
+	}
+	if len(envelope) != keyFileSize || envelope[0] != keyFileVersion {
+		return sk, errors.New("Invalid encrypted private key")
+	}
+
+	var nonce [keyFileNonceSize]byte
+	salt := envelope[1 : 1+keyFileSaltSize]
+	copy(nonce[:], envelope[1+keyFileSaltSize:])
+	box := envelope[1+keyFileSaltSize+keyFileNonceSize:]
+
+	key, err := keyFileKey(passphrase, salt)
+	if err != nil {
+		return sk, err
+	}
+	defer setZero(key[:])
+
+	plain, ok := secretbox.Open(nil, box, &nonce, key)
+	if !ok {
+		return sk, ErrWrongPassphrase
+	}
+	copy(sk[:], plain)
+	setZero(plain)
+	return sk, nil
+}
+
+/* Stores the private key of the device encrypted by the passphrase,
+ * replacing the file atomically
+ */
+func (device *Device) SaveEncryptedPrivateKey(path string, passphrase []byte) error {
+	device.noise.mutex.RLock()
+	sk := device.noise.privateKey
+	device.noise.mutex.RUnlock()
+
+	if sk.IsZero() {
+		return errors.New("Device has no private key")
+	}
+
+	sealed, err := sealPrivateKey(sk, passphrase)
+	setZero(sk[:])
+	if err != nil {
+		return err
+	}
+
+	file, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+
+	if _, err := file.WriteString(sealed + "\n"); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), path)
+}
+
+/* Sets the private key of the device from a file written by SaveEncryptedPrivateKey,
+ * returns ErrWrongPassphrase if the passphrase does not match
+ */
+func (device *Device) LoadEncryptedPrivateKey(path string, passphrase []byte) error {
+	sealed, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	sk, err := openPrivateKey(string(sealed), passphrase)
+	if err != nil {
+		return err
+	}
+	defer setZero(sk[:])
+	return device.SetPrivateKey(sk)
+}
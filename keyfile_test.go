@@ -0,0 +1,70 @@
+/* SPDX-License-Identifier: GPL-2.0
+ *
+ * Copyright (C) 2017-2018 Jason A. Donenfeld <Jason@zx2c4.com>. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestEncryptedPrivateKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wireguard")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	keyPath := path.Join(dir, "private.key")
+
+	device1 := randDevice(t)
+	defer device1.Close()
+	if err := device1.SaveEncryptedPrivateKey(keyPath, []byte("correct horse")); err != nil {
+		t.Fatal(err)
+	}
+
+	// the key is not stored in plaintext
+
+	stored, err := ioutil.ReadFile(keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(stored), device1.noise.privateKey.ToHex()) {
+		t.Fatal("private key stored in plaintext")
+	}
+	if info, _ := os.Stat(keyPath); info.Mode().Perm() != 0600 {
+		t.Fatal("key file readable by others:", info.Mode())
+	}
+
+	// the wrong passphrase is reported distinctly and leaves the key unchanged
+
+	device2 := randDevice(t)
+	defer device2.Close()
+	sk := device2.noise.privateKey
+	if err := device2.LoadEncryptedPrivateKey(keyPath, []byte("battery staple")); err != ErrWrongPassphrase {
+		t.Fatal("wrong passphrase not reported:", err)
+	}
+	if !device2.noise.privateKey.Equals(sk) {
+		t.Fatal("private key changed by wrong passphrase")
+	}
+
+	if err := device2.LoadEncryptedPrivateKey(keyPath, []byte("correct horse")); err != nil {
+		t.Fatal(err)
+	}
+	if !device2.noise.privateKey.Equals(device1.noise.privateKey) {
+		t.Fatal("private key not loaded")
+	}
+
+	// corrupted files are not mistaken for a wrong passphrase
+
+	if err := ioutil.WriteFile(keyPath, stored[:len(stored)/2], 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := device2.LoadEncryptedPrivateKey(keyPath, []byte("correct horse")); err == nil || err == ErrWrongPassphrase {
+		t.Fatal("truncated key file not rejected:", err)
+	}
+}
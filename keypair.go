@@ -24,6 +24,7 @@ type Keypair struct {
 	receive      cipher.AEAD
 	replayFilter ReplayFilter
 	isInitiator  bool
+	extended     bool // XChaCha20-Poly1305 with random nonces
 	created      time.Time
 	localIndex   uint32
 	remoteIndex  uint32
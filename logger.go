@@ -10,6 +10,8 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
+	"strings"
+	"time"
 )
 
 const (
@@ -24,8 +26,27 @@ type Logger struct {
 	Error *log.Logger
 }
 
+/* A single message, as passed to a LogHandler
+ */
+type LogRecord struct {
+	Time    time.Time
+	Level   int
+	Prefix  string // prepended to every message of the logger
+	Message string
+}
+
+/* Receives the messages of a logger,
+ * must be safe for concurrent use
+ */
+type LogHandler func(record LogRecord)
+
 func NewLogger(level int, prepend string) *Logger {
-	output := os.Stdout
+	return NewLoggerWriter(level, prepend, os.Stdout)
+}
+
+/* Creates a logger writing messages up to the level to output
+ */
+func NewLoggerWriter(level int, prepend string, output io.Writer) *Logger {
 	logger := new(Logger)
 
 	logErr, logInfo, logDebug := func() (io.Writer, io.Writer, io.Writer) {
@@ -53,3 +74,44 @@ func NewLogger(level int, prepend string) *Logger {
 	)
 	return logger
 }
+
+/* Creates a logger passing messages up to the level to the handler,
+ * allowing embedders to route them into their own logging system
+ */
+func NewLoggerHandler(level int, prepend string, handler LogHandler) *Logger {
+	logger := new(Logger)
+
+	writer := func(msgLevel int) io.Writer {
+		if msgLevel > level {
+			return ioutil.Discard
+		}
+		return &logHandlerWriter{
+			level:   msgLevel,
+			prepend: prepend,
+			handler: handler,
+		}
+	}
+
+	logger.Debug = log.New(writer(LogLevelDebug), "", 0)
+	logger.Info = log.New(writer(LogLevelInfo), "", 0)
+	logger.Error = log.New(writer(LogLevelError), "", 0)
+	return logger
+}
+
+/* The log package issues a single write for every message
+ */
+type logHandlerWriter struct {
+	level   int
+	prepend string
+	handler LogHandler
+}
+
+func (w *logHandlerWriter) Write(p []byte) (int, error) {
+	w.handler(LogRecord{
+		Time:    time.Now(),
+		Level:   w.level,
+		Prefix:  w.prepend,
+		Message: strings.TrimSuffix(string(p), "\n"),
+	})
+	return len(p), nil
+}
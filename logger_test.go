@@ -0,0 +1,128 @@
+/* SPDX-License-Identifier: GPL-2.0
+ *
+ * Copyright (C) 2017-2018 Jason A. Donenfeld <Jason@zx2c4.com>. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLoggerHandler(t *testing.T) {
+	var mutex sync.Mutex
+	var records []LogRecord
+
+	handler := func(record LogRecord) {
+		mutex.Lock()
+		records = append(records, record)
+		mutex.Unlock()
+	}
+
+	var loggers [2]*Logger
+	for i := range loggers {
+		loggers[i] = NewLoggerHandler(LogLevelDebug, fmt.Sprintf("dev%d ", i), handler)
+	}
+	dev1, dev2 := genChannelPairLogger(t, loggers)
+	defer dev1.Close()
+	defer dev2.Close()
+
+	dev1.tun.device.(*DummyTUN).packets <- genIPv4Packet(net.IPv4(10, 0, 0, 1), net.IPv4(10, 0, 0, 2), 100)
+	recvPacket(t, dev2.tun.device, time.Second*5)
+
+	// the handshake is reported by both devices
+
+	expected := map[string]string{
+		"dev0 ": "Sending handshake initiation",
+		"dev1 ": "Received handshake initiation",
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	for _, record := range records {
+		if strings.HasSuffix(record.Message, "\n") {
+			t.Fatal("message with trailing newline:", record.Message)
+		}
+		if msg, ok := expected[record.Prefix]; ok && record.Level == LogLevelDebug &&
+			strings.Contains(record.Message, msg) {
+			delete(expected, record.Prefix)
+		}
+	}
+	for prefix, msg := range expected {
+		t.Fatalf("no record %q from %q", msg, prefix)
+	}
+}
+
+func TestLoggerLevel(t *testing.T) {
+	var output bytes.Buffer
+	logger := NewLoggerWriter(LogLevelInfo, "wg0 ", &output)
+	logger.Debug.Println("debug message")
+	logger.Info.Println("info message")
+	logger.Error.Println("error message")
+
+	if strings.Contains(output.String(), "debug message") {
+		t.Fatal("debug message written at info level")
+	}
+	if !strings.Contains(output.String(), "INFO: wg0 ") ||
+		!strings.Contains(output.String(), "error message") {
+		t.Fatal("missing messages:", output.String())
+	}
+
+	var levels []int
+	logger = NewLoggerHandler(LogLevelError, "", func(record LogRecord) {
+		levels = append(levels, record.Level)
+	})
+	logger.Debug.Println("debug message")
+	logger.Info.Println("info message")
+	logger.Error.Println("error message")
+
+	if len(levels) != 1 || levels[0] != LogLevelError {
+		t.Fatal("unexpected records of levels", levels)
+	}
+}
+
+func TestLoggerInfoLevel(t *testing.T) {
+	var mutex sync.Mutex
+	var output bytes.Buffer
+
+	var loggers [2]*Logger
+	for i := range loggers {
+		loggers[i] = NewLoggerWriter(LogLevelInfo, fmt.Sprintf("dev%d ", i), writerFunc(func(p []byte) (int, error) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			return output.Write(p)
+		}))
+	}
+	dev1, dev2 := genChannelPairLogger(t, loggers)
+	defer dev1.Close()
+	defer dev2.Close()
+
+	dev1.tun.device.(*DummyTUN).packets <- genIPv4Packet(net.IPv4(10, 0, 0, 1), net.IPv4(10, 0, 0, 2), 100)
+	recvPacket(t, dev2.tun.device, time.Second*5)
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	log := output.String()
+	for _, msg := range []string{"Created new peer", "Handshake completed"} {
+		if !strings.Contains(log, msg) {
+			t.Fatalf("%q not logged at info level:\n%s", msg, log)
+		}
+	}
+	if strings.Contains(log, "DEBUG:") || strings.Contains(log, "Sending handshake initiation") {
+		t.Fatal("debug messages logged at info level:\n", log)
+	}
+}
+
+type writerFunc func(p []byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) {
+	return f(p)
+}
@@ -0,0 +1,142 @@
+/* SPDX-License-Identifier: GPL-2.0
+ *
+ * Copyright (C) 2017-2018 Jason A. Donenfeld <Jason@zx2c4.com>. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"strings"
+	"sync"
+)
+
+const (
+	DefaultLogRingSize = 0       // recent log lines retained (UAPI log=1), disabled unless configured
+	MaxLogRingSize     = 1 << 16 // limit on the lines retained
+)
+
+/* Recent log lines, the oldest overwritten once full
+ */
+type logRing struct {
+	mutex sync.Mutex
+	next  uint64   // lines written
+	lines []string // (next % len(lines) is the oldest once full)
+}
+
+func newLogRing(size int) *logRing {
+	return &logRing{
+		lines: make([]string, size),
+	}
+}
+
+func (ring *logRing) add(line string) {
+	ring.mutex.Lock()
+	ring.lines[ring.next%uint64(len(ring.lines))] = line
+	ring.next++
+	ring.mutex.Unlock()
+}
+
+/* Returns the retained lines, oldest first
+ */
+func (ring *logRing) Lines() []string {
+	ring.mutex.Lock()
+	defer ring.mutex.Unlock()
+
+	size := uint64(len(ring.lines))
+	start := uint64(0)
+	if ring.next > size {
+		start = ring.next - size
+	}
+	lines := make([]string, 0, ring.next-start)
+	for i := start; i < ring.next; i++ {
+		lines = append(lines, ring.lines[i%size])
+	}
+	return lines
+}
+
+/* Passes every message to the current ring of the device,
+ * the log package issues a single write for every message
+ *
+ * Messages spanning several lines are retained as separate lines,
+ * such that no retained line contains a newline (see ipcLogOperation)
+ */
+type logRingWriter struct {
+	device *Device
+}
+
+func (w logRingWriter) Write(p []byte) (int, error) {
+	if ring := w.device.logRing(); ring != nil {
+		for _, line := range strings.Split(strings.TrimSuffix(string(p), "\n"), "\n") {
+			ring.add(line)
+		}
+	}
+	return len(p), nil
+}
+
+/* Returns a copy of the logger also writing to the ring of the device,
+ * levels discarded by the logger are not retained (nor formatted)
+ */
+func (device *Device) ringLogger(logger *Logger) *Logger {
+	tee := func(l *log.Logger) *log.Logger {
+		if l.Writer() == ioutil.Discard {
+			return l
+		}
+		output := io.MultiWriter(logRingWriter{device}, l.Writer())
+		return log.New(output, l.Prefix(), l.Flags())
+	}
+	return &Logger{
+		Debug: tee(logger.Debug),
+		Info:  tee(logger.Info),
+		Error: tee(logger.Error),
+	}
+}
+
+func (device *Device) logRing() *logRing {
+	ring, _ := device.logs.ring.Load().(*logRing)
+	return ring
+}
+
+/* Sets the number of recent log lines retained (0 disables the ring),
+ * the most recent lines are carried over
+ */
+func (device *Device) SetLogRingSize(size int) error {
+	if size < 0 || size > MaxLogRingSize {
+		return errors.New("Invalid log ring size")
+	}
+
+	var ring *logRing
+	if size > 0 {
+		ring = newLogRing(size)
+		if old := device.logRing(); old != nil {
+			lines := old.Lines()
+			if len(lines) > size {
+				lines = lines[len(lines)-size:]
+			}
+			for _, line := range lines {
+				ring.add(line)
+			}
+		}
+	}
+	device.logs.ring.Store(ring)
+	return nil
+}
+
+func (device *Device) LogRingSize() int {
+	if ring := device.logRing(); ring != nil {
+		return len(ring.lines)
+	}
+	return 0
+}
+
+/* Returns the recent log lines of the device, oldest first
+ */
+func (device *Device) RecentLogs() []string {
+	if ring := device.logRing(); ring != nil {
+		return ring.Lines()
+	}
+	return nil
+}
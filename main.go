@@ -11,6 +11,7 @@ import (
 	"os/signal"
 	"runtime"
 	"strconv"
+	"syscall"
 )
 
 const (
@@ -22,6 +23,13 @@ const (
 	ENV_WG_TUN_FD             = "WG_TUN_FD"
 	ENV_WG_UAPI_FD            = "WG_UAPI_FD"
 	ENV_WG_PROCESS_FOREGROUND = "WG_PROCESS_FOREGROUND"
+	ENV_WG_CONFIG_FILE        = "WG_CONFIG_FILE"
+	ENV_WG_UAPI_UID           = "WG_UAPI_UID"
+	ENV_WG_UAPI_GID           = "WG_UAPI_GID"
+	ENV_WG_UAPI_DIR           = "WG_UAPI_DIR"
+	ENV_WG_UAPI_ABSTRACT      = "WG_UAPI_ABSTRACT"
+	ENV_WG_METRICS_ADDR       = "WG_METRICS_ADDR"
+	ENV_WG_EXTENDED_NONCE     = "WG_EXTENDED_NONCE"
 )
 
 func printUsage() {
@@ -155,10 +163,33 @@ func main() {
 
 	// open UAPI file (or use supplied fd)
 
+	if dir := os.Getenv(ENV_WG_UAPI_DIR); dir != "" {
+		SetSocketDirectory(dir)
+	}
+
 	fileUAPI, err := func() (*os.File, error) {
 		uapiFdStr := os.Getenv(ENV_WG_UAPI_FD)
 		if uapiFdStr == "" {
-			return UAPIOpen(interfaceName)
+
+			// owner of the socket (default: unchanged)
+
+			for _, owner := range []struct {
+				env string
+				id  *int
+			}{
+				{ENV_WG_UAPI_UID, &UAPISocketUID},
+				{ENV_WG_UAPI_GID, &UAPISocketGID},
+			} {
+				if str := os.Getenv(owner.env); str != "" {
+					id, err := strconv.ParseUint(str, 10, 31)
+					if err != nil {
+						return nil, err
+					}
+					*owner.id = int(id)
+				}
+			}
+
+			return UAPIOpen(interfaceName, os.Getenv(ENV_WG_UAPI_ABSTRACT) == "1")
 		}
 
 		// use supplied fd
@@ -216,14 +247,20 @@ func main() {
 
 	// create wireguard device
 
-	device := NewDevice(tun, logger)
+	var device *Device
+	if os.Getenv(ENV_WG_EXTENDED_NONCE) == "1" {
+		logger.Info.Println("Using extended nonces (non-standard, peers must do likewise)")
+		device = NewDeviceExtendedNonce(tun, logger)
+	} else {
+		device = NewDevice(tun, logger)
+	}
 
 	logger.Info.Println("Device started")
 
 	// start uapi listener
 
 	errs := make(chan error)
-	term := make(chan os.Signal)
+	term := make(chan os.Signal, 1)
 
 	uapi, err := UAPIListen(interfaceName, fileUAPI)
 	if err != nil {
@@ -244,6 +281,36 @@ func main() {
 
 	logger.Info.Println("UAPI listener started")
 
+	// load configuration file (reloaded on SIGHUP)
+
+	if configFile := os.Getenv(ENV_WG_CONFIG_FILE); configFile != "" {
+		if err := device.LoadConfigFile(configFile); err != nil {
+			logger.Error.Println("Failed to load configuration:", err)
+		}
+
+		reload := make(chan os.Signal, 1)
+		signal.Notify(reload, syscall.SIGHUP)
+		go func() {
+			for range reload {
+				if err := device.LoadConfigFile(configFile); err != nil {
+					logger.Error.Println("Failed to reload configuration:", err)
+				}
+			}
+		}()
+	}
+
+	// start metrics server
+
+	if addr := os.Getenv(ENV_WG_METRICS_ADDR); addr != "" {
+		metrics, err := NewMetricsServer(device, addr)
+		if err != nil {
+			logger.Error.Println("Failed to start metrics server:", err)
+		} else {
+			defer metrics.Close()
+			logger.Info.Println("Metrics server listening on", metrics.Addr())
+		}
+	}
+
 	// wait for program to terminate
 
 	signal.Notify(term, os.Kill)
@@ -258,7 +325,7 @@ func main() {
 	// clean up
 
 	uapi.Close()
-	device.Close()
+	device.Shutdown(DeviceShutdownTimeout)
 
 	logger.Info.Println("Shutting down")
 }
@@ -0,0 +1,291 @@
+/* SPDX-License-Identifier: GPL-2.0
+ *
+ * Copyright (C) 2017-2018 Jason A. Donenfeld <Jason@zx2c4.com>. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+/* Exports device and peer statistics in the Prometheus text format
+ *
+ * Values are read from the counters maintained by the device,
+ * hence scraping adds no synchronization to the packet path.
+ */
+
+type metricKind string
+
+const (
+	metricCounter metricKind = "counter"
+	metricGauge   metricKind = "gauge"
+)
+
+type deviceMetric struct {
+	name  string
+	help  string
+	kind  metricKind
+	value func(device *Device) float64
+}
+
+type peerMetric struct {
+	name  string
+	help  string
+	kind  metricKind
+	value func(peer *Peer) (float64, bool) // false if not available
+}
+
+var deviceMetrics = []deviceMetric{
+	{
+		"wireguard_handshake_failures_total",
+		"Handshake messages failing validation",
+		metricCounter,
+		func(device *Device) float64 {
+			return float64(atomic.LoadUint64(&device.stats.handshakeFailures))
+		},
+	},
+	{
+		"wireguard_decrypt_failures_total",
+		"Transport messages failing authentication",
+		metricCounter,
+		func(device *Device) float64 {
+			return float64(atomic.LoadUint64(&device.stats.decryptFailures))
+		},
+	},
+	{
+		"wireguard_invalid_mac_total",
+		"Handshake messages with an invalid mac1",
+		metricCounter,
+		func(device *Device) float64 {
+			return float64(atomic.LoadUint64(&device.stats.invalidMAC))
+		},
+	},
+	{
+		"wireguard_handshake_replays_total",
+		"Handshake initiations rejected as replays",
+		metricCounter,
+		func(device *Device) float64 {
+			return float64(atomic.LoadUint64(&device.stats.replayedInitiations))
+		},
+	},
+	{
+		"wireguard_src_invalidations_total",
+		"Cached source addresses found invalid on send",
+		metricCounter,
+		func(device *Device) float64 {
+			return float64(atomic.LoadUint64(&device.stats.srcInvalidations))
+		},
+	},
+	{
+		"wireguard_queue_encryption_length",
+		"Packets awaiting encryption",
+		metricGauge,
+		func(device *Device) float64 {
+			return float64(len(device.queue.encryption))
+		},
+	},
+	{
+		"wireguard_queue_decryption_length",
+		"Packets awaiting decryption",
+		metricGauge,
+		func(device *Device) float64 {
+			return float64(len(device.queue.decryption))
+		},
+	},
+	{
+		"wireguard_queue_handshake_length",
+		"Handshake messages awaiting processing",
+		metricGauge,
+		func(device *Device) float64 {
+			return float64(len(device.queue.handshake))
+		},
+	},
+}
+
+var peerMetrics = []peerMetric{
+	{
+		"wireguard_peer_tx_bytes_total",
+		"Bytes sent to the peer",
+		metricCounter,
+		func(peer *Peer) (float64, bool) {
+			return float64(atomic.LoadUint64(&peer.stats.txBytes)), true
+		},
+	},
+	{
+		"wireguard_peer_rx_bytes_total",
+		"Bytes received from the peer",
+		metricCounter,
+		func(peer *Peer) (float64, bool) {
+			return float64(atomic.LoadUint64(&peer.stats.rxBytes)), true
+		},
+	},
+	{
+		"wireguard_peer_handshake_failures_total",
+		"Handshake messages from the peer failing validation",
+		metricCounter,
+		func(peer *Peer) (float64, bool) {
+			return float64(atomic.LoadUint64(&peer.stats.handshakeFailures)), true
+		},
+	},
+	{
+		"wireguard_peer_decrypt_failures_total",
+		"Transport messages from the peer failing authentication",
+		metricCounter,
+		func(peer *Peer) (float64, bool) {
+			return float64(atomic.LoadUint64(&peer.stats.decryptFailures)), true
+		},
+	},
+	{
+		"wireguard_peer_invalid_mac_total",
+		"Handshake messages to the peer with an invalid mac1",
+		metricCounter,
+		func(peer *Peer) (float64, bool) {
+			return float64(atomic.LoadUint64(&peer.stats.invalidMAC)), true
+		},
+	},
+	{
+		"wireguard_peer_handshake_replays_total",
+		"Handshake initiations from the peer rejected as replays",
+		metricCounter,
+		func(peer *Peer) (float64, bool) {
+			return float64(atomic.LoadUint64(&peer.stats.replayedInitiations)), true
+		},
+	},
+	{
+		"wireguard_peer_rekeys_total",
+		"Completed handshakes with the peer",
+		metricCounter,
+		func(peer *Peer) (float64, bool) {
+			return float64(atomic.LoadUint64(&peer.stats.rekeys)), true
+		},
+	},
+	{
+		"wireguard_peer_nonce_queue_drops_total",
+		"Packets to the peer dropped awaiting a nonce (or a handshake)",
+		metricCounter,
+		func(peer *Peer) (float64, bool) {
+			return float64(atomic.LoadUint64(&peer.stats.nonceDrops)), true
+		},
+	},
+	{
+		"wireguard_peer_outbound_queue_drops_total",
+		"Packets to the peer dropped awaiting encryption or transmission",
+		metricCounter,
+		func(peer *Peer) (float64, bool) {
+			return float64(atomic.LoadUint64(&peer.stats.outboundDrops)), true
+		},
+	},
+	{
+		"wireguard_peer_handshake_age_seconds",
+		"Time since the last completed handshake with the peer",
+		metricGauge,
+		func(peer *Peer) (float64, bool) {
+			nano := atomic.LoadInt64(&peer.stats.lastHandshakeNano)
+			if nano == 0 {
+				return 0, false
+			}
+			return time.Since(time.Unix(0, nano)).Seconds(), true
+		},
+	},
+	{
+		"wireguard_peer_queue_nonce_length",
+		"Packets awaiting a nonce (or a handshake)",
+		metricGauge,
+		func(peer *Peer) (float64, bool) {
+			return float64(len(peer.queue.nonce)), true
+		},
+	},
+	{
+		"wireguard_peer_queue_outbound_length",
+		"Packets awaiting transmission to the peer",
+		metricGauge,
+		func(peer *Peer) (float64, bool) {
+			return float64(len(peer.queue.outbound)), true
+		},
+	},
+}
+
+type MetricsServer struct {
+	device   *Device
+	listener net.Listener
+	server   http.Server
+}
+
+/* Serves the metrics at http://addr/metrics
+ */
+func NewMetricsServer(device *Device, addr string) (*MetricsServer, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	metrics := &MetricsServer{
+		device:   device,
+		listener: listener,
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics)
+	metrics.server.Handler = mux
+
+	go func() {
+		err := metrics.server.Serve(listener)
+		if err != http.ErrServerClosed {
+			device.log.Error.Println("Metrics server failed:", err)
+		}
+	}()
+
+	return metrics, nil
+}
+
+func (metrics *MetricsServer) Addr() net.Addr {
+	return metrics.listener.Addr()
+}
+
+func (metrics *MetricsServer) Close() error {
+	return metrics.server.Close()
+}
+
+func (metrics *MetricsServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	device := metrics.device
+
+	// snapshot of the peer set
+
+	device.peers.mutex.RLock()
+	peers := make([]*Peer, 0, len(device.peers.keyMap))
+	for _, peer := range device.peers.keyMap {
+		peers = append(peers, peer)
+	}
+	device.peers.mutex.RUnlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	writer := bufio.NewWriter(w)
+	defer writer.Flush()
+
+	header := func(name, help string, kind metricKind) {
+		fmt.Fprintf(writer, "# HELP %s %s\n", name, help)
+		fmt.Fprintf(writer, "# TYPE %s %s\n", name, kind)
+	}
+
+	for _, metric := range deviceMetrics {
+		header(metric.name, metric.help, metric.kind)
+		fmt.Fprintf(writer, "%s %v\n", metric.name, metric.value(device))
+	}
+
+	for _, metric := range peerMetrics {
+		header(metric.name, metric.help, metric.kind)
+		for _, peer := range peers {
+			if value, ok := metric.value(peer); ok {
+				key := base64.StdEncoding.EncodeToString(peer.handshake.remoteStatic[:])
+				fmt.Fprintf(writer, "%s{public_key=\"%s\"} %v\n", metric.name, key, value)
+			}
+		}
+	}
+}
@@ -0,0 +1,61 @@
+/* SPDX-License-Identifier: GPL-2.0
+ *
+ * Copyright (C) 2017-2018 Jason A. Donenfeld <Jason@zx2c4.com>. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestMetricsServer(t *testing.T) {
+	device := randDevice(t)
+	defer device.Close()
+
+	peer := randPeer(t, device)
+	peer.timersHandshakeComplete()
+
+	metrics, err := NewMetricsServer(device, "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer metrics.Close()
+
+	resp, err := http.Get("http://" + metrics.Addr().String() + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal("unexpected status:", resp.Status)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	text := string(body)
+
+	for _, metric := range deviceMetrics {
+		if !strings.Contains(text, "# TYPE "+metric.name+" "+string(metric.kind)+"\n") {
+			t.Error("missing metric", metric.name)
+		}
+	}
+
+	key := base64.StdEncoding.EncodeToString(peer.handshake.remoteStatic[:])
+	for _, metric := range peerMetrics {
+		if !strings.Contains(text, metric.name+"{public_key=\""+key+"\"} ") {
+			t.Error("missing peer metric", metric.name)
+		}
+	}
+
+	if !strings.Contains(text, "wireguard_peer_rekeys_total{public_key=\""+key+"\"} 1\n") {
+		t.Error("rekey not counted:", text)
+	}
+}
@@ -0,0 +1,85 @@
+/* SPDX-License-Identifier: GPL-2.0
+ *
+ * Copyright (C) 2017-2018 Jason A. Donenfeld <Jason@zx2c4.com>. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	NetworkChangeDelay = time.Millisecond * 250 // quiet period before rebinding after a network change
+)
+
+/* Rebinds the sockets when local addresses or links change,
+ * since cached source addresses may no longer be usable
+ *
+ * Changes are reported by binds implementing NetworkChangeNotifier
+ */
+type NetworkChangeMonitor struct {
+	device   *Device
+	changed  chan struct{}  // signaled when the network may have changed
+	stop     chan struct{}  // closed to stop the monitor
+	stopping sync.WaitGroup // routines pending stop
+	stopOnce sync.Once
+}
+
+func newNetworkChangeMonitor(device *Device) *NetworkChangeMonitor {
+	monitor := &NetworkChangeMonitor{
+		device:  device,
+		changed: make(chan struct{}, 1),
+		stop:    make(chan struct{}),
+	}
+	monitor.stopping.Add(1)
+	go monitor.routineRebind()
+	return monitor
+}
+
+func (monitor *NetworkChangeMonitor) notify() {
+	select {
+	case monitor.changed <- struct{}{}:
+	default:
+	}
+}
+
+/* Rebinds once no further changes
+ * have been observed for NetworkChangeDelay
+ */
+func (monitor *NetworkChangeMonitor) routineRebind() {
+	device := monitor.device
+
+	defer monitor.stopping.Done()
+
+	timer := time.NewTimer(time.Hour)
+	timer.Stop()
+
+	for {
+		select {
+		case <-monitor.stop:
+			timer.Stop()
+			return
+
+		case <-monitor.changed:
+			timer.Reset(NetworkChangeDelay)
+
+		case <-timer.C:
+			if !device.isUp.Get() {
+				continue
+			}
+			device.log.Info.Println("Network changed, rebinding")
+			if err := device.BindUpdate(); err != nil {
+				device.log.Error.Println("Failed to rebind after network change:", err)
+			}
+		}
+	}
+}
+
+func (monitor *NetworkChangeMonitor) Stop() {
+	monitor.stopOnce.Do(func() {
+		close(monitor.stop)
+		monitor.stopping.Wait()
+	})
+}
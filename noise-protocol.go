@@ -12,6 +12,7 @@ import (
 	"golang.org/x/crypto/chacha20poly1305"
 	"golang.org/x/crypto/poly1305"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -35,6 +36,8 @@ const (
 	MessageResponseType    = 2
 	MessageCookieReplyType = 3
 	MessageTransportType   = 4
+
+	MessageTransportExtendedType = 5 // transport with extended nonce (non-standard)
 )
 
 const (
@@ -53,6 +56,16 @@ const (
 	MessageTransportOffsetContent  = 16
 )
 
+/* Transport messages with extended nonce carry a random XChaCha20-Poly1305 nonce
+ * between the counter (which only protects against replay) and the content
+ */
+const (
+	MessageTransportExtendedHeaderSize    = MessageTransportHeaderSize + chacha20poly1305.NonceSizeX
+	MessageTransportExtendedSize          = MessageTransportExtendedHeaderSize + poly1305.TagSize
+	MessageTransportExtendedOffsetNonce   = MessageTransportOffsetContent
+	MessageTransportExtendedOffsetContent = MessageTransportExtendedHeaderSize
+)
+
 /* Type is an 8-bit field, followed by 3 nul bytes,
  * by marshalling the messages in little-endian byteorder
  * we can treat these as a 32-bit unsigned int (for now)
@@ -99,6 +112,8 @@ type Handshake struct {
 	hash                      [blake2s.Size]byte       // hash value
 	chainKey                  [blake2s.Size]byte       // chain key
 	presharedKey              NoiseSymmetricKey        // psk
+	presharedKeyNext          NoiseSymmetricKey        // psk for the next handshake
+	presharedKeyStaged        bool                     // psk rotation pending
 	localEphemeral            NoisePrivateKey          // ephemeral secret key
 	localIndex                uint32                   // used to clear hash-table
 	remoteIndex               uint32                   // index for sending
@@ -107,6 +122,7 @@ type Handshake struct {
 	precomputedStaticStatic   [NoisePublicKeySize]byte // precomputed shared secret
 	lastTimestamp             tai64n.Timestamp
 	lastInitiationConsumption time.Time
+	lastSentTimestamp         tai64n.Timestamp // of the last initiation created
 }
 
 var (
@@ -136,6 +152,39 @@ func (h *Handshake) Clear() {
 	h.state = HandshakeZeroed
 }
 
+/* Stages a new preshared key, which takes effect at the next handshake,
+ * the current keypair (derived using the previous key) remains in use until then
+ */
+func (h *Handshake) SetPresharedKey(key NoiseSymmetricKey) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.presharedKeyNext = key
+	h.presharedKeyStaged = true
+}
+
+/* Returns the configured preshared key,
+ * including a rotation which has yet to take effect
+ */
+func (h *Handshake) PresharedKey() NoiseSymmetricKey {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	if h.presharedKeyStaged {
+		return h.presharedKeyNext
+	}
+	return h.presharedKey
+}
+
+/* Adopts a staged preshared key when a new handshake begins
+ * (the caller must hold the handshake lock)
+ */
+func (h *Handshake) rotatePresharedKey() {
+	if h.presharedKeyStaged {
+		h.presharedKey = h.presharedKeyNext
+		setZero(h.presharedKeyNext[:])
+		h.presharedKeyStaged = false
+	}
+}
+
 func (h *Handshake) mixHash(data []byte) {
 	mixHash(&h.hash, &h.hash, data)
 }
@@ -164,6 +213,8 @@ func (device *Device) CreateMessageInitiation(peer *Peer) (*MessageInitiation, e
 		return nil, errors.New("Static shared secret is zero")
 	}
 
+	handshake.rotatePresharedKey()
+
 	// create ephemeral key
 
 	var err error
@@ -210,9 +261,13 @@ func (device *Device) CreateMessageInitiation(peer *Peer) (*MessageInitiation, e
 	}()
 	handshake.mixHash(msg.Static[:])
 
-	// encrypt timestamp
+	// encrypt timestamp (increasing, even if the clock is set back)
 
 	timestamp := tai64n.Now()
+	if !timestamp.After(handshake.lastSentTimestamp) {
+		timestamp = handshake.lastSentTimestamp.Next()
+	}
+	handshake.lastSentTimestamp = timestamp
 	func() {
 		var key [chacha20poly1305.KeySize]byte
 		KDF2(
@@ -297,11 +352,15 @@ func (device *Device) ConsumeMessageInitiation(msg *MessageInitiation) *Peer {
 
 	// protect against replay & flood
 
-	var ok bool
-	ok = timestamp.After(handshake.lastTimestamp)
-	ok = ok && time.Now().Sub(handshake.lastInitiationConsumption) > HandshakeInitationRate
+	replay := !timestamp.After(handshake.lastTimestamp)
+	flood := time.Now().Sub(handshake.lastInitiationConsumption) <= HandshakeInitationRate
 	handshake.mutex.RUnlock()
-	if !ok {
+	if replay {
+		atomic.AddUint64(&device.stats.replayedInitiations, 1)
+		atomic.AddUint64(&peer.stats.replayedInitiations, 1)
+		return nil
+	}
+	if flood {
 		return nil
 	}
 
@@ -316,6 +375,7 @@ func (device *Device) ConsumeMessageInitiation(msg *MessageInitiation) *Peer {
 	handshake.lastTimestamp = timestamp
 	handshake.lastInitiationConsumption = time.Now()
 	handshake.state = HandshakeInitiationConsumed
+	handshake.rotatePresharedKey()
 
 	handshake.mutex.Unlock()
 
@@ -529,15 +589,25 @@ func (peer *Peer) NewKeypair() *Keypair {
 	// create AEAD instances
 
 	keyPair := new(Keypair)
-	keyPair.send, _ = chacha20poly1305.New(sendKey[:])
-	keyPair.receive, _ = chacha20poly1305.New(recvKey[:])
+	if device.transport.extended {
+		keyPair.send, _ = chacha20poly1305.NewX(sendKey[:])
+		keyPair.receive, _ = chacha20poly1305.NewX(recvKey[:])
+		keyPair.extended = true
+	} else {
+		keyPair.send, _ = chacha20poly1305.New(sendKey[:])
+		keyPair.receive, _ = chacha20poly1305.New(recvKey[:])
+	}
 
 	setZero(sendKey[:])
 	setZero(recvKey[:])
 
 	keyPair.created = time.Now()
 	keyPair.sendNonce = 0
-	keyPair.replayFilter.Init()
+	if keyPair.extended {
+		keyPair.replayFilter.InitWrappingSize(device.ReplayWindowSize())
+	} else {
+		keyPair.replayFilter.InitSize(device.ReplayWindowSize())
+	}
 	keyPair.isInitiator = isInitiator
 	keyPair.localIndex = peer.handshake.localIndex
 	keyPair.remoteIndex = peer.handshake.remoteIndex
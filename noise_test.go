@@ -6,9 +6,12 @@
 package main
 
 import (
+	"./tai64n"
 	"bytes"
 	"encoding/binary"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestCurveWrappers(t *testing.T) {
@@ -139,3 +142,58 @@ func TestNoiseHandshake(t *testing.T) {
 		assertEqual(t, out, testMsg)
 	}()
 }
+
+func TestNoiseInitiationReplay(t *testing.T) {
+	dev1 := randDevice(t)
+	dev2 := randDevice(t)
+
+	defer dev1.Close()
+	defer dev2.Close()
+
+	peer1, _ := dev2.NewPeer(dev1.noise.privateKey.publicKey())
+	peer2, _ := dev1.NewPeer(dev2.noise.privateKey.publicKey())
+
+	consume := func(msg *MessageInitiation) bool {
+		peer1.handshake.mutex.Lock()
+		peer1.handshake.lastInitiationConsumption = time.Time{} // not a flood
+		peer1.handshake.mutex.Unlock()
+		return dev2.ConsumeMessageInitiation(msg) != nil
+	}
+
+	msg, err := dev1.CreateMessageInitiation(peer2)
+	assertNil(t, err)
+	if !consume(msg) {
+		t.Fatal("initiation rejected")
+	}
+
+	// a captured initiation is rejected when replayed
+
+	if consume(msg) {
+		t.Fatal("replayed initiation accepted")
+	}
+	if replays := atomic.LoadUint64(&dev2.stats.replayedInitiations); replays != 1 {
+		t.Fatal("unexpected replays of device:", replays)
+	}
+	if replays := atomic.LoadUint64(&peer1.stats.replayedInitiations); replays != 1 {
+		t.Fatal("unexpected replays of peer:", replays)
+	}
+
+	// initiations increase in time, even if the clock is set back
+
+	peer2.handshake.mutex.Lock()
+	future := tai64n.Now()
+	binary.BigEndian.PutUint64(future[:], binary.BigEndian.Uint64(future[:])+3600)
+	peer2.handshake.lastSentTimestamp = future
+	peer2.handshake.mutex.Unlock()
+
+	for i := 0; i < 2; i++ {
+		msg, err := dev1.CreateMessageInitiation(peer2)
+		assertNil(t, err)
+		if !consume(msg) {
+			t.Fatal("initiation rejected after clock was set back")
+		}
+	}
+	if replays := atomic.LoadUint64(&dev2.stats.replayedInitiations); replays != 1 {
+		t.Fatal("unexpected replays of device:", replays)
+	}
+}
@@ -0,0 +1,71 @@
+/* SPDX-License-Identifier: GPL-2.0
+ *
+ * Copyright (C) 2017-2018 Jason A. Donenfeld <Jason@zx2c4.com>. All Rights Reserved.
+ */
+
+package main
+
+const (
+	QueueHandshakeCompleteSize = 128 // pending handshake completion notifications
+)
+
+type HandshakeCompleteHandler func(peer *Peer)
+
+/* Registers a handler called whenever a handshake with a peer completes,
+ * i.e. a new key pair is confirmed and the peer has live keys
+ *
+ * The handler is called from a separate routine (in order),
+ * notifications are dropped while the handler is unable to keep up.
+ * A nil handler disables the notifications.
+ */
+func (device *Device) SetHandshakeCompleteHandler(handler func(peer *Peer)) {
+	device.handshakes.handler.Store(HandshakeCompleteHandler(handler))
+}
+
+func (device *Device) handshakeCompleteHandler() HandshakeCompleteHandler {
+	handler, _ := device.handshakes.handler.Load().(HandshakeCompleteHandler)
+	return handler
+}
+
+func (peer *Peer) notifyHandshakeComplete() {
+	device := peer.device
+	device.publishEvent(Event{Kind: EventHandshakeComplete, PublicKey: peer.handshake.remoteStatic})
+
+	if device.handshakeCompleteHandler() == nil {
+		return
+	}
+
+	select {
+	case device.handshakes.queue <- peer:
+	default:
+		device.log.Debug.Println(peer, ": Dropping handshake completion notification")
+	}
+}
+
+/* Delivers handshake completion notifications to the handler
+ *
+ * Obs. Single instance per device
+ */
+func (device *Device) RoutineHandshakeComplete() {
+
+	logDebug := device.log.Debug
+
+	defer func() {
+		logDebug.Println("Routine: handshake completion notifier - stopped")
+		device.state.stopping.Done()
+	}()
+
+	logDebug.Println("Routine: handshake completion notifier - started")
+
+	for {
+		select {
+		case <-device.signals.stop:
+			return
+
+		case peer := <-device.handshakes.queue:
+			if handler := device.handshakeCompleteHandler(); handler != nil {
+				handler(peer)
+			}
+		}
+	}
+}
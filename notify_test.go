@@ -0,0 +1,61 @@
+/* SPDX-License-Identifier: GPL-2.0
+ *
+ * Copyright (C) 2017-2018 Jason A. Donenfeld <Jason@zx2c4.com>. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestHandshakeCompleteHandler(t *testing.T) {
+	dev1, dev2 := genChannelPair(t)
+	defer dev1.Close()
+	defer dev2.Close()
+
+	var completed [2]chan *Peer
+	for i, device := range []*Device{dev1, dev2} {
+		completed[i] = make(chan *Peer, 10)
+		ch := completed[i]
+		device.SetHandshakeCompleteHandler(func(peer *Peer) {
+			ch <- peer
+		})
+	}
+	peers := [2]*Peer{
+		dev1.LookupPeer(dev2.noise.publicKey),
+		dev2.LookupPeer(dev1.noise.publicKey),
+	}
+
+	expectOnce := func(handshake int) {
+		for i := range completed {
+			select {
+			case peer := <-completed[i]:
+				if peer != peers[i] {
+					t.Fatal("handler of device", i, "called with", peer)
+				}
+			case <-time.After(time.Second * 5):
+				t.Fatal("handler of device", i, "not called for handshake", handshake)
+			}
+		}
+		time.Sleep(time.Millisecond * 200)
+		for i := range completed {
+			if len(completed[i]) != 0 {
+				t.Fatal("handler of device", i, "called repeatedly for handshake", handshake)
+			}
+		}
+	}
+
+	// initiator completes on the response, the responder on the first data message
+
+	dev1.tun.device.(*DummyTUN).packets <- genIPv4Packet(net.IPv4(10, 0, 0, 1), net.IPv4(10, 0, 0, 2), 100)
+	recvPacket(t, dev2.tun.device, time.Second*5)
+	expectOnce(1)
+
+	// every subsequent handshake is reported
+
+	peers[0].SendHandshakeInitiation(false, true)
+	expectOnce(2)
+}
@@ -9,7 +9,10 @@ import (
 	"encoding/base64"
 	"errors"
 	"fmt"
+	"net"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
@@ -24,15 +27,41 @@ type Peer struct {
 	handshake                   Handshake
 	device                      *Device
 	endpoint                    Endpoint
+	endpointPinned              bool     // ignore packets from other endpoints
+	endpointBackup              Endpoint // tried once handshakes to the endpoint time out (nil = none)
+	srcAddress                  net.IP   // local source of datagrams sent to the peer (nil = learned)
+	fwmark                      uint32   // mark of datagrams sent to the peer (0 = that of the device)
 	persistentKeepaliveInterval uint16
-	_                           uint32 // padding for alignment
+	unreachable                 AtomicBool // handshakes gave up, until traffic resumes (also pads for alignment)
 
 	stats struct {
 		txBytes           uint64 // bytes send to peer (endpoint)
 		rxBytes           uint64 // bytes received from peer
 		lastHandshakeNano int64  // nano seconds since epoch
+		handshakeFailures uint64 // see Device.stats
+		decryptFailures   uint64
+		invalidMAC        uint64
+		rekeys            uint64 // completed handshakes
+		nonceDrops        uint64 // packets dropped awaiting a nonce (or handshake)
+		outboundDrops     uint64 // packets dropped awaiting encryption or transmission
+		rxInterface       int64  // index of the interface of the last authenticated packet (0 = unknown)
+
+		replayedInitiations uint64 // see Device.stats
 	}
 
+	txRate TokenBucket // bounds bytes per second send to peer
+
+	dns struct {
+		host     string   // endpoint string (host:port), if configured by hostname
+		resolved Endpoint // most recent resolution of the host
+	}
+
+	conn *PeerConn // connection attached to the tunnel (nil = TUN device)
+
+	lastReceived time.Time // last authenticated packet from the endpoint (zero = none)
+
+	pathMTU atomic.Value // pathMTUEstimate of the endpoint (reset when the endpoint changes)
+
 	timers struct {
 		retransmitHandshake     *Timer
 		sendKeepalive           *Timer
@@ -43,6 +72,7 @@ type Peer struct {
 		needAnotherKeepalive    bool
 		sentLastMinuteHandshake bool
 		lastSentHandshake       time.Time
+		handshakeStarted        time.Time // first attempt of the pending handshake
 	}
 
 	signals struct {
@@ -54,7 +84,8 @@ type Peer struct {
 		nonce                           chan *QueueOutboundElement // nonce / pre-handshake queue
 		outbound                        chan *QueueOutboundElement // sequential ordering of work
 		inbound                         chan *QueueInboundElement  // sequential ordering of work
-		packetInNonceQueueIsAwaitingKey bool
+		packetInNonceQueueIsAwaitingKey AtomicBool
+		flushes                         uint32 // incremented by FlushNonceQueue (atomic)
 	}
 
 	routines struct {
@@ -64,6 +95,12 @@ type Peer struct {
 		stop     chan struct{}  // size 0, stop all go-routines in peer
 	}
 
+	health struct {
+		nonce    RoutineHealth
+		sender   RoutineHealth
+		receiver RoutineHealth
+	}
+
 	mac CookieGenerator
 }
 
@@ -90,6 +127,10 @@ func (device *Device) NewPeer(pk NoisePublicKey) (*Peer, error) {
 		return nil, errors.New("Too many peers")
 	}
 
+	if limit := device.peers.limit; limit != 0 && len(device.peers.keyMap) >= limit {
+		return nil, fmt.Errorf("Too many peers, limit of %d reached", limit)
+	}
+
 	// create peer
 
 	peer := new(Peer)
@@ -126,6 +167,8 @@ func (device *Device) NewPeer(pk NoisePublicKey) (*Peer, error) {
 		peer.Start()
 	}
 
+	device.publishEvent(Event{Kind: EventPeerAdded, PublicKey: pk})
+
 	return peer, nil
 }
 
@@ -144,7 +187,39 @@ func (peer *Peer) SendBuffer(buffer []byte) error {
 		return errors.New("No known endpoint for peer")
 	}
 
-	return peer.device.net.bind.Send(buffer, peer.endpoint)
+	// send from the source address configured for the peer
+
+	if peer.srcAddress != nil {
+		source, ok := peer.endpoint.(SourceEndpoint)
+		if !ok {
+			return errors.New("Source address not supported by endpoint")
+		}
+		if err := source.SetSrc(peer.srcAddress); err != nil {
+			return err
+		}
+	}
+
+	// mark datagrams with the fwmark configured for the peer
+
+	if marker, ok := peer.endpoint.(MarkEndpoint); ok {
+		marker.SetMark(peer.fwmark)
+	} else if peer.fwmark != 0 {
+		return errors.New("Fwmark not supported by endpoint")
+	}
+
+	err := peer.device.net.bind.Send(buffer, peer.endpoint)
+
+	// datagram exceeds the path MTU (with the DF bit set)
+
+	if err == syscall.EMSGSIZE {
+		if discoverer, ok := peer.device.net.bind.(PathMTUDiscoverer); ok {
+			if pmtu, err := discoverer.PathMTU(peer.endpoint); err == nil {
+				peer.UpdatePathMTU(pmtu)
+			}
+		}
+	}
+
+	return err
 }
 
 /* Returns a short string identifier for logging
@@ -226,12 +301,25 @@ func (peer *Peer) Stop() {
 	close(peer.routines.stop)
 	peer.routines.stopping.Wait()
 
-	// close queues
+	// close queues and return the buffers of queued packets,
+	// waiting for the workers to release those being encrypted / decrypted
 
 	close(peer.queue.nonce)
 	close(peer.queue.outbound)
 	close(peer.queue.inbound)
 
+	for elem := range peer.queue.nonce {
+		device.releaseOutboundElement(elem)
+	}
+	for elem := range peer.queue.outbound {
+		elem.mutex.Lock()
+		device.releaseOutboundElement(elem)
+	}
+	for elem := range peer.queue.inbound {
+		elem.mutex.Lock()
+		device.PutMessageBuffer(elem.buffer)
+	}
+
 	// clear key pairs
 
 	kp := &peer.keyPairs
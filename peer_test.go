@@ -0,0 +1,69 @@
+/* SPDX-License-Identifier: GPL-2.0
+ *
+ * Copyright (C) 2017-2018 Jason A. Donenfeld <Jason@zx2c4.com>. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRemovePeerUnderLoad(t *testing.T) {
+	dev1, dev2 := genChannelPair(t)
+	defer dev1.Close()
+	defer dev2.Close()
+
+	tun1 := dev1.tun.device.(*DummyTUN)
+	tun2 := dev2.tun.device.(*DummyTUN)
+	src, dst := net.IPv4(10, 0, 0, 1), net.IPv4(10, 0, 0, 2)
+
+	tun1.packets <- genIPv4Packet(src, dst, 100)
+	recvPacket(t, tun2, time.Second*5)
+
+	// buffers held by the device routines while idle
+
+	time.Sleep(time.Millisecond * 100)
+	idle := atomic.LoadInt64(&dev1.pool.outstanding)
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case <-tun2.written:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	// remove the peer with packets pending in its queues
+
+	peer := dev1.LookupPeer(dev2.noise.publicKey)
+	for i := 0; i < 500; i++ {
+		tun1.packets <- genIPv4Packet(src, dst, 1000)
+		if i == 250 {
+			dev1.RemovePeer(dev2.noise.publicKey)
+		}
+	}
+
+	health := peer.Health()
+	if health.Nonce.IsRunning() || health.SequentialSender.IsRunning() || health.SequentialReceiver.IsRunning() {
+		t.Fatal("routines of removed peer still running")
+	}
+	if dev1.LookupPeer(dev2.noise.publicKey) != nil {
+		t.Fatal("peer not removed")
+	}
+
+	deadline := time.Now().Add(time.Second * 5)
+	for len(tun1.packets) > 0 || atomic.LoadInt64(&dev1.pool.outstanding) != idle {
+		if time.Now().After(deadline) {
+			t.Fatal("leaked", atomic.LoadInt64(&dev1.pool.outstanding)-idle, "buffers")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
@@ -0,0 +1,149 @@
+/* SPDX-License-Identifier: GPL-2.0
+ *
+ * Copyright (C) 2017-2018 Jason A. Donenfeld <Jason@zx2c4.com>. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"errors"
+	"io"
+	"sync"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+const (
+	QueuePeerConnSize = 1024 // inbound packets pending a read from a peer connection
+)
+
+/* The tunnel of a single peer, presented as a (packet oriented) io.ReadWriteCloser
+ * (e.g. as the link of a userspace network stack)
+ *
+ * While open, packets received from the peer are read from the connection,
+ * rather than written to the TUN device. Packets written to the connection
+ * are sent to the peer, regardless of the allowed IPs.
+ */
+type PeerConn struct {
+	peer      *Peer
+	inbound   chan []byte
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+var _ io.ReadWriteCloser = (*PeerConn)(nil)
+
+/* Attaches a connection to the tunnel of the peer,
+ * at most a single connection is open at a time
+ */
+func (peer *Peer) OpenConn() (*PeerConn, error) {
+	conn := &PeerConn{
+		peer:    peer,
+		inbound: make(chan []byte, QueuePeerConnSize),
+		closed:  make(chan struct{}),
+	}
+
+	peer.mutex.Lock()
+	defer peer.mutex.Unlock()
+
+	if peer.conn != nil {
+		return nil, errors.New("Peer connection already open")
+	}
+	peer.conn = conn
+	return conn, nil
+}
+
+func (peer *Peer) attachedConn() *PeerConn {
+	peer.mutex.RLock()
+	defer peer.mutex.RUnlock()
+	return peer.conn
+}
+
+/* Queues a copy of a packet received from the peer,
+ * packets are dropped while the reader is unable to keep up
+ */
+func (conn *PeerConn) deliver(packet []byte) {
+	select {
+	case conn.inbound <- append([]byte(nil), packet...):
+	default:
+		conn.peer.device.log.Debug.Println(conn.peer, ": Dropping packet pending a read from peer connection")
+	}
+}
+
+/* Reads a single packet received from the peer,
+ * blocking until a packet arrives or the connection is closed
+ */
+func (conn *PeerConn) Read(b []byte) (int, error) {
+	select {
+	case packet := <-conn.inbound:
+		if len(packet) > len(b) {
+			return 0, io.ErrShortBuffer
+		}
+		return copy(b, packet), nil
+	case <-conn.closed:
+		return 0, io.EOF
+	case <-conn.peer.device.signals.stop:
+		return 0, io.EOF
+	}
+}
+
+/* Sends a single (IPv4 or IPv6) packet to the peer
+ */
+func (conn *PeerConn) Write(packet []byte) (int, error) {
+	select {
+	case <-conn.closed:
+		return 0, io.ErrClosedPipe
+	default:
+	}
+
+	device := conn.peer.device
+	offset := device.tun.offset
+
+	// admit no new packets while shutting down
+
+	if device.isDraining.Get() {
+		return 0, errors.New("Device shutting down")
+	}
+
+	if len(packet) == 0 || len(packet) > MaxContentSize-(offset-MessageTransportHeaderSize) {
+		return 0, errors.New("Invalid packet size")
+	}
+	switch packet[0] >> 4 {
+	case ipv4.Version:
+		if len(packet) < ipv4.HeaderLen {
+			return 0, errors.New("Packet too short for IPv4 header")
+		}
+	case ipv6.Version:
+		if len(packet) < ipv6.HeaderLen {
+			return 0, errors.New("Packet too short for IPv6 header")
+		}
+	default:
+		return 0, errors.New("Packet of unknown IP version")
+	}
+
+	elem := device.NewOutboundElement()
+	elem.packet = elem.buffer[offset : offset+len(packet)]
+	copy(elem.packet, packet)
+	if !conn.peer.queueOutbound(elem) {
+		device.PutMessageBuffer(elem.buffer)
+		return 0, errors.New("Peer not running")
+	}
+	return len(packet), nil
+}
+
+/* Detaches the connection from the peer,
+ * packets received from the peer are again written to the TUN device
+ */
+func (conn *PeerConn) Close() error {
+	conn.closeOnce.Do(func() {
+		peer := conn.peer
+		peer.mutex.Lock()
+		if peer.conn == conn {
+			peer.conn = nil
+		}
+		peer.mutex.Unlock()
+		close(conn.closed)
+	})
+	return nil
+}
@@ -0,0 +1,90 @@
+/* SPDX-License-Identifier: GPL-2.0
+ *
+ * Copyright (C) 2017-2018 Jason A. Donenfeld <Jason@zx2c4.com>. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestPeerConn(t *testing.T) {
+	dev1, dev2 := genChannelPair(t)
+	defer dev1.Close()
+	defer dev2.Close()
+
+	conn1, err := dev1.LookupPeer(dev2.noise.publicKey).OpenConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer2 := dev2.LookupPeer(dev1.noise.publicKey)
+	conn2, err := peer2.OpenConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := peer2.OpenConn(); err == nil {
+		t.Fatal("second connection opened")
+	}
+
+	read := func(conn *PeerConn) []byte {
+		result := make(chan []byte, 1)
+		go func() {
+			buf := make([]byte, MaxContentSize)
+			n, err := conn.Read(buf)
+			if err != nil {
+				t.Error(err)
+			}
+			result <- buf[:n]
+		}()
+		select {
+		case packet := <-result:
+			return packet
+		case <-time.After(time.Second * 5):
+			t.Fatal("timed out reading from peer connection")
+		}
+		return nil
+	}
+
+	// packets written to the connection are read from the connection of the peer
+
+	src, dst := net.IPv4(10, 0, 0, 1), net.IPv4(10, 0, 0, 2)
+	packet := genIPv4Packet(src, dst, 100)
+	if n, err := conn1.Write(packet); err != nil || n != len(packet) {
+		t.Fatal("write failed:", n, err)
+	}
+	assertEqual(t, read(conn2), packet)
+
+	reply := genIPv4Packet(dst, src, 200)
+	if _, err := conn2.Write(reply); err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, read(conn1), reply)
+
+	select {
+	case <-dev2.tun.device.(*DummyTUN).written:
+		t.Fatal("packet written to TUN device while connection open")
+	default:
+	}
+
+	// once closed, packets are written to the TUN device again
+
+	conn2.Close()
+	if _, err := conn2.Write(packet); err != io.ErrClosedPipe {
+		t.Fatal("write on closed connection:", err)
+	}
+	if _, err := conn2.Read(make([]byte, MaxContentSize)); err != io.EOF {
+		t.Fatal("read on closed connection:", err)
+	}
+	if _, err := conn1.Write(packet); err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, recvPacket(t, dev2.tun.device, time.Second*5), packet)
+
+	if _, err := conn1.Write([]byte{0x50, 0, 0, 0}); err == nil {
+		t.Fatal("packet of unknown IP version written")
+	}
+}
@@ -0,0 +1,159 @@
+/* SPDX-License-Identifier: GPL-2.0
+ *
+ * Copyright (C) 2017-2018 Jason A. Donenfeld <Jason@zx2c4.com>. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+/* Explicit path MTU probing
+ *
+ * Probes are keepalives padded with zeros to the probed size, sent with the
+ * DF bit set, such that probes exceeding the path MTU are rejected with EMSGSIZE
+ * (once the kernel learned the path MTU from an ICMP "fragmentation needed").
+ * Receivers treat probes as keepalives.
+ */
+
+/* Discovers the largest transport message reaching the peer without fragmentation,
+ * probing the largest message of the TUN MTU first, then bisecting the sizes below
+ * (from the largest message possible if the TUN MTU is unknown)
+ *
+ * Returns the path MTU (excluding the IP and UDP headers),
+ * which is applied to the MTU estimate of the peer
+ */
+func (device *Device) ProbePathMTU(peer *Peer) (int, error) {
+	logDebug := device.log.Debug
+
+	keyPair := peer.keyPairs.Current()
+	if keyPair == nil || time.Now().Sub(keyPair.created) >= device.TimerConfig().RejectAfterTime {
+		return 0, errors.New("No current session with peer")
+	}
+
+	// probes require the DF bit, restored once done
+
+	device.net.mutex.RLock()
+	dontFrag := device.net.dontFrag
+	device.net.mutex.RUnlock()
+
+	if !dontFrag {
+		if err := device.BindSetDontFragment(true); err != nil {
+			return 0, err
+		}
+		defer device.BindSetDontFragment(false)
+	}
+
+	// bisect between the largest size known to fit and the smallest known not to
+
+	mtu := int(atomic.LoadInt32(&device.tun.mtu))
+	if mtu == 0 {
+		mtu = MaxContentSize
+	}
+	overhead := device.transportOverhead()
+	good := overhead
+	bad := mtu + overhead + 1
+
+	for size := bad - 1; bad-good > 1; size = good + (bad-good)/2 {
+		err := peer.sendPathMTUProbe(keyPair, size)
+		switch err {
+		case nil:
+			logDebug.Println(peer, ": Path MTU probe of", size, "bytes sent")
+			good = size
+		case syscall.EMSGSIZE:
+			logDebug.Println(peer, ": Path MTU probe of", size, "bytes too large")
+			bad = size
+		default:
+			return 0, err
+		}
+	}
+
+	device.log.Info.Println(peer, ": Path MTU probed:", good)
+	peer.UpdatePathMTU(good)
+	return good, nil
+}
+
+/* Path MTU discovered for the endpoint of a peer
+ */
+type pathMTUEstimate struct {
+	mtu     int       // content size fitting the path MTU (0 = unknown)
+	expires time.Time // forgotten after PathMTUExpiry
+}
+
+/* Returns the MTU used for padding messages to the peer:
+ * the MTU of the TUN device, limited by the path MTU discovered for the endpoint
+ */
+func (peer *Peer) EffectiveMTU() int {
+	mtu := peer.device.EffectiveMTU()
+	estimate, _ := peer.pathMTU.Load().(pathMTUEstimate)
+	if estimate.mtu > 0 && estimate.mtu < mtu && time.Now().Before(estimate.expires) {
+		return estimate.mtu
+	}
+	return mtu
+}
+
+/* Updates the MTU estimate of the peer from a discovered path MTU,
+ * which excludes the IP and UDP headers
+ */
+func (peer *Peer) UpdatePathMTU(pmtu int) {
+	mtu := pmtu - peer.device.transportOverhead()
+	if mtu < 0 {
+		mtu = 0
+	}
+	old, _ := peer.pathMTU.Load().(pathMTUEstimate)
+	peer.pathMTU.Store(pathMTUEstimate{mtu: mtu, expires: time.Now().Add(PathMTUExpiry)})
+	if old.mtu != mtu {
+		peer.device.log.Info.Println(peer, ": Path MTU updated:", mtu)
+	}
+}
+
+/* Forgets the path MTU, once the endpoint of the peer changed
+ */
+func (peer *Peer) resetPathMTU() {
+	peer.pathMTU.Store(pathMTUEstimate{})
+}
+
+/* Sends a keepalive padded to the size of a transport message
+ */
+func (peer *Peer) sendPathMTUProbe(keyPair *Keypair, size int) error {
+	device := peer.device
+	header := device.transportHeaderSize()
+	content := make([]byte, size-device.transportOverhead())
+
+	// assign nonce
+
+	if !keyPair.extended && atomic.LoadUint64(&keyPair.sendNonce) >= device.TimerConfig().RejectAfterMessages {
+		return errors.New("Nonces of session exhausted")
+	}
+	counter := atomic.AddUint64(&keyPair.sendNonce, 1) - 1
+
+	// populate header and encrypt content
+
+	msg := make([]byte, header, size)
+	binary.LittleEndian.PutUint32(msg[0:4], MessageTransportType)
+	binary.LittleEndian.PutUint32(msg[4:8], keyPair.remoteIndex)
+	binary.LittleEndian.PutUint64(msg[8:16], counter)
+
+	if keyPair.extended {
+		binary.LittleEndian.PutUint32(msg[0:4], MessageTransportExtendedType)
+		nonceX := msg[MessageTransportExtendedOffsetNonce:header]
+		if _, err := rand.Read(nonceX); err != nil {
+			return err
+		}
+		msg = keyPair.send.Seal(msg, nonceX, content, msg[:MessageTransportOffsetContent])
+	} else {
+		var nonce [chacha20poly1305.NonceSize]byte
+		binary.LittleEndian.PutUint64(nonce[4:], counter)
+		msg = keyPair.send.Seal(msg, nonce[:], content, nil)
+	}
+
+	return peer.SendBuffer(msg)
+}
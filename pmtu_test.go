@@ -0,0 +1,104 @@
+/* SPDX-License-Identifier: GPL-2.0
+ *
+ * Copyright (C) 2017-2018 Jason A. Donenfeld <Jason@zx2c4.com>. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"net"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+/* Bind simulating a path MTU: datagrams exceeding it are fragmented,
+ * unless the DF bit is set, in which case sends fail with EMSGSIZE
+ */
+type CappedBind struct {
+	*ChannelBind
+	mtu      int
+	dontFrag AtomicBool
+}
+
+func (b *CappedBind) SetDontFragment(enabled bool) error {
+	b.dontFrag.Set(enabled)
+	return nil
+}
+
+func (b *CappedBind) Send(buff []byte, end Endpoint) error {
+	if len(buff) > b.mtu && b.dontFrag.Get() {
+		return syscall.EMSGSIZE
+	}
+	return b.ChannelBind.Send(buff, end)
+}
+
+func TestProbePathMTU(t *testing.T) {
+	dev1, dev2 := genChannelPair(t)
+	defer dev1.Close()
+	defer dev2.Close()
+
+	tun1 := dev1.tun.device.(*DummyTUN)
+	tun2 := dev2.tun.device.(*DummyTUN)
+	src, dst := net.IPv4(10, 0, 0, 1), net.IPv4(10, 0, 0, 2)
+	peer := dev1.LookupPeer(dev2.noise.publicKey)
+
+	dev1.net.mutex.Lock()
+	channel := dev1.net.bind.(*ChannelBind)
+	capped := &CappedBind{ChannelBind: channel, mtu: 1337}
+	dev1.net.createBind = func(ports []uint16) (Bind, []uint16, error) {
+		select {
+		case <-channel.closed:
+			channel.closed = make(chan struct{})
+		default:
+		}
+		return capped, ports, nil
+	}
+	dev1.net.mutex.Unlock()
+
+	if err := dev1.BindUpdate(); err != nil {
+		t.Fatal(err)
+	}
+	atomic.StoreInt32(&dev1.tun.mtu, 1420)
+
+	// probes require a session
+
+	if _, err := dev1.ProbePathMTU(peer); err == nil {
+		t.Fatal("probed without session")
+	}
+
+	tun1.packets <- genIPv4Packet(src, dst, 100)
+	recvPacket(t, tun2, time.Second*5)
+
+	// the probe converges to the path MTU
+
+	pmtu, err := dev1.ProbePathMTU(peer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pmtu != capped.mtu {
+		t.Fatal("probed path MTU", pmtu, "expected", capped.mtu)
+	}
+	if peer.EffectiveMTU() != capped.mtu-MessageTransportSize {
+		t.Fatal("MTU estimate not updated:", peer.EffectiveMTU())
+	}
+	if capped.dontFrag.Get() {
+		t.Fatal("DF bit not restored")
+	}
+
+	// probes are received as keepalives, traffic continues
+
+	select {
+	case packet := <-tun2.written:
+		t.Fatal("probe written to TUN device:", packet)
+	case <-time.After(time.Millisecond * 100):
+	}
+	if failures := atomic.LoadUint64(&dev2.stats.decryptFailures); failures != 0 {
+		t.Fatal("probes failed authentication:", failures)
+	}
+	tun1.packets <- genIPv4Packet(src, dst, 1000)
+	if len(recvPacket(t, tun2, time.Second*5)) != 1000 {
+		t.Fatal("traffic disrupted by probes")
+	}
+}
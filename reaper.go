@@ -0,0 +1,87 @@
+/* SPDX-License-Identifier: GPL-2.0
+ *
+ * Copyright (C) 2017-2018 Jason A. Donenfeld <Jason@zx2c4.com>. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+const (
+	PeerReapInterval = time.Second * 10 // interval between searches for stale peers
+)
+
+/* Removes peers without a completed handshake for longer than age (0 = never),
+ * allowing relays to forget abandoned clients.
+ *
+ * Peers with persistent keepalive and peers which never completed
+ * a handshake are retained.
+ */
+func (device *Device) SetPeerMaxAge(age time.Duration) {
+	atomic.StoreInt64(&device.reaper.maxAge, int64(age))
+}
+
+func (device *Device) PeerMaxAge() time.Duration {
+	return time.Duration(atomic.LoadInt64(&device.reaper.maxAge))
+}
+
+/* Removes the peers exceeding the maximum age,
+ * returns the number of peers removed
+ */
+func (device *Device) reapStalePeers() int {
+	maxAge := device.PeerMaxAge()
+	if maxAge == 0 {
+		return 0
+	}
+
+	device.noise.mutex.Lock()
+	defer device.noise.mutex.Unlock()
+
+	device.routing.mutex.Lock()
+	defer device.routing.mutex.Unlock()
+
+	device.peers.mutex.Lock()
+	defer device.peers.mutex.Unlock()
+
+	reaped := 0
+	for key, peer := range device.peers.keyMap {
+		if peer.persistentKeepaliveInterval != 0 {
+			continue
+		}
+		nano := atomic.LoadInt64(&peer.stats.lastHandshakeNano)
+		if nano == 0 || time.Since(time.Unix(0, nano)) < maxAge {
+			continue
+		}
+		device.log.Info.Println("Removing stale peer:", peer)
+		unsafeRemovePeer(device, peer, key)
+		reaped += 1
+	}
+	return reaped
+}
+
+func (device *Device) RoutinePeerReaper() {
+
+	logDebug := device.log.Debug
+
+	defer func() {
+		logDebug.Println("Routine: peer reaper - stopped")
+		device.state.stopping.Done()
+	}()
+
+	logDebug.Println("Routine: peer reaper - started")
+
+	ticker := time.NewTicker(PeerReapInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-device.signals.stop:
+			return
+		case <-ticker.C:
+			device.reapStalePeers()
+		}
+	}
+}
@@ -0,0 +1,61 @@
+/* SPDX-License-Identifier: GPL-2.0
+ *
+ * Copyright (C) 2017-2018 Jason A. Donenfeld <Jason@zx2c4.com>. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPeerReaper(t *testing.T) {
+	device := randDevice(t)
+	defer device.Close()
+
+	stale := randPeer(t, device)
+	fresh := randPeer(t, device)
+	keepalive := randPeer(t, device)
+	never := randPeer(t, device)
+
+	aged := time.Now().Add(-time.Hour * 2)
+	atomic.StoreInt64(&stale.stats.lastHandshakeNano, aged.UnixNano())
+	atomic.StoreInt64(&keepalive.stats.lastHandshakeNano, aged.UnixNano())
+	atomic.StoreInt64(&fresh.stats.lastHandshakeNano, time.Now().UnixNano())
+	keepalive.persistentKeepaliveInterval = 25
+
+	// the handshake time is reported
+
+	get := uapiRequest(t, device, "get=1\n\n")
+	if !strings.Contains(get, fmt.Sprintf("last_handshake_time_sec=%d\n", aged.Unix())) {
+		t.Fatal("handshake time not reported:", get)
+	}
+
+	// nothing is removed while disabled
+
+	if device.reapStalePeers() != 0 {
+		t.Fatal("peers removed while disabled")
+	}
+
+	uapiSet(t, device, "peer_max_age=3600")
+	if device.PeerMaxAge() != time.Hour {
+		t.Fatal("maximum age not set")
+	}
+
+	if reaped := device.reapStalePeers(); reaped != 1 {
+		t.Fatal("expected 1 peer removed, got", reaped)
+	}
+
+	if device.LookupPeer(stale.handshake.remoteStatic) != nil {
+		t.Fatal("stale peer not removed")
+	}
+	for _, peer := range []*Peer{fresh, keepalive, never} {
+		if device.LookupPeer(peer.handshake.remoteStatic) == nil {
+			t.Fatal("removed", peer)
+		}
+	}
+}
@@ -32,7 +32,9 @@ type QueueInboundElement struct {
 	packet   []byte
 	counter  uint64
 	keyPair  *Keypair
+	peer     *Peer
 	endpoint Endpoint
+	tracker  EndpointTracker // bind to notify once authenticated
 }
 
 func (elem *QueueInboundElement) Drop() {
@@ -108,9 +110,9 @@ func (peer *Peer) keepKeyFreshReceiving() {
 		return
 	}
 	kp := peer.keyPairs.Current()
-	if kp != nil && kp.isInitiator && time.Now().Sub(kp.created) > (RejectAfterTime-KeepaliveTimeout-RekeyTimeout) {
+	if kp != nil && kp.isInitiator && time.Now().Sub(kp.created) > (peer.device.TimerConfig().RejectAfterTime-KeepaliveTimeout-RekeyTimeout) {
 		peer.timers.sentLastMinuteHandshake = true
-		peer.SendHandshakeInitiation(false)
+		peer.SendHandshakeInitiation(false, false)
 	}
 }
 
@@ -119,18 +121,32 @@ func (peer *Peer) keepKeyFreshReceiving() {
  * Every time the bind is updated a new routine is started for
  * IPv4 and IPv6 (separately)
  */
-func (device *Device) RoutineReceiveIncoming(IP int, bind Bind) {
+func (device *Device) RoutineReceiveIncoming(IP int, receiver int, bind Bind) {
 
 	logDebug := device.log.Debug
 	defer func() {
 		logDebug.Println("Routine: receive incoming IPv" + strconv.Itoa(IP) + " - stopped")
+		device.health.receive.stopped()
+		device.net.stopping.Done()
 	}()
 
 	logDebug.Println("Routine: receive incoming IPv" + strconv.Itoa(IP) + " - starting")
+	device.health.receive.started()
 
 	// receive datagrams until conn is closed
 
 	buffer := device.GetMessageBuffer()
+	tracker, _ := bind.(EndpointTracker)
+
+	receive4, receive6 := bind.ReceiveIPv4, bind.ReceiveIPv6
+	if parallel, ok := bind.(ParallelReceiveBind); ok {
+		receive4 = func(buff []byte) (int, Endpoint, error) {
+			return parallel.ReceiveIPv4On(receiver, buff)
+		}
+		receive6 = func(buff []byte) (int, Endpoint, error) {
+			return parallel.ReceiveIPv6On(receiver, buff)
+		}
+	}
 
 	var (
 		err      error
@@ -144,9 +160,9 @@ func (device *Device) RoutineReceiveIncoming(IP int, bind Bind) {
 
 		switch IP {
 		case ipv4.Version:
-			size, endpoint, err = bind.ReceiveIPv4(buffer[:])
+			size, endpoint, err = receive4(buffer[:])
 		case ipv6.Version:
-			size, endpoint, err = bind.ReceiveIPv6(buffer[:])
+			size, endpoint, err = receive6(buffer[:])
 		default:
 			panic("invalid IP version")
 		}
@@ -155,95 +171,139 @@ func (device *Device) RoutineReceiveIncoming(IP int, bind Bind) {
 			return
 		}
 
-		if size < MinMessageSize {
-			continue
+		device.health.receive.active()
+
+		if device.receiveDatagram(buffer, size, endpoint, tracker) {
+			buffer = device.GetMessageBuffer()
 		}
+	}
+}
 
-		// check size of packet
+/* Dispatches a received datagram to the decryption or handshake queue
+ *
+ * Returns true if the buffer was consumed (and must be replaced)
+ */
+func (device *Device) receiveDatagram(
+	buffer *[MaxMessageSize]byte,
+	size int,
+	endpoint Endpoint,
+	tracker EndpointTracker,
+) bool {
+
+	if size < MinMessageSize {
+		return false
+	}
 
-		packet := buffer[:size]
-		msgType := binary.LittleEndian.Uint32(packet[:4])
+	// check size of packet
 
-		var okay bool
+	packet := buffer[:size]
+	msgType := binary.LittleEndian.Uint32(packet[:4])
 
-		switch msgType {
+	var okay bool
 
-		// check if transport
+	switch msgType {
 
-		case MessageTransportType:
+	// check if transport
 
-			// check size
+	case MessageTransportType, MessageTransportExtendedType:
 
-			if len(packet) < MessageTransportType {
-				continue
-			}
+		// check size (and that the peers agree on the extension)
 
-			// lookup key pair
+		if len(packet) < MessageTransportType {
+			return false
+		}
 
-			receiver := binary.LittleEndian.Uint32(
-				packet[MessageTransportOffsetReceiver:MessageTransportOffsetCounter],
-			)
-			value := device.indices.Lookup(receiver)
-			keyPair := value.keyPair
-			if keyPair == nil {
-				continue
-			}
+		if extended := msgType == MessageTransportExtendedType; extended != device.transport.extended {
+			device.log.Debug.Println("Received transport message of mismatched nonce mode")
+			return false
+		} else if extended && len(packet) < MessageTransportExtendedSize {
+			return false
+		}
 
-			// check key-pair expiry
+		// lookup key pair
 
-			if keyPair.created.Add(RejectAfterTime).Before(time.Now()) {
-				continue
-			}
+		receiver := binary.LittleEndian.Uint32(
+			packet[MessageTransportOffsetReceiver:MessageTransportOffsetCounter],
+		)
+		value := device.indices.Lookup(receiver)
+		keyPair := value.keyPair
+		if keyPair == nil {
+			return false
+		}
 
-			// create work element
+		// check key-pair expiry
 
-			peer := value.peer
-			elem := &QueueInboundElement{
-				packet:   packet,
-				buffer:   buffer,
-				keyPair:  keyPair,
-				dropped:  AtomicFalse,
-				endpoint: endpoint,
-			}
-			elem.mutex.Lock()
+		if keyPair.created.Add(device.TimerConfig().RejectAfterTime).Before(time.Now()) {
+			return false
+		}
 
-			// add to decryption queues
+		// create work element
+
+		peer := value.peer
+		elem := &QueueInboundElement{
+			packet:   packet,
+			buffer:   buffer,
+			keyPair:  keyPair,
+			peer:     peer,
+			dropped:  AtomicFalse,
+			endpoint: endpoint,
+			tracker:  tracker,
+		}
+		elem.mutex.Lock()
 
-			if peer.isRunning.Get() {
-				device.addToDecryptionQueue(device.queue.decryption, elem)
-				device.addToInboundQueue(peer.queue.inbound, elem)
-				buffer = device.GetMessageBuffer()
-			}
+		// add to decryption queues
 
-			continue
+		if peer.isRunning.Get() {
+			device.addToDecryptionQueue(device.queue.decryption, elem)
+			device.addToInboundQueue(peer.queue.inbound, elem)
+			return true
+		}
 
-		// otherwise it is a fixed size & handshake related packet
+		return false
 
-		case MessageInitiationType:
-			okay = len(packet) == MessageInitiationSize
+	// otherwise it is a fixed size & handshake related packet
 
-		case MessageResponseType:
-			okay = len(packet) == MessageResponseSize
+	case MessageInitiationType:
+		okay = len(packet) == MessageInitiationSize
 
-		case MessageCookieReplyType:
-			okay = len(packet) == MessageCookieReplySize
+	case MessageResponseType:
+		okay = len(packet) == MessageResponseSize
 
-		default:
-			logDebug.Println("Received message with unknown type")
-		}
+	case MessageCookieReplyType:
+		okay = len(packet) == MessageCookieReplySize
 
-		if okay {
-			device.addToHandshakeQueue(
-				device.queue.handshake,
-				QueueHandshakeElement{
-					msgType:  msgType,
-					buffer:   buffer,
-					packet:   packet,
-					endpoint: endpoint,
-				},
-			)
-			buffer = device.GetMessageBuffer()
-		}
+	default:
+		device.log.Debug.Println("Received message with unknown type")
+	}
+
+	if okay {
+		device.addToHandshakeQueue(
+			device.queue.handshake,
+			QueueHandshakeElement{
+				msgType:  msgType,
+				buffer:   buffer,
+				packet:   packet,
+				endpoint: endpoint,
+			},
+		)
+		return true
+	}
+
+	return false
+}
+
+/* Feeds a datagram into the receive path, as if received from the endpoint
+ *
+ * Intended for testing the handling of crafted datagrams without sockets
+ */
+func (device *Device) InjectInbound(buff []byte, end Endpoint) {
+	if len(buff) > MaxMessageSize {
+		return
+	}
+	buffer := device.GetMessageBuffer()
+	size := copy(buffer[:], buff)
+	if !device.receiveDatagram(buffer, size, end, nil) {
+		device.PutMessageBuffer(buffer)
 	}
 }
 
@@ -252,23 +312,34 @@ func (device *Device) RoutineDecryption() {
 	var nonce [chacha20poly1305.NonceSize]byte
 
 	logDebug := device.log.Debug
+	pin := device.newWorkerPin("decryption")
 	defer func() {
 		logDebug.Println("Routine: decryption worker - stopped")
+		device.releaseAffinity(pin)
+		device.health.decryption.stopped()
 		device.state.stopping.Done()
 	}()
 	logDebug.Println("Routine: decryption worker - started")
+	device.health.decryption.started()
+
+	affinityChanged := device.applyAffinity(pin)
 
 	for {
 		select {
 		case <-device.signals.stop:
 			return
 
+		case <-affinityChanged:
+			affinityChanged = device.applyAffinity(pin)
+
 		case elem, ok := <-device.queue.decryption:
 
 			if !ok {
 				return
 			}
 
+			device.health.decryption.active()
+
 			// check if dropped
 
 			if elem.IsDropped() {
@@ -280,6 +351,26 @@ func (device *Device) RoutineDecryption() {
 			counter := elem.packet[MessageTransportOffsetCounter:MessageTransportOffsetContent]
 			content := elem.packet[MessageTransportOffsetContent:]
 
+			if elem.keyPair.extended {
+				var err error
+				nonceX := elem.packet[MessageTransportExtendedOffsetNonce:MessageTransportExtendedOffsetContent]
+				content = elem.packet[MessageTransportExtendedOffsetContent:]
+				elem.counter = binary.LittleEndian.Uint64(counter)
+				elem.packet, err = elem.keyPair.receive.Open(
+					content[:0],
+					nonceX,
+					content,
+					elem.packet[:MessageTransportOffsetContent],
+				)
+				if err != nil {
+					atomic.AddUint64(&device.stats.decryptFailures, 1)
+					atomic.AddUint64(&elem.peer.stats.decryptFailures, 1)
+					elem.Drop()
+				}
+				elem.mutex.Unlock()
+				continue
+			}
+
 			// expand nonce
 
 			nonce[0x4] = counter[0x0]
@@ -303,6 +394,8 @@ func (device *Device) RoutineDecryption() {
 				nil,
 			)
 			if err != nil {
+				atomic.AddUint64(&device.stats.decryptFailures, 1)
+				atomic.AddUint64(&elem.peer.stats.decryptFailures, 1)
 				elem.Drop()
 			}
 			elem.mutex.Unlock()
@@ -310,6 +403,17 @@ func (device *Device) RoutineDecryption() {
 	}
 }
 
+/* Returns the peer a handshake response is addressed to (if any),
+ * the message is not authenticated
+ */
+func (device *Device) lookupResponsePeer(elem QueueHandshakeElement) *Peer {
+	if elem.msgType != MessageResponseType {
+		return nil
+	}
+	receiver := binary.LittleEndian.Uint32(elem.packet[8:12])
+	return device.indices.Lookup(receiver).peer
+}
+
 /* Handles incoming packets related to handshake
  */
 func (device *Device) RoutineHandshake() {
@@ -320,10 +424,12 @@ func (device *Device) RoutineHandshake() {
 
 	defer func() {
 		logDebug.Println("Routine: handshake worker - stopped")
+		device.health.handshake.stopped()
 		device.state.stopping.Done()
 	}()
 
 	logDebug.Println("Routine: handshake worker - started")
+	device.health.handshake.started()
 
 	var temp [MessageHandshakeSize]byte
 	var elem QueueHandshakeElement
@@ -340,6 +446,8 @@ func (device *Device) RoutineHandshake() {
 			return
 		}
 
+		device.health.handshake.active()
+
 		// handle cookie fields and ratelimiting
 
 		switch elem.msgType {
@@ -378,6 +486,10 @@ func (device *Device) RoutineHandshake() {
 
 			if !device.mac.CheckMAC1(elem.packet) {
 				logDebug.Println("Received packet with invalid mac1")
+				atomic.AddUint64(&device.stats.invalidMAC, 1)
+				if peer := device.lookupResponsePeer(elem); peer != nil {
+					atomic.AddUint64(&peer.stats.invalidMAC, 1)
+				}
 				continue
 			}
 
@@ -391,6 +503,13 @@ func (device *Device) RoutineHandshake() {
 
 				if !device.mac.CheckMAC2(elem.packet, srcBytes) {
 
+					// limit cookie replies per source,
+					// to avoid being used as a reflector
+
+					if !device.rate.cookieLimiter.Allow(elem.endpoint.DstIP()) {
+						continue
+					}
+
 					// construct cookie reply
 
 					logDebug.Println(
@@ -409,7 +528,7 @@ func (device *Device) RoutineHandshake() {
 
 					writer := bytes.NewBuffer(temp[:0])
 					binary.Write(writer, binary.LittleEndian, reply)
-					device.net.bind.Send(writer.Bytes(), elem.endpoint)
+					err = device.net.bind.Send(writer.Bytes(), elem.endpoint)
 					if err != nil {
 						logDebug.Println("Failed to send cookie reply:", err)
 					}
@@ -447,6 +566,7 @@ func (device *Device) RoutineHandshake() {
 
 			peer := device.ConsumeMessageInitiation(&msg)
 			if peer == nil {
+				atomic.AddUint64(&device.stats.handshakeFailures, 1)
 				logInfo.Println(
 					"Received invalid initiation message from",
 					elem.endpoint.DstToString(),
@@ -454,6 +574,11 @@ func (device *Device) RoutineHandshake() {
 				continue
 			}
 
+			if !peer.acceptsEndpoint(elem.endpoint) {
+				logDebug.Println(peer, ": Dropping initiation from unpinned endpoint", elem.endpoint.DstToString())
+				continue
+			}
+
 			// update timers
 
 			peer.timersAnyAuthenticatedPacketTraversal()
@@ -461,9 +586,7 @@ func (device *Device) RoutineHandshake() {
 
 			// update endpoint
 
-			peer.mutex.Lock()
-			peer.endpoint = elem.endpoint
-			peer.mutex.Unlock()
+			peer.updateEndpoint(elem.endpoint)
 
 			logDebug.Println(peer, ": Received handshake initiation")
 
@@ -512,6 +635,10 @@ func (device *Device) RoutineHandshake() {
 
 			peer := device.ConsumeMessageResponse(&msg)
 			if peer == nil {
+				atomic.AddUint64(&device.stats.handshakeFailures, 1)
+				if peer := device.lookupResponsePeer(elem); peer != nil {
+					atomic.AddUint64(&peer.stats.handshakeFailures, 1)
+				}
 				logInfo.Println(
 					"Recieved invalid response message from",
 					elem.endpoint.DstToString(),
@@ -519,11 +646,14 @@ func (device *Device) RoutineHandshake() {
 				continue
 			}
 
+			if !peer.acceptsEndpoint(elem.endpoint) {
+				logDebug.Println(peer, ": Dropping response from unpinned endpoint", elem.endpoint.DstToString())
+				continue
+			}
+
 			// update endpoint
 
-			peer.mutex.Lock()
-			peer.endpoint = elem.endpoint
-			peer.mutex.Unlock()
+			peer.updateEndpoint(elem.endpoint)
 
 			logDebug.Println(peer, ": Received handshake response")
 
@@ -557,11 +687,13 @@ func (peer *Peer) RoutineSequentialReceiver() {
 
 	defer func() {
 		logDebug.Println(peer, ": Routine: sequential receiver - stopped")
+		peer.health.receiver.stopped()
 		peer.routines.stopping.Done()
 	}()
 
 	logDebug.Println(peer, ": Routine: sequential receiver - started")
 
+	peer.health.receiver.started()
 	peer.routines.starting.Done()
 
 	for {
@@ -577,25 +709,37 @@ func (peer *Peer) RoutineSequentialReceiver() {
 				return
 			}
 
+			peer.health.receiver.active()
+
 			// wait for decryption
 
 			elem.mutex.Lock()
 
 			if elem.IsDropped() {
+				device.PutMessageBuffer(elem.buffer)
+				continue
+			}
+
+			if !peer.acceptsEndpoint(elem.endpoint) {
+				logDebug.Println(peer, ": Dropping packet from unpinned endpoint", elem.endpoint.DstToString())
+				device.PutMessageBuffer(elem.buffer)
 				continue
 			}
 
 			// check for replay
 
 			if !elem.keyPair.replayFilter.ValidateCounter(elem.counter) {
+				device.PutMessageBuffer(elem.buffer)
 				continue
 			}
 
 			// update endpoint
 
-			peer.mutex.Lock()
-			peer.endpoint = elem.endpoint
-			peer.mutex.Unlock()
+			peer.updateEndpoint(elem.endpoint)
+
+			if elem.tracker != nil {
+				elem.tracker.UpdateLastEndpoint(elem.endpoint)
+			}
 
 			// check if using new key-pair
 
@@ -619,9 +763,9 @@ func (peer *Peer) RoutineSequentialReceiver() {
 			peer.timersAnyAuthenticatedPacketTraversal()
 			peer.timersAnyAuthenticatedPacketReceived()
 
-			// check for keepalive
+			// check for keepalive (padded by path MTU probes)
 
-			if len(elem.packet) == 0 {
+			if len(elem.packet) == 0 || elem.packet[0] == 0 && isZero(elem.packet) {
 				logDebug.Println(peer, ": Receiving keepalive packet")
 				continue
 			}
@@ -690,10 +834,22 @@ func (peer *Peer) RoutineSequentialReceiver() {
 				continue
 			}
 
+			atomic.AddUint64(&peer.stats.rxBytes, uint64(len(elem.packet)))
+
+			// deliver to an attached connection, rather than the tun device
+
+			if conn := peer.attachedConn(); conn != nil {
+				conn.deliver(elem.packet)
+				device.PutMessageBuffer(elem.buffer)
+				continue
+			}
+
 			// write to tun device
 
 			offset := MessageTransportOffsetContent
-			atomic.AddUint64(&peer.stats.rxBytes, uint64(len(elem.packet)))
+			if elem.keyPair.extended {
+				offset = MessageTransportExtendedOffsetContent
+			}
 			_, err := device.tun.device.Write(
 				elem.buffer[:offset+len(elem.packet)],
 				offset)
@@ -0,0 +1,287 @@
+/* SPDX-License-Identifier: GPL-2.0
+ *
+ * Copyright (C) 2017-2018 Jason A. Donenfeld <Jason@zx2c4.com>. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/poly1305"
+)
+
+func TestInvalidMACCounter(t *testing.T) {
+	device := randDevice(t)
+	defer device.Close()
+
+	peer := randPeer(t, device)
+
+	// register a local index for the peer
+
+	initiation, err := device.CreateMessageInitiation(peer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	endpoint, _ := CreateDummyEndpoint()
+	inject := func(msgType uint32, size int, receiver uint32) {
+		buffer := device.GetMessageBuffer()
+		packet := buffer[:size]
+		rand.Read(packet)
+		binary.LittleEndian.PutUint32(packet[0:4], msgType)
+		if msgType == MessageResponseType {
+			binary.LittleEndian.PutUint32(packet[8:12], receiver)
+		}
+		device.queue.handshake <- QueueHandshakeElement{
+			msgType:  msgType,
+			packet:   packet,
+			endpoint: endpoint,
+			buffer:   buffer,
+		}
+	}
+
+	waitFor := func(counter *uint64, value uint64) {
+		deadline := time.Now().Add(time.Second * 5)
+		for atomic.LoadUint64(counter) != value {
+			if time.Now().After(deadline) {
+				t.Fatal("counter is", atomic.LoadUint64(counter), "expected", value)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	// initiation from an unknown sender only counts on the device
+
+	inject(MessageInitiationType, MessageInitiationSize, 0)
+	waitFor(&device.stats.invalidMAC, 1)
+
+	// response addressed to the peer also counts on the peer
+
+	inject(MessageResponseType, MessageResponseSize, initiation.Sender)
+	waitFor(&device.stats.invalidMAC, 2)
+	waitFor(&peer.stats.invalidMAC, 1)
+
+	if atomic.LoadUint64(&device.stats.handshakeFailures) != 0 {
+		t.Fatal("invalid mac counted as handshake failure")
+	}
+
+	get := uapiRequest(t, device, "get=1\n\n")
+	if !strings.Contains(get, "invalid_mac=2\n") || !strings.Contains(get, "invalid_mac=1\n") {
+		t.Fatal("counters not reported:", get)
+	}
+}
+
+func TestInjectInbound(t *testing.T) {
+	dev1, dev2 := genChannelPair(t)
+	defer dev1.Close()
+	defer dev2.Close()
+
+	bind1 := dev1.net.bind.(*ChannelBind)
+	peer := dev2.LookupPeer(dev1.noise.publicKey)
+	tun2 := dev2.tun.device.(*DummyTUN)
+
+	waitFor := func(counter *uint64, value uint64) {
+		deadline := time.Now().Add(time.Second * 5)
+		for atomic.LoadUint64(counter) != value {
+			if time.Now().After(deadline) {
+				t.Fatal("counter is", atomic.LoadUint64(counter), "expected", value)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	// capture a transport message carrying data
+
+	src, dst := net.IPv4(10, 0, 0, 1), net.IPv4(10, 0, 0, 2)
+	dev1.tun.device.(*DummyTUN).packets <- genIPv4Packet(src, dst, 100)
+	recvPacket(t, tun2, time.Second*5)
+
+	var captured []byte
+	for captured == nil {
+		select {
+		case msg := <-bind1.sent:
+			msgType := binary.LittleEndian.Uint32(msg[:4])
+			if msgType == MessageTransportType && len(msg) > MessageKeepaliveSize {
+				captured = msg
+			}
+		default:
+			t.Fatal("no transport message sent")
+		}
+	}
+
+	// replayed nonce is rejected
+
+	dev2.InjectInbound(captured, bind1.local)
+	select {
+	case <-tun2.written:
+		t.Fatal("replayed packet accepted")
+	case <-time.After(time.Millisecond * 100):
+	}
+
+	// corrupted message fails authentication
+
+	corrupted := append([]byte{}, captured...)
+	corrupted[len(corrupted)-1] ^= 1
+	dev2.InjectInbound(corrupted, bind1.local)
+	waitFor(&peer.stats.decryptFailures, 1)
+
+	// initiation with invalid mac1
+
+	initiation := make([]byte, MessageInitiationSize)
+	binary.LittleEndian.PutUint32(initiation, MessageInitiationType)
+	dev2.InjectInbound(initiation, bind1.local)
+	waitFor(&dev2.stats.invalidMAC, 1)
+}
+
+func TestCookieReplyRatelimit(t *testing.T) {
+	dev1, dev2 := genChannelPair(t)
+	defer dev1.Close()
+	defer dev2.Close()
+
+	bind1 := dev1.net.bind.(*ChannelBind)
+	bind2 := dev2.net.bind.(*ChannelBind)
+	peer := dev1.LookupPeer(dev2.noise.publicKey)
+
+	dev2.rate.underLoadUntil.Store(time.Now().Add(time.Minute))
+
+	// initiation with valid mac1, but without a cookie (mac2)
+
+	msg, err := dev1.CreateMessageInitiation(peer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buff [MessageInitiationSize]byte
+	writer := bytes.NewBuffer(buff[:0])
+	binary.Write(writer, binary.LittleEndian, msg)
+	packet := writer.Bytes()
+	peer.mac.AddMacs(packet)
+
+	countReplies := func() int {
+		var replies int
+		deadline := time.After(time.Millisecond * 200)
+		for {
+			select {
+			case reply := <-bind2.sent:
+				if binary.LittleEndian.Uint32(reply[:4]) == MessageCookieReplyType {
+					replies++
+				}
+			case <-deadline:
+				return replies
+			}
+		}
+	}
+
+	// flood from a single source
+
+	const flood = 50
+	for i := 0; i < flood; i++ {
+		dev2.InjectInbound(packet, bind1.local)
+	}
+	replies := countReplies()
+	if replies == 0 || replies > flood/4 {
+		t.Fatal("sent", replies, "cookie replies to", flood, "initiations")
+	}
+
+	// other sources are not affected
+
+	other, _ := CreateDummyEndpoint()
+	dev2.InjectInbound(packet, other)
+	if replies := countReplies(); replies != 1 {
+		t.Fatal("sent", replies, "cookie replies to other source")
+	}
+}
+
+/* Decrypts batches of transport messages,
+ * either inline or by the pool of decryption workers
+ */
+func benchmarkDecryption(b *testing.B, pooled bool) {
+	const batch = 64
+	const size = 1420
+
+	device := randDevice(b)
+	defer device.Close()
+	peer := randPeer(b, device)
+
+	var key [chacha20poly1305.KeySize]byte
+	rand.Read(key[:])
+	aead, _ := chacha20poly1305.New(key[:])
+	keyPair := &Keypair{send: aead, receive: aead}
+
+	// encrypt messages once, to be restored before every batch
+
+	var nonce [chacha20poly1305.NonceSize]byte
+	var messages [batch][]byte
+	for i := range messages {
+		msg := make([]byte, MessageTransportHeaderSize, MessageTransportHeaderSize+size+poly1305.TagSize)
+		binary.LittleEndian.PutUint32(msg[0:4], MessageTransportType)
+		binary.LittleEndian.PutUint64(msg[MessageTransportOffsetCounter:], uint64(i))
+		binary.LittleEndian.PutUint64(nonce[4:], uint64(i))
+		messages[i] = aead.Seal(msg, nonce[:], make([]byte, size), nil)
+	}
+
+	var elems [batch]QueueInboundElement
+	for i := range elems {
+		elems[i].buffer = device.GetMessageBuffer()
+		elems[i].keyPair = keyPair
+		elems[i].peer = peer
+	}
+	defer func() {
+		for i := range elems {
+			device.PutMessageBuffer(elems[i].buffer)
+		}
+	}()
+
+	b.SetBytes(batch * size)
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		for i := range elems {
+			elem := &elems[i]
+			elem.dropped = AtomicFalse
+			elem.packet = elem.buffer[:copy(elem.buffer[:], messages[i])]
+		}
+
+		if !pooled {
+			for i := range elems {
+				elem := &elems[i]
+				counter := elem.packet[MessageTransportOffsetCounter:MessageTransportOffsetContent]
+				content := elem.packet[MessageTransportOffsetContent:]
+				copy(nonce[4:], counter)
+				var err error
+				elem.packet, err = keyPair.receive.Open(content[:0], nonce[:], content, nil)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+			continue
+		}
+
+		for i := range elems {
+			elems[i].mutex.Lock()
+			device.addToDecryptionQueue(device.queue.decryption, &elems[i])
+		}
+		for i := range elems {
+			elems[i].mutex.Lock()
+			if elems[i].IsDropped() {
+				b.Fatal("failed to decrypt message", i)
+			}
+			elems[i].mutex.Unlock()
+		}
+	}
+}
+
+func BenchmarkDecryptionInline(b *testing.B) {
+	benchmarkDecryption(b, false)
+}
+
+func BenchmarkDecryptionPooled(b *testing.B) {
+	benchmarkDecryption(b, true)
+}
@@ -5,6 +5,11 @@
 
 package main
 
+import (
+	"errors"
+	"fmt"
+)
+
 /* Copyright (C) 2015-2017 Jason A. Donenfeld <Jason@zx2c4.com>. All Rights Reserved. */
 
 /* Implementation of RFC6479
@@ -23,50 +28,103 @@ const (
 const (
 	CounterRedundantBitsLog = _WordLogSize + 3
 	CounterRedundantBits    = _WordSize * 8
-	CounterBitsTotal        = 2048
+	CounterBitsTotal        = 2048 // default size of the filter
 	CounterWindowSize       = uint64(CounterBitsTotal - CounterRedundantBits)
 )
 
 const (
-	BacktrackWords = CounterBitsTotal / _WordSize
+	CounterBitsTotalMin = 128
+	CounterBitsTotalMax = 1 << 16
 )
 
 type ReplayFilter struct {
 	counter   uint64
-	backtrack [BacktrackWords]uintptr
+	window    uint64 // greatest distance behind the counter accepted
+	wrapping  bool   // counters wrap around (compared in serial number arithmetic)
+	backtrack []uintptr
 }
 
 func (filter *ReplayFilter) Init() {
+	filter.InitSize(CounterBitsTotal)
+}
+
+/* Initializes the filter with a total size in bits,
+ * which must be valid according to ValidateReplayWindowSize
+ */
+func (filter *ReplayFilter) InitSize(bits uint64) {
+	filter.init(bits/_WordSize, bits)
+	filter.wrapping = false
+}
+
+/* Initializes the filter for counters which wrap around (RFC 1982),
+ * the number of words is a power of two, such that the word of
+ * a counter remains consistent when wrapping
+ */
+func (filter *ReplayFilter) InitWrappingSize(bits uint64) {
+	words := uint64(1)
+	for words < bits/_WordSize {
+		words <<= 1
+	}
+	filter.init(words, bits)
+	filter.wrapping = true
+}
+
+func (filter *ReplayFilter) init(words uint64, bits uint64) {
+	if uint64(len(filter.backtrack)) != words {
+		filter.backtrack = make([]uintptr, words)
+	}
 	filter.counter = 0
+	filter.window = bits - CounterRedundantBits
 	filter.backtrack[0] = 0
 }
 
+func ValidateReplayWindowSize(bits uint64) error {
+	if bits%64 != 0 {
+		return errors.New("Replay window size must be a multiple of 64")
+	}
+	if bits < CounterBitsTotalMin || bits > CounterBitsTotalMax {
+		return fmt.Errorf("Replay window size must be between %d and %d", CounterBitsTotalMin, CounterBitsTotalMax)
+	}
+	return nil
+}
+
+/* Reports whether the counter is ahead of the greatest counter seen
+ */
+func (filter *ReplayFilter) ahead(counter uint64) bool {
+	if filter.wrapping {
+		diff := counter - filter.counter
+		return diff != 0 && diff < 1<<63
+	}
+	return counter > filter.counter
+}
+
 func (filter *ReplayFilter) ValidateCounter(counter uint64) bool {
-	if counter >= RejectAfterMessages {
+	if counter >= RejectAfterMessages && !filter.wrapping {
 		return false
 	}
 
+	words := uint64(len(filter.backtrack))
 	indexWord := counter >> CounterRedundantBitsLog
 
-	if counter > filter.counter {
+	if filter.ahead(counter) {
 
-		// move window forward
+		// move window forward (word indices wrap along with the counter)
 
 		current := filter.counter >> CounterRedundantBitsLog
-		diff := minUint64(indexWord-current, BacktrackWords)
+		diff := minUint64((indexWord-current)&(^uint64(0)>>CounterRedundantBitsLog), words)
 		for i := uint64(1); i <= diff; i++ {
-			filter.backtrack[(current+i)%BacktrackWords] = 0
+			filter.backtrack[(current+i)%words] = 0
 		}
 		filter.counter = counter
 
-	} else if filter.counter-counter > CounterWindowSize {
+	} else if filter.counter-counter > filter.window {
 
 		// behind current window
 
 		return false
 	}
 
-	indexWord %= BacktrackWords
+	indexWord %= words
 	indexBit := counter & uint64(CounterRedundantBits-1)
 
 	// check and set bit
@@ -115,3 +115,100 @@ func TestReplay(t *testing.T) {
 	T(0, true)
 	T(CounterWindowSize+1, true)
 }
+
+func TestReplayWindowSize(t *testing.T) {
+	for _, bits := range []uint64{CounterBitsTotalMin, 4096 + 64, CounterBitsTotalMax} {
+		var filter ReplayFilter
+		filter.InitSize(bits)
+		window := bits - CounterRedundantBits
+
+		// reordered within the window
+
+		top := window * 3
+		if !filter.ValidateCounter(top) {
+			t.Fatal(bits, "rejected", top)
+		}
+		for i := top - 1; i >= top-window; i-- {
+			if !filter.ValidateCounter(i) {
+				t.Fatal(bits, "rejected reordered counter", i, "of", top)
+			}
+		}
+		if filter.ValidateCounter(top - window) {
+			t.Fatal(bits, "accepted replayed counter", top-window)
+		}
+
+		// beyond the window
+
+		if filter.ValidateCounter(top - window - 1) {
+			t.Fatal(bits, "accepted counter beyond window", top-window-1)
+		}
+	}
+
+	for _, bits := range []uint64{0, 64, 100, 2048 + 32, CounterBitsTotalMax + 64} {
+		if ValidateReplayWindowSize(bits) == nil {
+			t.Fatal("accepted invalid size", bits)
+		}
+	}
+
+	// filters are reused with a different size
+
+	var filter ReplayFilter
+	filter.InitSize(CounterBitsTotalMax)
+	filter.ValidateCounter(CounterBitsTotalMax)
+	filter.Init()
+	if !filter.ValidateCounter(CounterWindowSize+1) || filter.ValidateCounter(0) {
+		t.Fatal("reused filter retains previous size")
+	}
+}
+
+func TestReplayWrapping(t *testing.T) {
+	const bits = 4096 + 64
+	window := uint64(bits - CounterRedundantBits)
+
+	var filter ReplayFilter
+	filter.InitWrappingSize(bits)
+
+	// counters advance (in steps considered ahead) across the wrap
+
+	for _, counter := range []uint64{1 << 62, 2 << 62, 3 << 62} {
+		if !filter.ValidateCounter(counter) {
+			t.Fatal("rejected counter", counter)
+		}
+	}
+	start := -(window / 2)
+	for i := start; i != window/2; i++ {
+		if !filter.ValidateCounter(i) {
+			t.Fatal("rejected counter", i)
+		}
+	}
+
+	// replays from both sides of the wrap are detected
+
+	for _, counter := range []uint64{0, 1, ^uint64(0), start + window/4} {
+		if filter.ValidateCounter(counter) {
+			t.Fatal("accepted replayed counter", counter)
+		}
+	}
+	if filter.ValidateCounter(start - 2) {
+		t.Fatal("accepted counter beyond window", start-2)
+	}
+
+	// reordered within the window
+
+	top := window * 2
+	if !filter.ValidateCounter(top) {
+		t.Fatal("rejected", top)
+	}
+	for i := top - 1; i > top-window; i -= 7 {
+		if !filter.ValidateCounter(i) {
+			t.Fatal("rejected reordered counter", i)
+		}
+	}
+
+	// the standard filter is reinitialized without wrapping
+
+	filter.InitSize(bits)
+	if filter.ValidateCounter(RejectAfterMessages) {
+		t.Fatal("filter retains wrapping")
+	}
+}
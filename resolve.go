@@ -0,0 +1,222 @@
+/* SPDX-License-Identifier: GPL-2.0
+ *
+ * Copyright (C) 2017-2018 Jason A. Donenfeld <Jason@zx2c4.com>. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	DefaultResolveInterval = time.Minute * 5 // interval between resolutions of hostname endpoints
+	QueueResolveSize       = 128             // pending resolutions (e.g. after handshake timeouts)
+)
+
+/* Resolves an endpoint string (host:port) to an endpoint,
+ * created by the endpoint factory unless replaced (e.g. for testing)
+ */
+type EndpointResolver func(s string) (Endpoint, error)
+
+func (device *Device) SetEndpointResolver(resolver func(s string) (Endpoint, error)) {
+	device.resolver.resolve.Store(EndpointResolver(resolver))
+}
+
+func (device *Device) resolveEndpoint(s string) (Endpoint, error) {
+	if resolve, _ := device.resolver.resolve.Load().(EndpointResolver); resolve != nil {
+		return resolve(s)
+	}
+	return device.EndpointFactory().CreateEndpoint(s)
+}
+
+/* Sets the interval at which endpoints configured by hostname
+ * are resolved again, allowing peers behind dynamic DNS to change address
+ *
+ * An interval of 0 disables periodic resolution,
+ * endpoints are still resolved again when a handshake times out.
+ */
+func (device *Device) SetResolveInterval(interval time.Duration) {
+	atomic.StoreInt64(&device.resolver.interval, int64(interval))
+	select {
+	case device.resolver.reset <- struct{}{}:
+	default:
+	}
+}
+
+func (device *Device) ResolveInterval() time.Duration {
+	return time.Duration(atomic.LoadInt64(&device.resolver.interval))
+}
+
+/* Reports whether the host of the endpoint string is a name,
+ * rather than an IP address
+ */
+func isHostnameEndpoint(s string) bool {
+	host, _, err := net.SplitHostPort(s)
+	if err != nil {
+		return false
+	}
+	if i := strings.LastIndexByte(host, '%'); i >= 0 {
+		host = host[:i]
+	}
+	return net.ParseIP(host) == nil
+}
+
+/* Sets the endpoint of the peer, as resolved from the endpoint string,
+ * hostnames are retained for later resolution
+ *
+ * Must hold peer mutex
+ */
+func (peer *Peer) unsafeSetEndpoint(s string, endpoint Endpoint) {
+	if peer.endpoint == nil || !peer.endpoint.Equal(endpoint) {
+		peer.lastReceived = time.Time{}
+		peer.resetPathMTU()
+	}
+	peer.endpoint = endpoint
+	peer.dns.host = ""
+	peer.dns.resolved = nil
+	if isHostnameEndpoint(s) {
+		peer.dns.host = s
+		peer.dns.resolved = endpoint
+	}
+}
+
+/* Sets the endpoint configured for the peer (see unsafeSetEndpoint),
+ * packets awaiting a key are not held up by a handshake
+ * to the previous endpoint (bypassing RekeyTimeout)
+ */
+func (peer *Peer) configureEndpoint(s string, endpoint Endpoint) {
+	peer.mutex.Lock()
+	changed := peer.endpoint == nil || !peer.endpoint.Equal(endpoint)
+	peer.unsafeSetEndpoint(s, endpoint)
+	peer.mutex.Unlock()
+
+	if changed && peer.isRunning.Get() && peer.queue.packetInNonceQueueIsAwaitingKey.Get() {
+		peer.device.log.Debug.Println(peer, ": Restarting handshake at new endpoint")
+		peer.SendHandshakeInitiation(false, true)
+	}
+}
+
+/* Queues the hostname endpoint of the peer (if any) for resolution
+ */
+func (peer *Peer) requestEndpointResolution() {
+	peer.mutex.RLock()
+	host := peer.dns.host
+	peer.mutex.RUnlock()
+
+	if host == "" {
+		return
+	}
+
+	select {
+	case peer.device.resolver.queue <- peer:
+	default:
+		peer.device.log.Debug.Println(peer, ": Dropping endpoint resolution request")
+	}
+}
+
+/* Resolves the hostname endpoint of the peer again,
+ * the endpoint is only replaced if the resolved address changed
+ * (retaining the endpoint of a peer which roamed since)
+ */
+func (peer *Peer) resolveEndpoint() bool {
+	device := peer.device
+
+	peer.mutex.RLock()
+	host := peer.dns.host
+	peer.mutex.RUnlock()
+
+	if host == "" {
+		return false
+	}
+
+	endpoint, err := device.resolveEndpoint(host)
+	if err != nil {
+		device.log.Info.Println(peer, ": Failed to resolve endpoint", host, ":", err)
+		return false
+	}
+
+	peer.mutex.Lock()
+	defer peer.mutex.Unlock()
+
+	if peer.dns.host != host || peer.dns.resolved == nil || peer.dns.resolved.Equal(endpoint) {
+		return false
+	}
+	device.log.Info.Println(peer, ": Endpoint", host, "resolved to new address", endpoint.DstToString())
+	peer.endpoint = endpoint
+	peer.dns.resolved = endpoint
+	peer.lastReceived = time.Time{}
+	peer.resetPathMTU()
+	return true
+}
+
+func (device *Device) resolveEndpoints() {
+	device.peers.mutex.RLock()
+	peers := make([]*Peer, 0, len(device.peers.keyMap))
+	for _, peer := range device.peers.keyMap {
+		peers = append(peers, peer)
+	}
+	device.peers.mutex.RUnlock()
+
+	for _, peer := range peers {
+		peer.resolveEndpoint()
+	}
+}
+
+/* Resolves hostname endpoints periodically and on request
+ *
+ * Obs. Single instance per device
+ */
+func (device *Device) RoutineResolveEndpoints() {
+
+	logDebug := device.log.Debug
+
+	var timer *time.Timer
+	arm := func() <-chan time.Time {
+		if timer != nil {
+			timer.Stop()
+			timer = nil
+		}
+		if interval := device.ResolveInterval(); interval > 0 {
+			timer = time.NewTimer(interval)
+			return timer.C
+		}
+		return nil
+	}
+
+	defer func() {
+		if timer != nil {
+			timer.Stop()
+		}
+		logDebug.Println("Routine: endpoint resolver - stopped")
+		device.state.stopping.Done()
+	}()
+
+	logDebug.Println("Routine: endpoint resolver - started")
+
+	expired := arm()
+	for {
+		select {
+		case <-device.signals.stop:
+			return
+
+		case <-device.resolver.reset:
+			expired = arm()
+
+		case peer := <-device.resolver.queue:
+			peer.resolveEndpoint()
+
+		case <-expired:
+
+			// the interval may have been disabled after the timer fired
+
+			if device.ResolveInterval() > 0 {
+				device.resolveEndpoints()
+			}
+			expired = arm()
+		}
+	}
+}
@@ -0,0 +1,114 @@
+/* SPDX-License-Identifier: GPL-2.0
+ *
+ * Copyright (C) 2017-2018 Jason A. Donenfeld <Jason@zx2c4.com>. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+/* Resolver answering from a table of hostnames,
+ * which may be changed while in use
+ */
+type StubResolver struct {
+	mutex sync.Mutex
+	hosts map[string]string
+}
+
+func (r *StubResolver) set(host, addr string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.hosts[host] = addr
+}
+
+func (r *StubResolver) resolve(s string) (Endpoint, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	addr, ok := r.hosts[s]
+	if !ok {
+		return CreateEndpoint(s)
+	}
+	return CreateEndpoint(addr)
+}
+
+func TestResolveEndpoint(t *testing.T) {
+	device := randDevice(t)
+	defer device.Close()
+	peer := randPeer(t, device)
+
+	resolver := &StubResolver{hosts: make(map[string]string)}
+	resolver.set("peer.example:51820", "192.0.2.1:51820")
+	device.SetEndpointResolver(resolver.resolve)
+
+	publicKey := "public_key=" + peer.handshake.remoteStatic.ToHex() + "\n"
+	endpoint := func() string {
+		peer.mutex.RLock()
+		defer peer.mutex.RUnlock()
+		return peer.endpoint.DstToString()
+	}
+	waitEndpoint := func(expected string) {
+		deadline := time.Now().Add(time.Second * 5)
+		for endpoint() != expected {
+			if time.Now().After(deadline) {
+				t.Fatal("endpoint not resolved to", expected, ", is", endpoint())
+			}
+			time.Sleep(time.Millisecond * 10)
+		}
+	}
+
+	uapiSet(t, device, publicKey+"endpoint=peer.example:51820")
+	if endpoint() != "192.0.2.1:51820" {
+		t.Fatal("unexpected endpoint:", endpoint())
+	}
+
+	// periodic resolution follows a change of address
+
+	resolver.set("peer.example:51820", "192.0.2.2:51820")
+	device.SetResolveInterval(time.Millisecond * 20)
+	waitEndpoint("192.0.2.2:51820")
+
+	// an unchanged address does not override a roamed endpoint
+
+	roamed, _ := CreateEndpoint("198.51.100.1:51820")
+	peer.mutex.Lock()
+	peer.endpoint = roamed
+	peer.mutex.Unlock()
+	time.Sleep(time.Millisecond * 100)
+	if endpoint() != "198.51.100.1:51820" {
+		t.Fatal("roamed endpoint replaced by unchanged resolution:", endpoint())
+	}
+
+	// a handshake timeout resolves the endpoint again
+	// (once a periodic resolution still in flight completed)
+
+	device.SetResolveInterval(0)
+	time.Sleep(time.Millisecond * 100)
+	resolver.set("peer.example:51820", "192.0.2.3:51820")
+	time.Sleep(time.Millisecond * 100)
+	if endpoint() != "198.51.100.1:51820" {
+		t.Fatal("endpoint resolved with periodic resolution disabled:", endpoint())
+	}
+	expiredRetransmitHandshake(peer)
+	waitEndpoint("192.0.2.3:51820")
+
+	// failed resolutions retain the endpoint,
+	// endpoints configured by address are not resolved again
+
+	device.SetEndpointResolver(func(s string) (Endpoint, error) {
+		return nil, errors.New("resolver unavailable")
+	})
+	if peer.resolveEndpoint() || endpoint() != "192.0.2.3:51820" {
+		t.Fatal("endpoint changed by failed resolution:", endpoint())
+	}
+	device.SetEndpointResolver(resolver.resolve)
+	uapiSet(t, device, publicKey+"endpoint=192.0.2.9:51820")
+	resolver.set("peer.example:51820", "192.0.2.4:51820")
+	if peer.resolveEndpoint() || endpoint() != "192.0.2.9:51820" {
+		t.Fatal("endpoint configured by address resolved again:", endpoint())
+	}
+}
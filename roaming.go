@@ -0,0 +1,192 @@
+/* SPDX-License-Identifier: GPL-2.0
+ *
+ * Copyright (C) 2017-2018 Jason A. Donenfeld <Jason@zx2c4.com>. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+const (
+	QueueEndpointChangeSize = 128 // pending endpoint change notifications
+)
+
+type EndpointChangeHandler func(peer *Peer, old, new Endpoint)
+
+type endpointChange struct {
+	peer *Peer
+	old  Endpoint
+	new  Endpoint
+}
+
+/* Registers a handler called whenever a peer roams,
+ * i.e. authenticated packets from the peer arrive from a new address
+ *
+ * The handler is called from a separate routine (in order),
+ * notifications are dropped while the handler is unable to keep up.
+ * A nil handler disables the notifications.
+ */
+func (device *Device) SetEndpointChangeHandler(handler func(peer *Peer, old, new Endpoint)) {
+	device.roaming.handler.Store(EndpointChangeHandler(handler))
+}
+
+func (device *Device) endpointChangeHandler() EndpointChangeHandler {
+	handler, _ := device.roaming.handler.Load().(EndpointChangeHandler)
+	return handler
+}
+
+/* Records the index of the interface on which authenticated packets
+ * from a peer arrive (for diagnostics), if known to the bind
+ */
+func (device *Device) SetRecordRxInterface(enabled bool) {
+	device.roaming.rxInterface.Set(enabled)
+}
+
+func (device *Device) RecordRxInterface() bool {
+	return device.roaming.rxInterface.Get()
+}
+
+/* Returns the index of the interface on which the last authenticated packet
+ * from the peer arrived (0 if unknown or not recorded)
+ */
+func (peer *Peer) RxInterface() int {
+	if !peer.device.RecordRxInterface() {
+		return 0
+	}
+	return int(atomic.LoadInt64(&peer.stats.rxInterface))
+}
+
+/* Reports whether packets from the endpoint are accepted,
+ * a pinned peer only accepts packets from its current endpoint
+ * (or any endpoint, until the first is known)
+ */
+func (peer *Peer) acceptsEndpoint(endpoint Endpoint) bool {
+	peer.mutex.RLock()
+	defer peer.mutex.RUnlock()
+
+	if !peer.endpointPinned || peer.endpoint == nil {
+		return true
+	}
+	return peer.endpoint.Equal(endpoint)
+}
+
+/* Swaps the endpoint of the peer with the backup endpoint,
+ * such that the next handshake initiation is sent to the backup
+ * (a response then keeps the peer at the backup, see updateEndpoint)
+ */
+func (peer *Peer) failoverEndpoint() {
+	peer.mutex.Lock()
+	defer peer.mutex.Unlock()
+
+	if peer.endpointBackup == nil {
+		return
+	}
+	peer.device.log.Info.Println(peer, ": Failing over to endpoint", peer.endpointBackup.DstToString())
+	peer.endpoint, peer.endpointBackup = peer.endpointBackup, peer.endpoint
+	peer.endpoint.ClearSrc()
+	peer.lastReceived = time.Time{}
+}
+
+/* Sets the endpoint of the peer to the source of an authenticated packet,
+ * unless the endpoint of the peer is pinned
+ */
+func (peer *Peer) updateEndpoint(endpoint Endpoint) {
+	device := peer.device
+
+	if device.RecordRxInterface() {
+		if end, ok := endpoint.(InterfaceEndpoint); ok {
+			atomic.StoreInt64(&peer.stats.rxInterface, int64(end.SrcIfindex()))
+		}
+	}
+
+	peer.mutex.Lock()
+	peer.lastReceived = time.Now()
+	old := peer.endpoint
+	if peer.endpointPinned && old != nil {
+		peer.mutex.Unlock()
+		return
+	}
+	peer.endpoint = endpoint
+	if old == nil || !old.Equal(endpoint) {
+		peer.resetPathMTU()
+	}
+	peer.mutex.Unlock()
+
+	if old != nil && old.Equal(endpoint) {
+		return
+	}
+
+	device.publishEvent(Event{
+		Kind:      EventEndpointRoamed,
+		PublicKey: peer.handshake.remoteStatic,
+		Endpoint:  endpoint.DstToString(),
+	})
+
+	if device.endpointChangeHandler() == nil {
+		return
+	}
+
+	select {
+	case device.roaming.queue <- endpointChange{peer, old, endpoint}:
+	default:
+		device.log.Debug.Println(peer, ": Dropping endpoint change notification")
+	}
+}
+
+/* Delivers endpoint change notifications to the handler
+ *
+ * Obs. Single instance per device
+ */
+func (device *Device) RoutineEndpointChange() {
+
+	logDebug := device.log.Debug
+
+	defer func() {
+		logDebug.Println("Routine: endpoint change notifier - stopped")
+		device.state.stopping.Done()
+	}()
+
+	logDebug.Println("Routine: endpoint change notifier - started")
+
+	for {
+		select {
+		case <-device.signals.stop:
+			return
+
+		case change := <-device.roaming.queue:
+			if handler := device.endpointChangeHandler(); handler != nil {
+				handler(change.peer, change.old, change.new)
+			}
+		}
+	}
+}
+
+/* Endpoint of a peer, as enumerated by Device.Endpoints
+ */
+type PeerEndpoint struct {
+	Endpoint     string    // empty if unknown
+	LastReceived time.Time // zero if nothing was received from the endpoint
+}
+
+/* Enumerates the endpoints of the peers and when they were last heard from,
+ * e.g. for a dashboard of connected clients of an embedder
+ */
+func (device *Device) Endpoints() map[NoisePublicKey]PeerEndpoint {
+	device.peers.mutex.RLock()
+	defer device.peers.mutex.RUnlock()
+
+	endpoints := make(map[NoisePublicKey]PeerEndpoint, len(device.peers.keyMap))
+	for key, peer := range device.peers.keyMap {
+		peer.mutex.RLock()
+		endpoint := PeerEndpoint{LastReceived: peer.lastReceived}
+		if peer.endpoint != nil {
+			endpoint.Endpoint = peer.endpoint.DstToString()
+		}
+		peer.mutex.RUnlock()
+		endpoints[key] = endpoint
+	}
+	return endpoints
+}
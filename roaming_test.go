@@ -0,0 +1,215 @@
+/* SPDX-License-Identifier: GPL-2.0
+ *
+ * Copyright (C) 2017-2018 Jason A. Donenfeld <Jason@zx2c4.com>. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEndpointChangeHandler(t *testing.T) {
+	dev1, dev2 := genTestPair(t)
+	defer dev1.Close()
+	defer dev2.Close()
+
+	type change struct {
+		peer     *Peer
+		old, new string
+	}
+	changes := make(chan change, 16)
+	dev2.SetEndpointChangeHandler(func(peer *Peer, old, new Endpoint) {
+		changes <- change{peer, old.DstToString(), new.DstToString()}
+	})
+
+	src, dst := net.IPv4(10, 0, 0, 1), net.IPv4(10, 0, 0, 2)
+	tun1 := dev1.tun.device.(*DummyTUN)
+	peer := dev2.LookupPeer(dev1.noise.publicKey)
+
+	// packets from the configured endpoint cause no notification
+
+	tun1.packets <- genIPv4Packet(src, dst, 100)
+	recvPacket(t, dev2.tun.device, time.Second*10)
+
+	select {
+	case c := <-changes:
+		t.Fatal("unexpected endpoint change:", c.old, "->", c.new)
+	case <-time.After(time.Millisecond * 100):
+	}
+
+	// move the source of the first device to another port
+
+	oldPort, newPort := dev1.net.port, freePorts(t, 1)[0]
+	uapiSet(t, dev1, fmt.Sprintf("listen_port=%d", newPort))
+
+	tun1.packets <- genIPv4Packet(src, dst, 100)
+	recvPacket(t, dev2.tun.device, time.Second*10)
+
+	select {
+	case c := <-changes:
+		if c.peer != peer {
+			t.Fatal("change reported for wrong peer")
+		}
+		if c.old != fmt.Sprintf("127.0.0.1:%d", oldPort) || c.new != fmt.Sprintf("127.0.0.1:%d", newPort) {
+			t.Fatal("unexpected endpoint change:", c.old, "->", c.new)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("endpoint change not reported")
+	}
+}
+
+func TestEndpointPinning(t *testing.T) {
+	dev1, dev2 := genTestPair(t)
+	defer dev1.Close()
+	defer dev2.Close()
+
+	src, dst := net.IPv4(10, 0, 0, 1), net.IPv4(10, 0, 0, 2)
+	tun1 := dev1.tun.device.(*DummyTUN)
+	tun2 := dev2.tun.device.(*DummyTUN)
+	peer := dev2.LookupPeer(dev1.noise.publicKey)
+
+	tun1.packets <- genIPv4Packet(src, dst, 100)
+	recvPacket(t, tun2, time.Second*10)
+
+	// pin the peer to an endpoint it does not send from
+
+	pinned := "127.0.0.1:9"
+	uapiSet(t, dev2, fmt.Sprintf(
+		"public_key=%s\nendpoint=%s\nendpoint_pinned=1",
+		dev1.noise.publicKey.ToHex(), pinned,
+	))
+
+	tun1.packets <- genIPv4Packet(src, dst, 100)
+	select {
+	case <-tun2.written:
+		t.Fatal("packet from unpinned endpoint accepted")
+	case <-time.After(time.Millisecond * 200):
+	}
+
+	peer.mutex.RLock()
+	endpoint := peer.endpoint.DstToString()
+	peer.mutex.RUnlock()
+	if endpoint != pinned {
+		t.Fatal("pinned endpoint changed to", endpoint)
+	}
+
+	// unpinning allows the peer to roam again
+
+	uapiSet(t, dev2, fmt.Sprintf(
+		"public_key=%s\nendpoint_pinned=0",
+		dev1.noise.publicKey.ToHex(),
+	))
+
+	tun1.packets <- genIPv4Packet(src, dst, 100)
+	recvPacket(t, tun2, time.Second*10)
+
+	peer.mutex.RLock()
+	endpoint = peer.endpoint.DstToString()
+	peer.mutex.RUnlock()
+	if endpoint != fmt.Sprintf("127.0.0.1:%d", dev1.net.port) {
+		t.Fatal("endpoint did not roam after unpinning:", endpoint)
+	}
+}
+
+func TestEndpointFailover(t *testing.T) {
+	dev1, dev2 := genTestPair(t)
+	defer dev1.Close()
+	defer dev2.Close()
+
+	// the primary endpoint black-holes datagrams
+
+	hole, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hole.Close()
+
+	primary := hole.LocalAddr().String()
+	backup := fmt.Sprintf("127.0.0.1:%d", dev2.net.port)
+	peer := dev1.LookupPeer(dev2.noise.publicKey)
+	uapiSet(t, dev1, fmt.Sprintf(
+		"public_key=%s\nendpoint=%s\nendpoint_backup=%s",
+		peer.handshake.remoteStatic.ToHex(), primary, backup,
+	))
+	if get := uapiRequest(t, dev1, "get=1\n\n"); !strings.Contains(get, "endpoint_backup="+backup+"\n") {
+		t.Fatal("backup endpoint not reported:", get)
+	}
+
+	endpoint := func() string {
+		peer.mutex.RLock()
+		defer peer.mutex.RUnlock()
+		return peer.endpoint.DstToString()
+	}
+
+	src, dst := net.IPv4(10, 0, 0, 1), net.IPv4(10, 0, 0, 2)
+	packet := genIPv4Packet(src, dst, 100)
+	dev1.tun.device.(*DummyTUN).packets <- packet
+
+	// handshakes time out, until the backup is tried
+
+	for i := 0; i < HandshakeFailoverAttempts; i++ {
+		if endpoint() != primary {
+			t.Fatal("failed over after", i, "attempts:", endpoint())
+		}
+		peer.timers.lastSentHandshake = time.Time{}
+		expiredRetransmitHandshake(peer)
+	}
+	if endpoint() != backup {
+		t.Fatal("no failover to backup endpoint:", endpoint())
+	}
+
+	// the backup responds, the queued packet follows
+
+	assertEqual(t, recvPacket(t, dev2.tun.device, time.Second*5), packet)
+	if endpoint() != backup {
+		t.Fatal("peer not kept at backup endpoint:", endpoint())
+	}
+}
+
+func TestEndpoints(t *testing.T) {
+	dev1, dev2 := genTestPair(t)
+	defer dev1.Close()
+	defer dev2.Close()
+
+	// a second peer of the first device, whose endpoint is learned
+
+	dev3 := randDevice(t)
+	defer dev3.Close()
+	dev3.Up()
+	uapiSet(t, dev3, fmt.Sprintf("public_key=%s\nendpoint=127.0.0.1:%d\nallowed_ip=10.0.0.1/32",
+		dev1.noise.publicKey.ToHex(), dev1.net.port))
+	uapiSet(t, dev1, "public_key="+dev3.noise.publicKey.ToHex()+"\nallowed_ip=10.0.0.3/32")
+
+	if endpoint := dev1.Endpoints()[dev3.noise.publicKey]; endpoint.Endpoint != "" || !endpoint.LastReceived.IsZero() {
+		t.Fatal("endpoint of peer enumerated before receiving:", endpoint)
+	}
+
+	// both peers are enumerated once received from
+
+	start := time.Now()
+	dst := net.IPv4(10, 0, 0, 1)
+	for i, dev := range []*Device{dev2, dev3} {
+		packet := genIPv4Packet(net.IPv4(10, 0, 0, byte(2+i)), dst, 100)
+		dev.tun.device.(*DummyTUN).packets <- packet
+		assertEqual(t, recvPacket(t, dev1.tun.device, time.Second*5), packet)
+	}
+
+	endpoints := dev1.Endpoints()
+	if len(endpoints) != 2 {
+		t.Fatal("unexpected number of endpoints:", len(endpoints))
+	}
+	for _, dev := range []*Device{dev2, dev3} {
+		endpoint := endpoints[dev.noise.publicKey]
+		if endpoint.Endpoint != fmt.Sprintf("127.0.0.1:%d", dev.net.port) {
+			t.Fatal("unexpected endpoint:", endpoint.Endpoint)
+		}
+		if endpoint.LastReceived.Before(start) || endpoint.LastReceived.After(time.Now()) {
+			t.Fatal("last received not recent:", endpoint.LastReceived)
+		}
+	}
+}
@@ -27,6 +27,22 @@ func (table *RoutingTable) AllowedIPs(peer *Peer) []net.IPNet {
 	return allowed
 }
 
+/* Returns the allowed IPs of the peer,
+ * with the number of outbound packets routed by each
+ */
+func (table *RoutingTable) AllowedIPHits(peer *Peer) ([]net.IPNet, []uint64) {
+	table.mutex.RLock()
+	defer table.mutex.RUnlock()
+
+	allowed := make([]net.IPNet, 0, 10)
+	allowed = table.IPv4.AllowedIPs(peer, allowed)
+	allowed = table.IPv6.AllowedIPs(peer, allowed)
+	hits := make([]uint64, 0, len(allowed))
+	hits = table.IPv4.Hits(peer, hits)
+	hits = table.IPv6.Hits(peer, hits)
+	return allowed, hits
+}
+
 func (table *RoutingTable) Reset() {
 	table.mutex.Lock()
 	defer table.mutex.Unlock()
@@ -57,6 +73,34 @@ func (table *RoutingTable) Insert(ip net.IP, cidr uint, peer *Peer) {
 	}
 }
 
+func (table *RoutingTable) Remove(ip net.IP, cidr uint, peer *Peer) {
+	table.mutex.Lock()
+	defer table.mutex.Unlock()
+
+	switch len(ip) {
+	case net.IPv6len:
+		table.IPv6 = table.IPv6.Remove(ip, cidr, peer)
+	case net.IPv4len:
+		table.IPv4 = table.IPv4.Remove(ip, cidr, peer)
+	default:
+		panic(errors.New("Removing unknown address type"))
+	}
+}
+
+func (table *RoutingTable) Owner(ip net.IP, cidr uint) *Peer {
+	table.mutex.RLock()
+	defer table.mutex.RUnlock()
+
+	switch len(ip) {
+	case net.IPv6len:
+		return table.IPv6.Owner(ip, cidr)
+	case net.IPv4len:
+		return table.IPv4.Owner(ip, cidr)
+	default:
+		panic(errors.New("Looking up unknown address type"))
+	}
+}
+
 func (table *RoutingTable) LookupIPv4(address []byte) *Peer {
 	table.mutex.RLock()
 	defer table.mutex.RUnlock()
@@ -68,3 +112,56 @@ func (table *RoutingTable) LookupIPv6(address []byte) *Peer {
 	defer table.mutex.RUnlock()
 	return table.IPv6.Lookup(address)
 }
+
+/* Returns the peer packets to the address are sent to,
+ * counting the hit of the allowed IP (see AllowedIPHits)
+ */
+func (table *RoutingTable) RouteIPv4(address []byte) *Peer {
+	table.mutex.RLock()
+	defer table.mutex.RUnlock()
+	return table.IPv4.LookupCounted(address)
+}
+
+func (table *RoutingTable) RouteIPv6(address []byte) *Peer {
+	table.mutex.RLock()
+	defer table.mutex.RUnlock()
+	return table.IPv6.LookupCounted(address)
+}
+
+/* A change of the allowed IPs of a peer (see Update)
+ */
+type RoutingChange struct {
+	Peer    *Peer
+	Network *net.IPNet // nil removes all allowed IPs of the peer
+	Remove  bool
+}
+
+/* Applies the changes under a single lock,
+ * such that lookups observe either none or all of them
+ */
+func (table *RoutingTable) Update(changes []RoutingChange) {
+	table.mutex.Lock()
+	defer table.mutex.Unlock()
+
+	for _, change := range changes {
+		if change.Network == nil {
+			table.IPv4 = table.IPv4.RemovePeer(change.Peer)
+			table.IPv6 = table.IPv6.RemovePeer(change.Peer)
+			continue
+		}
+		ip := change.Network.IP
+		ones, _ := change.Network.Mask.Size()
+		switch {
+		case len(ip) == net.IPv4len && change.Remove:
+			table.IPv4 = table.IPv4.Remove(ip, uint(ones), change.Peer)
+		case len(ip) == net.IPv4len:
+			table.IPv4 = table.IPv4.Insert(ip, uint(ones), change.Peer)
+		case len(ip) == net.IPv6len && change.Remove:
+			table.IPv6 = table.IPv6.Remove(ip, uint(ones), change.Peer)
+		case len(ip) == net.IPv6len:
+			table.IPv6 = table.IPv6.Insert(ip, uint(ones), change.Peer)
+		default:
+			panic(errors.New("Updating unknown address type"))
+		}
+	}
+}
@@ -7,6 +7,7 @@ package main
 
 import (
 	"bytes"
+	"crypto/rand"
 	"encoding/binary"
 	"golang.org/x/crypto/chacha20poly1305"
 	"golang.org/x/net/ipv4"
@@ -49,26 +50,43 @@ type QueueOutboundElement struct {
 	nonce   uint64                // nonce for encryption
 	keyPair *Keypair              // key-pair for encryption
 	peer    *Peer                 // related peer
+	flushes uint32                // value of peer.queue.flushes when the nonce was assigned
+	flushed chan struct{}         // closed once preceding packets are sent (see Device.Shutdown)
 }
 
 func (device *Device) NewOutboundElement() *QueueOutboundElement {
 	return &QueueOutboundElement{
 		dropped: AtomicFalse,
-		buffer:  device.pool.messageBuffers.Get().(*[MaxMessageSize]byte),
+		buffer:  device.GetMessageBuffer(),
 	}
 }
 
-func (elem *QueueOutboundElement) Drop() {
-	atomic.StoreInt32(&elem.dropped, AtomicTrue)
+/* Marks the element as dropped,
+ * returns false if it was already dropped
+ */
+func (elem *QueueOutboundElement) Drop() bool {
+	return atomic.SwapInt32(&elem.dropped, AtomicTrue) == AtomicFalse
 }
 
 func (elem *QueueOutboundElement) IsDropped() bool {
 	return atomic.LoadInt32(&elem.dropped) == AtomicTrue
 }
 
+/* Drops the element if the nonce queue of the peer
+ * has been flushed since the element was assigned a nonce
+ */
+func (elem *QueueOutboundElement) dropIfFlushed() bool {
+	if atomic.LoadUint32(&elem.peer.queue.flushes) == elem.flushes {
+		return elem.IsDropped()
+	}
+	elem.Drop()
+	return true
+}
+
 func addToOutboundQueue(
 	queue chan *QueueOutboundElement,
 	element *QueueOutboundElement,
+	drops *uint64,
 ) {
 	for {
 		select {
@@ -77,7 +95,11 @@ func addToOutboundQueue(
 		default:
 			select {
 			case old := <-queue:
-				old.Drop()
+				if old.flushed != nil {
+					close(old.flushed) // release the waiter of a shutdown marker
+				} else if old.Drop() {
+					atomic.AddUint64(drops, 1)
+				}
 			default:
 			}
 		}
@@ -96,7 +118,9 @@ func addToEncryptionQueue(
 			select {
 			case old := <-queue:
 				// drop & release to potential consumer
-				old.Drop()
+				if old.Drop() {
+					atomic.AddUint64(&old.peer.stats.outboundDrops, 1)
+				}
 				old.mutex.Unlock()
 			default:
 			}
@@ -104,10 +128,21 @@ func addToEncryptionQueue(
 	}
 }
 
+/* Returns the buffer of an element which will not be sent,
+ * shutdown markers are passed by releasing their waiter
+ */
+func (device *Device) releaseOutboundElement(elem *QueueOutboundElement) {
+	if elem.flushed != nil {
+		close(elem.flushed)
+		return
+	}
+	device.PutMessageBuffer(elem.buffer)
+}
+
 /* Queues a keepalive if no packets are queued for peer
  */
 func (peer *Peer) SendKeepalive() bool {
-	if len(peer.queue.nonce) != 0 || peer.queue.packetInNonceQueueIsAwaitingKey {
+	if len(peer.queue.nonce) != 0 || peer.queue.packetInNonceQueueIsAwaitingKey.Get() {
 		return false
 	}
 	elem := peer.device.NewOutboundElement()
@@ -121,17 +156,38 @@ func (peer *Peer) SendKeepalive() bool {
 	}
 }
 
-/* Sends a new handshake initiation message to the peer (endpoint)
+/* Sends a new handshake initiation message to the peer (endpoint),
+ * unless one was sent within the retry timeout (bypassed when forced)
  */
-func (peer *Peer) SendHandshakeInitiation(isRetry bool) error {
-	if !isRetry {
+func (peer *Peer) SendHandshakeInitiation(isRetry bool, force bool) error {
+	// with backoff enabled, attempts are reset by a completed handshake
+	// or when a new cycle begins (no retransmission pending, e.g. after giving up)
+
+	if !isRetry && (!peer.device.handshakeBackoffEnabled() || !peer.timers.retransmitHandshake.isPending) {
 		peer.timers.handshakeAttempts = 0
 	}
 
-	if time.Now().Sub(peer.timers.lastSentHandshake) < RekeyTimeout {
+	// traffic resumed to an unreachable peer, handshakes are attempted anew
+
+	if !isRetry && peer.unreachable.Get() {
+		peer.unreachable.Set(false)
+		peer.timers.handshakeAttempts = 0
+	}
+
+	// retries are spaced by the timeout of the attempt that failed
+
+	attempts := peer.timers.handshakeAttempts
+	if isRetry && attempts > 0 {
+		attempts--
+	}
+
+	if !force && time.Now().Sub(peer.timers.lastSentHandshake) < peer.device.handshakeRetryTimeout(attempts) {
 		return nil
 	}
 	peer.timers.lastSentHandshake = time.Now() //TODO: locking for this variable?
+	if peer.timers.handshakeAttempts == 0 {
+		peer.timers.handshakeStarted = peer.timers.lastSentHandshake
+	}
 
 	// create initiation message
 
@@ -165,9 +221,10 @@ func (peer *Peer) keepKeyFreshSending() {
 	if kp == nil {
 		return
 	}
+	config := peer.device.TimerConfig()
 	nonce := atomic.LoadUint64(&kp.sendNonce)
-	if nonce > RekeyAfterMessages || (kp.isInitiator && time.Now().Sub(kp.created) > RekeyAfterTime) {
-		peer.SendHandshakeInitiation(false)
+	if (nonce > RekeyAfterMessages && !kp.extended) || (kp.isInitiator && time.Now().Sub(kp.created) > config.RekeyAfterTime) {
+		peer.SendHandshakeInitiation(false, false)
 	}
 }
 
@@ -178,23 +235,84 @@ func (peer *Peer) keepKeyFreshSending() {
  */
 func (device *Device) RoutineReadFromTUN() {
 
-	elem := device.NewOutboundElement()
+	var elems []*QueueOutboundElement
+	var bufs [][]byte
+	var scratch []byte // packets read with a virtio_net_hdr, split into the buffers
+
+	_, batchReader := device.tun.device.(TUNBatchReader)
 
 	logDebug := device.log.Debug
 	logError := device.log.Error
 
 	defer func() {
 		logDebug.Println("Routine: TUN reader - stopped")
+		device.health.readTUN.stopped()
 	}()
 
 	logDebug.Println("Routine: TUN reader - started")
+	device.health.readTUN.started()
 
 	for {
 
-		// read packet
+		// hold no buffers while suspended
+
+		if resumed := device.suspended(); resumed != nil {
+			for _, elem := range elems {
+				device.PutMessageBuffer(elem.buffer)
+			}
+			elems, bufs = elems[:0], bufs[:0]
+			logDebug.Println("Routine: TUN reader - suspended")
+			select {
+			case <-resumed:
+			case <-device.signals.stop:
+				return
+			}
+			logDebug.Println("Routine: TUN reader - resumed")
+		}
+
+		// read nothing (holding no buffers) while down
 
-		offset := MessageTransportHeaderSize
-		size, err := device.tun.device.Read(elem.buffer[:], offset)
+		if up := device.awaitingUp(); up != nil {
+			for _, elem := range elems {
+				device.PutMessageBuffer(elem.buffer)
+			}
+			elems, bufs = elems[:0], bufs[:0]
+			logDebug.Println("Routine: TUN reader - awaiting up")
+			select {
+			case <-up:
+			case <-device.signals.stop:
+				return
+			}
+			logDebug.Println("Routine: TUN reader - up")
+			continue
+		}
+
+		// buffers of a batch, replaced once handed to a peer
+
+		gso := device.tun.gso.Get()
+		batch := 1
+		if batchReader || gso {
+			batch = MaxTUNReadBatch
+		}
+		for len(elems) < batch {
+			elem := device.NewOutboundElement()
+			elems = append(elems, elem)
+			bufs = append(bufs, elem.buffer[:])
+		}
+
+		// read packets
+
+		var sizes []int
+		var err error
+		offset := device.tun.offset
+		if gso {
+			if scratch == nil {
+				scratch = make([]byte, offset+virtioNetHdrLen+MaxSegmentSize)
+			}
+			sizes, err = device.readTUNSegments(scratch, bufs, offset)
+		} else {
+			sizes, err = tunReadBatch(device.tun.device, bufs, offset)
+		}
 
 		if err != nil {
 			logError.Println("Failed to read packet from TUN device:", err)
@@ -202,51 +320,93 @@ func (device *Device) RoutineReadFromTUN() {
 			return
 		}
 
-		if size == 0 || size > MaxContentSize {
+		device.health.readTUN.active()
+
+		// packets read while suspending are dropped
+
+		if device.suspend.active.Get() {
 			continue
 		}
 
-		elem.packet = elem.buffer[offset : offset+size]
+		for i, size := range sizes {
+			if i >= len(elems) {
+				break
+			}
+			if device.routeOutbound(elems[i], offset, size) {
+				elems[i] = device.NewOutboundElement()
+				bufs[i] = elems[i].buffer[:]
+			}
+		}
+	}
+}
 
-		// lookup peer
+/* Inserts a packet read from the TUN into the nonce queue of its peer,
+ * returns false if the packet was discarded (and the element may be reused)
+ */
+func (device *Device) routeOutbound(elem *QueueOutboundElement, offset int, size int) bool {
 
-		var peer *Peer
-		switch elem.packet[0] >> 4 {
-		case ipv4.Version:
-			if len(elem.packet) < ipv4.HeaderLen {
-				continue
-			}
-			dst := elem.packet[IPv4offsetDst : IPv4offsetDst+net.IPv4len]
-			peer = device.routing.table.LookupIPv4(dst)
+	logDebug := device.log.Debug
 
-		case ipv6.Version:
-			if len(elem.packet) < ipv6.HeaderLen {
-				continue
-			}
-			dst := elem.packet[IPv6offsetDst : IPv6offsetDst+net.IPv6len]
-			peer = device.routing.table.LookupIPv6(dst)
+	if size == 0 || size > MaxContentSize-(offset-MessageTransportHeaderSize) {
+		return false
+	}
 
-		default:
-			logDebug.Println("Received packet with unknown IP version")
+	// admit no new packets while shutting down
+
+	if device.isDraining.Get() {
+		return false
+	}
+
+	elem.packet = elem.buffer[offset : offset+size]
+
+	// lookup peer
+
+	var peer *Peer
+	switch elem.packet[0] >> 4 {
+	case ipv4.Version:
+		if len(elem.packet) < ipv4.HeaderLen {
+			return false
 		}
+		dst := elem.packet[IPv4offsetDst : IPv4offsetDst+net.IPv4len]
+		peer = device.routing.table.RouteIPv4(dst)
 
-		if peer == nil {
-			continue
+	case ipv6.Version:
+		if len(elem.packet) < ipv6.HeaderLen {
+			return false
 		}
+		dst := elem.packet[IPv6offsetDst : IPv6offsetDst+net.IPv6len]
+		peer = device.routing.table.RouteIPv6(dst)
 
-		// insert into nonce/pre-handshake queue
+	default:
+		logDebug.Println("Received packet with unknown IP version")
+	}
 
-		if peer.isRunning.Get() {
-			if peer.queue.packetInNonceQueueIsAwaitingKey {
-				peer.SendHandshakeInitiation(false)
-			}
-			addToOutboundQueue(peer.queue.nonce, elem)
-			elem = device.NewOutboundElement()
-		}
+	if peer == nil {
+		return false
 	}
+
+	return peer.queueOutbound(elem)
 }
 
+/* Inserts a packet into the nonce/pre-handshake queue of the peer,
+ * returns false if the peer is not running
+ */
+func (peer *Peer) queueOutbound(elem *QueueOutboundElement) bool {
+	if !peer.isRunning.Get() {
+		return false
+	}
+	if peer.queue.packetInNonceQueueIsAwaitingKey.Get() {
+		peer.SendHandshakeInitiation(false, false)
+	}
+	addToOutboundQueue(peer.queue.nonce, elem, &peer.stats.nonceDrops)
+	return true
+}
+
+/* Drops the packets awaiting a key pair,
+ * as well as those already handed to the encryption workers
+ */
 func (peer *Peer) FlushNonceQueue() {
+	atomic.AddUint32(&peer.queue.flushes, 1)
 	select {
 	case peer.signals.flushNonceQueue <- struct{}{}:
 	default:
@@ -267,16 +427,18 @@ func (peer *Peer) RoutineNonce() {
 
 	defer func() {
 		logDebug.Println(peer, ": Routine: nonce worker - stopped")
-		peer.queue.packetInNonceQueueIsAwaitingKey = false
+		peer.queue.packetInNonceQueueIsAwaitingKey.Set(false)
+		peer.health.nonce.stopped()
 		peer.routines.stopping.Done()
 	}()
 
+	peer.health.nonce.started()
 	peer.routines.starting.Done()
 	logDebug.Println(peer, ": Routine: nonce worker - started")
 
 	for {
 	NextPacket:
-		peer.queue.packetInNonceQueueIsAwaitingKey = false
+		peer.queue.packetInNonceQueueIsAwaitingKey.Set(false)
 
 		select {
 		case <-peer.routines.stop:
@@ -288,23 +450,50 @@ func (peer *Peer) RoutineNonce() {
 				return
 			}
 
-			// wait for key pair
+			peer.health.nonce.active()
+
+			// pass on shutdown marker (in order)
+
+			if elem.flushed != nil {
+				addToOutboundQueue(peer.queue.outbound, elem, &peer.stats.outboundDrops)
+				continue
+			}
+
+			// wait for key pair and assign nonce,
+			// the packet is retained (in order) until a fresh key pair arrives
 
 			for {
+				force := false
+				config := device.TimerConfig()
 				keyPair = peer.keyPairs.Current()
-				if keyPair != nil && keyPair.sendNonce < RejectAfterMessages {
-					if time.Now().Sub(keyPair.created) < RejectAfterTime {
+				if keyPair != nil && time.Now().Sub(keyPair.created) < config.RejectAfterTime {
+
+					// random nonces are not exhausted, the counter wraps
+
+					if keyPair.extended {
+						elem.nonce = atomic.AddUint64(&keyPair.sendNonce, 1) - 1
 						break
 					}
+
+					if atomic.LoadUint64(&keyPair.sendNonce) < config.RejectAfterMessages {
+						elem.nonce = atomic.AddUint64(&keyPair.sendNonce, 1) - 1
+						if elem.nonce < config.RejectAfterMessages {
+							break
+						}
+					}
+
+					// nonces exhausted, force a handshake (bypassing RekeyTimeout)
+
+					force = true
 				}
-				peer.queue.packetInNonceQueueIsAwaitingKey = true
+				peer.queue.packetInNonceQueueIsAwaitingKey.Set(true)
 
 				select {
 				case <-peer.signals.newKeypairArrived:
 				default:
 				}
 
-				peer.SendHandshakeInitiation(false)
+				peer.SendHandshakeInitiation(false, force)
 
 				logDebug.Println(peer, ": Awaiting key-pair")
 
@@ -312,35 +501,34 @@ func (peer *Peer) RoutineNonce() {
 				case <-peer.signals.newKeypairArrived:
 					logDebug.Println(peer, ": Obtained awaited key-pair")
 				case <-peer.signals.flushNonceQueue:
+					device.releaseOutboundElement(elem)
 					for {
 						select {
-						case <-peer.queue.nonce:
+						case elem := <-peer.queue.nonce:
+							device.releaseOutboundElement(elem)
 						default:
 							goto NextPacket
 						}
 					}
 				case <-peer.routines.stop:
+					device.releaseOutboundElement(elem)
 					return
 				}
 			}
-			peer.queue.packetInNonceQueueIsAwaitingKey = false
+			peer.queue.packetInNonceQueueIsAwaitingKey.Set(false)
 
 			// populate work element
 
 			elem.peer = peer
-			elem.nonce = atomic.AddUint64(&keyPair.sendNonce, 1) - 1
-			// double check in case of race condition added by future code
-			if elem.nonce >= RejectAfterMessages {
-				goto NextPacket
-			}
 			elem.keyPair = keyPair
+			elem.flushes = atomic.LoadUint32(&peer.queue.flushes)
 			elem.dropped = AtomicFalse
 			elem.mutex.Lock()
 
 			// add to parallel and sequential queue
 
 			addToEncryptionQueue(device.queue.encryption, elem)
-			addToOutboundQueue(peer.queue.outbound, elem)
+			addToOutboundQueue(peer.queue.outbound, elem, &peer.stats.outboundDrops)
 		}
 	}
 }
@@ -348,20 +536,31 @@ func (peer *Peer) RoutineNonce() {
 /* Encrypts the elements in the queue
  * and marks them for sequential consumption (by releasing the mutex)
  *
- * Obs. One instance per core
+ * Obs. One instance per core,
+ * plus those started by the scaler (which may be retired)
  */
-func (device *Device) RoutineEncryption() {
+func (device *Device) RoutineEncryption(retire <-chan struct{}) {
 
 	var nonce [chacha20poly1305.NonceSize]byte
 
 	logDebug := device.log.Debug
 
+	pin := device.newWorkerPin("encryption")
+
 	defer func() {
 		logDebug.Println("Routine: encryption worker - stopped")
+		if retire != nil {
+			atomic.AddInt32(&device.workers.encryptionExtra, -1)
+		}
+		device.releaseAffinity(pin)
+		device.health.encryption.stopped()
 		device.state.stopping.Done()
 	}()
 
 	logDebug.Println("Routine: encryption worker - started")
+	device.health.encryption.started()
+
+	affinityChanged := device.applyAffinity(pin)
 
 	for {
 
@@ -371,33 +570,47 @@ func (device *Device) RoutineEncryption() {
 		case <-device.signals.stop:
 			return
 
+		case <-retire:
+			return
+
+		case <-affinityChanged:
+			affinityChanged = device.applyAffinity(pin)
+
 		case elem, ok := <-device.queue.encryption:
 
 			if !ok {
 				return
 			}
 
-			// check if dropped
+			device.health.encryption.active()
+
+			// check if dropped (or flushed)
 
-			if elem.IsDropped() {
+			if elem.dropIfFlushed() {
+				elem.mutex.Unlock()
 				continue
 			}
 
-			// populate header fields
+			// populate header fields (in front of the content)
 
-			header := elem.buffer[:MessageTransportHeaderSize]
+			offset := device.tun.offset
+			header := elem.buffer[offset-device.transportHeaderSize() : offset]
 
 			fieldType := header[0:4]
 			fieldReceiver := header[4:8]
 			fieldNonce := header[8:16]
 
-			binary.LittleEndian.PutUint32(fieldType, MessageTransportType)
+			msgType := uint32(MessageTransportType)
+			if elem.keyPair.extended {
+				msgType = MessageTransportExtendedType
+			}
+			binary.LittleEndian.PutUint32(fieldType, msgType)
 			binary.LittleEndian.PutUint32(fieldReceiver, elem.keyPair.remoteIndex)
 			binary.LittleEndian.PutUint64(fieldNonce, elem.nonce)
 
 			// pad content to multiple of 16
 
-			mtu := int(atomic.LoadInt32(&device.tun.mtu))
+			mtu := elem.peer.EffectiveMTU()
 			rem := len(elem.packet) % PaddingMultiple
 			if rem > 0 {
 				for i := 0; i < PaddingMultiple-rem && len(elem.packet) < mtu; i++ {
@@ -407,6 +620,26 @@ func (device *Device) RoutineEncryption() {
 
 			// encrypt content and release to consumer
 
+			// the counter is not part of the random nonce,
+			// hence the header is authenticated as additional data
+
+			if elem.keyPair.extended {
+				nonceX := header[MessageTransportExtendedOffsetNonce:]
+				if _, err := rand.Read(nonceX); err != nil {
+					elem.Drop()
+					elem.mutex.Unlock()
+					continue
+				}
+				elem.packet = elem.keyPair.send.Seal(
+					header,
+					nonceX,
+					elem.packet,
+					header[:MessageTransportOffsetContent],
+				)
+				elem.mutex.Unlock()
+				continue
+			}
+
 			binary.LittleEndian.PutUint64(nonce[4:], elem.nonce)
 			elem.packet = elem.keyPair.send.Seal(
 				header,
@@ -432,11 +665,13 @@ func (peer *Peer) RoutineSequentialSender() {
 
 	defer func() {
 		logDebug.Println(peer, ": Routine: sequential sender - stopped")
+		peer.health.sender.stopped()
 		peer.routines.stopping.Done()
 	}()
 
 	logDebug.Println(peer, ": Routine: sequential sender - started")
 
+	peer.health.sender.started()
 	peer.routines.starting.Done()
 
 	for {
@@ -451,16 +686,39 @@ func (peer *Peer) RoutineSequentialSender() {
 				return
 			}
 
+			peer.health.sender.active()
+
 			elem.mutex.Lock()
-			if elem.IsDropped() {
+			if elem.flushed != nil {
+				close(elem.flushed)
 				continue
 			}
+			if elem.dropIfFlushed() {
+				device.PutMessageBuffer(elem.buffer)
+				continue
+			}
+
+			// wait for transmission budget (preserves ordering)
+
+			if delay := peer.txRate.Reserve(len(elem.packet)); delay > 0 {
+				timer := time.NewTimer(delay)
+				select {
+				case <-timer.C:
+				case <-peer.routines.stop:
+					timer.Stop()
+					device.PutMessageBuffer(elem.buffer)
+					return
+				}
+			}
 
 			// send message and return buffer to pool
 
 			length := uint64(len(elem.packet))
 			err := peer.SendBuffer(elem.packet)
 			device.PutMessageBuffer(elem.buffer)
+			if err == ErrSendTimeout {
+				atomic.AddUint64(&peer.stats.outboundDrops, 1)
+			}
 			if err != nil {
 				logDebug.Println("Failed to send authenticated packet to peer", peer)
 				continue
@@ -470,7 +728,7 @@ func (peer *Peer) RoutineSequentialSender() {
 			// update timers
 
 			peer.timersAnyAuthenticatedPacketTraversal()
-			if len(elem.packet) != MessageKeepaliveSize {
+			if len(elem.packet) != device.transportOverhead() {
 				peer.timersDataSent()
 			}
 			peer.keepKeyFreshSending()
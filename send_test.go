@@ -0,0 +1,611 @@
+/* SPDX-License-Identifier: GPL-2.0
+ *
+ * Copyright (C) 2017-2018 Jason A. Donenfeld <Jason@zx2c4.com>. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestTxRateLimit(t *testing.T) {
+	dev1, dev2 := genTestPair(t)
+	defer dev1.Close()
+	defer dev2.Close()
+
+	const (
+		rate    = 40000
+		packets = 80
+		size    = 1000
+	)
+
+	uapiSet(t, dev1, "public_key="+dev2.noise.publicKey.ToHex()+"\ntx_rate_limit=40000")
+
+	src, dst := net.IPv4(10, 0, 0, 1), net.IPv4(10, 0, 0, 2)
+	tun1 := dev1.tun.device.(*DummyTUN)
+
+	start := time.Now()
+	for i := 0; i < packets; i++ {
+		tun1.packets <- genIPv4Packet(src, dst, size)
+	}
+	for i := 0; i < packets; i++ {
+		recvPacket(t, dev2.tun.device, time.Second*10)
+	}
+	elapsed := time.Since(start)
+
+	// one second worth of bytes may be send as a burst
+
+	total := packets * (size + MessageTransportSize)
+	bound := time.Duration(float64(total-rate) / rate * float64(time.Second))
+	if elapsed < bound*9/10 {
+		t.Fatal("throughput exceeds rate limit:", total, "bytes in", elapsed)
+	}
+}
+
+func TestPathMTUUpdate(t *testing.T) {
+	device := randDevice(t)
+	defer device.Close()
+
+	peer := randPeer(t, device)
+	other := randPeer(t, device)
+	peer.endpoint, _ = CreateDummyEndpoint()
+
+	device.tun.mtu = DefaultMTU
+	mtu := device.EffectiveMTU()
+
+	// sending exceeds the path MTU
+
+	const pmtu = 1280
+	device.net.bind = &DummyBind{
+		in4:     make(chan DummyDatagram),
+		in6:     make(chan DummyDatagram),
+		sendErr: syscall.EMSGSIZE,
+		pathMTU: pmtu,
+	}
+
+	if err := peer.SendBuffer(make([]byte, mtu)); err != syscall.EMSGSIZE {
+		t.Fatal("expected EMSGSIZE, got:", err)
+	}
+
+	if mtu := peer.EffectiveMTU(); mtu != pmtu-MessageTransportSize {
+		t.Fatal("effective MTU not reduced to path MTU:", mtu)
+	}
+
+	// the path MTU applies to the peer only
+
+	if other.EffectiveMTU() != mtu || device.EffectiveMTU() != mtu {
+		t.Fatal("path MTU of peer applied to other peers")
+	}
+
+	// path MTU above the TUN MTU
+
+	peer.UpdatePathMTU(1 << 16)
+	if peer.EffectiveMTU() != mtu {
+		t.Fatal("effective MTU exceeds the TUN MTU")
+	}
+
+	// the path MTU is forgotten once expired, or the endpoint changed
+
+	peer.pathMTU.Store(pathMTUEstimate{mtu: pmtu, expires: time.Now().Add(-time.Second)})
+	if peer.EffectiveMTU() != mtu {
+		t.Fatal("expired path MTU applied")
+	}
+
+	peer.UpdatePathMTU(pmtu)
+	end, _ := CreateDummyEndpoint()
+	peer.mutex.Lock()
+	peer.unsafeSetEndpoint("", end)
+	peer.mutex.Unlock()
+	if peer.EffectiveMTU() != mtu {
+		t.Fatal("path MTU of previous endpoint applied")
+	}
+}
+
+func TestOutboundQueueDrops(t *testing.T) {
+	dev1, dev2 := genTestPair(t)
+	defer dev1.Close()
+	defer dev2.Close()
+
+	peer := dev1.LookupPeer(dev2.noise.publicKey)
+	src, dst := net.IPv4(10, 0, 0, 1), net.IPv4(10, 0, 0, 2)
+	tun1 := dev1.tun.device.(*DummyTUN)
+
+	// complete a handshake, so packets move past the nonce queue
+
+	tun1.packets <- genIPv4Packet(src, dst, 100)
+	recvPacket(t, dev2.tun.device, time.Second*10)
+
+	// stall the sequential sender and overflow the outbound queue
+
+	uapiSet(t, dev1, "public_key="+dev2.noise.publicKey.ToHex()+"\ntx_rate_limit=1")
+
+	deadline := time.Now().Add(time.Second * 5)
+	waitFor := func(cond func() bool) {
+		for !cond() {
+			if time.Now().After(deadline) {
+				t.Fatal("timed out, outbound drops:", atomic.LoadUint64(&peer.stats.outboundDrops))
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	// pace the packets, so they are not dropped from the nonce queue
+
+	const excess = 100
+	for i := 0; i < QueueOutboundSize+excess; i++ {
+		tun1.packets <- genIPv4Packet(src, dst, 100)
+		if i%(QueueOutboundSize/4) == 0 {
+			waitFor(func() bool { return len(peer.queue.nonce) == 0 })
+		}
+	}
+
+	waitFor(func() bool { return atomic.LoadUint64(&peer.stats.outboundDrops) >= excess-1 })
+
+	if drops := atomic.LoadUint64(&peer.stats.nonceDrops); drops != 0 {
+		t.Fatal("outbound drops counted as nonce drops:", drops)
+	}
+
+	get := uapiRequest(t, dev1, "get=1\n\n")
+	if !strings.Contains(get, "outbound_queue_drops=") {
+		t.Fatal("outbound drops not reported:", get)
+	}
+}
+
+func TestTUNHeadroom(t *testing.T) {
+	var tuns [2]TUNDevice
+	for i, headroom := range []int{61, 0} {
+		tuns[i], _ = CreateDummyTUN(fmt.Sprintf("tun%d", i), 0)
+		tuns[i].(*DummyTUN).headroom = headroom
+	}
+
+	dev1, dev2 := genTestPairTUN(t, tuns)
+	defer dev1.Close()
+	defer dev2.Close()
+
+	if dev1.tun.offset != 61 || dev2.tun.offset != MessageTransportHeaderSize {
+		t.Fatal("unexpected read offsets", dev1.tun.offset, dev2.tun.offset)
+	}
+
+	// packets survive in both directions
+
+	addrs := [2]net.IP{net.IPv4(10, 0, 0, 1), net.IPv4(10, 0, 0, 2)}
+	devices := [2]*Device{dev1, dev2}
+	for i, device := range devices {
+		for _, size := range []int{20, 100, 1000} {
+			packet := genIPv4Packet(addrs[i], addrs[1-i], size)
+			device.tun.device.(*DummyTUN).packets <- packet
+			received := recvPacket(t, devices[1-i].tun.device, time.Second*5)
+			if !bytes.Equal(received, packet) {
+				t.Fatal("packet corrupted with read offset", device.tun.offset)
+			}
+		}
+	}
+}
+
+func TestTUNReadBatch(t *testing.T) {
+	dev1, dev2 := genChannelPair(t)
+	defer dev1.Close()
+	defer dev2.Close()
+
+	src, dst := net.IPv4(10, 0, 0, 1), net.IPv4(10, 0, 0, 2)
+	tun1 := dev1.tun.device.(*DummyTUN)
+
+	// packets of a batch are routed individually (in order),
+	// discarded packets do not affect the others
+
+	var batch, expected [][]byte
+	for i, size := range []int{20, 1000, 100, 100, 500, 60} {
+		packet := genIPv4Packet(src, dst, size)
+		if i == 3 {
+			packet = genIPv4Packet(src, net.IPv4(10, 0, 0, 3), size) // no peer
+		} else {
+			expected = append(expected, packet)
+		}
+		batch = append(batch, packet)
+	}
+	for round := 0; round < 3; round++ {
+		tun1.batches <- batch
+	}
+
+	for round := 0; round < 3; round++ {
+		for i, packet := range expected {
+			if !bytes.Equal(recvPacket(t, dev2.tun.device, time.Second*5), packet) {
+				t.Fatal("unexpected packet", i, "of batch", round)
+			}
+		}
+	}
+
+	// devices without batches read a single packet
+
+	dummy, _ := CreateDummyTUN("tun2", 0)
+	dummy.(*DummyTUN).packets <- expected[0]
+	dummy.(*DummyTUN).packets <- expected[1]
+	tun := struct{ TUNDevice }{dummy}
+
+	bufs := [][]byte{make([]byte, 2000), make([]byte, 2000)}
+	sizes, err := tunReadBatch(tun, bufs, MessageTransportHeaderSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sizes) != 1 || !bytes.Equal(bufs[0][MessageTransportHeaderSize:][:sizes[0]], expected[0]) {
+		t.Fatal("unexpected read of single packet:", sizes)
+	}
+}
+
+func TestTUNMTU(t *testing.T) {
+	var tuns [2]TUNDevice
+	for i := range tuns {
+		tuns[i], _ = CreateDummyTUN(fmt.Sprintf("tun%d", i), 1000)
+	}
+
+	dev1, dev2 := genTestPairTUN(t, tuns)
+	defer dev1.Close()
+	defer dev2.Close()
+
+	src, dst := net.IPv4(10, 0, 0, 1), net.IPv4(10, 0, 0, 2)
+	tun1, tun2 := tuns[0].(*DummyTUN), tuns[1].(*DummyTUN)
+	peer := dev1.LookupPeer(dev2.noise.publicKey)
+
+	// returns the size of the transport message sent for the packet
+
+	send := func(size int) uint64 {
+		sent := atomic.LoadUint64(&peer.stats.txBytes)
+		tun1.packets <- genIPv4Packet(src, dst, size)
+		deadline := time.Now().Add(time.Second * 5)
+		for atomic.LoadUint64(&peer.stats.txBytes) == sent {
+			if time.Now().After(deadline) {
+				t.Fatal("packet not sent")
+			}
+			time.Sleep(time.Millisecond)
+		}
+		return atomic.LoadUint64(&peer.stats.txBytes) - sent
+	}
+
+	// padding is capped at the MTU
+
+	if length := send(1000); length != 1000+MessageTransportSize {
+		t.Fatal("padding exceeds MTU, sent", length, "bytes")
+	}
+	recvPacket(t, tun2, time.Second*5)
+
+	// the device observes MTU changes
+
+	tun1.SetMTU(1500)
+	deadline := time.Now().Add(time.Second * 5)
+	for atomic.LoadInt32(&dev1.tun.mtu) != 1500 {
+		if time.Now().After(deadline) {
+			t.Fatal("MTU update not observed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if length := send(1000); length != 1008+MessageTransportSize {
+		t.Fatal("packet not padded, sent", length, "bytes")
+	}
+	recvPacket(t, tun2, time.Second*5)
+
+	// oversize packets are not written to the TUN device
+
+	send(1100)
+	select {
+	case <-tun2.written:
+		t.Fatal("oversize packet written")
+	case <-time.After(time.Millisecond * 100):
+	}
+
+	if _, err := tun2.Write(make([]byte, MessageTransportOffsetContent+1001), MessageTransportOffsetContent); err == nil {
+		t.Fatal("oversize write accepted")
+	}
+}
+
+func TestFlushInFlightEncryption(t *testing.T) {
+	dev1, dev2 := genChannelPair(t)
+	defer dev1.Close()
+	defer dev2.Close()
+
+	peer := dev1.LookupPeer(dev2.noise.publicKey)
+	src, dst := net.IPv4(10, 0, 0, 1), net.IPv4(10, 0, 0, 2)
+	tun1 := dev1.tun.device.(*DummyTUN)
+
+	tun1.packets <- genIPv4Packet(src, dst, 100)
+	recvPacket(t, dev2.tun.device, time.Second*5)
+
+	// stall encryption with the current key pair
+
+	aead := &stalledAEAD{release: make(chan struct{})}
+	keyPair := peer.keyPairs.Current()
+	keyPair.send = aead
+
+	nonce := atomic.LoadUint64(&keyPair.sendNonce)
+	txBytes := atomic.LoadUint64(&peer.stats.txBytes)
+
+	const count = 8
+	for i := 0; i < count; i++ {
+		tun1.packets <- genIPv4Packet(src, dst, 100)
+	}
+
+	deadline := time.Now().Add(time.Second * 5)
+	for atomic.LoadUint64(&keyPair.sendNonce) < nonce+count {
+		if time.Now().After(deadline) {
+			t.Fatal("packets not handed to the encryption workers")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// flush while the elements are mid-encryption
+
+	peer.FlushNonceQueue()
+	close(aead.release)
+
+	time.Sleep(time.Millisecond * 100)
+	if sent := atomic.LoadUint64(&peer.stats.txBytes); sent != txBytes {
+		t.Fatal("sent", sent-txBytes, "bytes of flushed packets")
+	}
+
+	// packets queued after the flush are still sent
+
+	tun1.packets <- genIPv4Packet(src, dst, 100)
+	for atomic.LoadUint64(&peer.stats.txBytes) == txBytes {
+		if time.Now().After(deadline) {
+			t.Fatal("sender stalled after flush")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestNonceExhaustion(t *testing.T) {
+	dev1, dev2 := genChannelPair(t)
+	defer dev1.Close()
+	defer dev2.Close()
+
+	peer := dev1.LookupPeer(dev2.noise.publicKey)
+	src, dst := net.IPv4(10, 0, 0, 1), net.IPv4(10, 0, 0, 2)
+	tun1 := dev1.tun.device.(*DummyTUN)
+
+	tun1.packets <- genIPv4Packet(src, dst, 100)
+	recvPacket(t, dev2.tun.device, time.Second*5)
+
+	// leave nonces for only a part of the packets,
+	// once the responder accepts another initiation
+
+	time.Sleep(HandshakeInitationRate)
+	keyPair := peer.keyPairs.Current()
+	atomic.StoreUint64(&keyPair.sendNonce, RejectAfterMessages-2)
+
+	const count = 6
+	for i := 0; i < count; i++ {
+		tun1.packets <- genIPv4Packet(src, dst, 100+i)
+	}
+
+	// every packet is delivered in order, the remainder after rekeying
+	// (without waiting for the handshake to be retransmitted)
+
+	for i := 0; i < count; i++ {
+		packet := recvPacket(t, dev2.tun.device, RekeyTimeout/2)
+		if len(packet) != 100+i {
+			t.Fatal("packet", i, "delivered out of order, length", len(packet))
+		}
+	}
+
+	if peer.keyPairs.Current() == keyPair {
+		t.Fatal("exhausted key pair still in use")
+	}
+}
+
+func TestExtendedNonce(t *testing.T) {
+	var loggers [2]*Logger
+	for i := range loggers {
+		loggers[i] = NewLogger(LogLevelError, fmt.Sprintf("dev%d ", i))
+	}
+	dev1, dev2 := genChannelPairWith(t, loggers, NewDeviceExtendedNonce)
+	defer dev1.Close()
+	defer dev2.Close()
+
+	peer := dev1.LookupPeer(dev2.noise.publicKey)
+	src, dst := net.IPv4(10, 0, 0, 1), net.IPv4(10, 0, 0, 2)
+	tun1 := dev1.tun.device.(*DummyTUN)
+
+	tun1.packets <- genIPv4Packet(src, dst, 100)
+	recvPacket(t, dev2.tun.device, time.Second*5)
+
+	// transport messages carry the extended nonce
+
+	dev1.net.mutex.RLock()
+	sent := dev1.net.bind.(*ChannelBind).sent
+	dev1.net.mutex.RUnlock()
+
+	transport := 0
+	for len(sent) > 0 {
+		msg := <-sent
+		switch binary.LittleEndian.Uint32(msg[:4]) {
+		case MessageTransportType:
+			t.Fatal("sent standard transport message")
+		case MessageTransportExtendedType:
+			if len(msg) != MessageTransportExtendedSize+100 && len(msg) != MessageTransportExtendedSize {
+				t.Fatal("unexpected size of transport message:", len(msg))
+			}
+			transport++
+		}
+	}
+	if transport == 0 {
+		t.Fatal("no transport message sent")
+	}
+
+	// send well beyond the message limit of a session,
+	// advancing the counter in steps the receiver considers ahead
+
+	keyPair := peer.keyPairs.Current()
+	for _, nonce := range []uint64{1 << 62, 2 << 62, 3 << 62} {
+		atomic.StoreUint64(&keyPair.sendNonce, nonce)
+		tun1.packets <- genIPv4Packet(src, dst, 100)
+		recvPacket(t, dev2.tun.device, time.Second*5)
+	}
+	atomic.StoreUint64(&keyPair.sendNonce, RejectAfterMessages-2)
+
+	const count = 100
+	for i := 0; i < count; i++ {
+		tun1.packets <- genIPv4Packet(src, dst, 100+i)
+	}
+	for i := 0; i < count; i++ {
+		packet := recvPacket(t, dev2.tun.device, time.Second*5)
+		if len(packet) != 100+i {
+			t.Fatal("packet", i, "delivered out of order, length", len(packet))
+		}
+	}
+
+	if peer.keyPairs.Current() != keyPair {
+		t.Fatal("key pair replaced, despite random nonces")
+	}
+	if nonce := atomic.LoadUint64(&keyPair.sendNonce); nonce >= RejectAfterMessages-2 || nonce < count-20 {
+		t.Fatal("counter did not wrap:", nonce)
+	}
+}
+
+func TestExtendedNonceCounterAuthenticated(t *testing.T) {
+	var loggers [2]*Logger
+	for i := range loggers {
+		loggers[i] = NewLogger(LogLevelError, fmt.Sprintf("dev%d ", i))
+	}
+	dev1, dev2 := genChannelPairWith(t, loggers, NewDeviceExtendedNonce)
+	defer dev1.Close()
+	defer dev2.Close()
+
+	src, dst := net.IPv4(10, 0, 0, 1), net.IPv4(10, 0, 0, 2)
+	dev1.tun.device.(*DummyTUN).packets <- genIPv4Packet(src, dst, 100)
+	recvPacket(t, dev2.tun.device, time.Second*5)
+
+	dev1.net.mutex.RLock()
+	bind := dev1.net.bind.(*ChannelBind)
+	dev1.net.mutex.RUnlock()
+
+	var captured []byte
+	for len(bind.sent) > 0 {
+		msg := <-bind.sent
+		if binary.LittleEndian.Uint32(msg[:4]) == MessageTransportExtendedType && len(msg) > MessageTransportExtendedSize {
+			captured = msg
+		}
+	}
+	if captured == nil {
+		t.Fatal("no transport message sent")
+	}
+
+	// a captured message resent with a fresh counter fails to authenticate
+
+	peer := dev2.LookupPeer(dev1.noise.publicKey)
+	failures := atomic.LoadUint64(&peer.stats.decryptFailures)
+
+	forged := append([]byte(nil), captured...)
+	binary.LittleEndian.PutUint64(forged[MessageTransportOffsetCounter:], 1<<40)
+	bind.tx <- forged
+
+	deadline := time.Now().Add(time.Second * 5)
+	for atomic.LoadUint64(&peer.stats.decryptFailures) == failures {
+		if time.Now().After(deadline) {
+			t.Fatal("message with rewritten counter authenticated")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	select {
+	case <-dev2.tun.device.(*DummyTUN).written:
+		t.Fatal("message with rewritten counter delivered")
+	default:
+	}
+}
+
+/* Bind which never delivers datagrams,
+ * sends block until the send timeout elapses (or the bind is closed)
+ */
+type BlackholeBind struct {
+	*ChannelBind
+	timeout int64 // nanoseconds, accessed atomically
+}
+
+func (b *BlackholeBind) SetSendTimeout(timeout time.Duration) error {
+	atomic.StoreInt64(&b.timeout, timeout.Nanoseconds())
+	return nil
+}
+
+func (b *BlackholeBind) Send(buff []byte, end Endpoint) error {
+	var expired <-chan time.Time
+	if timeout := atomic.LoadInt64(&b.timeout); timeout != 0 {
+		expired = time.After(time.Duration(timeout))
+	}
+	select {
+	case <-expired:
+		return ErrSendTimeout
+	case <-b.closed:
+		return errors.New("closed")
+	}
+}
+
+func TestSendTimeout(t *testing.T) {
+	dev1, dev2 := genChannelPair(t)
+	defer dev1.Close()
+	defer dev2.Close()
+
+	peer := dev1.LookupPeer(dev2.noise.publicKey)
+	src, dst := net.IPv4(10, 0, 0, 1), net.IPv4(10, 0, 0, 2)
+	tun1 := dev1.tun.device.(*DummyTUN)
+
+	tun1.packets <- genIPv4Packet(src, dst, 100)
+	recvPacket(t, dev2.tun.device, time.Second*5)
+
+	// binds without support reject a timeout
+
+	response := uapiRequest(t, dev2, "set=1\nsend_timeout_ms=50\n\n")
+	if strings.HasSuffix(response, "errno=0\n\n") {
+		t.Fatal("send timeout accepted by channel bind")
+	}
+
+	// replace the bind of the first device with a black hole
+
+	dev1.net.mutex.Lock()
+	channel := dev1.net.bind.(*ChannelBind)
+	dev1.net.createBind = func(ports []uint16) (Bind, []uint16, error) {
+		select {
+		case <-channel.closed:
+			channel.closed = make(chan struct{})
+		default:
+		}
+		return &BlackholeBind{ChannelBind: channel}, ports, nil
+	}
+	dev1.net.mutex.Unlock()
+
+	if err := dev1.BindUpdate(); err != nil {
+		t.Fatal(err)
+	}
+
+	const timeout = time.Millisecond * 50
+	uapiSet(t, dev1, "send_timeout_ms=50")
+	if get := uapiRequest(t, dev1, "get=1\n\n"); !strings.Contains(get, "send_timeout_ms=50\n") {
+		t.Fatal("send timeout not reported:", get)
+	}
+
+	// each stuck send is dropped after the timeout
+
+	const packets = 5
+	start := time.Now()
+	drops := atomic.LoadUint64(&peer.stats.outboundDrops)
+	for i := 0; i < packets; i++ {
+		tun1.packets <- genIPv4Packet(src, dst, 100)
+	}
+	for atomic.LoadUint64(&peer.stats.outboundDrops) < drops+packets {
+		if time.Since(start) > packets*timeout+time.Second*2 {
+			t.Fatal("sender blocked past the send timeout, drops:", atomic.LoadUint64(&peer.stats.outboundDrops)-drops)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if elapsed := time.Since(start); elapsed < packets*timeout {
+		t.Fatal("sends returned before the timeout:", elapsed)
+	}
+}
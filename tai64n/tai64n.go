@@ -20,12 +20,25 @@ func Now() Timestamp {
 	var tai64n Timestamp
 	now := time.Now()
 	secs := base + uint64(now.Unix())
-	nano := uint32(now.UnixNano())
+	nano := uint32(now.Nanosecond())
 	binary.BigEndian.PutUint64(tai64n[:], secs)
 	binary.BigEndian.PutUint32(tai64n[8:], nano)
 	return tai64n
 }
 
+/* Returns the timestamp a nano-second later
+ */
+func (t Timestamp) Next() Timestamp {
+	secs := binary.BigEndian.Uint64(t[:])
+	nano := binary.BigEndian.Uint32(t[8:]) + 1
+	if nano >= uint32(time.Second) {
+		secs, nano = secs+1, 0
+	}
+	binary.BigEndian.PutUint64(t[:], secs)
+	binary.BigEndian.PutUint32(t[8:], nano)
+	return t
+}
+
 func (t1 Timestamp) After(t2 Timestamp) bool {
 	return bytes.Compare(t1[:], t2[:]) > 0
 }
@@ -6,6 +6,7 @@
 package tai64n
 
 import (
+	"encoding/binary"
 	"testing"
 	"time"
 )
@@ -24,3 +25,25 @@ func TestMonotonic(t *testing.T) {
 		old = next
 	}
 }
+
+func TestNext(t *testing.T) {
+	for _, nano := range []int{0, 999999999} {
+		now := time.Unix(1500000000, int64(nano))
+		var t1 Timestamp
+		binary.BigEndian.PutUint64(t1[:], base+uint64(now.Unix()))
+		binary.BigEndian.PutUint32(t1[8:], uint32(now.Nanosecond()))
+
+		t2 := t1.Next()
+		if !t2.After(t1) {
+			t.Error("TAI64N, next timestamp not after", nano)
+		}
+		if next := binary.BigEndian.Uint32(t2[8:]); next >= uint32(time.Second) {
+			t.Error("TAI64N, nano-seconds of next timestamp out of range:", next)
+		}
+	}
+
+	now := Now()
+	if nano := binary.BigEndian.Uint32(now[8:]); nano >= uint32(time.Second) {
+		t.Error("TAI64N, nano-seconds out of range:", nano)
+	}
+}
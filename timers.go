@@ -8,6 +8,9 @@
 package main
 
 import (
+	"errors"
+	"fmt"
+	"math"
 	"math/rand"
 	"sync/atomic"
 	"time"
@@ -42,13 +45,162 @@ func (timer *Timer) Del() {
 	timer.timer.Stop()
 }
 
+/* Overrides of the specification constants governing key rotation,
+ * primarily so that tests can force rapid rekeys
+ */
+type TimerConfig struct {
+	RekeyAfterTime      time.Duration // age after which the initiator rekeys
+	RejectAfterTime     time.Duration // age after which a key pair is no longer used
+	RejectAfterMessages uint64        // number of messages after which a key pair is no longer used
+}
+
+func DefaultTimerConfig() TimerConfig {
+	return TimerConfig{
+		RekeyAfterTime:      RekeyAfterTime,
+		RejectAfterTime:     RejectAfterTime,
+		RejectAfterMessages: RejectAfterMessages,
+	}
+}
+
+func (config TimerConfig) Validate() error {
+	if config.RekeyAfterTime <= 0 {
+		return errors.New("RekeyAfterTime must be positive")
+	}
+	if config.RejectAfterTime <= config.RekeyAfterTime {
+		return errors.New("RejectAfterTime must exceed RekeyAfterTime")
+	}
+	if config.RejectAfterMessages == 0 || config.RejectAfterMessages > RejectAfterMessages {
+		return fmt.Errorf("RejectAfterMessages must be within [1, %d]", uint64(RejectAfterMessages))
+	}
+	return nil
+}
+
+/* Applies to key pairs of all peers,
+ * including those already established
+ */
+func (device *Device) SetTimerConfig(config TimerConfig) error {
+	if err := config.Validate(); err != nil {
+		return err
+	}
+	device.timers.config.Store(config)
+	return nil
+}
+
+func (device *Device) TimerConfig() TimerConfig {
+	if config, ok := device.timers.config.Load().(TimerConfig); ok {
+		return config
+	}
+	return DefaultTimerConfig()
+}
+
+func (device *Device) handshakeBackoffEnabled() bool {
+	return time.Duration(atomic.LoadInt64(&device.timers.handshakeBackoffMax)) > RekeyTimeout
+}
+
+/* Returns the interval to wait for a response after the given number
+ * of consecutive failed handshake attempts. The interval doubles on every
+ * attempt, up to the ceiling configured on the device.
+ */
+func (device *Device) handshakeRetryTimeout(attempts uint) time.Duration {
+	ceiling := time.Duration(atomic.LoadInt64(&device.timers.handshakeBackoffMax))
+	timeout := RekeyTimeout
+	for i := uint(0); i < attempts && timeout < ceiling; i++ {
+		timeout *= 2
+	}
+	if timeout > ceiling && ceiling > RekeyTimeout {
+		timeout = ceiling
+	}
+	return timeout
+}
+
+/* Sets the number of handshake attempts after which a peer is marked unreachable
+ * (and packets awaiting a key are dropped), until traffic to the peer resumes
+ *
+ * 0 restores DefaultMaxHandshakeAttempts
+ */
+func (device *Device) SetMaxHandshakeAttempts(attempts int) error {
+	if attempts < 0 || attempts > math.MaxInt32 {
+		return errors.New("Invalid number of handshake attempts")
+	}
+	atomic.StoreInt32(&device.timers.maxHandshakeAttempts, int32(attempts))
+	return nil
+}
+
+func (device *Device) MaxHandshakeAttempts() int {
+	if attempts := atomic.LoadInt32(&device.timers.maxHandshakeAttempts); attempts > 0 {
+		return int(attempts)
+	}
+	return DefaultMaxHandshakeAttempts
+}
+
+/* Sets the time after the first attempt of a handshake at which
+ * a peer is marked unreachable, regardless of the number of attempts
+ *
+ * 0 disables the timeout (bounding handshakes by attempts only)
+ */
+func (device *Device) SetHandshakeTimeout(timeout time.Duration) {
+	atomic.StoreInt64(&device.timers.handshakeTimeout, int64(timeout))
+}
+
+func (device *Device) HandshakeTimeout() time.Duration {
+	return time.Duration(atomic.LoadInt64(&device.timers.handshakeTimeout))
+}
+
+/* Reports whether handshakes to the peer should give up
+ */
+func (peer *Peer) handshakeExhausted() bool {
+	device := peer.device
+	if peer.timers.handshakeAttempts+1 >= uint(device.MaxHandshakeAttempts()) {
+		return true
+	}
+	timeout := device.HandshakeTimeout()
+	return timeout > 0 && time.Now().Sub(peer.timers.handshakeStarted) >= timeout
+}
+
+/* Reports whether handshakes to the peer gave up,
+ * cleared once traffic to (or from) the peer resumes
+ */
+func (peer *Peer) Unreachable() bool {
+	return peer.unreachable.Get()
+}
+
+/* Spreads the persistent keepalives of all peers randomly by up to
+ * the given percentage of their interval (in either direction),
+ * such that peers sharing an interval do not emit keepalives in bursts
+ */
+func (device *Device) SetKeepaliveJitter(percent int) error {
+	if percent < 0 || percent > MaxKeepaliveJitter {
+		return fmt.Errorf("Keepalive jitter must be within [0, %d] percent", MaxKeepaliveJitter)
+	}
+	atomic.StoreInt32(&device.timers.keepaliveJitter, int32(percent))
+	return nil
+}
+
+func (device *Device) KeepaliveJitter() int {
+	return int(atomic.LoadInt32(&device.timers.keepaliveJitter))
+}
+
+/* Returns the interval until the next persistent keepalive,
+ * the configured interval spread by the jitter of the device
+ */
+func (peer *Peer) persistentKeepaliveTimeout() time.Duration {
+	interval := time.Duration(peer.persistentKeepaliveInterval) * time.Second
+	spread := interval * time.Duration(peer.device.KeepaliveJitter()) / 100
+	if spread == 0 {
+		return interval
+	}
+	return interval - spread + time.Duration(rand.Int63n(int64(2*spread)+1))
+}
+
 func (peer *Peer) timersActive() bool {
-	return peer.isRunning.Get() && peer.device != nil && peer.device.isUp.Get() && len(peer.device.peers.keyMap) > 0
+	return peer.isRunning.Get() && peer.device != nil && peer.device.isUp.Get() && !peer.device.suspend.active.Get() && len(peer.device.peers.keyMap) > 0
 }
 
 func expiredRetransmitHandshake(peer *Peer) {
-	if peer.timers.handshakeAttempts > MaxTimerHandshakes {
-		peer.device.log.Debug.Printf("%s: Handshake did not complete after %d attempts, giving up\n", peer, MaxTimerHandshakes+2)
+	if peer.handshakeExhausted() {
+		peer.device.log.Info.Printf("%s: Handshake did not complete after %d attempts, giving up\n", peer, peer.timers.handshakeAttempts+1)
+
+		peer.unreachable.Set(true)
 
 		if peer.timersActive() {
 			peer.timers.sendKeepalive.Del()
@@ -63,11 +215,12 @@ func expiredRetransmitHandshake(peer *Peer) {
 		 * of a partial exchange.
 		 */
 		if peer.timersActive() && !peer.timers.zeroKeyMaterial.isPending {
-			peer.timers.zeroKeyMaterial.Mod(RejectAfterTime * 3)
+			peer.timers.zeroKeyMaterial.Mod(peer.device.TimerConfig().RejectAfterTime * 3)
 		}
 	} else {
+		timeout := peer.device.handshakeRetryTimeout(peer.timers.handshakeAttempts)
 		peer.timers.handshakeAttempts++
-		peer.device.log.Debug.Printf("%s: Handshake did not complete after %d seconds, retrying (try %d)\n", peer, int(RekeyTimeout.Seconds()), peer.timers.handshakeAttempts+1)
+		peer.device.log.Debug.Printf("%s: Handshake did not complete after %d seconds, retrying (try %d)\n", peer, int(timeout.Seconds()), peer.timers.handshakeAttempts+1)
 
 		/* We clear the endpoint address src address, in case this is the cause of trouble. */
 		peer.mutex.Lock()
@@ -76,7 +229,15 @@ func expiredRetransmitHandshake(peer *Peer) {
 		}
 		peer.mutex.Unlock()
 
-		peer.SendHandshakeInitiation(true)
+		/* The address of an endpoint configured by hostname may have changed. */
+		peer.requestEndpointResolution()
+
+		/* The endpoint may be unreachable, alternate with the backup endpoint (if any). */
+		if peer.timers.handshakeAttempts%HandshakeFailoverAttempts == 0 {
+			peer.failoverEndpoint()
+		}
+
+		peer.SendHandshakeInitiation(true, false)
 	}
 }
 
@@ -91,19 +252,19 @@ func expiredSendKeepalive(peer *Peer) {
 }
 
 func expiredNewHandshake(peer *Peer) {
-	peer.device.log.Debug.Printf("%s: Retrying handshake because we stopped hearing back after %d seconds\n", peer, int((KeepaliveTimeout + RekeyTimeout).Seconds()))
+	peer.device.log.Info.Printf("%s: Retrying handshake because we stopped hearing back after %d seconds\n", peer, int((KeepaliveTimeout + RekeyTimeout).Seconds()))
 	/* We clear the endpoint address src address, in case this is the cause of trouble. */
 	peer.mutex.Lock()
 	if peer.endpoint != nil {
 		peer.endpoint.ClearSrc()
 	}
 	peer.mutex.Unlock()
-	peer.SendHandshakeInitiation(false)
+	peer.SendHandshakeInitiation(false, false)
 
 }
 
 func expiredZeroKeyMaterial(peer *Peer) {
-	peer.device.log.Debug.Printf(":%s Removing all keys, since we haven't received a new one in %d seconds\n", peer, int((RejectAfterTime * 3).Seconds()))
+	peer.device.log.Info.Printf("%s: Removing all keys, since we haven't received a new one in %d seconds\n", peer, int((peer.device.TimerConfig().RejectAfterTime * 3).Seconds()))
 
 	hs := &peer.handshake
 	hs.mutex.Lock()
@@ -139,10 +300,14 @@ func expiredPersistentKeepalive(peer *Peer) {
 	}
 }
 
-/* Should be called after an authenticated data packet is sent. */
+/* Should be called after an authenticated data packet is sent.
+ * The packet acknowledges all data received so far,
+ * so keepalives are only sent after the peer goes idle.
+ */
 func (peer *Peer) timersDataSent() {
 	if peer.timersActive() {
 		peer.timers.sendKeepalive.Del()
+		peer.timers.needAnotherKeepalive = false
 	}
 
 	if peer.timersActive() && !peer.timers.newHandshake.isPending {
@@ -172,7 +337,7 @@ func (peer *Peer) timersAnyAuthenticatedPacketReceived() {
 func (peer *Peer) timersHandshakeInitiated() {
 	if peer.timersActive() {
 		peer.timers.sendKeepalive.Del()
-		peer.timers.retransmitHandshake.Mod(RekeyTimeout + time.Millisecond*time.Duration(rand.Int31n(RekeyTimeoutJitterMaxMs)))
+		peer.timers.retransmitHandshake.Mod(peer.device.handshakeRetryTimeout(peer.timers.handshakeAttempts) + time.Millisecond*time.Duration(rand.Int31n(RekeyTimeoutJitterMaxMs)))
 	}
 }
 
@@ -183,20 +348,24 @@ func (peer *Peer) timersHandshakeComplete() {
 	}
 	peer.timers.handshakeAttempts = 0
 	peer.timers.sentLastMinuteHandshake = false
+	peer.unreachable.Set(false)
 	atomic.StoreInt64(&peer.stats.lastHandshakeNano, time.Now().UnixNano())
+	atomic.AddUint64(&peer.stats.rekeys, 1)
+	peer.device.log.Info.Println(peer, ": Handshake completed")
+	peer.notifyHandshakeComplete()
 }
 
 /* Should be called after an ephemeral key is created, which is before sending a handshake response or after receiving a handshake response. */
 func (peer *Peer) timersSessionDerived() {
 	if peer.timersActive() {
-		peer.timers.zeroKeyMaterial.Mod(RejectAfterTime * 3)
+		peer.timers.zeroKeyMaterial.Mod(peer.device.TimerConfig().RejectAfterTime * 3)
 	}
 }
 
 /* Should be called before a packet with authentication -- data, keepalive, either handshake -- is sent, or after one is received. */
 func (peer *Peer) timersAnyAuthenticatedPacketTraversal() {
 	if peer.persistentKeepaliveInterval > 0 && peer.timersActive() {
-		peer.timers.persistentKeepalive.Mod(time.Duration(peer.persistentKeepaliveInterval) * time.Second)
+		peer.timers.persistentKeepalive.Mod(peer.persistentKeepaliveTimeout())
 	}
 }
 
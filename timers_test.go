@@ -0,0 +1,345 @@
+/* SPDX-License-Identifier: GPL-2.0
+ *
+ * Copyright (C) 2017-2018 Jason A. Donenfeld <Jason@zx2c4.com>. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHandshakeBackoff(t *testing.T) {
+	device := randDevice(t)
+	defer device.Close()
+
+	ceiling := time.Second * 60
+	atomic.StoreInt64(&device.timers.handshakeBackoffMax, int64(ceiling))
+
+	peer := randPeer(t, device)
+	peer.timersInit()
+
+	sent := func() bool {
+		last := peer.timers.lastSentHandshake
+		peer.SendHandshakeInitiation(true, false)
+		return peer.timers.lastSentHandshake != last
+	}
+
+	// simulate consecutive failed handshakes
+
+	var spacing time.Duration
+	for attempts := uint(0); attempts < 8; attempts++ {
+		peer.timers.handshakeAttempts = attempts + 1
+
+		timeout := device.handshakeRetryTimeout(attempts)
+		if timeout < spacing {
+			t.Fatal("backoff decreased after attempt", attempts, ":", timeout, "<", spacing)
+		}
+		if timeout == spacing && timeout != ceiling {
+			t.Fatal("backoff did not grow after attempt", attempts)
+		}
+		if timeout > ceiling {
+			t.Fatal("backoff exceeds ceiling:", timeout)
+		}
+		spacing = timeout
+
+		peer.timers.lastSentHandshake = time.Now().Add(-timeout + time.Second)
+		if sent() {
+			t.Fatal("initiation sent before backoff elapsed, attempt", attempts)
+		}
+
+		peer.timers.lastSentHandshake = time.Now().Add(-timeout)
+		if !sent() {
+			t.Fatal("initiation not sent after backoff elapsed, attempt", attempts)
+		}
+	}
+
+	if spacing != ceiling {
+		t.Fatal("backoff did not reach ceiling:", spacing)
+	}
+
+	// successful handshake resets the backoff
+
+	peer.timersHandshakeComplete()
+	if timeout := device.handshakeRetryTimeout(peer.timers.handshakeAttempts); timeout != RekeyTimeout {
+		t.Fatal("backoff not reset by completed handshake:", timeout)
+	}
+
+	// a new cycle (no retransmission pending) starts with fresh attempts,
+	// while initiations during a cycle retain the backoff
+
+	peer.timers.handshakeAttempts = uint(device.MaxHandshakeAttempts())
+	peer.timers.retransmitHandshake.Mod(time.Hour)
+	peer.SendHandshakeInitiation(false, true)
+	if peer.timers.handshakeAttempts == 0 {
+		t.Fatal("attempts reset during a handshake cycle")
+	}
+
+	peer.timers.retransmitHandshake.Del()
+	peer.SendHandshakeInitiation(false, true)
+	if peer.timers.handshakeAttempts != 0 {
+		t.Fatal("attempts not reset by a new handshake cycle:", peer.timers.handshakeAttempts)
+	}
+
+	// without a ceiling the spec interval is used
+
+	atomic.StoreInt64(&device.timers.handshakeBackoffMax, 0)
+	if timeout := device.handshakeRetryTimeout(5); timeout != RekeyTimeout {
+		t.Fatal("backoff applied while disabled:", timeout)
+	}
+}
+
+func TestPersistentKeepalive(t *testing.T) {
+	dev1, dev2 := genTestPair(t)
+	defer dev1.Close()
+	defer dev2.Close()
+
+	peer := dev1.LookupPeer(dev2.noise.publicKey)
+
+	// out of range intervals are rejected
+
+	for _, value := range []string{"65536", "-1", "soon"} {
+		response := uapiRequest(t, dev1, "set=1\npublic_key="+peer.handshake.remoteStatic.ToHex()+"\npersistent_keepalive_interval="+value+"\n\n")
+		if strings.HasSuffix(response, "errno=0\n\n") {
+			t.Fatal("accepted interval", value, ":", response)
+		}
+	}
+
+	// enabling sends a keepalive, which triggers a handshake
+
+	uapiSet(t, dev1, "public_key="+peer.handshake.remoteStatic.ToHex()+"\npersistent_keepalive_interval=1")
+
+	deadline := time.Now().Add(time.Second * 5)
+	for atomic.LoadInt64(&peer.stats.lastHandshakeNano) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("handshake did not complete")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	// keepalives are emitted at the configured interval
+
+	time.Sleep(time.Millisecond * 100)
+	sent := atomic.LoadUint64(&peer.stats.txBytes)
+	time.Sleep(time.Millisecond * 2500)
+	if keepalives := (atomic.LoadUint64(&peer.stats.txBytes) - sent) / MessageKeepaliveSize; keepalives < 2 {
+		t.Fatal("expected at least 2 keepalives, got", keepalives)
+	}
+
+	// disabling stops them
+
+	uapiSet(t, dev1, "public_key="+peer.handshake.remoteStatic.ToHex()+"\npersistent_keepalive_interval=0")
+
+	sent = atomic.LoadUint64(&peer.stats.txBytes)
+	time.Sleep(time.Millisecond * 1500)
+	if atomic.LoadUint64(&peer.stats.txBytes) != sent {
+		t.Fatal("keepalives sent after disabling")
+	}
+}
+
+func TestKeepaliveJitter(t *testing.T) {
+	device := randDevice(t)
+	defer device.Close()
+	peer := randPeer(t, device)
+	peer.persistentKeepaliveInterval = 10
+
+	if peer.persistentKeepaliveTimeout() != time.Second*10 {
+		t.Fatal("interval spread without jitter:", peer.persistentKeepaliveTimeout())
+	}
+
+	// out of range jitter is rejected
+
+	for _, value := range []string{"51", "-1", "100"} {
+		response := uapiRequest(t, device, "set=1\nkeepalive_jitter="+value+"\n\n")
+		if strings.HasSuffix(response, "errno=0\n\n") {
+			t.Fatal("accepted jitter", value, ":", response)
+		}
+	}
+
+	// timeouts vary within the configured percentage of the interval
+
+	uapiSet(t, device, "keepalive_jitter=20")
+	if get := uapiRequest(t, device, "get=1\n\n"); !strings.Contains(get, "keepalive_jitter=20\n") {
+		t.Fatal("jitter not reported:", get)
+	}
+
+	min, max := time.Duration(1<<62), time.Duration(0)
+	for i := 0; i < 1000; i++ {
+		timeout := peer.persistentKeepaliveTimeout()
+		if timeout < time.Second*8 || timeout > time.Second*12 {
+			t.Fatal("timeout outside of jitter bounds:", timeout)
+		}
+		if timeout < min {
+			min = timeout
+		}
+		if timeout > max {
+			max = timeout
+		}
+	}
+	if min > time.Second*9 || max < time.Second*11 {
+		t.Fatal("timeouts not spread over jitter bounds:", min, max)
+	}
+}
+
+func TestKeepaliveSuppressedByTraffic(t *testing.T) {
+	dev1, dev2 := genTestPair(t)
+	defer dev1.Close()
+	defer dev2.Close()
+
+	tun1 := dev1.tun.device.(*DummyTUN)
+	tun2 := dev2.tun.device.(*DummyTUN)
+	src, dst := net.IPv4(10, 0, 0, 1), net.IPv4(10, 0, 0, 2)
+	peer := dev1.LookupPeer(dev2.noise.publicKey)
+
+	exchange := func() {
+		tun1.packets <- genIPv4Packet(src, dst, 100)
+		recvPacket(t, tun2, time.Second*5)
+		tun2.packets <- genIPv4Packet(dst, src, 100)
+		recvPacket(t, tun1, time.Second*5)
+	}
+	exchange()
+
+	// data sent acknowledges data received, no keepalive remains due
+
+	peer.timersDataReceived()
+	peer.timersDataReceived()
+	peer.timersDataSent()
+	if peer.timers.sendKeepalive.isPending || peer.timers.needAnotherKeepalive {
+		t.Fatal("keepalive due after sending data")
+	}
+
+	// size of a data packet on the wire
+
+	sent := atomic.LoadUint64(&peer.stats.txBytes)
+	exchange()
+	size := atomic.LoadUint64(&peer.stats.txBytes) - sent
+
+	// continuous traffic in both directions suppresses persistent keepalives
+
+	uapiSet(t, dev1, "public_key="+dev2.noise.publicKey.ToHex()+"\npersistent_keepalive_interval=1")
+	time.Sleep(time.Millisecond * 100)
+
+	sent = atomic.LoadUint64(&peer.stats.txBytes)
+	packets := uint64(0)
+	for start := time.Now(); time.Since(start) < time.Millisecond*2500; packets++ {
+		exchange()
+		time.Sleep(time.Millisecond * 50)
+	}
+	if keepalives := (atomic.LoadUint64(&peer.stats.txBytes) - sent - packets*size) / MessageKeepaliveSize; keepalives != 0 {
+		t.Fatal("sent", keepalives, "keepalives during continuous traffic")
+	}
+}
+
+func TestRekeyAfterTime(t *testing.T) {
+	dev1, dev2 := genChannelPair(t)
+	defer dev1.Close()
+	defer dev2.Close()
+
+	config := DefaultTimerConfig()
+	config.RejectAfterTime = config.RekeyAfterTime
+	if dev1.SetTimerConfig(config) == nil {
+		t.Fatal("accepted RejectAfterTime not exceeding RekeyAfterTime")
+	}
+	config.RekeyAfterTime = time.Second
+	if err := dev1.SetTimerConfig(config); err != nil {
+		t.Fatal(err)
+	}
+
+	peer := dev1.LookupPeer(dev2.noise.publicKey)
+	tun1 := dev1.tun.device.(*DummyTUN)
+	send := func() {
+		tun1.packets <- genIPv4Packet(net.IPv4(10, 0, 0, 1), net.IPv4(10, 0, 0, 2), 100)
+		recvPacket(t, dev2.tun.device, time.Second*5)
+	}
+
+	send()
+	initial := peer.keyPairs.Current()
+	if initial == nil || !initial.isInitiator {
+		t.Fatal("no initiated key pair")
+	}
+
+	// sending rekeys once the key pair is older than RekeyAfterTime
+	// (handshakes are still spaced by RekeyTimeout)
+
+	deadline := time.Now().Add(RekeyTimeout + time.Second*5)
+	for peer.keyPairs.Current() == initial {
+		if time.Now().After(deadline) {
+			t.Fatal("no rekey after", config.RekeyAfterTime)
+		}
+		send()
+		time.Sleep(time.Millisecond * 100)
+	}
+}
+
+func TestHandshakeGiveUp(t *testing.T) {
+	dev1, dev2 := genTestPair(t)
+	defer dev1.Close()
+	defer dev2.Close()
+
+	// handshakes to a black hole time out
+
+	hole, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hole.Close()
+
+	peer := dev1.LookupPeer(dev2.noise.publicKey)
+	uapiSet(t, dev1, "max_handshake_attempts=3\nhandshake_timeout=60\npublic_key="+
+		peer.handshake.remoteStatic.ToHex()+"\nendpoint="+hole.LocalAddr().String())
+	get := uapiRequest(t, dev1, "get=1\n\n")
+	if !strings.Contains(get, "max_handshake_attempts=3\n") || !strings.Contains(get, "handshake_timeout=60\n") {
+		t.Fatal("handshake limits not reported:", get)
+	}
+
+	// the timers and routines of the peer are stopped with the device,
+	// such that the attempts are driven by the test alone
+
+	dev1.Down()
+
+	expire := func() {
+		peer.timers.lastSentHandshake = time.Time{}
+		expiredRetransmitHandshake(peer)
+	}
+
+	peer.SendHandshakeInitiation(false, true)
+	flushes := atomic.LoadUint32(&peer.queue.flushes)
+
+	// exhausting the attempts marks the peer unreachable, flushing its queue
+
+	for i := 0; i < 2; i++ {
+		expire()
+		if peer.Unreachable() {
+			t.Fatal("unreachable after", i+2, "attempts")
+		}
+	}
+	expire()
+	if !peer.Unreachable() {
+		t.Fatal("not unreachable once attempts are exhausted")
+	}
+	if atomic.LoadUint32(&peer.queue.flushes) != flushes+1 {
+		t.Fatal("nonce queue not flushed")
+	}
+	if get := uapiRequest(t, dev1, "get=1\n\n"); !strings.Contains(get, "unreachable=1\n") {
+		t.Fatal("unreachable peer not reported:", get)
+	}
+
+	// resumed traffic attempts handshakes anew
+
+	peer.SendHandshakeInitiation(false, false)
+	if peer.Unreachable() || peer.timers.handshakeAttempts != 0 {
+		t.Fatal("still unreachable after traffic resumed")
+	}
+
+	// the timeout bounds handshakes regardless of attempts
+
+	peer.timers.handshakeStarted = time.Now().Add(-time.Minute)
+	expire()
+	if !peer.Unreachable() {
+		t.Fatal("not unreachable once handshakes timed out")
+	}
+}
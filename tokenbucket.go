@@ -0,0 +1,69 @@
+/* SPDX-License-Identifier: GPL-2.0
+ *
+ * Copyright (C) 2017-2018 Jason A. Donenfeld <Jason@zx2c4.com>. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+/* Token bucket bounding the rate (tokens per second) of some resource,
+ * allowing a burst of one second worth of tokens.
+ *
+ * Consumers may go into debt, the debt is paid by waiting.
+ */
+
+type TokenBucket struct {
+	mutex    sync.Mutex
+	rate     uint64 // tokens per second (0 = unlimited)
+	tokens   float64
+	lastTime time.Time
+}
+
+func (bucket *TokenBucket) SetRate(rate uint64) {
+	bucket.mutex.Lock()
+	defer bucket.mutex.Unlock()
+
+	bucket.rate = rate
+	bucket.tokens = float64(rate)
+	bucket.lastTime = time.Now()
+}
+
+func (bucket *TokenBucket) Rate() uint64 {
+	bucket.mutex.Lock()
+	defer bucket.mutex.Unlock()
+	return bucket.rate
+}
+
+/* Takes n tokens from the bucket and returns
+ * the time to wait before they are available
+ */
+func (bucket *TokenBucket) Reserve(n int) time.Duration {
+	bucket.mutex.Lock()
+	defer bucket.mutex.Unlock()
+
+	if bucket.rate == 0 {
+		return 0
+	}
+
+	// refill bucket
+
+	now := time.Now()
+	elapsed := now.Sub(bucket.lastTime)
+	bucket.lastTime = now
+	bucket.tokens += elapsed.Seconds() * float64(bucket.rate)
+	if bucket.tokens > float64(bucket.rate) {
+		bucket.tokens = float64(bucket.rate)
+	}
+
+	// consume tokens
+
+	bucket.tokens -= float64(n)
+	if bucket.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-bucket.tokens / float64(bucket.rate) * float64(time.Second))
+}
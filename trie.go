@@ -8,6 +8,7 @@ package main
 import (
 	"errors"
 	"net"
+	"sync/atomic"
 )
 
 /* Binary trie
@@ -18,9 +19,14 @@ import (
  *
  * Synchronization done separately
  * See: routing.go
+ *
+ * Lookups of outbound packets count the hits of the matching prefix atomically,
+ * such that lookups only require a read lock. The source checks of inbound
+ * packets are not counted, sparing the decryption workers the shared counters.
  */
 
 type Trie struct {
+	hits  uint64 // lookups matched by the prefix (first for 64-bit alignment)
 	cidr  uint
 	child [2]*Trie
 	bits  []byte
@@ -113,6 +119,44 @@ func (node *Trie) RemovePeer(p *Peer) *Trie {
 	return node.child[0]
 }
 
+/* Removes the prefix if routed to the peer,
+ * addresses covered by the prefix fall back to the longest remaining prefix
+ */
+func (node *Trie) Remove(ip net.IP, cidr uint, p *Peer) *Trie {
+	if node == nil {
+		return node
+	}
+
+	// check if prefix is below node
+
+	if node.cidr > cidr || commonBits(node.bits, ip) < node.cidr {
+		return node
+	}
+
+	if node.cidr == cidr {
+		if node.peer != p {
+			return node
+		}
+		node.peer = nil
+	} else {
+		bit := node.choose(ip)
+		node.child[bit] = node.child[bit].Remove(ip, cidr, p)
+		if node.peer != nil {
+			return node
+		}
+	}
+
+	// merge nodes without peer
+
+	if node.child[0] == nil {
+		return node.child[1]
+	}
+	if node.child[1] == nil {
+		return node.child[0]
+	}
+	return node
+}
+
 func (node *Trie) choose(ip net.IP) byte {
 	return (ip[node.bit_at_byte] >> node.bit_at_shift) & 1
 }
@@ -136,6 +180,9 @@ func (node *Trie) Insert(ip net.IP, cidr uint, peer *Peer) *Trie {
 	common := commonBits(node.bits, ip)
 	if node.cidr <= cidr && common >= node.cidr {
 		if node.cidr == cidr {
+			if node.peer != peer {
+				atomic.StoreUint64(&node.hits, 0)
+			}
 			node.peer = peer
 			return node
 		}
@@ -182,11 +229,29 @@ func (node *Trie) Insert(ip net.IP, cidr uint, peer *Peer) *Trie {
 }
 
 func (node *Trie) Lookup(ip net.IP) *Peer {
-	var found *Peer
+	if found := node.lookup(ip); found != nil {
+		return found.peer
+	}
+	return nil
+}
+
+/* Looks up the peer as Lookup, counting the hit of the matching prefix
+ */
+func (node *Trie) LookupCounted(ip net.IP) *Peer {
+	found := node.lookup(ip)
+	if found == nil {
+		return nil
+	}
+	atomic.AddUint64(&found.hits, 1)
+	return found.peer
+}
+
+func (node *Trie) lookup(ip net.IP) *Trie {
+	var found *Trie
 	size := uint(len(ip))
 	for node != nil && commonBits(node.bits, ip) >= node.cidr {
 		if node.peer != nil {
-			found = node.peer
+			found = node
 		}
 		if node.bit_at_byte == size {
 			break
@@ -197,6 +262,18 @@ func (node *Trie) Lookup(ip net.IP) *Peer {
 	return found
 }
 
+/* Returns the peer of the exact prefix (not the longest match)
+ */
+func (node *Trie) Owner(ip net.IP, cidr uint) *Peer {
+	for node != nil && node.cidr <= cidr && commonBits(node.bits, ip) >= node.cidr {
+		if node.cidr == cidr {
+			return node.peer
+		}
+		node = node.child[node.choose(ip)]
+	}
+	return nil
+}
+
 func (node *Trie) Count() uint {
 	if node == nil {
 		return 0
@@ -231,3 +308,18 @@ func (node *Trie) AllowedIPs(p *Peer, results []net.IPNet) []net.IPNet {
 	results = node.child[1].AllowedIPs(p, results)
 	return results
 }
+
+/* Returns the hits of the prefixes of the peer,
+ * in the order of AllowedIPs
+ */
+func (node *Trie) Hits(p *Peer, results []uint64) []uint64 {
+	if node == nil {
+		return results
+	}
+	if node.peer == p {
+		results = append(results, atomic.LoadUint64(&node.hits))
+	}
+	results = node.child[0].Hits(p, results)
+	results = node.child[1].Hits(p, results)
+	return results
+}
@@ -258,3 +258,64 @@ func TestTrieIPv6(t *testing.T) {
 	assertEQ(h, 0x24046800, 0x40040800, 0x10101010, 0x10101010)
 	assertEQ(a, 0x24046800, 0x40040800, 0xdeadbeef, 0xdeadbeef)
 }
+
+func TestTrieRemove(t *testing.T) {
+	a := &Peer{}
+	b := &Peer{}
+	c := &Peer{}
+
+	var trie *Trie
+
+	insert := func(peer *Peer, a, b, c, d byte, cidr uint) {
+		trie = trie.Insert([]byte{a, b, c, d}, cidr, peer)
+	}
+
+	remove := func(peer *Peer, a, b, c, d byte, cidr uint) {
+		trie = trie.Remove([]byte{a, b, c, d}, cidr, peer)
+	}
+
+	assertEQ := func(peer *Peer, a, b, c, d byte) {
+		p := trie.Lookup([]byte{a, b, c, d})
+		if p != peer {
+			t.Error("Assert EQ failed for", net.IPv4(a, b, c, d))
+		}
+	}
+
+	insert(a, 10, 0, 0, 0, 8)
+	insert(b, 10, 1, 0, 0, 16)
+	insert(c, 10, 1, 1, 0, 24)
+	insert(a, 10, 1, 1, 1, 32)
+	insert(b, 10, 2, 0, 0, 16)
+
+	assertEQ(a, 10, 1, 1, 1)
+	assertEQ(c, 10, 1, 1, 2)
+	assertEQ(b, 10, 1, 2, 1)
+
+	// removing a prefix exposes the shorter one
+
+	remove(c, 10, 1, 1, 0, 24)
+	assertEQ(a, 10, 1, 1, 1)
+	assertEQ(b, 10, 1, 1, 2)
+
+	remove(b, 10, 1, 0, 0, 16)
+	assertEQ(a, 10, 1, 1, 1)
+	assertEQ(a, 10, 1, 1, 2)
+	assertEQ(b, 10, 2, 0, 1)
+
+	// only prefixes routed to the peer are removed
+
+	remove(a, 10, 2, 0, 0, 16)
+	remove(a, 10, 2, 0, 0, 15)
+	assertEQ(b, 10, 2, 0, 1)
+
+	remove(a, 10, 0, 0, 0, 8)
+	assertEQ(a, 10, 1, 1, 1)
+	assertEQ(nil, 10, 1, 1, 2)
+	assertEQ(b, 10, 2, 0, 1)
+
+	remove(a, 10, 1, 1, 1, 32)
+	remove(b, 10, 2, 0, 0, 16)
+	if trie != nil {
+		t.Error("Trie not empty after removing all prefixes")
+	}
+}
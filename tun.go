@@ -30,24 +30,79 @@ type TUNDevice interface {
 	Close() error                   // stops the device and closes the event channel
 }
 
+/* Implemented by TUN devices requiring room in front of read packets,
+ * e.g. to prepend their own headers
+ */
+type TUNHeadroom interface {
+	HeadroomBytes() int // bytes required in front of the packet passed to Read
+}
+
+/* Implemented by TUN devices able to read several packets at once,
+ * e.g. using readv or by splitting a coalesced read
+ */
+type TUNBatchReader interface {
+	ReadBatch(bufs [][]byte, offset int) ([]int, error) // reads packets into the buffers (at offset), returns their sizes
+}
+
+/* Reads a batch of packets from the TUN device,
+ * devices without support for batches read a single packet into the first buffer
+ */
+func tunReadBatch(tun TUNDevice, bufs [][]byte, offset int) ([]int, error) {
+	if reader, ok := tun.(TUNBatchReader); ok {
+		return reader.ReadBatch(bufs, offset)
+	}
+	size, err := tun.Read(bufs[0], offset)
+	if err != nil {
+		return nil, err
+	}
+	return []int{size}, nil
+}
+
+/* Returns the offset at which packets are read into message buffers,
+ * leaving room for the transport header (and the headroom of the device)
+ */
+func tunReadOffset(tun TUNDevice, header int) int {
+	offset := header
+	if headroom, ok := tun.(TUNHeadroom); ok && headroom.HeadroomBytes() > offset {
+		offset = headroom.HeadroomBytes()
+	}
+	return offset
+}
+
+/* Limits an MTU reported by the TUN device to the range
+ * of content sizes which fit in a transport message
+ */
+func clampMTU(mtu int) int32 {
+	if mtu < 0 {
+		return 0
+	}
+	if mtu > MaxContentSize {
+		return MaxContentSize
+	}
+	return int32(mtu)
+}
+
 func (device *Device) RoutineTUNEventReader() {
 	setUp := false
 	logInfo := device.log.Info
 	logError := device.log.Error
 
+	device.health.tunEvents.started()
+	defer device.health.tunEvents.stopped()
+
 	for event := range device.tun.device.Events() {
+		device.health.tunEvents.active()
+
 		if event&TUNEventMTUUpdate != 0 {
 			mtu, err := device.tun.device.MTU()
-			old := atomic.LoadInt32(&device.tun.mtu)
 			if err != nil {
 				logError.Println("Failed to load updated MTU of device:", err)
-			} else if int(old) != mtu {
-				if mtu+MessageTransportSize > MaxMessageSize {
-					logInfo.Println("MTU updated:", mtu, "(too large)")
+			} else if clamped := clampMTU(mtu); atomic.SwapInt32(&device.tun.mtu, clamped) != clamped {
+				if int(clamped) != mtu {
+					logInfo.Println("MTU updated:", mtu, "(clamped to", clamped, ")")
 				} else {
 					logInfo.Println("MTU updated:", mtu)
 				}
-				atomic.StoreInt32(&device.tun.mtu, int32(mtu))
 			}
 		}
 
@@ -7,8 +7,11 @@ package main
 
 import (
 	"bufio"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
 	"strconv"
 	"strings"
@@ -28,79 +31,504 @@ func (s *IPCError) ErrorCode() int64 {
 	return s.Code
 }
 
-func ipcGetOperation(device *Device, socket *bufio.ReadWriter) *IPCError {
+/* Snapshot of the device state, as reported by the get operation
+ */
+type IPCKeypairState struct {
+	RemoteIndex uint32 `json:"remote_index"`
+	CreatedSec  int64  `json:"created_sec"`
+	SendNonce   uint64 `json:"send_nonce"`
+}
 
-	device.log.Debug.Println("UAPI: Processing get operation")
+type IPCPeerState struct {
+	PublicKey                   string           `json:"public_key"`
+	PresharedKey                string           `json:"preshared_key"`
+	Endpoint                    string           `json:"endpoint,omitempty"`
+	EndpointBackup              string           `json:"endpoint_backup,omitempty"`
+	SrcAddress                  string           `json:"src_address,omitempty"`
+	Fwmark                      uint32           `json:"fwmark,omitempty"`
+	EndpointPinned              bool             `json:"endpoint_pinned,omitempty"`
+	Unreachable                 bool             `json:"unreachable,omitempty"`
+	LastHandshakeTimeSec        int64            `json:"last_handshake_time_sec"`
+	LastHandshakeTimeNsec       int64            `json:"last_handshake_time_nsec"`
+	TxBytes                     uint64           `json:"tx_bytes"`
+	RxBytes                     uint64           `json:"rx_bytes"`
+	RxInterface                 int              `json:"rx_interface,omitempty"`
+	PersistentKeepaliveInterval uint16           `json:"persistent_keepalive_interval"`
+	TxRateLimit                 uint64           `json:"tx_rate_limit,omitempty"`
+	HandshakeFailures           uint64           `json:"handshake_failures"`
+	DecryptFailures             uint64           `json:"decrypt_failures"`
+	InvalidMAC                  uint64           `json:"invalid_mac"`
+	HandshakeReplays            uint64           `json:"handshake_replays"`
+	NonceQueueDrops             uint64           `json:"nonce_queue_drops"`
+	OutboundQueueDrops          uint64           `json:"outbound_queue_drops"`
+	CurrentKeypair              *IPCKeypairState `json:"current_keypair,omitempty"`
+	PreviousKeypair             *IPCKeypairState `json:"previous_keypair,omitempty"`
+	AllowedIPs                  []string         `json:"allowed_ips"`
+	AllowedIPHits               []uint64         `json:"allowed_ip_hits,omitempty"`
+
+	endpointHost string // endpoint as configured by hostname (if any)
+}
+
+type IPCDeviceState struct {
+	PrivateKey          string         `json:"private_key,omitempty"`
+	ListenPort          uint16         `json:"listen_port,omitempty"`
+	ExtraListenPorts    []uint16       `json:"extra_listen_ports,omitempty"`
+	BindErrno           int64          `json:"bind_errno,omitempty"`
+	ListenAddress       string         `json:"listen_address,omitempty"`
+	ListenFreebind      bool           `json:"listen_freebind,omitempty"`
+	TUNGSO              bool           `json:"tun_gso,omitempty"`
+	Fwmark              uint32         `json:"fwmark,omitempty"`
+	DontFragment        bool           `json:"dont_fragment,omitempty"`
+	TrafficClass        uint8          `json:"traffic_class,omitempty"`
+	PointToPoint        bool           `json:"point_to_point,omitempty"`
+	DualStack           bool           `json:"dual_stack,omitempty"`
+	DisableSticky       bool           `json:"disable_sticky_sockets,omitempty"`
+	Receivers           int            `json:"receivers,omitempty"`
+	StrictAllowedIPs    bool           `json:"strict_allowed_ips,omitempty"`
+	FlowLabel           uint32         `json:"flow_label,omitempty"`
+	SendTimeoutMs       int64          `json:"send_timeout_ms,omitempty"`
+	HandshakeBackoffMax int64          `json:"handshake_backoff_max,omitempty"`
+	HandshakeTimeout    int64          `json:"handshake_timeout,omitempty"`
+	MaxHandshakes       int            `json:"max_handshake_attempts,omitempty"`
+	KeepaliveJitter     int            `json:"keepalive_jitter,omitempty"`
+	RecordRxInterface   bool           `json:"record_rx_interface,omitempty"`
+	WorkerAffinity      bool           `json:"worker_affinity,omitempty"`
+	MaxPeers            int            `json:"max_peers,omitempty"`
+	PeerMaxAge          int64          `json:"peer_max_age,omitempty"`
+	ReplayWindowSize    uint64         `json:"replay_window_size,omitempty"`
+	BufferRingSize      int            `json:"buffer_ring_size,omitempty"`
+	LogRingSize         int            `json:"log_ring_size,omitempty"`
+	ClearBuffers        string         `json:"clear_buffers,omitempty"`
+	HandshakeFailures   uint64         `json:"handshake_failures"`
+	DecryptFailures     uint64         `json:"decrypt_failures"`
+	InvalidMAC          uint64         `json:"invalid_mac"`
+	SrcInvalidations    uint64         `json:"src_invalidations"`
+	HandshakeReplays    uint64         `json:"handshake_replays"`
+	Peers               []IPCPeerState `json:"peers"`
+}
+
+/* Parses a comma separated list of listening ports,
+ * the first of which is the primary port
+ */
+func parseListenPorts(value string) ([]uint16, error) {
+	var ports []uint16
+	for _, field := range strings.Split(value, ",") {
+		port, err := strconv.ParseUint(strings.TrimSpace(field), 10, 16)
+		if err != nil {
+			return nil, err
+		}
+		ports = append(ports, uint16(port))
+	}
+	return ports, nil
+}
+
+func formatListenPorts(ports []uint16) string {
+	fields := make([]string, len(ports))
+	for i, port := range ports {
+		fields[i] = strconv.Itoa(int(port))
+	}
+	return strings.Join(fields, ",")
+}
+
+func ipcGetState(device *Device) *IPCDeviceState {
+
+	// lock required resources
+
+	device.net.mutex.RLock()
+	defer device.net.mutex.RUnlock()
+
+	device.noise.mutex.RLock()
+	defer device.noise.mutex.RUnlock()
+
+	device.routing.mutex.RLock()
+	defer device.routing.mutex.RUnlock()
+
+	device.peers.mutex.Lock()
+	defer device.peers.mutex.Unlock()
+
+	// serialize device related values
+
+	state := &IPCDeviceState{
+		ListenPort:          device.net.port,
+		ExtraListenPorts:    append([]uint16(nil), device.net.extra...),
+		BindErrno:           device.net.bindErr,
+		Fwmark:              device.net.fwmark,
+		DontFragment:        device.net.dontFrag,
+		TrafficClass:        device.net.tclass,
+		PointToPoint:        device.net.p2p,
+		DualStack:           device.net.dual,
+		DisableSticky:       device.net.noSticky,
+		Receivers:           device.net.receivers,
+		ListenFreebind:      device.net.freebind,
+		TUNGSO:              device.TUNSegmentationOffload(),
+		StrictAllowedIPs:    device.routing.strict,
+		FlowLabel:           device.net.flow,
+		SendTimeoutMs:       int64(device.net.sndTimeout / time.Millisecond),
+		HandshakeBackoffMax: atomic.LoadInt64(&device.timers.handshakeBackoffMax) / time.Second.Nanoseconds(),
+		HandshakeTimeout:    int64(device.HandshakeTimeout() / time.Second),
+		MaxHandshakes:       int(atomic.LoadInt32(&device.timers.maxHandshakeAttempts)),
+		KeepaliveJitter:     device.KeepaliveJitter(),
+		RecordRxInterface:   device.RecordRxInterface(),
+		WorkerAffinity:      device.WorkerAffinity(),
+		MaxPeers:            device.peers.limit,
+		PeerMaxAge:          int64(device.PeerMaxAge() / time.Second),
+		ReplayWindowSize:    atomic.LoadUint64(&device.replay.size),
+		BufferRingSize:      device.MessageBufferRingSize(),
+		LogRingSize:         device.LogRingSize(),
+		HandshakeFailures:   atomic.LoadUint64(&device.stats.handshakeFailures),
+		DecryptFailures:     atomic.LoadUint64(&device.stats.decryptFailures),
+		InvalidMAC:          atomic.LoadUint64(&device.stats.invalidMAC),
+		SrcInvalidations:    atomic.LoadUint64(&device.stats.srcInvalidations),
+		HandshakeReplays:    atomic.LoadUint64(&device.stats.replayedInitiations),
+		Peers:               make([]IPCPeerState, 0, len(device.peers.keyMap)),
+	}
+
+	if !device.noise.privateKey.IsZero() {
+		state.PrivateKey = device.noise.privateKey.ToHex()
+	}
+
+	if device.net.address != nil {
+		state.ListenAddress = device.net.address.String()
+	}
+
+	switch device.MessageBufferClearing() {
+	case BufferClearingOn:
+		state.ClearBuffers = "true"
+	case BufferClearingOff:
+		state.ClearBuffers = "false"
+	}
+
+	// serialize each peer state
+
+	for _, peer := range device.peers.keyMap {
+		peer.mutex.RLock()
+		defer peer.mutex.RUnlock()
+
+		nano := atomic.LoadInt64(&peer.stats.lastHandshakeNano)
+		psk := peer.handshake.PresharedKey()
+
+		peerState := IPCPeerState{
+			PublicKey:                   peer.handshake.remoteStatic.ToHex(),
+			PresharedKey:                psk.ToHex(),
+			LastHandshakeTimeSec:        nano / time.Second.Nanoseconds(),
+			LastHandshakeTimeNsec:       nano % time.Second.Nanoseconds(),
+			TxBytes:                     atomic.LoadUint64(&peer.stats.txBytes),
+			RxBytes:                     atomic.LoadUint64(&peer.stats.rxBytes),
+			RxInterface:                 peer.RxInterface(),
+			Unreachable:                 peer.Unreachable(),
+			PersistentKeepaliveInterval: peer.persistentKeepaliveInterval,
+			TxRateLimit:                 peer.txRate.Rate(),
+			HandshakeFailures:           atomic.LoadUint64(&peer.stats.handshakeFailures),
+			DecryptFailures:             atomic.LoadUint64(&peer.stats.decryptFailures),
+			InvalidMAC:                  atomic.LoadUint64(&peer.stats.invalidMAC),
+			HandshakeReplays:            atomic.LoadUint64(&peer.stats.replayedInitiations),
+			NonceQueueDrops:             atomic.LoadUint64(&peer.stats.nonceDrops),
+			OutboundQueueDrops:          atomic.LoadUint64(&peer.stats.outboundDrops),
+			AllowedIPs:                  make([]string, 0),
+		}
+
+		if peer.endpoint != nil {
+			peerState.Endpoint = peer.endpoint.DstToString()
+		}
+		if peer.endpointBackup != nil {
+			peerState.EndpointBackup = peer.endpointBackup.DstToString()
+		}
+		if peer.srcAddress != nil {
+			peerState.SrcAddress = peer.srcAddress.String()
+		}
+		peerState.Fwmark = peer.fwmark
+		peerState.endpointHost = peer.dns.host
+		peerState.EndpointPinned = peer.endpointPinned
+
+		peer.keyPairs.mutex.RLock()
+		peerState.CurrentKeypair = keypairState(peer.keyPairs.current)
+		peerState.PreviousKeypair = keypairState(peer.keyPairs.previous)
+		peer.keyPairs.mutex.RUnlock()
+
+		allowed, hits := device.routing.table.AllowedIPHits(peer)
+		for _, ip := range allowed {
+			peerState.AllowedIPs = append(peerState.AllowedIPs, ip.String())
+		}
+		peerState.AllowedIPHits = hits
+
+		state.Peers = append(state.Peers, peerState)
+	}
+
+	return state
+}
 
-	// create lines
+/* Snapshot of a keypair, the send nonce is read atomically
+ * as it is concurrently incremented by the sending routines
+ */
+func keypairState(kp *Keypair) *IPCKeypairState {
+	if kp == nil {
+		return nil
+	}
+	return &IPCKeypairState{
+		RemoteIndex: kp.remoteIndex,
+		CreatedSec:  kp.created.Unix(),
+		SendNonce:   atomic.LoadUint64(&kp.sendNonce),
+	}
+}
 
+/* Serializes the state in the line based key=value format
+ */
+func (state *IPCDeviceState) lines() []string {
 	lines := make([]string, 0, 100)
 	send := func(line string) {
 		lines = append(lines, line)
 	}
 
-	func() {
+	if state.PrivateKey != "" {
+		send("private_key=" + state.PrivateKey)
+	}
 
-		// lock required resources
+	if state.ListenPort != 0 {
+		ports := append([]uint16{state.ListenPort}, state.ExtraListenPorts...)
+		send("listen_port=" + formatListenPorts(ports))
+	}
 
-		device.net.mutex.RLock()
-		defer device.net.mutex.RUnlock()
+	// a failed bind is reported (as listen_port is then omitted),
+	// not named errno, which terminates the response
 
-		device.noise.mutex.RLock()
-		defer device.noise.mutex.RUnlock()
+	if state.BindErrno != 0 {
+		send(fmt.Sprintf("bind_errno=%d", state.BindErrno))
+	}
 
-		device.routing.mutex.RLock()
-		defer device.routing.mutex.RUnlock()
+	// freebind precedes the address it applies to
 
-		device.peers.mutex.Lock()
-		defer device.peers.mutex.Unlock()
+	if state.ListenFreebind {
+		send("listen_freebind=true")
+	}
 
-		// serialize device related values
+	if state.ListenAddress != "" {
+		send("listen_address=" + state.ListenAddress)
+	}
 
-		if !device.noise.privateKey.IsZero() {
-			send("private_key=" + device.noise.privateKey.ToHex())
-		}
+	if state.Fwmark != 0 {
+		send(fmt.Sprintf("fwmark=%d", state.Fwmark))
+	}
+
+	if state.DontFragment {
+		send("dont_fragment=true")
+	}
+
+	if state.TrafficClass != 0 {
+		send(fmt.Sprintf("traffic_class=%d", state.TrafficClass))
+	}
+
+	if state.PointToPoint {
+		send("point_to_point=true")
+	}
+
+	if state.DualStack {
+		send("dual_stack=true")
+	}
+
+	if state.DisableSticky {
+		send("disable_sticky_sockets=true")
+	}
+
+	if state.Receivers > 1 {
+		send(fmt.Sprintf("receivers=%d", state.Receivers))
+	}
+
+	if state.StrictAllowedIPs {
+		send("strict_allowed_ips=true")
+	}
+
+	if state.TUNGSO {
+		send("tun_gso=true")
+	}
 
-		if device.net.port != 0 {
-			send(fmt.Sprintf("listen_port=%d", device.net.port))
+	if state.FlowLabel != 0 {
+		send(fmt.Sprintf("flow_label=%d", state.FlowLabel))
+	}
+
+	if state.SendTimeoutMs != 0 {
+		send(fmt.Sprintf("send_timeout_ms=%d", state.SendTimeoutMs))
+	}
+
+	if state.HandshakeBackoffMax != 0 {
+		send(fmt.Sprintf("handshake_backoff_max=%d", state.HandshakeBackoffMax))
+	}
+
+	if state.HandshakeTimeout != 0 {
+		send(fmt.Sprintf("handshake_timeout=%d", state.HandshakeTimeout))
+	}
+
+	if state.MaxHandshakes != 0 {
+		send(fmt.Sprintf("max_handshake_attempts=%d", state.MaxHandshakes))
+	}
+
+	if state.KeepaliveJitter != 0 {
+		send(fmt.Sprintf("keepalive_jitter=%d", state.KeepaliveJitter))
+	}
+
+	if state.RecordRxInterface {
+		send("record_rx_interface=true")
+	}
+
+	if state.WorkerAffinity {
+		send("worker_affinity=true")
+	}
+
+	if state.MaxPeers != 0 {
+		send(fmt.Sprintf("max_peers=%d", state.MaxPeers))
+	}
+
+	if state.PeerMaxAge != 0 {
+		send(fmt.Sprintf("peer_max_age=%d", state.PeerMaxAge))
+	}
+
+	if state.ReplayWindowSize != 0 {
+		send(fmt.Sprintf("replay_window_size=%d", state.ReplayWindowSize))
+	}
+
+	if state.BufferRingSize != 0 {
+		send(fmt.Sprintf("buffer_ring_size=%d", state.BufferRingSize))
+	}
+
+	if state.LogRingSize != DefaultLogRingSize {
+		send(fmt.Sprintf("log_ring_size=%d", state.LogRingSize))
+	}
+
+	if state.ClearBuffers != "" {
+		send("clear_buffers=" + state.ClearBuffers)
+	}
+
+	// failure counters are only reported once non-zero
+
+	counters := func(handshake, decrypt, mac, replays uint64) {
+		if handshake != 0 {
+			send(fmt.Sprintf("handshake_failures=%d", handshake))
+		}
+		if decrypt != 0 {
+			send(fmt.Sprintf("decrypt_failures=%d", decrypt))
+		}
+		if mac != 0 {
+			send(fmt.Sprintf("invalid_mac=%d", mac))
+		}
+		if replays != 0 {
+			send(fmt.Sprintf("handshake_replays=%d", replays))
 		}
+	}
+
+	counters(state.HandshakeFailures, state.DecryptFailures, state.InvalidMAC, state.HandshakeReplays)
+	if state.SrcInvalidations != 0 {
+		send(fmt.Sprintf("src_invalidations=%d", state.SrcInvalidations))
+	}
 
-		if device.net.fwmark != 0 {
-			send(fmt.Sprintf("fwmark=%d", device.net.fwmark))
+	for _, peer := range state.Peers {
+		send("public_key=" + peer.PublicKey)
+		send("preshared_key=" + peer.PresharedKey)
+		if peer.Endpoint != "" {
+			send("endpoint=" + peer.Endpoint)
+		}
+		if peer.EndpointBackup != "" {
+			send("endpoint_backup=" + peer.EndpointBackup)
+		}
+		if peer.SrcAddress != "" {
+			send("src_address=" + peer.SrcAddress)
+		}
+		if peer.Fwmark != 0 {
+			send(fmt.Sprintf("fwmark=%d", peer.Fwmark))
+		}
+		if peer.EndpointPinned {
+			send("endpoint_pinned=1")
+		}
+		if peer.Unreachable {
+			send("unreachable=1")
+		}
+		send(fmt.Sprintf("last_handshake_time_sec=%d", peer.LastHandshakeTimeSec))
+		send(fmt.Sprintf("last_handshake_time_nsec=%d", peer.LastHandshakeTimeNsec))
+		send(fmt.Sprintf("tx_bytes=%d", peer.TxBytes))
+		send(fmt.Sprintf("rx_bytes=%d", peer.RxBytes))
+		if peer.RxInterface != 0 {
+			send(fmt.Sprintf("rx_interface=%d", peer.RxInterface))
+		}
+		send(fmt.Sprintf("persistent_keepalive_interval=%d", peer.PersistentKeepaliveInterval))
+		if peer.TxRateLimit != 0 {
+			send(fmt.Sprintf("tx_rate_limit=%d", peer.TxRateLimit))
+		}
+		counters(peer.HandshakeFailures, peer.DecryptFailures, peer.InvalidMAC, peer.HandshakeReplays)
+		if peer.NonceQueueDrops != 0 {
+			send(fmt.Sprintf("nonce_queue_drops=%d", peer.NonceQueueDrops))
+		}
+		if peer.OutboundQueueDrops != 0 {
+			send(fmt.Sprintf("outbound_queue_drops=%d", peer.OutboundQueueDrops))
+		}
+		keypair := func(name string, kp *IPCKeypairState) {
+			if kp != nil {
+				send(fmt.Sprintf("%s_keypair_remote_index=%d", name, kp.RemoteIndex))
+				send(fmt.Sprintf("%s_keypair_created_sec=%d", name, kp.CreatedSec))
+				send(fmt.Sprintf("%s_keypair_send_nonce=%d", name, kp.SendNonce))
+			}
+		}
+		keypair("current", peer.CurrentKeypair)
+		keypair("previous", peer.PreviousKeypair)
+		for i, ip := range peer.AllowedIPs {
+			send("allowed_ip=" + ip)
+			if i < len(peer.AllowedIPHits) {
+				send(fmt.Sprintf("allowed_ip_hits=%d", peer.AllowedIPHits[i]))
+			}
 		}
+	}
 
-		// serialize each peer state
+	return lines
+}
 
-		for _, peer := range device.peers.keyMap {
-			peer.mutex.RLock()
-			defer peer.mutex.RUnlock()
+func ipcGetOperation(device *Device, socket *bufio.ReadWriter) *IPCError {
 
-			send("public_key=" + peer.handshake.remoteStatic.ToHex())
-			send("preshared_key=" + peer.handshake.presharedKey.ToHex())
-			if peer.endpoint != nil {
-				send("endpoint=" + peer.endpoint.DstToString())
-			}
+	device.log.Debug.Println("UAPI: Processing get operation")
 
-			nano := atomic.LoadInt64(&peer.stats.lastHandshakeNano)
-			secs := nano / time.Second.Nanoseconds()
-			nano %= time.Second.Nanoseconds()
+	// parse options (terminated by an empty line)
 
-			send(fmt.Sprintf("last_handshake_time_sec=%d", secs))
-			send(fmt.Sprintf("last_handshake_time_nsec=%d", nano))
-			send(fmt.Sprintf("tx_bytes=%d", peer.stats.txBytes))
-			send(fmt.Sprintf("rx_bytes=%d", peer.stats.rxBytes))
-			send(fmt.Sprintf("persistent_keepalive_interval=%d", peer.persistentKeepaliveInterval))
+	useJSON := false
+	useHits := false
 
-			for _, ip := range device.routing.table.AllowedIPs(peer) {
-				send("allowed_ip=" + ip.String())
-			}
+	for {
+		line, err := socket.ReadString('\n')
+		if err != nil {
+			return &IPCError{Code: ipcErrorIO}
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" {
+			break
+		}
+		switch line {
+		case "json=1":
+			useJSON = true
+		case "allowed_ip_hits=1":
+			useHits = true
+		default:
+			device.log.Error.Println("Invalid UAPI key (get operation):", line)
+			return &IPCError{Code: ipcErrorInvalid}
+		}
+	}
+
+	// create snapshot
+
+	state := ipcGetState(device)
+
+	// hits of the allowed IPs are only reported on request
 
+	if !useHits {
+		for i := range state.Peers {
+			state.Peers[i].AllowedIPHits = nil
 		}
-	}()
+	}
 
-	// send lines (does not require resource locks)
+	// send state (does not require resource locks)
 
-	for _, line := range lines {
+	if useJSON {
+		if err := json.NewEncoder(socket).Encode(state); err != nil {
+			return &IPCError{Code: ipcErrorIO}
+		}
+		return nil
+	}
+
+	for _, line := range state.lines() {
 		_, err := socket.WriteString(line + "\n")
 		if err != nil {
 			return &IPCError{
@@ -112,15 +540,43 @@ func ipcGetOperation(device *Device, socket *bufio.ReadWriter) *IPCError {
 	return nil
 }
 
+const (
+	ipcSetApply    = iota // lines are applied as they are read
+	ipcSetValidate        // lines are parsed and validated, nothing is applied
+	ipcSetCommit          // lines of a validated transaction are applied
+)
+
 func ipcSetOperation(device *Device, socket *bufio.ReadWriter) *IPCError {
-	scanner := bufio.NewScanner(socket)
+	device.ipc.mutex.Lock()
+	defer device.ipc.mutex.Unlock()
+	return ipcSetConfig(device, bufio.NewScanner(socket), ipcSetApply)
+}
+
+func ipcSetConfig(device *Device, scanner *bufio.Scanner, mode int) *IPCError {
 	logError := device.log.Error
+	logInfo := device.log.Info
 	logDebug := device.log.Debug
 
 	var peer *Peer
 
 	dummy := false
+	override := false // allowed IPs may be moved to the peer
 	deviceConfig := true
+	dryRun := mode == ipcSetValidate
+	first := true
+
+	// peers or endpoints may have changed
+
+	defer func() {
+		device.net.mutex.RLock()
+		p2p := device.net.p2p
+		device.net.mutex.RUnlock()
+		if p2p && !dryRun {
+			if err := device.BindSetPointToPoint(true); err != nil {
+				logError.Println("Failed to update point-to-point mode:", err)
+			}
+		}
+	}()
 
 	for scanner.Scan() {
 
@@ -137,6 +593,21 @@ func ipcSetOperation(device *Device, socket *bufio.ReadWriter) *IPCError {
 		key := parts[0]
 		value := parts[1]
 
+		// a transaction is read completely, validated and only then applied
+
+		if key == "transaction" {
+			if !first || mode != ipcSetApply || value != "true" {
+				logError.Println("Failed to start transaction:", line)
+				return &IPCError{Code: ipcErrorInvalid}
+			}
+			var lines []string
+			for scanner.Scan() && scanner.Text() != "" {
+				lines = append(lines, scanner.Text())
+			}
+			return ipcSetTransaction(device, lines)
+		}
+		first = false
+
 		/* device configuration */
 
 		if deviceConfig {
@@ -149,6 +620,9 @@ func ipcSetOperation(device *Device, socket *bufio.ReadWriter) *IPCError {
 					logError.Println("Failed to set private_key:", err)
 					return &IPCError{Code: ipcErrorInvalid}
 				}
+				if dryRun {
+					continue
+				}
 				logDebug.Println("UAPI: Updating device private key")
 				device.SetPrivateKey(sk)
 
@@ -156,25 +630,72 @@ func ipcSetOperation(device *Device, socket *bufio.ReadWriter) *IPCError {
 
 				// parse port number
 
-				port, err := strconv.ParseUint(value, 10, 16)
+				ports, err := parseListenPorts(value)
 				if err != nil {
 					logError.Println("Failed to parse listen_port:", err)
 					return &IPCError{Code: ipcErrorInvalid}
 				}
 
-				// update port and rebind
+				if dryRun {
+					continue
+				}
 
-				logDebug.Println("UAPI: Updating listen port")
+				// migrate to the new port (the previous port is retained on failure)
 
-				device.net.mutex.Lock()
-				device.net.port = uint16(port)
-				device.net.mutex.Unlock()
+				logDebug.Println("UAPI: Updating listen port")
 
-				if err := device.BindUpdate(); err != nil {
+				if err := device.BindMigrate(ports); err != nil {
 					logError.Println("Failed to set listen_port:", err)
 					return &IPCError{Code: ipcErrorPortInUse}
 				}
 
+			case "listen_address":
+
+				// parse address (empty for the wildcard address)
+
+				var addr net.IP
+				if value != "" {
+					addr = net.ParseIP(value)
+					if addr == nil {
+						logError.Println("Failed to parse listen_address:", value)
+						return &IPCError{Code: ipcErrorInvalid}
+					}
+				}
+
+				if dryRun {
+					continue
+				}
+
+				logDebug.Println("UAPI: Updating listen address")
+
+				if err := device.BindSetAddress(addr); err != nil {
+					logError.Println("Failed to set listen_address:", err)
+					return &IPCError{Code: ipcErrorPortInUse}
+				}
+
+			case "listen_freebind":
+
+				var enabled bool
+				switch value {
+				case "true":
+					enabled = true
+				case "false":
+				default:
+					logError.Println("Failed to set listen_freebind, invalid value:", value)
+					return &IPCError{Code: ipcErrorInvalid}
+				}
+
+				if dryRun {
+					continue
+				}
+
+				logDebug.Println("UAPI: Updating listen freebind")
+
+				if err := device.BindSetFreebind(enabled); err != nil {
+					logError.Println("Failed to set listen_freebind:", err)
+					return &IPCError{Code: ipcErrorPortInUse}
+				}
+
 			case "fwmark":
 
 				// parse fwmark field
@@ -192,6 +713,10 @@ func ipcSetOperation(device *Device, socket *bufio.ReadWriter) *IPCError {
 					return &IPCError{Code: ipcErrorInvalid}
 				}
 
+				if dryRun {
+					continue
+				}
+
 				logDebug.Println("UAPI: Updating fwmark")
 
 				if err := device.BindSetMark(uint32(fwmark)); err != nil {
@@ -199,142 +724,756 @@ func ipcSetOperation(device *Device, socket *bufio.ReadWriter) *IPCError {
 					return &IPCError{Code: ipcErrorPortInUse}
 				}
 
-			case "public_key":
-				// switch to peer configuration
-				logDebug.Println("UAPI: Transition to peer configuration")
-				deviceConfig = false
+			case "dont_fragment":
 
-			case "replace_peers":
-				if value != "true" {
-					logError.Println("Failed to set replace_peers, invalid value:", value)
+				var enabled bool
+				switch value {
+				case "true":
+					enabled = true
+				case "false":
+				default:
+					logError.Println("Failed to set dont_fragment, invalid value:", value)
 					return &IPCError{Code: ipcErrorInvalid}
 				}
-				logDebug.Println("UAPI: Removing all peers")
-				device.RemoveAllPeers()
 
-			default:
-				logError.Println("Invalid UAPI key (device configuration):", key)
-				return &IPCError{Code: ipcErrorInvalid}
-			}
-		}
+				if dryRun {
+					continue
+				}
 
-		/* peer configuration */
+				logDebug.Println("UAPI: Updating DF bit")
 
-		if !deviceConfig {
+				if err := device.BindSetDontFragment(enabled); err != nil {
+					logError.Println("Failed to update dont_fragment:", err)
+					return &IPCError{Code: ipcErrorIO}
+				}
 
-			switch key {
+			case "point_to_point":
 
-			case "public_key":
-				var publicKey NoisePublicKey
-				err := publicKey.FromHex(value)
-				if err != nil {
-					logError.Println("Failed to get peer by public_key:", err)
+				var enabled bool
+				switch value {
+				case "true":
+					enabled = true
+				case "false":
+				default:
+					logError.Println("Failed to set point_to_point, invalid value:", value)
 					return &IPCError{Code: ipcErrorInvalid}
 				}
 
-				// ignore peer with public key of device
+				if dryRun {
+					continue
+				}
 
-				device.noise.mutex.RLock()
-				equals := device.noise.publicKey.Equals(publicKey)
-				device.noise.mutex.RUnlock()
+				logDebug.Println("UAPI: Updating point-to-point mode")
 
-				if equals {
-					peer = &Peer{}
-					dummy = true
+				if err := device.BindSetPointToPoint(enabled); err != nil {
+					logError.Println("Failed to update point_to_point:", err)
+					return &IPCError{Code: ipcErrorIO}
 				}
 
-				// find peer referenced
+			case "dual_stack":
 
-				peer = device.LookupPeer(publicKey)
+				var enabled bool
+				switch value {
+				case "true":
+					enabled = true
+				case "false":
+				default:
+					logError.Println("Failed to set dual_stack, invalid value:", value)
+					return &IPCError{Code: ipcErrorInvalid}
+				}
 
-				if peer == nil {
-					peer, err = device.NewPeer(publicKey)
-					if err != nil {
-						logError.Println("Failed to create new peer:", err)
-						return &IPCError{Code: ipcErrorInvalid}
-					}
-					logDebug.Println("UAPI: Created new peer:", peer)
+				if dryRun {
+					continue
 				}
 
-			case "remove":
+				logDebug.Println("UAPI: Updating dual-stack mode")
 
-				// remove currently selected peer from device
+				if err := device.BindSetDualStack(enabled); err != nil {
+					logError.Println("Failed to set dual_stack:", err)
+					return &IPCError{Code: ipcErrorPortInUse}
+				}
 
-				if value != "true" {
-					logError.Println("Failed to set remove, invalid value:", value)
+			case "disable_sticky_sockets":
+
+				var disabled bool
+				switch value {
+				case "true":
+					disabled = true
+				case "false":
+				default:
+					logError.Println("Failed to set disable_sticky_sockets, invalid value:", value)
 					return &IPCError{Code: ipcErrorInvalid}
 				}
-				if !dummy {
-					logDebug.Println("UAPI: Removing peer:", peer)
-					device.RemovePeer(peer.handshake.remoteStatic)
+
+				if dryRun {
+					continue
 				}
-				peer = &Peer{}
-				dummy = true
 
-			case "preshared_key":
+				logDebug.Println("UAPI: Updating sticky sockets")
 
-				// update PSK
+				if err := device.BindSetDisableStickySockets(disabled); err != nil {
+					logError.Println("Failed to set disable_sticky_sockets:", err)
+					return &IPCError{Code: ipcErrorPortInUse}
+				}
 
-				logDebug.Println("UAPI: Updating pre-shared key for peer:", peer)
+			case "flow_label":
 
-				peer.handshake.mutex.Lock()
-				err := peer.handshake.presharedKey.FromHex(value)
-				peer.handshake.mutex.Unlock()
+				// parse IPv6 flow label (decimal or 0x prefixed hexadecimal)
 
-				if err != nil {
-					logError.Println("Failed to set preshared_key:", err)
+				label, err := strconv.ParseUint(value, 0, 32)
+				if err != nil || label&^FlowLabelMask != 0 {
+					logError.Println("Failed to set flow_label, invalid value:", value)
 					return &IPCError{Code: ipcErrorInvalid}
 				}
 
-			case "endpoint":
+				if dryRun {
+					continue
+				}
 
-				// set endpoint destination
+				logDebug.Println("UAPI: Updating IPv6 flow label")
 
-				logDebug.Println("UAPI: Updating endpoint for peer:", peer)
+				if err := device.BindSetFlowLabel(uint32(label)); err != nil {
+					logError.Println("Failed to update flow_label:", err)
+					return &IPCError{Code: ipcErrorIO}
+				}
 
-				err := func() error {
-					peer.mutex.Lock()
-					defer peer.mutex.Unlock()
-					endpoint, err := CreateEndpoint(value)
-					if err != nil {
-						return err
-					}
-					peer.endpoint = endpoint
-					return nil
-				}()
+			case "receivers":
 
-				if err != nil {
-					logError.Println("Failed to set endpoint:", value)
+				// parallel receive routines, balanced by the kernel (SO_REUSEPORT)
+
+				receivers, err := strconv.ParseUint(value, 10, 32)
+				if err != nil || receivers == 0 || receivers > MaxReceivers {
+					logError.Println("Failed to set receivers, invalid value:", value)
 					return &IPCError{Code: ipcErrorInvalid}
 				}
 
+				if dryRun {
+					continue
+				}
+
+				logDebug.Println("UAPI: Updating receivers")
+
+				if err := device.BindSetReceivers(int(receivers)); err != nil {
+					logError.Println("Failed to set receivers:", err)
+					return &IPCError{Code: ipcErrorPortInUse}
+				}
+
+			case "send_timeout_ms":
+
+				// bound the time a send blocks on a full socket buffer
+
+				ms, err := strconv.ParseUint(value, 10, 32)
+				if err != nil {
+					logError.Println("Failed to set send_timeout_ms, invalid value:", value)
+					return &IPCError{Code: ipcErrorInvalid}
+				}
+
+				if dryRun {
+					continue
+				}
+
+				logDebug.Println("UAPI: Updating send timeout")
+
+				if err := device.BindSetSendTimeout(time.Duration(ms) * time.Millisecond); err != nil {
+					logError.Println("Failed to update send_timeout_ms:", err)
+					return &IPCError{Code: ipcErrorIO}
+				}
+
+			case "strict_allowed_ips":
+
+				var enabled bool
+				switch value {
+				case "true":
+					enabled = true
+				case "false":
+				default:
+					logError.Println("Failed to set strict_allowed_ips, invalid value:", value)
+					return &IPCError{Code: ipcErrorInvalid}
+				}
+
+				if dryRun {
+					continue
+				}
+
+				logDebug.Println("UAPI: Updating strict allowed IPs mode")
+
+				device.SetStrictAllowedIPs(enabled)
+
+			case "tun_gso":
+
+				var enabled bool
+				switch value {
+				case "true":
+					enabled = true
+				case "false":
+				default:
+					logError.Println("Failed to set tun_gso, invalid value:", value)
+					return &IPCError{Code: ipcErrorInvalid}
+				}
+
+				if dryRun {
+					continue
+				}
+
+				logDebug.Println("UAPI: Updating TUN segmentation offload")
+
+				device.SetTUNSegmentationOffload(enabled)
+
+			case "traffic_class":
+
+				// parse IPv4 TOS / IPv6 traffic class (DSCP and ECN bits)
+
+				tc, err := strconv.ParseUint(value, 0, 8)
+				if err != nil {
+					logError.Println("Failed to parse traffic_class:", err)
+					return &IPCError{Code: ipcErrorInvalid}
+				}
+
+				if dryRun {
+					continue
+				}
+
+				logDebug.Println("UAPI: Updating traffic class")
+
+				if err := device.BindSetTrafficClass(uint8(tc)); err != nil {
+					logError.Println("Failed to update traffic_class:", err)
+					return &IPCError{Code: ipcErrorIO}
+				}
+
+			case "handshake_backoff_max":
+
+				// parse ceiling of handshake retry backoff (seconds)
+
+				secs, err := strconv.ParseUint(value, 10, 16)
+				if err != nil {
+					logError.Println("Failed to parse handshake_backoff_max:", err)
+					return &IPCError{Code: ipcErrorInvalid}
+				}
+
+				if dryRun {
+					continue
+				}
+
+				logDebug.Println("UAPI: Updating handshake backoff ceiling")
+
+				atomic.StoreInt64(&device.timers.handshakeBackoffMax, int64(time.Duration(secs)*time.Second))
+
+			case "handshake_timeout":
+
+				// parse time after which handshakes give up (seconds, 0 = disabled)
+
+				secs, err := strconv.ParseUint(value, 10, 16)
+				if err != nil {
+					logError.Println("Failed to parse handshake_timeout:", err)
+					return &IPCError{Code: ipcErrorInvalid}
+				}
+
+				if dryRun {
+					continue
+				}
+
+				logDebug.Println("UAPI: Updating handshake timeout")
+
+				device.SetHandshakeTimeout(time.Duration(secs) * time.Second)
+
+			case "max_handshake_attempts":
+
+				// parse attempts after which handshakes give up (0 = default)
+
+				attempts, err := strconv.ParseUint(value, 10, 16)
+				if err != nil {
+					logError.Println("Failed to parse max_handshake_attempts:", err)
+					return &IPCError{Code: ipcErrorInvalid}
+				}
+
+				if dryRun {
+					continue
+				}
+
+				logDebug.Println("UAPI: Updating maximum handshake attempts")
+
+				device.SetMaxHandshakeAttempts(int(attempts))
+
+			case "keepalive_jitter":
+
+				// parse spread of persistent keepalives (percent of the interval)
+
+				percent, err := strconv.ParseUint(value, 10, 8)
+				if err == nil && percent > MaxKeepaliveJitter {
+					err = fmt.Errorf("Jitter must be within [0, %d] percent", MaxKeepaliveJitter)
+				}
+				if err != nil {
+					logError.Println("Failed to set keepalive_jitter:", err)
+					return &IPCError{Code: ipcErrorInvalid}
+				}
+
+				if dryRun {
+					continue
+				}
+
+				logDebug.Println("UAPI: Updating keepalive jitter")
+
+				device.SetKeepaliveJitter(int(percent))
+
+			case "record_rx_interface":
+
+				var enabled bool
+				switch value {
+				case "true":
+					enabled = true
+				case "false":
+				default:
+					logError.Println("Failed to set record_rx_interface, invalid value:", value)
+					return &IPCError{Code: ipcErrorInvalid}
+				}
+
+				if dryRun {
+					continue
+				}
+
+				logDebug.Println("UAPI: Updating recording of receive interfaces")
+
+				device.SetRecordRxInterface(enabled)
+
+			case "worker_affinity":
+
+				var enabled bool
+				switch value {
+				case "true":
+					enabled = true
+				case "false":
+				default:
+					logError.Println("Failed to set worker_affinity, invalid value:", value)
+					return &IPCError{Code: ipcErrorInvalid}
+				}
+
+				if dryRun {
+					continue
+				}
+
+				logDebug.Println("UAPI: Updating pinning of workers")
+
+				device.SetWorkerAffinity(enabled)
+
+			case "max_peers":
+
+				// parse limit on the number of peers (0 = unlimited)
+
+				limit, err := strconv.ParseUint(value, 10, 32)
+				if err == nil && limit > MaxPeers {
+					err = errors.New("Peer limit out of range")
+				}
+				if err == nil && !dryRun {
+					err = device.SetMaxPeers(int(limit))
+				}
+				if err != nil {
+					logError.Println("Failed to set max_peers:", err)
+					return &IPCError{Code: ipcErrorInvalid}
+				}
+
+				if dryRun {
+					continue
+				}
+
+				logDebug.Println("UAPI: Updating peer limit")
+
+			case "replay_window_size":
+
+				// parse size of the replay filter in bits (0 = default)
+
+				bits, err := strconv.ParseUint(value, 10, 64)
+				if err == nil && bits != 0 {
+					err = ValidateReplayWindowSize(bits)
+				}
+				if err == nil && !dryRun {
+					err = device.SetReplayWindowSize(bits)
+				}
+				if err != nil {
+					logError.Println("Failed to set replay_window_size:", err)
+					return &IPCError{Code: ipcErrorInvalid}
+				}
+
+				if dryRun {
+					continue
+				}
+
+				logDebug.Println("UAPI: Updating replay window size")
+
+			case "buffer_ring_size":
+
+				// parse number of pre-allocated message buffers (0 = sync.Pool only)
+
+				size, err := strconv.ParseUint(value, 10, 32)
+				if err == nil && size > MaxBufferRingSize {
+					err = errors.New("Invalid buffer ring size")
+				}
+				if err == nil && !dryRun {
+					err = device.SetMessageBufferRing(int(size))
+				}
+				if err != nil {
+					logError.Println("Failed to set buffer_ring_size:", err)
+					return &IPCError{Code: ipcErrorInvalid}
+				}
+
+				if dryRun {
+					continue
+				}
+
+				logDebug.Println("UAPI: Updating message buffer ring")
+
+			case "log_ring_size":
+
+				// parse number of recent log lines retained (0 = disabled)
+
+				size, err := strconv.ParseUint(value, 10, 32)
+				if err != nil || size > MaxLogRingSize {
+					logError.Println("Failed to set log_ring_size, invalid value:", value)
+					return &IPCError{Code: ipcErrorInvalid}
+				}
+
+				if dryRun {
+					continue
+				}
+
+				logDebug.Println("UAPI: Updating log ring size")
+
+				device.SetLogRingSize(int(size))
+
+			case "clear_buffers":
+
+				var mode int32
+				switch value {
+				case "true":
+					mode = BufferClearingOn
+				case "false":
+					mode = BufferClearingOff
+				case "auto":
+					mode = BufferClearingAuto
+				default:
+					logError.Println("Failed to set clear_buffers, invalid value:", value)
+					return &IPCError{Code: ipcErrorInvalid}
+				}
+
+				if dryRun {
+					continue
+				}
+
+				logDebug.Println("UAPI: Updating message buffer clearing")
+
+				device.SetMessageBufferClearing(mode)
+
+			case "peer_max_age":
+
+				// parse age after which peers are removed (seconds)
+
+				secs, err := strconv.ParseUint(value, 10, 32)
+				if err != nil {
+					logError.Println("Failed to parse peer_max_age:", err)
+					return &IPCError{Code: ipcErrorInvalid}
+				}
+
+				if dryRun {
+					continue
+				}
+
+				logDebug.Println("UAPI: Updating maximum peer age")
+
+				device.SetPeerMaxAge(time.Duration(secs) * time.Second)
+
+			case "public_key":
+				// switch to peer configuration
+				logDebug.Println("UAPI: Transition to peer configuration")
+				deviceConfig = false
+
+			case "replace_peers":
+				if value != "true" {
+					logError.Println("Failed to set replace_peers, invalid value:", value)
+					return &IPCError{Code: ipcErrorInvalid}
+				}
+				if dryRun {
+					continue
+				}
+				logInfo.Println("UAPI: Removing all peers")
+				device.RemoveAllPeers()
+
+			default:
+				logError.Println("Invalid UAPI key (device configuration):", key)
+				return &IPCError{Code: ipcErrorInvalid}
+			}
+		}
+
+		/* peer configuration */
+
+		if !deviceConfig {
+
+			switch key {
+
+			case "public_key":
+				var publicKey NoisePublicKey
+				err := publicKey.FromHex(value)
+				if err != nil {
+					logError.Println("Failed to get peer by public_key:", err)
+					return &IPCError{Code: ipcErrorInvalid}
+				}
+
+				// ignore peer with public key of device
+				// (and create no peers while validating)
+
+				device.noise.mutex.RLock()
+				equals := device.noise.publicKey.Equals(publicKey)
+				device.noise.mutex.RUnlock()
+
+				override = false
+				dummy = equals || dryRun
+				if dummy {
+					peer = &Peer{}
+					continue
+				}
+
+				// find peer referenced
+
+				peer = device.LookupPeer(publicKey)
+
+				if peer == nil {
+					peer, err = device.NewPeer(publicKey)
+					if err != nil {
+						logError.Println("Failed to create new peer:", err)
+						return &IPCError{Code: ipcErrorInvalid}
+					}
+					logInfo.Println("UAPI: Created new peer:", peer)
+				}
+
+			case "remove":
+
+				// remove currently selected peer from device
+
+				if value != "true" {
+					logError.Println("Failed to set remove, invalid value:", value)
+					return &IPCError{Code: ipcErrorInvalid}
+				}
+				if !dummy {
+					logInfo.Println("UAPI: Removing peer:", peer)
+					device.RemovePeer(peer.handshake.remoteStatic)
+				}
+				peer = &Peer{}
+				dummy = true
+
+			case "preshared_key":
+
+				// stage PSK, used from the next handshake onwards
+
+				logDebug.Println("UAPI: Updating pre-shared key for peer:", peer)
+
+				var psk NoiseSymmetricKey
+				err := psk.FromHex(value)
+				if err != nil {
+					logError.Println("Failed to set preshared_key:", err)
+					return &IPCError{Code: ipcErrorInvalid}
+				}
+				peer.handshake.SetPresharedKey(psk)
+				if !dummy && !isZero(psk[:]) {
+					device.pool.psk.Set(true)
+				}
+
+			case "endpoint":
+
+				// set endpoint destination
+				// (endpoints of transactions are resolved once, see parseIPCTransaction)
+
+				if dryRun {
+					continue
+				}
+
+				logDebug.Println("UAPI: Updating endpoint for peer:", peer)
+
+				endpoint, err := device.resolveEndpoint(value)
+				if err != nil {
+					logError.Println("Failed to set endpoint:", value)
+					return &IPCError{Code: ipcErrorInvalid}
+				}
+
+				peer.configureEndpoint(value, endpoint)
+
+			case "endpoint_backup":
+
+				// set endpoint tried once handshakes time out (empty = none)
+				// (resolved once for transactions, as the endpoint)
+
+				if dryRun {
+					continue
+				}
+
+				logDebug.Println("UAPI: Updating backup endpoint for peer:", peer)
+
+				var endpoint Endpoint
+				if value != "" {
+					var err error
+					endpoint, err = device.resolveEndpoint(value)
+					if err != nil {
+						logError.Println("Failed to set endpoint_backup:", value)
+						return &IPCError{Code: ipcErrorInvalid}
+					}
+				}
+
+				peer.mutex.Lock()
+				peer.endpointBackup = endpoint
+				peer.mutex.Unlock()
+
+			case "src_address":
+
+				// set local source of datagrams sent to the peer (empty = learned)
+
+				logDebug.Println("UAPI: Updating source address for peer:", peer)
+
+				var src net.IP
+				if value != "" {
+					src = net.ParseIP(value)
+					if src == nil || src.IsUnspecified() {
+						logError.Println("Failed to set src_address, invalid address:", value)
+						return &IPCError{Code: ipcErrorInvalid}
+					}
+				}
+
+				peer.mutex.Lock()
+				peer.srcAddress = src
+				for _, endpoint := range []Endpoint{peer.endpoint, peer.endpointBackup} {
+					if source, ok := endpoint.(SourceEndpoint); ok && src == nil {
+						source.SetSrc(nil)
+					}
+				}
+				peer.mutex.Unlock()
+
+			case "fwmark":
+
+				// set mark of datagrams sent to the peer (0 = that of the device)
+
+				var fwmark uint64
+				if value != "" {
+					var err error
+					fwmark, err = strconv.ParseUint(value, 10, 32)
+					if err != nil {
+						logError.Println("Failed to set fwmark for peer:", err)
+						return &IPCError{Code: ipcErrorInvalid}
+					}
+				}
+
+				logDebug.Println("UAPI: Updating fwmark for peer:", peer)
+
+				peer.mutex.Lock()
+				peer.fwmark = uint32(fwmark)
+				peer.mutex.Unlock()
+
+			case "endpoint_pinned":
+
+				// forbid roaming of the peer
+
+				var pinned bool
+				switch value {
+				case "1":
+					pinned = true
+				case "0":
+				default:
+					logError.Println("Failed to set endpoint_pinned, invalid value:", value)
+					return &IPCError{Code: ipcErrorInvalid}
+				}
+
+				logDebug.Println("UAPI: Updating endpoint pinning for peer:", peer)
+
+				peer.mutex.Lock()
+				peer.endpointPinned = pinned
+				peer.mutex.Unlock()
+
 			case "persistent_keepalive_interval":
 
-				// update persistent keepalive interval
+				// update persistent keepalive interval
+
+				logDebug.Println("UAPI: Updating persistent_keepalive_interval for peer:", peer)
+
+				secs, err := strconv.ParseUint(value, 10, 64)
+				if err == nil && secs > MaxPersistentKeepaliveInterval {
+					err = errors.New("Interval must be between 1 and 65535 seconds, or 0 to disable")
+				}
+				if err != nil {
+					logError.Println("Failed to set persistent_keepalive_interval:", err)
+					return &IPCError{Code: ipcErrorInvalid}
+				}
+
+				if dummy {
+					continue
+				}
+
+				old := peer.persistentKeepaliveInterval
+				peer.persistentKeepaliveInterval = uint16(secs)
+
+				// send immediate keepalive if we're turning it on and before it wasn't on
+
+				if old == 0 && secs != 0 {
+					if device.isUp.Get() {
+						peer.SendKeepalive()
+					}
+				}
+
+				// stop pending keepalives if we're turning it off
+
+				if secs == 0 && peer.timersActive() {
+					peer.timers.persistentKeepalive.Del()
+				}
+
+			case "tx_rate_limit":
+
+				// update outbound bandwidth limit (bytes per second)
+
+				logDebug.Println("UAPI: Updating tx_rate_limit for peer:", peer)
+
+				rate, err := strconv.ParseUint(value, 10, 64)
+				if err != nil {
+					logError.Println("Failed to set tx_rate_limit:", err)
+					return &IPCError{Code: ipcErrorInvalid}
+				}
+
+				if dummy {
+					continue
+				}
+
+				peer.txRate.SetRate(rate)
 
-				logDebug.Println("UAPI: Updating persistent_keepalive_interval for peer:", peer)
+			case "trigger_handshake":
 
-				secs, err := strconv.ParseUint(value, 10, 16)
-				if err != nil {
-					logError.Println("Failed to set persistent_keepalive_interval:", err)
+				// initiate handshake immediately (bypassing RekeyTimeout)
+
+				if value != "1" {
+					logError.Println("Failed to set trigger_handshake, invalid value:", value)
 					return &IPCError{Code: ipcErrorInvalid}
 				}
 
-				old := peer.persistentKeepaliveInterval
-				peer.persistentKeepaliveInterval = uint16(secs)
+				if dummy {
+					continue
+				}
 
-				// send immediate keepalive if we're turning it on and before it wasn't on
+				peer.mutex.RLock()
+				endpoint := peer.endpoint
+				peer.mutex.RUnlock()
 
-				if old == 0 && secs != 0 {
-					if err != nil {
-						logError.Println("Failed to get tun device status:", err)
-						return &IPCError{Code: ipcErrorIO}
-					}
-					if device.isUp.Get() && !dummy {
-						peer.SendKeepalive()
-					}
+				if endpoint == nil {
+					logError.Println("Failed to trigger handshake, no known endpoint for peer:", peer)
+					return &IPCError{Code: ipcErrorInvalid}
+				}
+
+				logDebug.Println("UAPI: Triggering handshake with peer:", peer)
+
+				if err := peer.SendHandshakeInitiation(true, true); err != nil {
+					logError.Println("Failed to trigger handshake:", err)
+					return &IPCError{Code: ipcErrorIO}
 				}
 
+			case "override_allowed_ips":
+
+				if value != "true" {
+					logError.Println("Failed to set override_allowed_ips, invalid value:", value)
+					return &IPCError{Code: ipcErrorInvalid}
+				}
+				override = true
+
 			case "replace_allowed_ips":
 
 				logDebug.Println("UAPI: Removing all allowed IPs for peer:", peer)
@@ -354,9 +1493,16 @@ func ipcSetOperation(device *Device, socket *bufio.ReadWriter) *IPCError {
 
 			case "allowed_ip":
 
-				logDebug.Println("UAPI: Adding allowed_ip to peer:", peer)
+				// a "-" prefix removes the allowed_ip from the peer
+
+				remove := strings.HasPrefix(value, "-")
+				if remove {
+					logDebug.Println("UAPI: Removing allowed_ip from peer:", peer)
+				} else {
+					logDebug.Println("UAPI: Adding allowed_ip to peer:", peer)
+				}
 
-				_, network, err := net.ParseCIDR(value)
+				_, network, err := net.ParseCIDR(strings.TrimPrefix(value, "-"))
 				if err != nil {
 					logError.Println("Failed to set allowed_ip:", err)
 					return &IPCError{Code: ipcErrorInvalid}
@@ -368,7 +1514,23 @@ func ipcSetOperation(device *Device, socket *bufio.ReadWriter) *IPCError {
 
 				ones, _ := network.Mask.Size()
 				device.routing.mutex.Lock()
-				device.routing.table.Insert(network.IP, uint(ones), peer)
+
+				// in strict mode, refuse to move the prefix from another peer
+
+				if !remove && device.routing.strict && !override {
+					owner := device.routing.table.Owner(network.IP, uint(ones))
+					if owner != nil && owner != peer {
+						device.routing.mutex.Unlock()
+						logError.Println("Failed to set allowed_ip:", network, "already assigned to", owner)
+						return &IPCError{Code: ipcErrorExists}
+					}
+				}
+
+				if remove {
+					device.routing.table.Remove(network.IP, uint(ones), peer)
+				} else {
+					device.routing.table.Insert(network.IP, uint(ones), peer)
+				}
 				device.routing.mutex.Unlock()
 
 			default:
@@ -381,6 +1543,646 @@ func ipcSetOperation(device *Device, socket *bufio.ReadWriter) *IPCError {
 	return nil
 }
 
+/* Keys of the device configuration applied to the bind,
+ * these are applied first by transactions as they may fail (e.g. a port in use)
+ */
+var ipcBindKeys = map[string]bool{
+	"listen_port":            true,
+	"listen_address":         true,
+	"listen_freebind":        true,
+	"fwmark":                 true,
+	"dont_fragment":          true,
+	"point_to_point":         true,
+	"dual_stack":             true,
+	"disable_sticky_sockets": true,
+	"flow_label":             true,
+	"receivers":              true,
+	"send_timeout_ms":        true,
+	"traffic_class":          true,
+}
+
+/* A set operation read as a whole,
+ * such that it is validated against the device before any line is applied
+ */
+type ipcTransaction struct {
+	bind    []string // device lines applied to the bind
+	device  []string // remaining device lines
+	replace bool     // replace_peers
+	peers   []*ipcPeerTransaction
+	removed []*Peer // peers removed before the others are configured (set by validate)
+}
+
+type ipcPeerTransaction struct {
+	publicKey NoisePublicKey
+	remove    bool
+	lines     []string         // peer lines other than those below
+	routes    []ipcRouteChange // allowed IP lines, in order
+	endpoint  *ipcEndpoint     // endpoint (nil = unchanged)
+	backup    *ipcEndpoint     // endpoint_backup (nil = unchanged)
+	trigger   bool             // trigger_handshake
+	apply     bool             // not superseded by a later removal (set by validate)
+}
+
+/* An endpoint resolved when the transaction is parsed,
+ * such that applying the transaction does not depend on name resolution
+ */
+type ipcEndpoint struct {
+	value    string // as configured
+	endpoint Endpoint
+}
+
+type ipcRouteChange struct {
+	network  *net.IPNet // nil for replace_allowed_ips
+	remove   bool
+	override bool // the allowed IP may be moved from another peer
+}
+
+/* Parses the lines of a transaction,
+ * the values are checked by a dry run of the set operation
+ * and the endpoints are resolved
+ */
+func parseIPCTransaction(device *Device, lines []string) (*ipcTransaction, *IPCError) {
+	logError := device.log.Error
+
+	scanner := bufio.NewScanner(strings.NewReader(strings.Join(lines, "\n")))
+	if err := ipcSetConfig(device, scanner, ipcSetValidate); err != nil {
+		return nil, err
+	}
+
+	txn := &ipcTransaction{}
+	var peer *ipcPeerTransaction
+	override := false
+
+	for _, line := range lines {
+		parts := strings.Split(line, "=")
+		key, value := parts[0], parts[1]
+
+		// device configuration
+
+		if peer == nil && key != "public_key" {
+			switch {
+			case key == "replace_peers":
+				txn.replace = true
+			case ipcBindKeys[key]:
+				txn.bind = append(txn.bind, line)
+			default:
+				txn.device = append(txn.device, line)
+			}
+			continue
+		}
+
+		// peer configuration (ignored once the peer is removed)
+
+		if key == "public_key" {
+			peer = &ipcPeerTransaction{}
+			peer.publicKey.FromHex(value)
+			txn.peers = append(txn.peers, peer)
+			override = false
+			continue
+		}
+		if peer.remove {
+			continue
+		}
+
+		switch key {
+		case "remove":
+			peer.remove = true
+		case "override_allowed_ips":
+			override = true
+		case "replace_allowed_ips":
+			peer.routes = append(peer.routes, ipcRouteChange{})
+		case "allowed_ip":
+			_, network, _ := net.ParseCIDR(strings.TrimPrefix(value, "-"))
+			peer.routes = append(peer.routes, ipcRouteChange{
+				network:  network,
+				remove:   strings.HasPrefix(value, "-"),
+				override: override,
+			})
+		case "trigger_handshake":
+			peer.trigger = true
+		case "endpoint":
+			endpoint, err := device.resolveEndpoint(value)
+			if err != nil {
+				logError.Println("Failed to set endpoint:", value)
+				return nil, &IPCError{Code: ipcErrorInvalid}
+			}
+			peer.endpoint = &ipcEndpoint{value: value, endpoint: endpoint}
+		case "endpoint_backup":
+			peer.backup = &ipcEndpoint{value: value}
+			if value != "" {
+				endpoint, err := device.resolveEndpoint(value)
+				if err != nil {
+					logError.Println("Failed to set endpoint_backup:", value)
+					return nil, &IPCError{Code: ipcErrorInvalid}
+				}
+				peer.backup.endpoint = endpoint
+			}
+		default:
+			peer.lines = append(peer.lines, line)
+		}
+	}
+
+	return txn, nil
+}
+
+/* Validates the transaction against the configuration of the device:
+ * the number of peers, allowed IPs in strict mode and triggered handshakes,
+ * must hold the ipc lock (until the transaction is applied)
+ */
+func (txn *ipcTransaction) validate(device *Device) *IPCError {
+	logError := device.log.Error
+
+	device.noise.mutex.RLock()
+	publicKey := device.noise.publicKey
+	device.noise.mutex.RUnlock()
+
+	device.peers.mutex.RLock()
+	limit := device.peers.limit
+	existing := make(map[NoisePublicKey]*Peer, len(device.peers.keyMap))
+	for key, peer := range device.peers.keyMap {
+		existing[key] = peer
+	}
+	device.peers.mutex.RUnlock()
+
+	strict := device.StrictAllowedIPs()
+
+	// device settings of the transaction apply to its peers
+
+	for _, line := range txn.device {
+		parts := strings.Split(line, "=")
+		switch parts[0] {
+		case "private_key":
+			var sk NoisePrivateKey
+			sk.FromHex(parts[1])
+			publicKey = sk.publicKey()
+		case "strict_allowed_ips":
+			strict = parts[1] == "true"
+		case "max_peers":
+			limit, _ = strconv.Atoi(parts[1])
+		}
+	}
+
+	// sections are superseded by a later removal of the peer
+	// (a peer with the public key of the device is removed by the key change)
+
+	last := make(map[NoisePublicKey]int)
+	for key := range existing {
+		if txn.replace || key.Equals(publicKey) {
+			last[key] = -1
+		}
+	}
+	for i, peer := range txn.peers {
+		if peer.remove && !peer.publicKey.Equals(publicKey) {
+			last[peer.publicKey] = i
+		}
+	}
+
+	txn.removed = nil
+	for key, peer := range existing {
+		if _, ok := last[key]; ok {
+			txn.removed = append(txn.removed, peer)
+		}
+	}
+
+	peers := len(existing) - len(txn.removed)
+	created := make(map[NoisePublicKey]bool)
+	for i, peer := range txn.peers {
+		index, removed := last[peer.publicKey]
+		peer.apply = !peer.remove && !peer.publicKey.Equals(publicKey) && (!removed || i > index)
+		if _, ok := existing[peer.publicKey]; peer.apply && (!ok || removed) && !created[peer.publicKey] {
+			created[peer.publicKey] = true
+			peers++
+		}
+	}
+
+	if peers > MaxPeers || (limit != 0 && peers > limit) {
+		logError.Println("Failed to create new peers, limit reached:", peers)
+		return &IPCError{Code: ipcErrorInvalid}
+	}
+
+	// handshakes are triggered only for peers with an endpoint
+
+	endpoints := make(map[NoisePublicKey]bool)
+	for key, peer := range existing {
+		if _, removed := last[key]; !removed {
+			peer.mutex.RLock()
+			endpoints[key] = peer.endpoint != nil
+			peer.mutex.RUnlock()
+		}
+	}
+
+	for _, peer := range txn.peers {
+		if !peer.apply {
+			continue
+		}
+		if peer.endpoint != nil {
+			endpoints[peer.publicKey] = true
+		}
+		if peer.trigger && !endpoints[peer.publicKey] {
+			logError.Println("Failed to trigger handshake, no known endpoint for peer:", peer.publicKey.ToHex())
+			return &IPCError{Code: ipcErrorInvalid}
+		}
+	}
+
+	// in strict mode, prefixes are not moved from other peers (unless overridden)
+
+	device.routing.mutex.RLock()
+	defer device.routing.mutex.RUnlock()
+
+	var none NoisePublicKey
+	owners := make(map[string]NoisePublicKey) // prefixes assigned by the transaction
+	cleared := make(map[NoisePublicKey]bool)  // peers losing their prior allowed IPs
+	for _, peer := range txn.removed {
+		cleared[peer.handshake.remoteStatic] = true
+	}
+
+	owner := func(network *net.IPNet) NoisePublicKey {
+		if key, ok := owners[network.String()]; ok {
+			return key
+		}
+		ones, _ := network.Mask.Size()
+		peer := device.routing.table.Owner(network.IP, uint(ones))
+		if peer == nil || cleared[peer.handshake.remoteStatic] {
+			return none
+		}
+		return peer.handshake.remoteStatic
+	}
+
+	for _, peer := range txn.peers {
+		if !peer.apply {
+			continue
+		}
+		for _, route := range peer.routes {
+			switch {
+			case route.network == nil:
+				cleared[peer.publicKey] = true
+				for prefix, key := range owners {
+					if key == peer.publicKey {
+						owners[prefix] = none
+					}
+				}
+			case route.remove:
+				if owner(route.network) == peer.publicKey {
+					owners[route.network.String()] = none
+				}
+			default:
+				if key := owner(route.network); strict && !route.override && key != none && key != peer.publicKey {
+					logError.Println("Failed to set allowed_ip:", route.network, "already assigned to", key.ToHex())
+					return &IPCError{Code: ipcErrorExists}
+				}
+				owners[route.network.String()] = peer.publicKey
+			}
+		}
+	}
+
+	return nil
+}
+
+/* Applies a validated transaction:
+ * the bind is configured first, the remaining lines have been validated,
+ * with the allowed IPs of all peers updated at once
+ *
+ * Should applying fail nonetheless, the prior configuration is restored
+ */
+func (txn *ipcTransaction) apply(device *Device) *IPCError {
+	logError := device.log.Error
+	logInfo := device.log.Info
+	logDebug := device.log.Debug
+
+	set := func(lines []string) *IPCError {
+		scanner := bufio.NewScanner(strings.NewReader(strings.Join(lines, "\n")))
+		return ipcSetConfig(device, scanner, ipcSetCommit)
+	}
+
+	snapshot := takeIPCSnapshot(device)
+	fail := func(err *IPCError) *IPCError {
+		logError.Println("UAPI: Failed to apply transaction, rolling back:", err)
+		txn.rollback(device, snapshot)
+		return err
+	}
+
+	if err := set(txn.bind); err != nil {
+		return fail(err)
+	}
+	if err := set(txn.device); err != nil {
+		return fail(err)
+	}
+
+	for _, peer := range txn.removed {
+		logInfo.Println("UAPI: Removing peer:", peer)
+		device.RemovePeer(peer.handshake.remoteStatic)
+	}
+
+	// peers are configured before they are routed to
+
+	var changes []RoutingChange
+	var triggers []*Peer
+
+	for _, section := range txn.peers {
+		if !section.apply {
+			continue
+		}
+		if err := set(append([]string{"public_key=" + section.publicKey.ToHex()}, section.lines...)); err != nil {
+			return fail(err)
+		}
+		peer := device.LookupPeer(section.publicKey)
+		if peer == nil {
+			return fail(&IPCError{Code: ipcErrorInvalid})
+		}
+		if section.endpoint != nil {
+			logDebug.Println("UAPI: Updating endpoint for peer:", peer)
+			peer.configureEndpoint(section.endpoint.value, section.endpoint.endpoint)
+		}
+		if section.backup != nil {
+			logDebug.Println("UAPI: Updating backup endpoint for peer:", peer)
+			peer.mutex.Lock()
+			peer.endpointBackup = section.backup.endpoint
+			peer.mutex.Unlock()
+		}
+		for _, route := range section.routes {
+			changes = append(changes, RoutingChange{Peer: peer, Network: route.network, Remove: route.remove})
+		}
+		if section.trigger {
+			triggers = append(triggers, peer)
+		}
+	}
+
+	device.routing.mutex.Lock()
+	device.routing.table.Update(changes)
+	device.routing.mutex.Unlock()
+
+	// the transaction is committed, failed handshakes are retried by the timers
+
+	for _, peer := range triggers {
+		logDebug.Println("UAPI: Triggering handshake with peer:", peer)
+		if err := peer.SendHandshakeInitiation(true, true); err != nil {
+			logError.Println("Failed to trigger handshake:", err)
+		}
+	}
+
+	return nil
+}
+
+/* Configuration of the device prior to a transaction
+ */
+type ipcSnapshot struct {
+	state     *IPCDeviceState
+	bind      bindSettings
+	endpoints map[NoisePublicKey]ipcPeerEndpoints
+}
+
+type ipcPeerEndpoints struct {
+	host     string // endpoint as configured by hostname (if any)
+	endpoint Endpoint
+	backup   Endpoint
+}
+
+func takeIPCSnapshot(device *Device) *ipcSnapshot {
+	snapshot := &ipcSnapshot{
+		state:     ipcGetState(device),
+		bind:      device.bindSettings(),
+		endpoints: make(map[NoisePublicKey]ipcPeerEndpoints),
+	}
+
+	device.peers.mutex.RLock()
+	defer device.peers.mutex.RUnlock()
+
+	for key, peer := range device.peers.keyMap {
+		peer.mutex.RLock()
+		snapshot.endpoints[key] = ipcPeerEndpoints{
+			host:     peer.dns.host,
+			endpoint: peer.endpoint,
+			backup:   peer.endpointBackup,
+		}
+		peer.mutex.RUnlock()
+	}
+
+	return snapshot
+}
+
+/* Restores the configuration prior to a transaction which failed to apply:
+ * the bind, the device keys set by the transaction and the peers it configured or removed
+ * (removed peers are created anew, their sessions are lost), peers it created are removed
+ */
+func (txn *ipcTransaction) rollback(device *Device, snapshot *ipcSnapshot) {
+	logError := device.log.Error
+	logInfo := device.log.Info
+
+	if len(txn.bind) > 0 {
+		if err := device.bindRestore(snapshot.bind); err != nil {
+			logError.Println("UAPI: Failed to restore bind:", err)
+		}
+	}
+
+	var restore []string
+	send := func(line string) {
+		restore = append(restore, line)
+	}
+
+	for _, line := range txn.device {
+		key := strings.Split(line, "=")[0]
+		if value, ok := snapshot.state.deviceValue(key); ok {
+			send(key + "=" + value)
+		}
+	}
+
+	prior := make(map[NoisePublicKey]*IPCPeerState)
+	for i := range snapshot.state.Peers {
+		var publicKey NoisePublicKey
+		publicKey.FromHex(snapshot.state.Peers[i].PublicKey)
+		prior[publicKey] = &snapshot.state.Peers[i]
+	}
+
+	touched := make(map[NoisePublicKey]bool)
+	for _, peer := range txn.removed {
+		touched[peer.handshake.remoteStatic] = true
+	}
+	for _, section := range txn.peers {
+		if section.apply {
+			touched[section.publicKey] = true
+		}
+	}
+
+	var restored []NoisePublicKey
+	for key := range touched {
+		peer, ok := prior[key]
+		if !ok {
+			send("public_key=" + key.ToHex())
+			send("remove=true")
+			continue
+		}
+		restored = append(restored, key)
+		send("public_key=" + peer.PublicKey)
+		send("preshared_key=" + peer.PresharedKey)
+		send("src_address=" + peer.SrcAddress)
+		send(fmt.Sprintf("fwmark=%d", peer.Fwmark))
+		if peer.EndpointPinned {
+			send("endpoint_pinned=1")
+		} else {
+			send("endpoint_pinned=0")
+		}
+		send(fmt.Sprintf("persistent_keepalive_interval=%d", peer.PersistentKeepaliveInterval))
+		send(fmt.Sprintf("tx_rate_limit=%d", peer.TxRateLimit))
+		send("override_allowed_ips=true")
+		send("replace_allowed_ips=true")
+		for _, ip := range peer.AllowedIPs {
+			send("allowed_ip=" + ip)
+		}
+	}
+
+	scanner := bufio.NewScanner(strings.NewReader(strings.Join(restore, "\n")))
+	if err := ipcSetConfig(device, scanner, ipcSetCommit); err != nil {
+		logError.Println("UAPI: Failed to roll back transaction:", err)
+	}
+
+	// endpoints are restored as resolved, not resolved again
+
+	for _, key := range restored {
+		peer := device.LookupPeer(key)
+		if peer == nil {
+			continue
+		}
+		endpoints := snapshot.endpoints[key]
+		peer.mutex.Lock()
+		peer.unsafeSetEndpoint(endpoints.host, endpoints.endpoint)
+		peer.endpointBackup = endpoints.backup
+		peer.mutex.Unlock()
+	}
+
+	logInfo.Println("UAPI: Rolled back transaction")
+}
+
+/* Returns the value of a device key in the state,
+ * as accepted by a set operation (the keys of the bind are restored by bindRestore)
+ */
+func (state *IPCDeviceState) deviceValue(key string) (string, bool) {
+	switch key {
+	case "private_key":
+		if state.PrivateKey == "" {
+			var sk NoisePrivateKey
+			return sk.ToHex(), true
+		}
+		return state.PrivateKey, true
+	case "strict_allowed_ips":
+		return strconv.FormatBool(state.StrictAllowedIPs), true
+	case "tun_gso":
+		return strconv.FormatBool(state.TUNGSO), true
+	case "handshake_backoff_max":
+		return strconv.FormatInt(state.HandshakeBackoffMax, 10), true
+	case "handshake_timeout":
+		return strconv.FormatInt(state.HandshakeTimeout, 10), true
+	case "max_handshake_attempts":
+		return strconv.Itoa(state.MaxHandshakes), true
+	case "keepalive_jitter":
+		return strconv.Itoa(state.KeepaliveJitter), true
+	case "record_rx_interface":
+		return strconv.FormatBool(state.RecordRxInterface), true
+	case "worker_affinity":
+		return strconv.FormatBool(state.WorkerAffinity), true
+	case "max_peers":
+		return strconv.Itoa(state.MaxPeers), true
+	case "peer_max_age":
+		return strconv.FormatInt(state.PeerMaxAge, 10), true
+	case "replay_window_size":
+		return strconv.FormatUint(state.ReplayWindowSize, 10), true
+	case "buffer_ring_size":
+		return strconv.Itoa(state.BufferRingSize), true
+	case "log_ring_size":
+		return strconv.Itoa(state.LogRingSize), true
+	case "clear_buffers":
+		if state.ClearBuffers == "" {
+			return "auto", true
+		}
+		return state.ClearBuffers, true
+	}
+	return "", false
+}
+
+/* Applies the lines of a set operation as a transaction:
+ * all lines are validated against the device before any is applied,
+ * must hold the ipc lock
+ */
+func ipcSetTransaction(device *Device, lines []string) *IPCError {
+	txn, err := parseIPCTransaction(device, lines)
+	if err == nil {
+		err = txn.validate(device)
+	}
+	if err != nil {
+		device.log.Error.Println("UAPI: Rejecting transaction:", err)
+		return err
+	}
+	return txn.apply(device)
+}
+
+/* Dumps the recent log lines of the device,
+ * each prefixed by log= (such that no line is taken for the errno terminator)
+ */
+func ipcLogOperation(device *Device, socket *bufio.ReadWriter) *IPCError {
+
+	// no options (terminated by an empty line)
+
+	for {
+		line, err := socket.ReadString('\n')
+		if err != nil {
+			return &IPCError{Code: ipcErrorIO}
+		}
+		if line == "\n" {
+			break
+		}
+		device.log.Error.Println("Invalid UAPI key (log operation):", strings.TrimSuffix(line, "\n"))
+		return &IPCError{Code: ipcErrorInvalid}
+	}
+
+	for _, line := range device.RecentLogs() {
+		if _, err := socket.WriteString("log=" + line + "\n"); err != nil {
+			return &IPCError{Code: ipcErrorIO}
+		}
+	}
+
+	return nil
+}
+
+/* Streams events until the connection or the device is closed,
+ * every event is a block of lines terminated by an empty line
+ * (preceded by errno=0 once subscribed)
+ */
+func ipcSubscribeOperation(device *Device, socket *bufio.ReadWriter) {
+	events, cancel := device.Subscribe()
+	defer cancel()
+
+	fmt.Fprintf(socket, "errno=0\n\n")
+	if err := socket.Flush(); err != nil {
+		return
+	}
+
+	// the client ends the subscription by closing the connection
+
+	closed := make(chan struct{})
+	go func() {
+		io.Copy(ioutil.Discard, socket)
+		close(closed)
+	}()
+
+	for {
+		select {
+		case <-device.signals.stop:
+			return
+
+		case <-closed:
+			return
+
+		case event := <-events:
+			for _, line := range event.lines() {
+				fmt.Fprintln(socket, line)
+			}
+			fmt.Fprintln(socket)
+			if err := socket.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
 func ipcHandle(device *Device, socket net.Conn) {
 
 	// create buffered read/writer
@@ -413,6 +2215,15 @@ func ipcHandle(device *Device, socket net.Conn) {
 		device.log.Debug.Println("Config, get operation")
 		status = ipcGetOperation(device, buffered)
 
+	case "log=1\n":
+		device.log.Debug.Println("Config, log operation")
+		status = ipcLogOperation(device, buffered)
+
+	case "subscribe=1\n":
+		device.log.Debug.Println("Config, subscribe operation")
+		ipcSubscribeOperation(device, buffered)
+		return
+
 	default:
 		device.log.Error.Println("Invalid UAPI operation:", op)
 		return
@@ -422,6 +2233,7 @@ func ipcHandle(device *Device, socket net.Conn) {
 
 	if status != nil {
 		device.log.Error.Println(status)
+		device.publishEvent(Event{Kind: EventError, Message: status.Error()})
 		fmt.Fprintf(buffered, "errno=%d\n\n", status.ErrorCode())
 	} else {
 		fmt.Fprintf(buffered, "errno=0\n\n")
@@ -6,6 +6,7 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"golang.org/x/sys/unix"
@@ -19,7 +20,7 @@ const (
 	ipcErrorProtocol  = -int64(unix.EPROTO)
 	ipcErrorInvalid   = -int64(unix.EINVAL)
 	ipcErrorPortInUse = -int64(unix.EADDRINUSE)
-	socketDirectory   = "/var/run/wireguard"
+	ipcErrorExists    = -int64(unix.EEXIST)
 	socketName        = "%s.sock"
 )
 
@@ -43,6 +44,22 @@ func (l *UAPIListener) Accept() (net.Conn, error) {
 	}
 }
 
+/* Accepts the next connection,
+ * returning ctx.Err() if the context is cancelled first
+ */
+func (l *UAPIListener) AcceptContext(ctx context.Context) (net.Conn, error) {
+	select {
+	case conn := <-l.connNew:
+		return conn, nil
+
+	case err := <-l.connErr:
+		return nil, err
+
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
 func (l *UAPIListener) Close() error {
 	err1 := unix.Close(l.kqueueFd)
 	err2 := unix.Close(l.keventFd)
@@ -131,11 +148,15 @@ func UAPIListen(name string, file *os.File) (net.Listener, error) {
 	return uapi, nil
 }
 
-func UAPIOpen(name string) (*os.File, error) {
+func UAPIOpen(name string, abstract bool) (*os.File, error) {
+
+	if abstract {
+		return nil, errors.New("Abstract unix sockets not supported on this platform")
+	}
 
 	// check if path exist
 
-	err := os.MkdirAll(socketDirectory, 0600)
+	err := os.MkdirAll(socketDirectory, socketDirectoryMode)
 	if err != nil && !os.IsExist(err) {
 		return nil, err
 	}
@@ -147,36 +168,7 @@ func UAPIOpen(name string) (*os.File, error) {
 		fmt.Sprintf(socketName, name),
 	)
 
-	addr, err := net.ResolveUnixAddr("unix", socketPath)
-	if err != nil {
-		return nil, err
-	}
-
-	listener, err := func() (*net.UnixListener, error) {
-
-		// initial connection attempt
-
-		listener, err := net.ListenUnix("unix", addr)
-		if err == nil {
-			return listener, nil
-		}
-
-		// check if socket already active
-
-		_, err = net.Dial("unix", socketPath)
-		if err == nil {
-			return nil, errors.New("unix socket in use")
-		}
-
-		// cleanup & attempt again
-
-		err = os.Remove(socketPath)
-		if err != nil {
-			return nil, err
-		}
-		return net.ListenUnix("unix", addr)
-	}()
-
+	listener, err := uapiListenUnix(socketPath)
 	if err != nil {
 		return nil, err
 	}
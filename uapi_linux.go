@@ -6,12 +6,13 @@
 package main
 
 import (
-	"errors"
+	"context"
 	"fmt"
 	"golang.org/x/sys/unix"
 	"net"
 	"os"
 	"path"
+	"strings"
 )
 
 const (
@@ -19,15 +20,16 @@ const (
 	ipcErrorProtocol  = -int64(unix.EPROTO)
 	ipcErrorInvalid   = -int64(unix.EINVAL)
 	ipcErrorPortInUse = -int64(unix.EADDRINUSE)
-	socketDirectory   = "/var/run/wireguard"
+	ipcErrorExists    = -int64(unix.EEXIST)
 	socketName        = "%s.sock"
+	abstractPrefix    = "@wireguard/" // "@" denotes the abstract namespace
 )
 
 type UAPIListener struct {
-	listener  net.Listener // unix socket listener
-	connNew   chan net.Conn
-	connErr   chan error
-	inotifyFd int
+	listener net.Listener // unix socket listener
+	connNew  chan net.Conn
+	connErr  chan error
+	inotify  *os.File // nil for abstract sockets (no file to watch)
 }
 
 func (l *UAPIListener) Accept() (net.Conn, error) {
@@ -42,8 +44,27 @@ func (l *UAPIListener) Accept() (net.Conn, error) {
 	}
 }
 
+/* Accepts the next connection,
+ * returning ctx.Err() if the context is cancelled first
+ */
+func (l *UAPIListener) AcceptContext(ctx context.Context) (net.Conn, error) {
+	select {
+	case conn := <-l.connNew:
+		return conn, nil
+
+	case err := <-l.connErr:
+		return nil, err
+
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
 func (l *UAPIListener) Close() error {
-	err1 := unix.Close(l.inotifyFd)
+	var err1 error
+	if l.inotify != nil {
+		err1 = l.inotify.Close()
+	}
 	err2 := l.listener.Close()
 	if err1 != nil {
 		return err1
@@ -70,6 +91,64 @@ func UAPIListen(name string, file *os.File) (net.Listener, error) {
 		connErr:  make(chan error, 1),
 	}
 
+	abstract := strings.HasPrefix(listener.Addr().String(), "@")
+	if !abstract {
+		if err := uapi.watchSocket(name); err != nil {
+			listener.Close()
+			return nil, err
+		}
+	}
+
+	// watch for new connections
+
+	go func(l *UAPIListener) {
+		for {
+			conn, err := l.listener.Accept()
+			if err != nil {
+				l.connErr <- err
+				break
+			}
+			if abstract && !uapiPeerAllowed(conn) {
+				conn.Close()
+				continue
+			}
+			l.connNew <- conn
+		}
+	}(uapi)
+
+	return uapi, nil
+}
+
+/* Abstract sockets lack file permissions,
+ * hence the credentials of connecting processes are checked instead
+ */
+func uapiPeerAllowed(conn net.Conn) bool {
+	unixConn, ok := conn.(*net.UnixConn)
+	if !ok {
+		return false
+	}
+	raw, err := unixConn.SyscallConn()
+	if err != nil {
+		return false
+	}
+
+	var cred *unix.Ucred
+	raw.Control(func(fd uintptr) {
+		cred, err = unix.GetsockoptUcred(int(fd), unix.SOL_SOCKET, unix.SO_PEERCRED)
+	})
+	if err != nil {
+		return false
+	}
+
+	uid := int(cred.Uid)
+	return uid == 0 || uid == os.Geteuid() || uid == UAPISocketUID
+}
+
+/* Fails pending and future Accept calls once the socket file is deleted
+ */
+func (uapi *UAPIListener) watchSocket(name string) error {
+	var err error
+
 	// watch for deletion of socket
 
 	socketPath := path.Join(
@@ -77,21 +156,14 @@ func UAPIListen(name string, file *os.File) (net.Listener, error) {
 		fmt.Sprintf(socketName, name),
 	)
 
-	uapi.inotifyFd, err = unix.InotifyInit()
-	if err != nil {
-		return nil, err
-	}
-
-	_, err = unix.InotifyAddWatch(
-		uapi.inotifyFd,
+	uapi.inotify, err = inotifyWatch(
 		socketPath,
 		unix.IN_ATTRIB|
 			unix.IN_DELETE|
 			unix.IN_DELETE_SELF,
 	)
-
 	if err != nil {
-		return nil, err
+		return err
 	}
 
 	go func(l *UAPIListener) {
@@ -102,31 +174,37 @@ func UAPIListen(name string, file *os.File) (net.Listener, error) {
 				l.connErr <- err
 				return
 			}
-			unix.Read(uapi.inotifyFd, buff[:])
-		}
-	}(uapi)
-
-	// watch for new connections
-
-	go func(l *UAPIListener) {
-		for {
-			conn, err := l.listener.Accept()
-			if err != nil {
-				l.connErr <- err
-				break
+			if _, err := l.inotify.Read(buff[:]); err != nil {
+				return
 			}
-			l.connNew <- conn
 		}
 	}(uapi)
 
-	return uapi, nil
+	return nil
 }
 
-func UAPIOpen(name string) (*os.File, error) {
+/* Opens the UAPI socket of the interface,
+ * either in the socket directory or in the abstract namespace
+ * (which leaves nothing behind to clean up after a crash)
+ */
+func UAPIOpen(name string, abstract bool) (*os.File, error) {
+
+	if abstract {
+		addr := &net.UnixAddr{
+			Name: abstractPrefix + fmt.Sprintf(socketName, name),
+			Net:  "unix",
+		}
+		listener, err := net.ListenUnix("unix", addr)
+		if err != nil {
+			return nil, err
+		}
+		defer listener.Close()
+		return listener.File()
+	}
 
 	// check if path exist
 
-	err := os.MkdirAll(socketDirectory, 0600)
+	err := os.MkdirAll(socketDirectory, socketDirectoryMode)
 	if err != nil && !os.IsExist(err) {
 		return nil, err
 	}
@@ -138,36 +216,7 @@ func UAPIOpen(name string) (*os.File, error) {
 		fmt.Sprintf(socketName, name),
 	)
 
-	addr, err := net.ResolveUnixAddr("unix", socketPath)
-	if err != nil {
-		return nil, err
-	}
-
-	listener, err := func() (*net.UnixListener, error) {
-
-		// initial connection attempt
-
-		listener, err := net.ListenUnix("unix", addr)
-		if err == nil {
-			return listener, nil
-		}
-
-		// check if socket already active
-
-		_, err = net.Dial("unix", socketPath)
-		if err == nil {
-			return nil, errors.New("unix socket in use")
-		}
-
-		// cleanup & attempt again
-
-		err = os.Remove(socketPath)
-		if err != nil {
-			return nil, err
-		}
-		return net.ListenUnix("unix", addr)
-	}()
-
+	listener, err := uapiListenUnix(socketPath)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,130 @@
+/* SPDX-License-Identifier: GPL-2.0
+ *
+ * Copyright (C) 2017-2018 Jason A. Donenfeld <Jason@zx2c4.com>. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUAPIAbstractSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wireguard")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	defer SetSocketDirectory(socketDirectory)
+	SetSocketDirectory(dir)
+
+	device := randDevice(t)
+	defer device.Close()
+
+	name := fmt.Sprintf("wgtest%d", os.Getpid())
+	file, err := UAPIOpen(name, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	listener, err := UAPIListen(name, file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	if listener.(*UAPIListener).inotify != nil {
+		t.Fatal("watching abstract socket")
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go ipcHandle(device, conn)
+		}
+	}()
+
+	// no file is created
+
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+		t.Fatal("abstract socket created", files[0].Name())
+	}
+
+	// get over the abstract socket
+
+	conn, err := net.Dial("unix", abstractPrefix+fmt.Sprintf(socketName, name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte("get=1\n\n")); err != nil {
+		t.Fatal(err)
+	}
+	response, err := ioutil.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(string(response), "errno=0\n\n") {
+		t.Fatal("unexpected response:", string(response))
+	}
+	if !strings.Contains(string(response), "private_key=") {
+		t.Fatal("device state missing from response:", string(response))
+	}
+}
+
+func TestUAPISocketDeleted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wireguard")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	defer SetSocketDirectory(socketDirectory)
+	SetSocketDirectory(dir)
+
+	file, err := UAPIOpen("wg0", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	listener, err := UAPIListen("wg0", file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	// deleting the socket file fails the pending accept
+
+	done := make(chan error)
+	go func() {
+		_, err := listener.Accept()
+		done <- err
+	}()
+
+	if err := os.Remove(path.Join(dir, "wg0.sock")); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err := <-done:
+		if !os.IsNotExist(err) {
+			t.Fatal("unexpected error:", err)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("accept not failed by deletion of the socket")
+	}
+}
@@ -0,0 +1,1017 @@
+/* SPDX-License-Identifier: GPL-2.0
+ *
+ * Copyright (C) 2017-2018 Jason A. Donenfeld <Jason@zx2c4.com>. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+/* Issues a request against the UAPI handler of the device
+ * and returns the complete response
+ */
+func uapiRequest(t *testing.T, device *Device, request string) string {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	go ipcHandle(device, server)
+
+	if _, err := client.Write([]byte(request)); err != nil {
+		t.Fatal(err)
+	}
+	response, err := ioutil.ReadAll(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(response)
+}
+
+func TestUAPIGetJSON(t *testing.T) {
+	device := randDevice(t)
+	defer device.Close()
+
+	peer := randPeer(t, device)
+	uapiSet(t, device, strings.Join([]string{
+		"public_key=" + peer.handshake.remoteStatic.ToHex(),
+		"endpoint=192.0.2.1:51820",
+		"allowed_ip=10.0.0.0/24",
+		"allowed_ip=fd00::1/128",
+	}, "\n"))
+
+	response := uapiRequest(t, device, "get=1\njson=1\n\n")
+
+	reader := bufio.NewReader(strings.NewReader(response))
+	var state struct {
+		PrivateKey string `json:"private_key"`
+		Peers      []struct {
+			PublicKey  string   `json:"public_key"`
+			Endpoint   string   `json:"endpoint"`
+			TxBytes    uint64   `json:"tx_bytes"`
+			AllowedIPs []string `json:"allowed_ips"`
+		} `json:"peers"`
+	}
+	if err := json.NewDecoder(reader).Decode(&state); err != nil {
+		t.Fatal("malformed JSON response:", err, response)
+	}
+	if !strings.HasSuffix(response, "errno=0\n\n") {
+		t.Fatal("missing status in response:", response)
+	}
+
+	if state.PrivateKey != device.noise.privateKey.ToHex() {
+		t.Fatal("wrong private key:", state.PrivateKey)
+	}
+	if len(state.Peers) != 1 {
+		t.Fatal("expected one peer, got", len(state.Peers))
+	}
+	if state.Peers[0].PublicKey != peer.handshake.remoteStatic.ToHex() {
+		t.Fatal("wrong public key:", state.Peers[0].PublicKey)
+	}
+	if state.Peers[0].Endpoint != "192.0.2.1:51820" {
+		t.Fatal("wrong endpoint:", state.Peers[0].Endpoint)
+	}
+	if len(state.Peers[0].AllowedIPs) != 2 {
+		t.Fatal("wrong allowed ips:", state.Peers[0].AllowedIPs)
+	}
+
+	// text format remains the default
+
+	response = uapiRequest(t, device, "get=1\n\n")
+	if !strings.HasPrefix(response, "private_key=") || !strings.Contains(response, "\nallowed_ip=10.0.0.0/24\n") {
+		t.Fatal("unexpected text response:", response)
+	}
+}
+
+func TestUAPIMaxPeers(t *testing.T) {
+	device := randDevice(t)
+	defer device.Close()
+
+	var keys [2]NoisePublicKey
+	for i := range keys {
+		sk, err := newPrivateKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys[i] = sk.publicKey()
+	}
+
+	uapiSet(t, device, "max_peers=1\npublic_key="+keys[0].ToHex())
+
+	response := uapiRequest(t, device, "set=1\npublic_key="+keys[1].ToHex()+"\n\n")
+	if strings.HasSuffix(response, "errno=0\n\n") {
+		t.Fatal("peer added beyond limit")
+	}
+	if device.LookupPeer(keys[1]) != nil || len(device.peers.keyMap) != 1 {
+		t.Fatal("peer added beyond limit")
+	}
+
+	// reconfiguring an existing peer is unaffected
+
+	uapiSet(t, device, "public_key="+keys[0].ToHex()+"\npersistent_keepalive_interval=25")
+
+	if get := uapiRequest(t, device, "get=1\n\n"); !strings.Contains(get, "max_peers=1\n") {
+		t.Fatal("limit not reported:", get)
+	}
+
+	// zero lifts the limit
+
+	uapiSet(t, device, "max_peers=0\npublic_key="+keys[1].ToHex())
+	if device.LookupPeer(keys[1]) == nil {
+		t.Fatal("peer not added without limit")
+	}
+}
+
+func TestUAPITriggerHandshake(t *testing.T) {
+	dev1, dev2 := genChannelPair(t)
+	defer dev1.Close()
+	defer dev2.Close()
+
+	bind1 := dev1.net.bind.(*ChannelBind)
+	trigger := "public_key=" + dev2.noise.publicKey.ToHex() + "\ntrigger_handshake=1"
+
+	// repeated triggers are not suppressed by RekeyTimeout
+
+	uapiSet(t, dev1, trigger)
+	uapiSet(t, dev1, trigger)
+
+	initiations := 0
+	timeout := time.After(time.Second * 5)
+	for initiations < 2 {
+		select {
+		case msg := <-bind1.sent:
+			if binary.LittleEndian.Uint32(msg) == MessageInitiationType {
+				initiations++
+			}
+		case <-timeout:
+			t.Fatal("sent", initiations, "of 2 initiations")
+		}
+	}
+
+	// peers without an endpoint are rejected
+
+	sk, err := newPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pk := sk.publicKey()
+	response := uapiRequest(t, dev1, "set=1\npublic_key="+pk.ToHex()+"\ntrigger_handshake=1\n\n")
+	if strings.HasSuffix(response, "errno=0\n\n") {
+		t.Fatal("handshake triggered without endpoint")
+	}
+}
+
+func TestUAPIReplayWindowSize(t *testing.T) {
+	dev1, dev2 := genChannelPair(t)
+	defer dev1.Close()
+	defer dev2.Close()
+
+	for _, value := range []string{"100", "64", "131072"} {
+		response := uapiRequest(t, dev2, "set=1\nreplay_window_size="+value+"\n\n")
+		if strings.HasSuffix(response, "errno=0\n\n") {
+			t.Fatal("accepted replay window size", value)
+		}
+	}
+
+	uapiSet(t, dev2, "replay_window_size=8192")
+	if get := uapiRequest(t, dev2, "get=1\n\n"); !strings.Contains(get, "replay_window_size=8192\n") {
+		t.Fatal("replay window size not reported:", get)
+	}
+
+	// key pairs of subsequent handshakes use the size
+
+	dev1.tun.device.(*DummyTUN).packets <- genIPv4Packet(net.IPv4(10, 0, 0, 1), net.IPv4(10, 0, 0, 2), 100)
+	recvPacket(t, dev2.tun.device, time.Second*5)
+
+	keyPair := dev2.LookupPeer(dev1.noise.publicKey).keyPairs.Current()
+	if keyPair == nil {
+		t.Fatal("no key pair")
+	}
+	if window := keyPair.replayFilter.window; window != 8192-CounterRedundantBits {
+		t.Fatal("key pair has replay window", window)
+	}
+}
+
+func TestUAPIPresharedKeyRotation(t *testing.T) {
+	dev1, dev2 := genChannelPair(t)
+	defer dev1.Close()
+	defer dev2.Close()
+
+	devices := [2]*Device{dev1, dev2}
+	addrs := [2]net.IP{net.IPv4(10, 0, 0, 1), net.IPv4(10, 0, 0, 2)}
+	peers := [2]*Peer{
+		dev1.LookupPeer(dev2.noise.publicKey),
+		dev2.LookupPeer(dev1.noise.publicKey),
+	}
+
+	var psk NoiseSymmetricKey
+
+	exchange := func() {
+		for i, device := range devices {
+			device.tun.device.(*DummyTUN).packets <- genIPv4Packet(addrs[i], addrs[1-i], 100)
+			recvPacket(t, devices[1-i].tun.device, time.Second*5)
+		}
+	}
+
+	adopted := func(peer *Peer) bool {
+		peer.handshake.mutex.RLock()
+		defer peer.handshake.mutex.RUnlock()
+		return peer.handshake.presharedKey == psk
+	}
+
+	exchange()
+	handshake := atomic.LoadInt64(&peers[0].stats.lastHandshakeNano)
+
+	// rotate the key on both ends
+
+	rand.Read(psk[:])
+	for i, device := range devices {
+		uapiSet(t, device, fmt.Sprintf(
+			"public_key=%s\npreshared_key=%s",
+			devices[1-i].noise.publicKey.ToHex(), psk.ToHex(),
+		))
+		if get := uapiRequest(t, device, "get=1\n\n"); !strings.Contains(get, "preshared_key="+psk.ToHex()+"\n") {
+			t.Fatal("staged key not reported:", get)
+		}
+	}
+
+	// current keypair keeps carrying traffic
+
+	exchange()
+	for _, peer := range peers {
+		if adopted(peer) {
+			t.Fatal("key adopted before the next handshake")
+		}
+	}
+	if atomic.LoadInt64(&peers[0].stats.lastHandshakeNano) != handshake {
+		t.Fatal("key rotation caused a handshake")
+	}
+
+	// next handshake adopts the key
+
+	time.Sleep(HandshakeInitationRate)
+	uapiSet(t, dev1, "public_key="+dev2.noise.publicKey.ToHex()+"\ntrigger_handshake=1")
+	deadline := time.Now().Add(time.Second * 5)
+	for atomic.LoadInt64(&peers[0].stats.lastHandshakeNano) == handshake {
+		if time.Now().After(deadline) {
+			t.Fatal("no handshake after key rotation")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	for _, peer := range peers {
+		if !adopted(peer) || peer.handshake.PresharedKey() != psk {
+			t.Fatal("key not adopted by handshake")
+		}
+	}
+	exchange()
+}
+
+func TestUAPIKeypairState(t *testing.T) {
+	dev1, dev2 := genChannelPair(t)
+	defer dev1.Close()
+	defer dev2.Close()
+
+	// no keypair before the handshake
+
+	get := uapiRequest(t, dev1, "get=1\n\n")
+	if strings.Contains(get, "_keypair_") {
+		t.Fatal("keypair reported before handshake:", get)
+	}
+
+	before := time.Now().Unix()
+	for i := 0; i < 3; i++ {
+		dev1.tun.device.(*DummyTUN).packets <- genIPv4Packet(
+			net.IPv4(10, 0, 0, 1),
+			net.IPv4(10, 0, 0, 2),
+			100,
+		)
+		recvPacket(t, dev2.tun.device, time.Second*5)
+	}
+
+	peer := dev1.LookupPeer(dev2.noise.publicKey)
+	kp := peer.keyPairs.Current()
+	state := ipcGetState(dev1).Peers[0].CurrentKeypair
+	if state == nil {
+		t.Fatal("current keypair not reported")
+	}
+	if state.RemoteIndex != kp.remoteIndex || state.RemoteIndex == 0 {
+		t.Fatal("remote index is", state.RemoteIndex, "expected", kp.remoteIndex)
+	}
+	if state.CreatedSec < before || state.CreatedSec > time.Now().Unix() {
+		t.Fatal("invalid creation time:", state.CreatedSec)
+	}
+	if state.SendNonce < 3 {
+		t.Fatal("send nonce is", state.SendNonce, "after sending 3 packets")
+	}
+
+	get = uapiRequest(t, dev1, "get=1\n\n")
+	for _, key := range []string{
+		fmt.Sprintf("current_keypair_remote_index=%d\n", state.RemoteIndex),
+		fmt.Sprintf("current_keypair_created_sec=%d\n", state.CreatedSec),
+		"current_keypair_send_nonce=",
+	} {
+		if !strings.Contains(get, key) {
+			t.Fatal("missing", strings.TrimSpace(key), "in", get)
+		}
+	}
+}
+
+func TestUAPIRemoveAllowedIP(t *testing.T) {
+	device := randDevice(t)
+	defer device.Close()
+
+	peer1 := randPeer(t, device)
+	peer2 := randPeer(t, device)
+	key1 := peer1.handshake.remoteStatic.ToHex()
+	key2 := peer2.handshake.remoteStatic.ToHex()
+
+	uapiSet(t, device, "public_key="+key1+"\nallowed_ip=10.0.0.0/16\nallowed_ip=fd00::/64")
+	uapiSet(t, device, "public_key="+key2+"\nallowed_ip=10.0.1.0/24\nallowed_ip=fd00::/96")
+
+	lookup := func(ip string) *Peer {
+		addr := net.ParseIP(ip)
+		if ip4 := addr.To4(); ip4 != nil {
+			return device.routing.table.LookupIPv4(ip4)
+		}
+		return device.routing.table.LookupIPv6(addr)
+	}
+
+	if lookup("10.0.1.1") != peer2 || lookup("fd00::1") != peer2 {
+		t.Fatal("longest prefix not routed to second peer")
+	}
+
+	// removal by another peer is ignored
+
+	uapiSet(t, device, "public_key="+key1+"\nallowed_ip=-10.0.1.0/24")
+	if lookup("10.0.1.1") != peer2 {
+		t.Fatal("allowed IP of other peer removed")
+	}
+
+	// routing falls back to the covering prefix
+
+	uapiSet(t, device, "public_key="+key2+"\nallowed_ip=-10.0.1.0/24\nallowed_ip=-fd00::/96")
+	if lookup("10.0.1.1") != peer1 || lookup("fd00::1") != peer1 {
+		t.Fatal("routing did not fall back to the shorter prefix")
+	}
+	if ips := device.AllowedIPs(peer1); len(ips) != 2 {
+		t.Fatal("unexpected allowed IPs:", ips)
+	}
+
+	response := uapiRequest(t, device, "set=1\npublic_key="+key1+"\nallowed_ip=-10.0.0.0\n\n")
+	if strings.HasSuffix(response, "errno=0\n\n") {
+		t.Fatal("accepted invalid allowed IP")
+	}
+}
+
+func TestUAPIStrictAllowedIPs(t *testing.T) {
+	device := randDevice(t)
+	defer device.Close()
+
+	peer1 := randPeer(t, device)
+	peer2 := randPeer(t, device)
+	key1 := peer1.handshake.remoteStatic.ToHex()
+	key2 := peer2.handshake.remoteStatic.ToHex()
+	addr := []byte{10, 0, 0, 1}
+
+	uapiSet(t, device, "public_key="+key1+"\nallowed_ip=10.0.0.1/32")
+
+	// prefix is moved when not in strict mode
+
+	uapiSet(t, device, "public_key="+key2+"\nallowed_ip=10.0.0.1/32")
+	if device.routing.table.LookupIPv4(addr) != peer2 {
+		t.Fatal("prefix not reassigned")
+	}
+
+	// conflict is reported in strict mode
+
+	uapiSet(t, device, "strict_allowed_ips=true")
+	if get := uapiRequest(t, device, "get=1\n\n"); !strings.Contains(get, "strict_allowed_ips=true\n") {
+		t.Fatal("strict mode not reported:", get)
+	}
+
+	response := uapiRequest(t, device, "set=1\npublic_key="+key1+"\nallowed_ip=10.0.0.1/32\n\n")
+	if !strings.HasSuffix(response, fmt.Sprintf("errno=%d\n\n", ipcErrorExists)) {
+		t.Fatal("conflict not reported:", response)
+	}
+	if device.routing.table.LookupIPv4(addr) != peer2 {
+		t.Fatal("prefix reassigned in strict mode")
+	}
+
+	// covering and re-assigned prefixes of the same peer are accepted
+
+	uapiSet(t, device, "public_key="+key1+"\nallowed_ip=10.0.0.0/24")
+	uapiSet(t, device, "public_key="+key2+"\nallowed_ip=10.0.0.1/32")
+
+	// override applies to the selected peer only
+
+	uapiSet(t, device, "public_key="+key1+"\noverride_allowed_ips=true\nallowed_ip=10.0.0.1/32")
+	if device.routing.table.LookupIPv4(addr) != peer1 {
+		t.Fatal("override did not reassign prefix")
+	}
+
+	response = uapiRequest(t, device, fmt.Sprintf(
+		"set=1\npublic_key=%s\noverride_allowed_ips=true\npublic_key=%s\nallowed_ip=10.0.0.1/32\n\n",
+		key1, key2,
+	))
+	if !strings.HasSuffix(response, fmt.Sprintf("errno=%d\n\n", ipcErrorExists)) {
+		t.Fatal("override applied to other peer:", response)
+	}
+}
+
+/* Bind which records the destination of sent datagrams,
+ * without delivering them
+ */
+type RecordingBind struct {
+	*ChannelBind
+	datagrams chan DummyDatagram
+}
+
+func (b *RecordingBind) Send(buff []byte, end Endpoint) error {
+	msg := make([]byte, len(buff))
+	copy(msg, buff)
+	select {
+	case b.datagrams <- DummyDatagram{msg: msg, endpoint: end}:
+	default:
+	}
+	return nil
+}
+
+func TestUAPIEndpointHandshake(t *testing.T) {
+	dev1, dev2 := genChannelPair(t)
+	defer dev1.Close()
+	defer dev2.Close()
+
+	tun1 := dev1.tun.device.(*DummyTUN)
+	publicKey := "public_key=" + dev2.noise.publicKey.ToHex() + "\n"
+
+	// datagrams of the first device are lost, handshakes do not complete
+
+	dev1.net.mutex.Lock()
+	channel := dev1.net.bind.(*ChannelBind)
+	recorder := &RecordingBind{ChannelBind: channel, datagrams: make(chan DummyDatagram, 16)}
+	dev1.net.createBind = func(ports []uint16) (Bind, []uint16, error) {
+		select {
+		case <-channel.closed:
+			channel.closed = make(chan struct{})
+		default:
+		}
+		return recorder, ports, nil
+	}
+	dev1.net.mutex.Unlock()
+
+	if err := dev1.BindUpdate(); err != nil {
+		t.Fatal(err)
+	}
+
+	initiation := func(timeout time.Duration) Endpoint {
+		expired := time.After(timeout)
+		for {
+			select {
+			case datagram := <-recorder.datagrams:
+				if binary.LittleEndian.Uint32(datagram.msg) == MessageInitiationType {
+					return datagram.endpoint
+				}
+			case <-expired:
+				return nil
+			}
+		}
+	}
+
+	tun1.packets <- genIPv4Packet(net.IPv4(10, 0, 0, 1), net.IPv4(10, 0, 0, 2), 100)
+	if end := initiation(time.Second * 5); end == nil || !end.Equal(channel.remote) {
+		t.Fatal("no initiation sent to the initial endpoint")
+	}
+
+	// the next initiation goes to the new endpoint (well before RekeyTimeout)
+
+	uapiSet(t, dev1, publicKey+"endpoint=192.0.2.1:51820")
+	end := initiation(RekeyTimeout / 2)
+	if end == nil {
+		t.Fatal("no initiation sent after updating the endpoint")
+	}
+	if end.DstToString() != "192.0.2.1:51820" {
+		t.Fatal("initiation sent to", end.DstToString())
+	}
+
+	// setting an unchanged endpoint does not restart the handshake
+
+	uapiSet(t, dev1, publicKey+"endpoint=192.0.2.1:51820")
+	if end := initiation(time.Millisecond * 200); end != nil {
+		t.Fatal("initiation sent for unchanged endpoint")
+	}
+}
+
+func TestUAPITransaction(t *testing.T) {
+	device := randDevice(t)
+	defer device.Close()
+
+	peer := randPeer(t, device)
+	key := peer.handshake.remoteStatic.ToHex()
+	sk1, _ := newPrivateKey()
+	sk2, _ := newPrivateKey()
+	key1 := sk1.publicKey().ToHex()
+	key2 := sk2.publicKey().ToHex()
+
+	uapiSet(t, device, "strict_allowed_ips=true\npublic_key="+key+"\nallowed_ip=10.1.0.0/16")
+
+	// invalid lines are rejected before any line is applied
+
+	response := uapiRequest(t, device, strings.Join([]string{
+		"set=1",
+		"transaction=true",
+		"peer_max_age=60",
+		"public_key=" + key1,
+		"allowed_ip=10.2.0.0/16",
+		"public_key=" + key2,
+		"allowed_ip=10.3.0.0/33",
+	}, "\n")+"\n\n")
+	if !strings.HasSuffix(response, fmt.Sprintf("errno=%d\n\n", ipcErrorInvalid)) {
+		t.Fatal("invalid transaction not rejected:", response)
+	}
+	if device.PeerMaxAge() != 0 {
+		t.Fatal("device configuration applied by rejected transaction")
+	}
+	if device.LookupPeer(sk1.publicKey()) != nil || device.LookupPeer(sk2.publicKey()) != nil {
+		t.Fatal("peer created by rejected transaction")
+	}
+	if device.routing.table.LookupIPv4([]byte{10, 2, 0, 1}) != nil {
+		t.Fatal("allowed IP added by rejected transaction")
+	}
+
+	// conflicts with the configuration of the device are rejected before any line is applied
+
+	response = uapiRequest(t, device, strings.Join([]string{
+		"set=1",
+		"transaction=true",
+		"peer_max_age=60",
+		"public_key=" + key,
+		"persistent_keepalive_interval=25",
+		"replace_allowed_ips=true",
+		"allowed_ip=10.9.0.0/16",
+		"public_key=" + key1,
+		"endpoint=192.0.2.1:51820",
+		"allowed_ip=10.9.0.0/16",
+	}, "\n")+"\n\n")
+	if !strings.HasSuffix(response, fmt.Sprintf("errno=%d\n\n", ipcErrorExists)) {
+		t.Fatal("conflicting transaction not rejected:", response)
+	}
+	if device.PeerMaxAge() != 0 {
+		t.Fatal("device configuration applied by conflicting transaction")
+	}
+	if peer.persistentKeepaliveInterval != 0 {
+		t.Fatal("peer configuration applied by conflicting transaction")
+	}
+	if device.routing.table.LookupIPv4([]byte{10, 1, 0, 1}) != peer ||
+		device.routing.table.LookupIPv4([]byte{10, 9, 0, 1}) != nil {
+		t.Fatal("allowed IPs changed by conflicting transaction")
+	}
+	if device.LookupPeer(sk1.publicKey()) != nil {
+		t.Fatal("peer created by conflicting transaction")
+	}
+
+	// as is exceeding the peer limit
+
+	response = uapiRequest(t, device, strings.Join([]string{
+		"set=1",
+		"transaction=true",
+		"max_peers=2",
+		"public_key=" + key1,
+		"public_key=" + key2,
+	}, "\n")+"\n\n")
+	if !strings.HasSuffix(response, fmt.Sprintf("errno=%d\n\n", ipcErrorInvalid)) {
+		t.Fatal("transaction exceeding peer limit not rejected:", response)
+	}
+	if device.peers.limit != 0 || device.LookupPeer(sk1.publicKey()) != nil {
+		t.Fatal("transaction exceeding peer limit applied")
+	}
+
+	// valid transactions are applied
+
+	response = uapiRequest(t, device, "set=1\ntransaction=true\npeer_max_age=60\npublic_key="+key1+"\nallowed_ip=10.2.0.0/16\n\n")
+	if !strings.HasSuffix(response, "errno=0\n\n") {
+		t.Fatal("valid transaction failed:", response)
+	}
+	if device.PeerMaxAge() != time.Minute || device.routing.table.LookupIPv4([]byte{10, 2, 0, 1}) == nil {
+		t.Fatal("transaction not applied")
+	}
+}
+
+func TestUAPITransactionBindRestored(t *testing.T) {
+	dev1, dev2 := genTestPair(t)
+	defer dev1.Close()
+	defer dev2.Close()
+
+	tun1 := dev1.tun.device.(*DummyTUN)
+	tun2 := dev2.tun.device.(*DummyTUN)
+	port := dev1.net.port
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	busy := conn.LocalAddr().(*net.UDPAddr).Port
+
+	// settings of the bind applied before the failure are restored
+
+	response := uapiRequest(t, dev1, strings.Join([]string{
+		"set=1",
+		"transaction=true",
+		"peer_max_age=60",
+		"traffic_class=32",
+		fmt.Sprintf("listen_port=%d", busy),
+	}, "\n")+"\n\n")
+	if !strings.HasSuffix(response, fmt.Sprintf("errno=%d\n\n", ipcErrorPortInUse)) {
+		t.Fatal("transaction with port in use not rejected:", response)
+	}
+	if dev1.bindSettings().tclass != 0 || dev1.net.port != port {
+		t.Fatal("bind not restored")
+	}
+	if dev1.PeerMaxAge() != 0 {
+		t.Fatal("device configuration applied by failed transaction")
+	}
+
+	packet := genIPv4Packet(net.IPv4(10, 0, 0, 1), net.IPv4(10, 0, 0, 2), 100)
+	tun1.packets <- packet
+	assertEqual(t, recvPacket(t, tun2, time.Second*5), packet)
+}
+
+func TestUAPITransactionRolledBack(t *testing.T) {
+	dev1, dev2 := genTestPair(t)
+	defer dev1.Close()
+	defer dev2.Close()
+
+	tun1 := dev1.tun.device.(*DummyTUN)
+	tun2 := dev2.tun.device.(*DummyTUN)
+	key := dev2.noise.publicKey.ToHex()
+	sk1, _ := newPrivateKey()
+	sk2, _ := newPrivateKey()
+	key1 := sk1.publicKey().ToHex()
+	key2 := sk2.publicKey().ToHex()
+
+	uapiSet(t, dev1, "public_key="+key+"\npersistent_keepalive_interval=25\n"+
+		"public_key="+key1+"\nallowed_ip=10.9.0.0/16\nendpoint=192.0.2.1:51820\nfwmark=7")
+
+	// complete the handshake, such that traffic does not depend on the endpoint changed below
+
+	packet := genIPv4Packet(net.IPv4(10, 0, 0, 1), net.IPv4(10, 0, 0, 2), 100)
+	tun1.packets <- packet
+	assertEqual(t, recvPacket(t, tun2, time.Second*5), packet)
+
+	// endpoints are resolved once, when the transaction is parsed
+
+	resolved := 0
+	dev1.SetEndpointResolver(func(s string) (Endpoint, error) {
+		resolved++
+		return CreateEndpoint(s)
+	})
+	defer dev1.SetEndpointResolver(nil)
+
+	lines := []string{
+		"peer_max_age=60",
+		"traffic_class=32",
+		"public_key=" + key1,
+		"remove=true",
+		"public_key=" + key,
+		"persistent_keepalive_interval=5",
+		"endpoint=192.0.2.2:51820",
+		"public_key=" + key2,
+		"allowed_ip=10.8.0.0/16",
+	}
+
+	dev1.ipc.mutex.Lock()
+	txn, err := parseIPCTransaction(dev1, lines)
+	if err == nil {
+		err = txn.validate(dev1)
+	}
+	if err != nil {
+		dev1.ipc.mutex.Unlock()
+		t.Fatal(err)
+	}
+	if resolved != 1 {
+		dev1.ipc.mutex.Unlock()
+		t.Fatal("endpoint resolved", resolved, "times")
+	}
+
+	// a section failing to apply (after validation) restores the prior configuration
+
+	for _, section := range txn.peers {
+		if section.publicKey.ToHex() == key2 {
+			section.lines = append(section.lines, "persistent_keepalive_interval=70000")
+		}
+	}
+	err = txn.apply(dev1)
+	dev1.ipc.mutex.Unlock()
+	if err == nil {
+		t.Fatal("failing transaction applied")
+	}
+	if resolved != 1 {
+		t.Fatal("endpoint resolved again when applied")
+	}
+
+	if dev1.PeerMaxAge() != 0 || dev1.bindSettings().tclass != 0 {
+		t.Fatal("device configuration not restored")
+	}
+	if dev1.LookupPeer(sk2.publicKey()) != nil {
+		t.Fatal("created peer not removed")
+	}
+	peer1 := dev1.LookupPeer(sk1.publicKey())
+	if peer1 == nil {
+		t.Fatal("removed peer not restored")
+	}
+	if peer1.fwmark != 7 || peer1.endpoint == nil || peer1.endpoint.DstToString() != "192.0.2.1:51820" {
+		t.Fatal("configuration of removed peer not restored")
+	}
+	if dev1.routing.table.LookupIPv4([]byte{10, 9, 0, 1}) != peer1 {
+		t.Fatal("allowed IPs of removed peer not restored")
+	}
+	peer := dev1.LookupPeer(dev2.noise.publicKey)
+	if peer.persistentKeepaliveInterval != 25 || peer.endpoint.DstToString() == "192.0.2.2:51820" {
+		t.Fatal("configuration of peer not restored")
+	}
+
+	tun1.packets <- packet
+	assertEqual(t, recvPacket(t, tun2, time.Second*5), packet)
+}
+
+func TestUAPIAllowedIPHits(t *testing.T) {
+	dev1, dev2 := genTestPair(t)
+	defer dev1.Close()
+	defer dev2.Close()
+
+	key := dev2.noise.publicKey.ToHex()
+	uapiSet(t, dev1, "public_key="+key+"\nallowed_ip=10.1.0.0/16\nallowed_ip=10.1.2.0/24\nallowed_ip=fd00::/64")
+
+	tun1 := dev1.tun.device.(*DummyTUN)
+	src := net.IPv4(10, 0, 0, 1)
+	for _, dst := range []net.IP{
+		net.IPv4(10, 1, 0, 1),
+		net.IPv4(10, 1, 2, 1),
+		net.IPv4(10, 1, 2, 2),
+		net.IPv4(10, 1, 2, 3),
+	} {
+		tun1.packets <- genIPv4Packet(src, dst, 100)
+		recvPacket(t, dev2.tun.device, time.Second*5)
+	}
+
+	// received packets are not counted
+
+	dev2.tun.device.(*DummyTUN).packets <- genIPv4Packet(net.IPv4(10, 0, 0, 2), src, 100)
+	recvPacket(t, tun1, time.Second*5)
+
+	// hits are reported after the prefix they apply to
+
+	hits := make(map[string]string)
+	var prefix string
+	for _, line := range strings.Split(uapiRequest(t, dev1, "get=1\nallowed_ip_hits=1\n\n"), "\n") {
+		parts := strings.SplitN(line, "=", 2)
+		switch parts[0] {
+		case "allowed_ip":
+			prefix = parts[1]
+		case "allowed_ip_hits":
+			hits[prefix] = parts[1]
+		}
+	}
+	for prefix, expected := range map[string]string{
+		"10.0.0.2/32": "0",
+		"10.1.0.0/16": "1",
+		"10.1.2.0/24": "3",
+		"fd00::/64":   "0",
+	} {
+		if hits[prefix] != expected {
+			t.Fatal("wrong hits of", prefix, ":", hits[prefix], "expected", expected)
+		}
+	}
+
+	// hits are only reported on request
+
+	if get := uapiRequest(t, dev1, "get=1\n\n"); strings.Contains(get, "allowed_ip_hits") {
+		t.Fatal("hits reported without request:", get)
+	}
+}
+
+func TestUAPIBindErrno(t *testing.T) {
+	dev1, dev2 := genChannelPair(t)
+	defer dev1.Close()
+	defer dev2.Close()
+
+	dev1.net.mutex.Lock()
+	channel := dev1.net.bind.(*ChannelBind)
+	dev1.net.mutex.Unlock()
+
+	rebind := func(err error) {
+		dev1.net.mutex.Lock()
+		dev1.net.createBind = func(ports []uint16) (Bind, []uint16, error) {
+			if err != nil {
+				return nil, nil, err
+			}
+			channel.closed = make(chan struct{})
+			return channel, ports, nil
+		}
+		dev1.net.mutex.Unlock()
+		dev1.BindUpdate()
+	}
+	if get := uapiRequest(t, dev1, "get=1\n\n"); strings.Contains(get, "bind_errno=") {
+		t.Fatal("bind error reported for working bind:", get)
+	}
+
+	// failed binds are reported, by cause
+
+	for _, failure := range []struct {
+		err   error
+		errno int64
+	}{
+		{os.NewSyscallError("bind", syscall.EADDRINUSE), ipcErrorPortInUse},
+		{errors.New("Bind failed"), ipcErrorIO},
+	} {
+		rebind(failure.err)
+		get := uapiRequest(t, dev1, "get=1\n\n")
+		if !strings.Contains(get, fmt.Sprintf("bind_errno=%d\n", failure.errno)) {
+			t.Fatal("bind error not reported:", failure.err, get)
+		}
+		if !strings.HasSuffix(get, "errno=0\n\n") {
+			t.Fatal("get failed:", get)
+		}
+	}
+
+	// a successful bind clears the error
+
+	rebind(nil)
+	if get := uapiRequest(t, dev1, "get=1\n\n"); strings.Contains(get, "bind_errno=") {
+		t.Fatal("bind error reported after rebinding:", get)
+	}
+}
+
+func TestUAPISubscribe(t *testing.T) {
+	dev1, dev2 := genTestPair(t)
+	defer dev1.Close()
+	defer dev2.Close()
+
+	client, server := net.Pipe()
+	defer client.Close()
+	go ipcHandle(dev1, server)
+
+	if _, err := client.Write([]byte("subscribe=1\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	reader := bufio.NewReader(client)
+	readBlock := func() []string {
+		var lines []string
+		client.SetReadDeadline(time.Now().Add(time.Second * 5))
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				t.Fatal("failed to read event:", err)
+			}
+			if line == "\n" {
+				return lines
+			}
+			lines = append(lines, strings.TrimSuffix(line, "\n"))
+		}
+	}
+	readEvent := func(kind string) []string {
+		for {
+			if lines := readBlock(); lines[0] == "event="+kind {
+				return lines
+			}
+		}
+	}
+
+	if ack := readBlock(); len(ack) != 1 || ack[0] != "errno=0" {
+		t.Fatal("subscription not confirmed:", ack)
+	}
+
+	// a handshake is streamed once completed
+
+	packet := genIPv4Packet(net.IPv4(10, 0, 0, 1), net.IPv4(10, 0, 0, 2), 100)
+	dev1.tun.device.(*DummyTUN).packets <- packet
+	assertEqual(t, recvPacket(t, dev2.tun.device, time.Second*5), packet)
+
+	event := readEvent(EventHandshakeComplete)
+	if event[1] != "public_key="+dev2.noise.publicKey.ToHex() {
+		t.Fatal("handshake event of other peer:", event)
+	}
+
+	// as are peers added and removed
+
+	peer := randPeer(t, dev1)
+	event = readEvent(EventPeerAdded)
+	if event[1] != "public_key="+peer.handshake.remoteStatic.ToHex() {
+		t.Fatal("peer added event of other peer:", event)
+	}
+	uapiSet(t, dev1, "public_key="+peer.handshake.remoteStatic.ToHex()+"\nremove=true")
+	event = readEvent(EventPeerRemoved)
+	if event[1] != "public_key="+peer.handshake.remoteStatic.ToHex() {
+		t.Fatal("peer removed event of other peer:", event)
+	}
+
+	// closing the connection ends the subscription
+
+	client.Close()
+	deadline := time.Now().Add(time.Second * 5)
+	for {
+		dev1.events.mutex.Lock()
+		subscribers := len(dev1.events.subscribers)
+		dev1.events.mutex.Unlock()
+		if subscribers == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("subscription not ended")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+func TestUAPILog(t *testing.T) {
+	tun, _ := CreateDummyTUN("dummy", 0)
+	device := NewDevice(tun, NewLogger(LogLevelDebug, "dev "))
+	defer device.Close()
+
+	dump := func() []string {
+		response := uapiRequest(t, device, "log=1\n\n")
+		if !strings.HasSuffix(response, "errno=0\n\n") {
+			t.Fatal("log failed:", response)
+		}
+		var lines []string
+		for _, line := range strings.Split(response, "\n") {
+			if strings.HasPrefix(line, "log=") {
+				lines = append(lines, strings.TrimPrefix(line, "log="))
+			}
+		}
+		return lines
+	}
+
+	// no lines are retained unless enabled
+
+	device.log.Info.Println("Test message")
+	if lines := dump(); len(lines) != 0 {
+		t.Fatal("lines retained by default:", lines)
+	}
+
+	// messages of the device are retained, as formatted by the logger
+
+	uapiSet(t, device, "log_ring_size=256")
+	device.log.Info.Println("Test message")
+	retained := false
+	for _, line := range dump() {
+		if strings.HasPrefix(line, "INFO: dev ") && strings.HasSuffix(line, " Test message") {
+			retained = true
+		}
+	}
+	if !retained {
+		t.Fatal("message not retained")
+	}
+
+	// messages spanning several lines do not end the response
+
+	device.log.Info.Println("First line\n\nerrno=0\nLast line")
+	lines := dump()
+	i := len(lines) - 1
+	for i >= 0 && !strings.HasSuffix(lines[i], " First line") {
+		i--
+	}
+	if i < 0 || i+3 >= len(lines) || lines[i+1] != "" || lines[i+2] != "errno=0" || lines[i+3] != "Last line" {
+		t.Fatal("message spanning lines not split:", lines)
+	}
+
+	// only the most recent lines are retained
+
+	uapiSet(t, device, "log_ring_size=4")
+	if get := uapiRequest(t, device, "get=1\n\n"); !strings.Contains(get, "log_ring_size=4\n") {
+		t.Fatal("log ring size not reported:", get)
+	}
+	for i := 0; i < 10; i++ {
+		device.log.Error.Println("Message", i)
+	}
+	lines = dump()
+	if len(lines) != 4 {
+		t.Fatal("unexpected number of lines:", lines)
+	}
+	joined := strings.Join(lines, "\n")
+	if !strings.Contains(joined, "Message 9") || strings.Contains(joined, "Message 5") {
+		t.Fatal("unexpected lines retained:", lines)
+	}
+
+	// the ring may be disabled
+
+	uapiSet(t, device, "log_ring_size=0")
+	device.log.Error.Println("Message")
+	if lines := dump(); len(lines) != 0 {
+		t.Fatal("lines retained by disabled ring:", lines)
+	}
+}
@@ -0,0 +1,131 @@
+// +build linux darwin
+
+/* SPDX-License-Identifier: GPL-2.0
+ *
+ * Copyright (C) 2017-2018 Jason A. Donenfeld <Jason@zx2c4.com>. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"golang.org/x/sys/unix"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	socketMode          = 0600
+	socketDirectoryMode = 0700
+	socketProbeTimeout  = time.Second
+)
+
+/* Owner of the UAPI socket (-1 leaves the id unchanged)
+ */
+var (
+	UAPISocketUID = -1
+	UAPISocketGID = -1
+)
+
+var socketDirectory = "/var/run/wireguard"
+
+/* Changes the directory holding the UAPI sockets
+ * (e.g. to a runtime directory of an unprivileged user),
+ * must be called before the socket is opened or listened on
+ */
+func SetSocketDirectory(dir string) {
+	socketDirectory = dir
+}
+
+/* Listens on the unix socket at socketPath,
+ * replacing a stale socket left behind by a previous instance.
+ *
+ * The socket is only accessible to its owner,
+ * since any process able to connect can reconfigure the device.
+ */
+func uapiListenUnix(socketPath string) (*net.UnixListener, error) {
+	addr, err := net.ResolveUnixAddr("unix", socketPath)
+	if err != nil {
+		return nil, err
+	}
+
+	listener, err := func() (*net.UnixListener, error) {
+
+		// initial connection attempt
+
+		listener, err := listenUnixPrivate(addr)
+		if err == nil {
+			return listener, nil
+		}
+
+		// check if socket already served by a running instance
+		// (rather than an unrelated process listening on a stale path)
+
+		if uapiProbe(socketPath) {
+			return nil, errors.New("unix socket in use")
+		}
+
+		// cleanup & attempt again
+
+		err = os.Remove(socketPath)
+		if err != nil {
+			return nil, err
+		}
+		return listenUnixPrivate(addr)
+	}()
+
+	if err != nil {
+		return nil, err
+	}
+
+	// set the exact mode (the umask may have been stricter still)
+
+	err = os.Chmod(socketPath, socketMode)
+	if err == nil && (UAPISocketUID != -1 || UAPISocketGID != -1) {
+		err = os.Chown(socketPath, UAPISocketUID, UAPISocketGID)
+	}
+
+	if err != nil {
+		listener.Close() // removes the socket file
+		return nil, err
+	}
+
+	return listener, nil
+}
+
+/* Listens with a umask denying access beyond socketMode,
+ * such that the socket is never accessible to others (not even until chmod)
+ *
+ * The umask is process-wide, files created concurrently are at most restricted further
+ */
+func listenUnixPrivate(addr *net.UnixAddr) (*net.UnixListener, error) {
+	defer unix.Umask(unix.Umask(^socketMode & 0777))
+	return net.ListenUnix("unix", addr)
+}
+
+/* Reports whether the socket is served by a WireGuard instance,
+ * by issuing a get operation and awaiting the status line of the response
+ */
+func uapiProbe(socketPath string) bool {
+	conn, err := net.DialTimeout("unix", socketPath, socketProbeTimeout)
+	if err != nil {
+		return false
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(socketProbeTimeout))
+	if _, err := conn.Write([]byte("get=1\n\n")); err != nil {
+		return false
+	}
+
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		if strings.HasPrefix(scanner.Text(), "errno=") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,243 @@
+// +build linux darwin
+
+/* SPDX-License-Identifier: GPL-2.0
+ *
+ * Copyright (C) 2017-2018 Jason A. Donenfeld <Jason@zx2c4.com>. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"context"
+	"golang.org/x/sys/unix"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestUAPISocketMode(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wireguard")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// permissive umask, the socket must be restricted regardless
+
+	defer unix.Umask(unix.Umask(0))
+
+	socketPath := path.Join(dir, "wg0.sock")
+	listener, err := uapiListenUnix(socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	info, err := os.Stat(socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		t.Fatal("not a socket:", info.Mode())
+	}
+	if mode := info.Mode().Perm(); mode != socketMode {
+		t.Fatalf("socket has mode %o, expected %o", mode, socketMode)
+	}
+
+	// the socket is restricted when created, not only once changed
+
+	addr := &net.UnixAddr{Name: path.Join(dir, "wg1.sock"), Net: "unix"}
+	private, err := listenUnixPrivate(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer private.Close()
+	info, err = os.Stat(addr.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := info.Mode().Perm(); mode&^socketMode != 0 {
+		t.Fatalf("socket created with mode %o", mode)
+	}
+	if mask := unix.Umask(0); mask != 0 {
+		t.Fatalf("umask not restored: %o", mask)
+	}
+}
+
+func TestUAPIStaleSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wireguard")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	socketPath := path.Join(dir, "wg0.sock")
+
+	// unrelated process listening on the path left behind
+
+	unrelated, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unrelated.Close()
+	go func() {
+		for {
+			conn, err := unrelated.Accept()
+			if err != nil {
+				return
+			}
+			conn.Write([]byte("HTTP/1.0 400 Bad Request\n\n"))
+			conn.Close()
+		}
+	}()
+
+	listener, err := uapiListenUnix(socketPath)
+	if err != nil {
+		t.Fatal("stale socket not replaced:", err)
+	}
+	defer listener.Close()
+
+	// socket served by a running instance is not replaced
+
+	device := randDevice(t)
+	defer device.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go ipcHandle(device, conn)
+		}
+	}()
+
+	if _, err := uapiListenUnix(socketPath); err == nil {
+		t.Fatal("listened on socket already in use")
+	}
+}
+
+func TestUAPISocketDirectory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wireguard")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	defer SetSocketDirectory(socketDirectory)
+	SetSocketDirectory(path.Join(dir, "run"))
+
+	file, err := UAPIOpen("wg0", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	info, err := os.Stat(path.Join(dir, "run"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := info.Mode().Perm(); mode != socketDirectoryMode {
+		t.Fatalf("directory has mode %o, expected %o", mode, socketDirectoryMode)
+	}
+
+	listener, err := UAPIListen("wg0", file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	// connections are accepted on the socket in the directory
+
+	socketPath := path.Join(dir, "run", "wg0.sock")
+	conn, err := net.Dial("unix", socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	accepted, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted.Close()
+
+	// removal of the socket is still detected
+
+	if err := os.Remove(socketPath); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error)
+	go func() {
+		_, err := listener.Accept()
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("accepted connection after removal")
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("socket removal not detected")
+	}
+}
+
+func TestUAPIAcceptContext(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wireguard")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	defer SetSocketDirectory(socketDirectory)
+	SetSocketDirectory(dir)
+
+	file, err := UAPIOpen("wg0", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	listener, err := UAPIListen("wg0", file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	uapi := listener.(*UAPIListener)
+
+	// pending connections are still accepted
+
+	conn, err := net.Dial("unix", path.Join(dir, "wg0.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	accepted, err := uapi.AcceptContext(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted.Close()
+
+	// cancellation unblocks the accept
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		_, err := uapi.AcceptContext(ctx)
+		done <- err
+	}()
+	cancel()
+
+	select {
+	case err := <-done:
+		if err != context.Canceled {
+			t.Fatal("unexpected error:", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("accept not cancelled")
+	}
+}
@@ -9,6 +9,7 @@ package main
  */
 
 import (
+	"context"
 	"fmt"
 	"github.com/Microsoft/go-winio"
 	"golang.org/x/sys/windows"
@@ -20,30 +21,87 @@ const (
 	ipcErrorProtocol  = -int64(windows.ERROR_INVALID_NAME)
 	ipcErrorInvalid   = -int64(windows.ERROR_INVALID_PARAMETER)
 	ipcErrorPortInUse = -int64(windows.ERROR_ALREADY_EXISTS)
+	ipcErrorExists    = -int64(windows.ERROR_FILE_EXISTS)
 )
 
-const PipeNameFmt = "\\\\.\\pipe\\wireguard-ipc-%s"
+const PipeNameFmt = "\\\\.\\pipe\\WireGuard\\%s"
+
+/* Only the administrators group and the local system
+ * may connect to the pipe (protected from inherited entries)
+ */
+const pipeSecurityDescriptor = "O:SYD:P(A;;GA;;;SY)(A;;GA;;;BA)"
 
 type UAPIListener struct {
-	listener net.Listener
+	listener net.Listener // named pipe listener
+	connNew  chan net.Conn
+	connErr  chan error
 }
 
-func (uapi *UAPIListener) Accept() (net.Conn, error) {
-	return nil, nil
+func (l *UAPIListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.connNew:
+		return conn, nil
+
+	case err := <-l.connErr:
+		return nil, err
+	}
 }
 
-func (uapi *UAPIListener) Close() error {
-	return uapi.listener.Close()
+/* Accepts the next connection,
+ * returning ctx.Err() if the context is cancelled first
+ */
+func (l *UAPIListener) AcceptContext(ctx context.Context) (net.Conn, error) {
+	select {
+	case conn := <-l.connNew:
+		return conn, nil
+
+	case err := <-l.connErr:
+		return nil, err
+
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
 }
 
-func (uapi *UAPIListener) Addr() net.Addr {
-	return nil
+func (l *UAPIListener) Close() error {
+	return l.listener.Close()
 }
 
-func NewUAPIListener(name string) (net.Listener, error) {
-	path := fmt.Sprintf(PipeNameFmt, name)
-	return winio.ListenPipe(path, &winio.PipeConfig{
-		InputBufferSize:  2048,
-		OutputBufferSize: 2048,
+func (l *UAPIListener) Addr() net.Addr {
+	return l.listener.Addr()
+}
+
+/* Creates the named pipe of the interface,
+ * connections are handled by ipcHandle like those of the unix socket
+ */
+func UAPIListen(name string) (net.Listener, error) {
+	listener, err := winio.ListenPipe(fmt.Sprintf(PipeNameFmt, name), &winio.PipeConfig{
+		SecurityDescriptor: pipeSecurityDescriptor,
+		InputBufferSize:    2048,
+		OutputBufferSize:   2048,
 	})
+	if err != nil {
+		return nil, err
+	}
+
+	uapi := &UAPIListener{
+		listener: listener,
+		connNew:  make(chan net.Conn, 1),
+		connErr:  make(chan error, 1),
+	}
+
+	// watch for new connections
+
+	go func(l *UAPIListener) {
+		for {
+			conn, err := l.listener.Accept()
+			if err != nil {
+				l.connErr <- err
+				break
+			}
+			l.connNew <- conn
+		}
+	}(uapi)
+
+	return uapi, nil
 }
@@ -0,0 +1,58 @@
+/* SPDX-License-Identifier: GPL-2.0
+ *
+ * Copyright (C) 2017-2018 Jason A. Donenfeld <Jason@zx2c4.com>. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"fmt"
+	"github.com/Microsoft/go-winio"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUAPINamedPipe(t *testing.T) {
+	device := randDevice(t)
+	defer device.Close()
+
+	listener, err := UAPIListen("wgtest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go ipcHandle(device, conn)
+		}
+	}()
+
+	timeout := time.Second * 5
+	conn, err := winio.DialPipe(fmt.Sprintf(PipeNameFmt, "wgtest"), &timeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte("get=1\n\n")); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	response, err := ioutil.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(string(response), "errno=0\n\n") {
+		t.Fatal("unexpected response:", string(response))
+	}
+	if !strings.Contains(string(response), "private_key=") {
+		t.Fatal("device state missing from response:", string(response))
+	}
+}
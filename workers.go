@@ -0,0 +1,84 @@
+/* SPDX-License-Identifier: GPL-2.0
+ *
+ * Copyright (C) 2017-2018 Jason A. Donenfeld <Jason@zx2c4.com>. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+const (
+	EncryptionScaleInterval      = time.Millisecond * 50 // interval between samples of the queue depth
+	EncryptionScaleSamples       = 3                     // consecutive samples beyond a mark before scaling
+	EncryptionHighWater          = QueueOutboundSize / 4
+	EncryptionLowWater           = QueueOutboundSize / 32
+	EncryptionExtraWorkersPerCPU = 2 // limit on additional encryption workers
+)
+
+/* Adjusts the number of encryption workers to the depth of the encryption queue
+ *
+ * The per-CPU workers started with the device always run,
+ * additional workers are started while the queue stays above EncryptionHighWater
+ * and retired (one at a time) while it stays below EncryptionLowWater.
+ */
+func (device *Device) RoutineEncryptionScaler() {
+
+	logDebug := device.log.Debug
+
+	defer func() {
+		logDebug.Println("Routine: encryption scaler - stopped")
+		device.state.stopping.Done()
+	}()
+
+	logDebug.Println("Routine: encryption scaler - started")
+
+	ticker := time.NewTicker(EncryptionScaleInterval)
+	defer ticker.Stop()
+
+	var above, below int
+
+	for {
+		select {
+		case <-device.signals.stop:
+			return
+		case <-ticker.C:
+		}
+
+		depth := len(device.queue.encryption)
+		extra := atomic.LoadInt32(&device.workers.encryptionExtra)
+
+		// track how long the queue remains beyond the marks
+
+		if depth > EncryptionHighWater {
+			above, below = above+1, 0
+		} else if depth < EncryptionLowWater {
+			above, below = 0, below+1
+		} else {
+			above, below = 0, 0
+		}
+
+		// start additional worker
+
+		if above >= EncryptionScaleSamples && extra < device.workers.encryptionMax {
+			above = 0
+			logDebug.Println("Encryption queue backlog of", depth, "packets, starting additional worker")
+			atomic.AddInt32(&device.workers.encryptionExtra, 1)
+			device.state.stopping.Add(1)
+			go device.RoutineEncryption(device.workers.retire)
+			continue
+		}
+
+		// retire idle worker
+
+		if below >= EncryptionScaleSamples && extra > 0 {
+			select {
+			case device.workers.retire <- struct{}{}:
+				below = 0
+			default:
+			}
+		}
+	}
+}
@@ -0,0 +1,84 @@
+/* SPDX-License-Identifier: GPL-2.0
+ *
+ * Copyright (C) 2017-2018 Jason A. Donenfeld <Jason@zx2c4.com>. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+/* AEAD blocking on Seal until released
+ */
+type stalledAEAD struct {
+	release chan struct{}
+}
+
+func (aead *stalledAEAD) NonceSize() int { return 12 }
+func (aead *stalledAEAD) Overhead() int  { return 16 }
+
+func (aead *stalledAEAD) Seal(dst, nonce, plaintext, additionalData []byte) []byte {
+	<-aead.release
+	return append(dst, plaintext...)
+}
+
+func (aead *stalledAEAD) Open(dst, nonce, ciphertext, additionalData []byte) ([]byte, error) {
+	return append(dst, ciphertext...), nil
+}
+
+func TestEncryptionScaler(t *testing.T) {
+	device := randDevice(t)
+	defer device.Close()
+
+	aead := &stalledAEAD{release: make(chan struct{})}
+	keyPair := &Keypair{send: aead}
+	peer := &Peer{device: device}
+
+	waitFor := func(what string, cond func() bool) {
+		deadline := time.Now().Add(time.Second * 5)
+		for !cond() {
+			if time.Now().After(deadline) {
+				t.Fatal("timed out waiting for", what)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	extra := func() int32 {
+		return atomic.LoadInt32(&device.workers.encryptionExtra)
+	}
+
+	// flood the queue while the workers are stalled
+
+	elems := make([]*QueueOutboundElement, QueueOutboundSize)
+	for i := range elems {
+		elem := device.NewOutboundElement()
+		elem.packet = elem.buffer[MessageTransportHeaderSize : MessageTransportHeaderSize+64]
+		elem.keyPair = keyPair
+		elem.peer = peer
+		elem.mutex.Lock()
+		elems[i] = elem
+		device.queue.encryption <- elem
+	}
+
+	waitFor("additional workers", func() bool {
+		return extra() >= 2
+	})
+
+	if extra() > device.workers.encryptionMax {
+		t.Fatal("exceeded worker limit:", extra())
+	}
+
+	// drain the queue, the additional workers are retired
+
+	close(aead.release)
+	for _, elem := range elems {
+		elem.mutex.Lock()
+	}
+
+	waitFor("workers to retire", func() bool {
+		return extra() == 0
+	})
+}